@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Amendment states
+const (
+	amendmentPending  = "pending_approval"
+	amendmentApplied  = "applied"
+	amendmentRejected = "rejected"
+)
+
+// Quantity change, in percent of the recorded quantity, above which an amendment needs approval
+const defaultAmendmentThresholdPercent = 10.0
+
+// Reasons an invoice may be amended for
+var amendmentReasonCodes = map[string]bool{
+	"pricing_error":       true,
+	"quantity_error":      true,
+	"item_error":          true,
+	"tax_error":           true,
+	"supplier_correction": true,
+	"other":               true,
+}
+
+// AmendmentPolicy structure
+type AmendmentPolicy struct {
+	DocType                  string  `json:"doc_type"`
+	QuantityThresholdPercent float64 `json:"quantity_threshold_percent"`
+	UpdatedBy                string  `json:"updated_by"`
+	UpdatedAt                string  `json:"updated_at"`
+}
+
+// InvoiceAmendment structure
+type InvoiceAmendment struct {
+	DocType               string  `json:"doc_type"`
+	InvoiceID             string  `json:"invoice_id"`
+	StoreID               string  `json:"store_id"`
+	Version               int     `json:"version"` // version of the invoice the amendment creates
+	Attempt               int     `json:"attempt"` // counts the requests for the same version, as rejected ones may be retried
+	ReasonCode            string  `json:"reason_code"`
+	Justification         string  `json:"justification"`
+	PrevTransactionHash   string  `json:"prev_transaction_hash"` // hash of the version being amended
+	QuantityChangePercent float64 `json:"quantity_change_percent"`
+	AfterRecordingWindow  bool    `json:"after_recording_window,omitempty" metadata:",optional"` // requested after the window for recording the invoice closed
+	Invoice               Invoice `json:"invoice"`                                               // proposed content of the new version
+	Status                string  `json:"status"`
+	RequestedBy           string  `json:"requested_by"`
+	RequestedAt           string  `json:"requested_at"`
+	ReviewedBy            string  `json:"reviewed_by,omitempty" metadata:",optional"`
+	ReviewedAt            string  `json:"reviewed_at,omitempty" metadata:",optional"`
+	RejectionReason       string  `json:"rejection_reason,omitempty" metadata:",optional"`
+}
+
+// InvoiceVersion structure, the invoice is nested so that archived versions never match invoice queries
+type InvoiceVersion struct {
+	DocType    string  `json:"doc_type"`
+	InvoiceID  string  `json:"invoice_id"`
+	Version    int     `json:"version"`
+	Invoice    Invoice `json:"invoice"`
+	ArchivedAt string  `json:"archived_at"`
+}
+
+// Ledger key of the amendment policy
+const amendmentPolicyKey = "AMENDMENT_POLICY"
+
+// Composite key object types of amendments and archived versions
+const (
+	invoiceAmendmentObjectType = "INVOICE_AMENDMENT"
+	invoiceVersionObjectType   = "INVOICE_VERSION"
+)
+
+// Ledger key of a request to amend an invoice to a version, zero-padded so that scans return them in order
+func invoiceAmendmentKey(ctx contractapi.TransactionContextInterface, invoiceID string, version int, attempt int) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(invoiceAmendmentObjectType, []string{invoiceID, fmt.Sprintf("%06d", version), fmt.Sprintf("%06d", attempt)})
+}
+
+// Ledger key of an archived version of an invoice
+func invoiceVersionKey(ctx contractapi.TransactionContextInterface, invoiceID string, version int) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(invoiceVersionObjectType, []string{invoiceID, fmt.Sprintf("%06d", version)})
+}
+
+// Set the quantity change above which amendments need approval, restricted to regulators
+func (s *SmartContract) SetAmendmentPolicy(ctx contractapi.TransactionContextInterface, quantityThresholdPercent float64) error {
+	err := requireRole(ctx, roleRegulator)
+	if err != nil {
+		return err
+	}
+	if quantityThresholdPercent < 0 || math.IsNaN(quantityThresholdPercent) {
+		return fmt.Errorf("amendment threshold must not be negative, got %v", quantityThresholdPercent)
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	policy := AmendmentPolicy{
+		DocType:                  "amendment_policy",
+		QuantityThresholdPercent: quantityThresholdPercent,
+		UpdatedBy:                signer,
+		UpdatedAt:                now.Format(time.RFC3339),
+	}
+
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(amendmentPolicyKey, policyJSON)
+}
+
+// Retrieve the amendment policy, falling back to the default threshold
+func (s *SmartContract) GetAmendmentPolicy(ctx contractapi.TransactionContextInterface) (AmendmentPolicy, error) {
+	policyJSON, err := ctx.GetStub().GetState(amendmentPolicyKey)
+	if err != nil {
+		return AmendmentPolicy{}, err
+	}
+	if policyJSON == nil {
+		return AmendmentPolicy{DocType: "amendment_policy", QuantityThresholdPercent: defaultAmendmentThresholdPercent}, nil
+	}
+
+	var policy AmendmentPolicy
+	err = json.Unmarshal(policyJSON, &policy)
+	if err != nil {
+		return AmendmentPolicy{}, err
+	}
+
+	return policy, nil
+}
+
+// Amend a recorded invoice as a new version; quantity changes above the policy threshold, and any change
+// once the recording window of the invoice has closed, wait for approval
+func (s *SmartContract) AmendInvoice(ctx contractapi.TransactionContextInterface, invoice Invoice, reasonCode string, justification string) error {
+	if !amendmentReasonCodes[reasonCode] {
+		return fmt.Errorf("unknown amendment reason code %q", reasonCode)
+	}
+	if strings.TrimSpace(justification) == "" {
+		return fmt.Errorf("amendment of invoice %s requires a justification", invoice.InvoiceID)
+	}
+
+	existingInvoice, err := s.GetInvoice(ctx, invoice.InvoiceID)
+	if err != nil {
+		return err
+	}
+	if existingInvoice.StoreID != invoice.StoreID {
+		return fmt.Errorf("invoice %s belongs to store %s", invoice.InvoiceID, existingInvoice.StoreID)
+	}
+	if existingInvoice.Status == invoiceVoided {
+		return fmt.Errorf("invoice %s is voided, restore it before amending", invoice.InvoiceID)
+	}
+
+	// Only the organisation owning the store may amend its invoices
+	store, err := s.GetStore(ctx, invoice.StoreID)
+	if err != nil {
+		return err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	// Stores required to sign their invoices sign their amendments too
+	err = s.prepareInvoice(ctx, &invoice, store.RequireSignedInvoices)
+	if err != nil {
+		return err
+	}
+	if storedContentHash(existingInvoice) == invoice.ContentHash {
+		return nil
+	}
+
+	// Only a pending request blocks another; a rejected one is retried as the next attempt
+	version := invoiceVersion(existingInvoice) + 1
+	attempt := 1
+	latest, err := s.getInvoiceAmendment(ctx, invoice.InvoiceID, version)
+	if err != nil {
+		return err
+	}
+	if latest != nil {
+		if latest.Status == amendmentPending {
+			if latest.Invoice.ContentHash == invoice.ContentHash {
+				return nil
+			}
+			return fmt.Errorf("invoice %s already has a %s amendment to version %d", invoice.InvoiceID, latest.Status, version)
+		}
+		attempt = latest.Attempt + 1
+	}
+
+	policy, err := s.GetAmendmentPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	recordingPolicy, err := s.GetRecordingPolicy(ctx)
+	if err != nil {
+		return err
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, existingInvoice.Timestamp)
+	if err != nil {
+		return fmt.Errorf("invoice %s has an invalid timestamp %q, expected RFC 3339", invoice.InvoiceID, existingInvoice.Timestamp)
+	}
+
+	amendment := InvoiceAmendment{
+		DocType:               "invoice_amendment",
+		InvoiceID:             invoice.InvoiceID,
+		StoreID:               invoice.StoreID,
+		Version:               version,
+		Attempt:               attempt,
+		ReasonCode:            reasonCode,
+		Justification:         justification,
+		PrevTransactionHash:   existingInvoice.TransactionHash,
+		QuantityChangePercent: quantityChangePercent(existingInvoice.Items, invoice.Items),
+		AfterRecordingWindow:  now.Sub(timestamp) > time.Duration(recordingPolicy.MaxDelayMinutes)*time.Minute,
+		Invoice:               invoice,
+		Status:                amendmentApplied,
+		RequestedBy:           signer,
+		RequestedAt:           now.Format(time.RFC3339),
+	}
+
+	// Large quantity changes and late changes are held until a manager or auditor approves them
+	if amendment.QuantityChangePercent > policy.QuantityThresholdPercent || amendment.AfterRecordingWindow {
+		amendment.Status = amendmentPending
+		return s.putInvoiceAmendment(ctx, amendment)
+	}
+
+	err = s.putInvoiceAmendment(ctx, amendment)
+	if err != nil {
+		return err
+	}
+
+	return s.recordInvoice(ctx, invoice, true)
+}
+
+// Approve a pending amendment and record the new invoice version, restricted to managers and auditors
+func (s *SmartContract) ApproveInvoiceAmendment(ctx contractapi.TransactionContextInterface, invoiceID string, version int) error {
+	amendment, err := s.reviewInvoiceAmendment(ctx, invoiceID, version)
+	if err != nil {
+		return err
+	}
+
+	// The amendment was requested against a version that must still be current
+	existingInvoice, err := s.GetInvoice(ctx, invoiceID)
+	if err != nil {
+		return err
+	}
+	if existingInvoice.TransactionHash != amendment.PrevTransactionHash {
+		return fmt.Errorf("invoice %s changed after the amendment to version %d was requested", invoiceID, version)
+	}
+
+	amendment.Status = amendmentApplied
+	err = s.putInvoiceAmendment(ctx, amendment)
+	if err != nil {
+		return err
+	}
+
+	return s.recordInvoice(ctx, amendment.Invoice, true)
+}
+
+// Reject a pending amendment, leaving the invoice unchanged, restricted to managers and auditors
+func (s *SmartContract) RejectInvoiceAmendment(ctx contractapi.TransactionContextInterface, invoiceID string, version int, reason string) error {
+	amendment, err := s.reviewInvoiceAmendment(ctx, invoiceID, version)
+	if err != nil {
+		return err
+	}
+
+	amendment.Status = amendmentRejected
+	amendment.RejectionReason = reason
+
+	return s.putInvoiceAmendment(ctx, amendment)
+}
+
+// Retrieve every amendment requested for an invoice, oldest first
+func (s *SmartContract) GetInvoiceAmendments(ctx contractapi.TransactionContextInterface, invoiceID string) ([]InvoiceAmendment, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(invoiceAmendmentObjectType, []string{invoiceID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	amendments := []InvoiceAmendment{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var amendment InvoiceAmendment
+		err = json.Unmarshal(queryResponse.Value, &amendment)
+		if err != nil {
+			return nil, err
+		}
+		amendments = append(amendments, amendment)
+	}
+
+	return amendments, nil
+}
+
+// Retrieve every version of an invoice, from the original to the current one
+func (s *SmartContract) GetInvoiceVersions(ctx contractapi.TransactionContextInterface, invoiceID string) ([]Invoice, error) {
+	currentInvoice, err := s.GetInvoice(ctx, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(invoiceVersionObjectType, []string{invoiceID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var versions []Invoice
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var version InvoiceVersion
+		err = json.Unmarshal(queryResponse.Value, &version)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version.Invoice)
+	}
+
+	return append(versions, currentInvoice), nil
+}
+
+// Load a pending amendment and record the reviewer, who must not be its requester
+func (s *SmartContract) reviewInvoiceAmendment(ctx contractapi.TransactionContextInterface, invoiceID string, version int) (InvoiceAmendment, error) {
+	err := requireRole(ctx, roleManager, roleAuditor)
+	if err != nil {
+		return InvoiceAmendment{}, err
+	}
+
+	amendment, err := s.getInvoiceAmendment(ctx, invoiceID, version)
+	if err != nil {
+		return InvoiceAmendment{}, err
+	}
+	if amendment == nil {
+		return InvoiceAmendment{}, fmt.Errorf("Amendment not found for invoice %s version %d", invoiceID, version)
+	}
+	if amendment.Status != amendmentPending {
+		return InvoiceAmendment{}, fmt.Errorf("amendment of invoice %s to version %d is already %s", invoiceID, version, amendment.Status)
+	}
+
+	// Auditors review any store, managers only the stores of their own organisation
+	if requireRole(ctx, roleAuditor) != nil {
+		store, err := s.GetStore(ctx, amendment.StoreID)
+		if err != nil {
+			return InvoiceAmendment{}, err
+		}
+		err = requireStoreOwner(ctx, store)
+		if err != nil {
+			return InvoiceAmendment{}, err
+		}
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return InvoiceAmendment{}, fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	if signer == amendment.RequestedBy {
+		return InvoiceAmendment{}, fmt.Errorf("amendment of invoice %s must be reviewed by someone other than its requester", invoiceID)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return InvoiceAmendment{}, err
+	}
+
+	amendment.ReviewedBy = signer
+	amendment.ReviewedAt = now.Format(time.RFC3339)
+
+	return *amendment, nil
+}
+
+// Retrieve the latest request to amend an invoice to a version, or nil if none was made
+func (s *SmartContract) getInvoiceAmendment(ctx contractapi.TransactionContextInterface, invoiceID string, version int) (*InvoiceAmendment, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(invoiceAmendmentObjectType, []string{invoiceID, fmt.Sprintf("%06d", version)})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var latest *InvoiceAmendment
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var amendment InvoiceAmendment
+		err = json.Unmarshal(queryResponse.Value, &amendment)
+		if err != nil {
+			return nil, err
+		}
+		latest = &amendment
+	}
+
+	return latest, nil
+}
+
+// Save an amendment to the ledger
+func (s *SmartContract) putInvoiceAmendment(ctx contractapi.TransactionContextInterface, amendment InvoiceAmendment) error {
+	amendmentJSON, err := json.Marshal(amendment)
+	if err != nil {
+		return err
+	}
+
+	amendmentKey, err := invoiceAmendmentKey(ctx, amendment.InvoiceID, amendment.Version, amendment.Attempt)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(amendmentKey, amendmentJSON)
+}
+
+// Archive a version of an invoice before it is replaced
+func (s *SmartContract) archiveInvoiceVersion(ctx contractapi.TransactionContextInterface, invoice Invoice) error {
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	version := InvoiceVersion{
+		DocType:    "invoice_version",
+		InvoiceID:  invoice.InvoiceID,
+		Version:    invoiceVersion(invoice),
+		Invoice:    invoice,
+		ArchivedAt: now.Format(time.RFC3339),
+	}
+
+	versionJSON, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+
+	versionKey, err := invoiceVersionKey(ctx, version.InvoiceID, version.Version)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(versionKey, versionJSON)
+}
+
+// Version number of an invoice, counting invoices recorded before versioning as the first
+func invoiceVersion(invoice Invoice) int {
+	if invoice.Version == 0 {
+		return 1
+	}
+	return invoice.Version
+}
+
+// Largest change, in percent, of the base quantity recorded for any item key
+func quantityChangePercent(before []Item, after []Item) float64 {
+	quantities := map[ItemKey][2]float64{}
+	for _, item := range before {
+		itemKey := ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate}
+		quantity := quantities[itemKey]
+		quantity[0] += baseQuantity(item)
+		quantities[itemKey] = quantity
+	}
+	for _, item := range after {
+		itemKey := ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate}
+		quantity := quantities[itemKey]
+		quantity[1] += baseQuantity(item)
+		quantities[itemKey] = quantity
+	}
+
+	var largest float64
+	for _, quantity := range quantities {
+		change := math.Abs(quantity[1] - quantity[0])
+		if change == 0 {
+			continue
+		}
+		// An item key added by the amendment counts as a full change
+		if quantity[0] == 0 {
+			largest = math.Max(largest, 100)
+			continue
+		}
+		largest = math.Max(largest, change/quantity[0]*100)
+	}
+
+	return largest
+}
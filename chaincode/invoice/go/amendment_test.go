@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestAmendInvoice(t *testing.T) {
+	f := newFixture(t)
+	milk := lot("milk", "2027-03-10")
+	original := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 20, 1))
+	original["idempotency_key"] = "K1"
+	f.ok(f.org1, "CreateOrUpdateInvoice", original)
+
+	// A small correction carrying the original idempotency key is applied at once
+	corrected := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 21, 1))
+	corrected["idempotency_key"] = "K1"
+	f.fail(f.org1, "unknown amendment reason code", "AmendInvoice", corrected, "typo", "miscounted")
+	f.fail(f.org1, "requires a justification", "AmendInvoice", corrected, "quantity_error", " ")
+	f.fail(f.org2, "is owned by Org1MSP", "AmendInvoice", corrected, "quantity_error", "miscounted")
+	f.ok(f.org1, "AmendInvoice", corrected, "quantity_error", "miscounted")
+
+	var invoice Invoice
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Version != 2 || invoice.Items[0].Quantity != 21 || invoice.PrevBlockHash == "" {
+		t.Fatalf("amendment not applied: %+v", invoice)
+	}
+	var total float64
+	f.get(&total, f.org1, "GetTotalPurchases", "S1", milk)
+	if total != 21 {
+		t.Fatalf("amended quantity not counted: %v", total)
+	}
+
+	// A late retry of the original submission stays a no-op
+	f.ok(f.org1, "CreateOrUpdateInvoice", original)
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Version != 2 {
+		t.Fatalf("retry of the original overwrote the amendment: %+v", invoice)
+	}
+
+	// An amendment may not borrow the key of another invoice
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P2", "S1", "purchase", lineArg("cheese", "2027-03-20", 1, 5)))
+	borrowed := invoiceArg("P2", "S1", "purchase", lineArg("cheese", "2027-03-20", 1, 6))
+	borrowed["idempotency_key"] = "K1"
+	f.fail(f.org1, "already used for invoice P1", "AmendInvoice", borrowed, "pricing_error", "wrong price")
+
+	// A large quantity change waits for a manager or auditor other than the requester
+	large := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 30, 1))
+	large["idempotency_key"] = "K1"
+	f.ok(f.org1, "AmendInvoice", large, "quantity_error", "second pallet")
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Version != 2 {
+		t.Fatalf("large amendment applied without approval: %+v", invoice)
+	}
+	f.fail(f.org1, "already has a pending_approval amendment to version 3", "AmendInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 22, 1)), "quantity_error", "again")
+	f.fail(f.org1, "not permitted", "ApproveInvoiceAmendment", "P1", 3)
+	f.ok(f.manager, "ApproveInvoiceAmendment", "P1", 3)
+
+	f.get(&total, f.org1, "GetTotalPurchases", "S1", milk)
+	if total != 30 {
+		t.Fatalf("approved quantity not counted: %v", total)
+	}
+	var versions []Invoice
+	f.get(&versions, f.auditor, "GetInvoiceVersions", "P1")
+	if len(versions) != 3 || versions[0].Items[0].Quantity != 20 || versions[2].Items[0].Quantity != 30 {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+	var amendments []InvoiceAmendment
+	f.get(&amendments, f.auditor, "GetInvoiceAmendments", "P1")
+	if len(amendments) != 2 || amendments[1].Status != amendmentApplied || amendments[1].ReviewedBy == "" {
+		t.Fatalf("unexpected amendments %+v", amendments)
+	}
+
+	f.ok(f.org1, "AmendInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 60, 1)), "quantity_error", "doubled")
+	f.ok(f.auditor, "RejectInvoiceAmendment", "P1", 4, "no delivery note")
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Version != 3 {
+		t.Fatalf("rejected amendment applied: %+v", invoice)
+	}
+
+	// A rejected request does not lock the invoice, the next one is a new attempt at the same version
+	f.ok(f.org1, "AmendInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 31, 1)), "quantity_error", "one more")
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Version != 4 || invoice.Items[0].Quantity != 31 {
+		t.Fatalf("amendment after a rejection not applied: %+v", invoice)
+	}
+
+	// Invoices whose ID extends another's keep their amendments and versions apart
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1_1", "S1", "purchase", lineArg("milk", "2027-03-10", 5, 1)))
+	f.ok(f.org1, "AmendInvoice", invoiceArg("P1_1", "S1", "purchase", lineArg("milk", "2027-03-10", 5, 2)), "pricing_error", "wrong price")
+	amendments = nil
+	f.get(&amendments, f.auditor, "GetInvoiceAmendments", "P1")
+	if len(amendments) != 4 || amendments[2].Status != amendmentRejected || amendments[3].Version != 4 || amendments[3].Attempt != 2 {
+		t.Fatalf("unexpected amendments %+v", amendments)
+	}
+	versions = nil
+	f.get(&versions, f.auditor, "GetInvoiceVersions", "P1")
+	if len(versions) != 4 {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+}
+
+func TestAmendmentControls(t *testing.T) {
+	f := newFixture(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f.ok(f.org1, "RegisterDevice", deviceArg("POS1", "S1", devicePOS, publicKeyPEM(t, &key.PublicKey)))
+	f.ok(f.regulator, "SetStoreControls", "S1", StoreControls{RequireSignedInvoices: true})
+
+	signed := func(quantity float64) map[string]interface{} {
+		invoice := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", quantity, 1))
+		invoice["device_id"] = "POS1"
+		return signInvoiceArg(t, invoice, key)
+	}
+	f.ok(f.org1, "CreateOrUpdateInvoice", signed(20))
+
+	// An amendment must be signed like the invoice it replaces
+	f.fail(f.org1, "only accepts invoices signed by a registered device", "AmendInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 21, 1)), "quantity_error", "miscounted")
+	forged := signed(21)
+	forged["items"].([]map[string]interface{})[0]["quantity"] = 22.0
+	f.fail(f.org1, "does not verify against device POS1", "AmendInvoice", forged, "quantity_error", "miscounted")
+	f.ok(f.org1, "AmendInvoice", signed(21), "quantity_error", "miscounted")
+
+	// Once the recording window has closed even a small change waits for approval
+	f.now = f.now.Add(time.Duration(defaultRecordingPolicy().MaxDelayMinutes+1) * time.Minute)
+	f.ok(f.org1, "AmendInvoice", signed(22), "quantity_error", "miscounted again")
+	var invoice Invoice
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Version != 2 {
+		t.Fatalf("late amendment applied without approval: %+v", invoice)
+	}
+	var amendments []InvoiceAmendment
+	f.get(&amendments, f.auditor, "GetInvoiceAmendments", "P1")
+	if len(amendments) != 2 || amendments[0].AfterRecordingWindow || !amendments[1].AfterRecordingWindow || amendments[1].Status != amendmentPending {
+		t.Fatalf("unexpected amendments %+v", amendments)
+	}
+	f.ok(f.manager, "ApproveInvoiceAmendment", "P1", 3)
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Version != 3 || invoice.Items[0].Quantity != 22 {
+		t.Fatalf("approved late amendment not applied: %+v", invoice)
+	}
+}
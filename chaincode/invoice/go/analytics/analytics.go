@@ -0,0 +1,108 @@
+// Package analytics scores observations against a history of earlier ones, so that outlying
+// quantities, prices and timings can be flagged without any knowledge of the ledger.
+package analytics
+
+import (
+	"math"
+	"sort"
+)
+
+// Mean of a sample, zero for an empty one
+func Mean(sample []float64) float64 {
+	if len(sample) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, x := range sample {
+		sum += x
+	}
+	return sum / float64(len(sample))
+}
+
+// StdDev is the sample standard deviation, zero for fewer than two observations
+func StdDev(sample []float64) float64 {
+	if len(sample) < 2 {
+		return 0
+	}
+	mean := Mean(sample)
+	var squares float64
+	for _, x := range sample {
+		squares += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(squares / float64(len(sample)-1))
+}
+
+// ZScore of x against a sample; ok is false when the sample has no spread to measure against
+func ZScore(x float64, sample []float64) (z float64, ok bool) {
+	stdDev := StdDev(sample)
+	if stdDev == 0 {
+		return 0, false
+	}
+	return (x - Mean(sample)) / stdDev, true
+}
+
+// Quantile of a sample by linear interpolation between order statistics, q between 0 and 1
+func Quantile(sample []float64, q float64) float64 {
+	if len(sample) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), sample...)
+	sort.Float64s(sorted)
+
+	position := q * float64(len(sorted)-1)
+	lower := int(math.Floor(position))
+	upper := int(math.Ceil(position))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(position-float64(lower))
+}
+
+// Median of a sample
+func Median(sample []float64) float64 {
+	return Quantile(sample, 0.5)
+}
+
+// TukeyFences returns the bounds k interquartile ranges beyond the quartiles of a sample;
+// k is 1.5 for outliers and 3 for far outliers
+func TukeyFences(sample []float64, k float64) (lower float64, upper float64) {
+	q1 := Quantile(sample, 0.25)
+	q3 := Quantile(sample, 0.75)
+	iqr := q3 - q1
+	return q1 - k*iqr, q3 + k*iqr
+}
+
+// OutsideFences reports whether x lies beyond the Tukey fences of a sample
+func OutsideFences(x float64, sample []float64, k float64) bool {
+	lower, upper := TukeyFences(sample, k)
+	return x < lower || x > upper
+}
+
+// SpikeRatio of x to the median of recent observations; ok is false when that median is not positive
+func SpikeRatio(x float64, recent []float64) (ratio float64, ok bool) {
+	median := Median(recent)
+	if median <= 0 {
+		return 0, false
+	}
+	return x / median, true
+}
+
+// IsRound reports whether x is a non-zero whole multiple of unit
+func IsRound(x float64, unit float64) bool {
+	if x == 0 || unit <= 0 {
+		return false
+	}
+	quotient := x / unit
+	return math.Abs(quotient-math.Round(quotient)) < 1e-9
+}
+
+// BucketShare is the fraction of a sample falling into the same bucket as x
+func BucketShare(x int, sample []int) float64 {
+	if len(sample) == 0 {
+		return 0
+	}
+	var same int
+	for _, y := range sample {
+		if y == x {
+			same++
+		}
+	}
+	return float64(same) / float64(len(sample))
+}
@@ -0,0 +1,96 @@
+package analytics
+
+import (
+	"math"
+	"testing"
+)
+
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestMeanAndStdDev(t *testing.T) {
+	if Mean(nil) != 0 || StdDev([]float64{4}) != 0 {
+		t.Fatal("empty and single samples should have zero mean and spread")
+	}
+	sample := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	if !near(Mean(sample), 5) {
+		t.Fatalf("unexpected mean %v", Mean(sample))
+	}
+	if !near(StdDev(sample), math.Sqrt(32.0/7)) {
+		t.Fatalf("unexpected standard deviation %v", StdDev(sample))
+	}
+}
+
+func TestZScore(t *testing.T) {
+	if _, ok := ZScore(10, []float64{3, 3, 3}); ok {
+		t.Fatal("a sample without spread has no z-score")
+	}
+	z, ok := ZScore(9, []float64{1, 3, 5})
+	if !ok || !near(z, 3) {
+		t.Fatalf("unexpected z-score %v, %v", z, ok)
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	sample := []float64{7, 1, 3, 5}
+	if Quantile(nil, 0.5) != 0 {
+		t.Fatal("empty sample should have a zero quantile")
+	}
+	if !near(Median(sample), 4) || !near(Quantile(sample, 0), 1) || !near(Quantile(sample, 1), 7) || !near(Quantile(sample, 0.25), 2.5) {
+		t.Fatalf("unexpected quantiles of %v", sample)
+	}
+	if sample[0] != 7 {
+		t.Fatal("quantiles must not reorder the sample")
+	}
+}
+
+func TestTukeyFences(t *testing.T) {
+	sample := []float64{1, 2, 3, 4, 5}
+	lower, upper := TukeyFences(sample, 1.5)
+	if !near(lower, -1) || !near(upper, 7) {
+		t.Fatalf("unexpected fences %v, %v", lower, upper)
+	}
+	if OutsideFences(7, sample, 1.5) || !OutsideFences(7.5, sample, 1.5) || !OutsideFences(-2, sample, 1.5) {
+		t.Fatal("fences should include their bounds and exclude what lies beyond")
+	}
+}
+
+func TestSpikeRatio(t *testing.T) {
+	if _, ok := SpikeRatio(5, []float64{0, 0, 1}); ok {
+		t.Fatal("a non-positive median has no ratio")
+	}
+	ratio, ok := SpikeRatio(30, []float64{2, 3, 4})
+	if !ok || !near(ratio, 10) {
+		t.Fatalf("unexpected spike ratio %v, %v", ratio, ok)
+	}
+}
+
+func TestIsRound(t *testing.T) {
+	cases := []struct {
+		x     float64
+		unit  float64
+		round bool
+	}{
+		{50, 10, true},
+		{-200, 100, true},
+		{0, 10, false},
+		{55, 10, false},
+		{0.3, 0.1, true},
+		{10, 0, false},
+	}
+	for _, c := range cases {
+		if IsRound(c.x, c.unit) != c.round {
+			t.Errorf("IsRound(%v, %v) should be %v", c.x, c.unit, c.round)
+		}
+	}
+}
+
+func TestBucketShare(t *testing.T) {
+	if BucketShare(3, nil) != 0 {
+		t.Fatal("empty sample should have a zero share")
+	}
+	if !near(BucketShare(9, []int{9, 10, 9, 11}), 0.5) || BucketShare(2, []int{9, 10}) != 0 {
+		t.Fatal("unexpected bucket shares")
+	}
+}
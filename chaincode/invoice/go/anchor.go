@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gravityinescapable/BTP/chaincode/invoice/go/merkle"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// MerkleRoot structure
+type MerkleRoot struct {
+	DocType       string   `json:"doc_type"`
+	StoreID       string   `json:"store_id"`
+	Date          string   `json:"date"`
+	Root          string   `json:"root"`
+	InvoiceIDs    []string `json:"invoice_ids,omitempty" metadata:",optional"`    // leaf order
+	ContentHashes []string `json:"content_hashes,omitempty" metadata:",optional"` // leaves, in the same order as the invoice IDs
+	Revision      int      `json:"revision"`                                      // 1 for the first anchoring, raised by each re-anchoring
+	Justification string   `json:"justification,omitempty" metadata:",optional"`  // reason given for re-anchoring
+	AnchoredBy    string   `json:"anchored_by"`
+	AnchoredAt    string   `json:"anchored_at"`
+}
+
+// InclusionProof structure
+type InclusionProof struct {
+	InvoiceID   string        `json:"invoice_id"`
+	StoreID     string        `json:"store_id"`
+	Date        string        `json:"date"`
+	ContentHash string        `json:"content_hash"`
+	LeafIndex   int           `json:"leaf_index"`
+	LeafCount   int           `json:"leaf_count"`
+	Path        []merkle.Step `json:"path,omitempty" metadata:",optional"` // empty for a day with a single invoice
+	Root        string        `json:"root"`
+}
+
+// Ledger key of the Merkle root of a store's invoices for a day
+func merkleRootKey(storeID string, date string) string {
+	return fmt.Sprintf("MERKLE_ROOT_%s_%s", storeID, date)
+}
+
+// Composite key object types of the invoices a store dated on a day and of superseded Merkle roots
+const (
+	invoiceDayObjectType         = "INVOICE_DAY"
+	merkleRootRevisionObjectType = "MERKLE_ROOT_REVISION"
+)
+
+// Ledger key indexing an invoice under the store and day it is dated
+func invoiceDayKey(ctx contractapi.TransactionContextInterface, storeID string, date string, invoiceID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(invoiceDayObjectType, []string{storeID, date, invoiceID})
+}
+
+// Ledger key of a superseded Merkle root, zero-padded so that scans return them in order
+func merkleRootRevisionKey(ctx contractapi.TransactionContextInterface, storeID string, date string, revision int) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(merkleRootRevisionObjectType, []string{storeID, date, fmt.Sprintf("%06d", revision)})
+}
+
+// Compute and store the Merkle root over the content hashes of a store's invoices dated on a day;
+// a day is anchored once, only a regulator may re-anchor it
+func (s *SmartContract) AnchorDailyMerkleRoot(ctx contractapi.TransactionContextInterface, storeID string, date string) (MerkleRoot, error) {
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return MerkleRoot{}, fmt.Errorf("invalid date: %q", date)
+	}
+
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil && requireRole(ctx, roleRegulator) != nil {
+		return MerkleRoot{}, err
+	}
+
+	existingJSON, err := ctx.GetStub().GetState(merkleRootKey(storeID, date))
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	if existingJSON != nil {
+		return MerkleRoot{}, fmt.Errorf("invoices of store %s dated %s are already anchored, a regulator may re-anchor them", storeID, date)
+	}
+
+	return s.putDailyMerkleRoot(ctx, storeID, date, 1, "")
+}
+
+// Replace the anchored Merkle root of a store's day, archiving the root it supersedes, restricted to regulators
+func (s *SmartContract) ReanchorDailyMerkleRoot(ctx contractapi.TransactionContextInterface, storeID string, date string, justification string) (MerkleRoot, error) {
+	err := requireRole(ctx, roleRegulator)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	if strings.TrimSpace(justification) == "" {
+		return MerkleRoot{}, fmt.Errorf("re-anchoring store %s on %s requires a justification", storeID, date)
+	}
+
+	previous, err := s.GetDailyMerkleRoot(ctx, storeID, date)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	revision := merkleRootRevision(previous)
+
+	previousJSON, err := json.Marshal(previous)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	revisionKey, err := merkleRootRevisionKey(ctx, storeID, date, revision)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	err = ctx.GetStub().PutState(revisionKey, previousJSON)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+
+	return s.putDailyMerkleRoot(ctx, storeID, date, revision+1, justification)
+}
+
+// Retrieve the Merkle roots anchored for a store's day, oldest first and ending with the current one
+func (s *SmartContract) GetDailyMerkleRootHistory(ctx contractapi.TransactionContextInterface, storeID string, date string) ([]MerkleRoot, error) {
+	current, err := s.GetDailyMerkleRoot(ctx, storeID, date)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(merkleRootRevisionObjectType, []string{storeID, date})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var roots []MerkleRoot
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var root MerkleRoot
+		err = json.Unmarshal(queryResponse.Value, &root)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+
+	return append(roots, current), nil
+}
+
+// Compute the Merkle root over a store's invoices dated on a day, leaving out voided invoices, and save it
+func (s *SmartContract) putDailyMerkleRoot(ctx contractapi.TransactionContextInterface, storeID string, date string, revision int, justification string) (MerkleRoot, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(invoiceDayObjectType, []string{storeID, date})
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	defer resultsIterator.Close()
+
+	// The index returns invoices ordered by ID, so every peer builds the same tree
+	var invoices []Invoice
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return MerkleRoot{}, err
+		}
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return MerkleRoot{}, err
+		}
+
+		invoice, err := s.GetInvoice(ctx, keyParts[2])
+		if err != nil {
+			return MerkleRoot{}, err
+		}
+		if invoice.Status == invoiceVoided {
+			continue
+		}
+		invoices = append(invoices, invoice)
+	}
+	if len(invoices) == 0 {
+		return MerkleRoot{}, fmt.Errorf("store %s has no invoices dated %s", storeID, date)
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return MerkleRoot{}, fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+
+	merkleRoot := MerkleRoot{
+		DocType:       "merkle_root",
+		StoreID:       storeID,
+		Date:          date,
+		Revision:      revision,
+		Justification: justification,
+		AnchoredBy:    signer,
+		AnchoredAt:    now.Format(time.RFC3339),
+	}
+	for _, invoice := range invoices {
+		merkleRoot.InvoiceIDs = append(merkleRoot.InvoiceIDs, invoice.InvoiceID)
+		merkleRoot.ContentHashes = append(merkleRoot.ContentHashes, storedContentHash(invoice))
+	}
+
+	merkleRoot.Root, err = merkle.Root(merkleRoot.ContentHashes)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+
+	merkleRootJSON, err := json.Marshal(merkleRoot)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	err = ctx.GetStub().PutState(merkleRootKey(storeID, date), merkleRootJSON)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+
+	return merkleRoot, nil
+}
+
+// Revision of an anchored root, roots anchored before revisions were numbered being the first
+func merkleRootRevision(merkleRoot MerkleRoot) int {
+	if merkleRoot.Revision == 0 {
+		return 1
+	}
+	return merkleRoot.Revision
+}
+
+// Retrieve the anchored Merkle root of a store's invoices for a day
+func (s *SmartContract) GetDailyMerkleRoot(ctx contractapi.TransactionContextInterface, storeID string, date string) (MerkleRoot, error) {
+	merkleRootJSON, err := ctx.GetStub().GetState(merkleRootKey(storeID, date))
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	if merkleRootJSON == nil {
+		return MerkleRoot{}, fmt.Errorf("Merkle root not found for store %s on %s", storeID, date)
+	}
+
+	var merkleRoot MerkleRoot
+	err = json.Unmarshal(merkleRootJSON, &merkleRoot)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+
+	return merkleRoot, nil
+}
+
+// Retrieve the Merkle path proving that an invoice is included under its day's anchored root
+func (s *SmartContract) GetInclusionProof(ctx contractapi.TransactionContextInterface, invoiceID string) (InclusionProof, error) {
+	invoice, err := s.GetInvoice(ctx, invoiceID)
+	if err != nil {
+		return InclusionProof{}, err
+	}
+
+	merkleRoot, err := s.GetDailyMerkleRoot(ctx, invoice.StoreID, invoice.Date)
+	if err != nil {
+		return InclusionProof{}, err
+	}
+
+	leafIndex := -1
+	for i, anchoredID := range merkleRoot.InvoiceIDs {
+		if anchoredID == invoiceID {
+			leafIndex = i
+		}
+	}
+	if leafIndex < 0 {
+		return InclusionProof{}, fmt.Errorf("invoice %s was recorded after the root for %s was anchored", invoiceID, invoice.Date)
+	}
+
+	contentHash := storedContentHash(invoice)
+	if merkleRoot.ContentHashes[leafIndex] != contentHash {
+		return InclusionProof{}, fmt.Errorf("invoice %s was amended after the root for %s was anchored", invoiceID, invoice.Date)
+	}
+
+	path, err := merkle.Proof(merkleRoot.ContentHashes, leafIndex)
+	if err != nil {
+		return InclusionProof{}, err
+	}
+
+	return InclusionProof{
+		InvoiceID:   invoiceID,
+		StoreID:     invoice.StoreID,
+		Date:        invoice.Date,
+		ContentHash: contentHash,
+		LeafIndex:   leafIndex,
+		LeafCount:   len(merkleRoot.ContentHashes),
+		Path:        path,
+		Root:        merkleRoot.Root,
+	}, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gravityinescapable/BTP/chaincode/invoice/go/merkle"
+)
+
+func TestDailyMerkleRoot(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 4, 2)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X2", "S1", "sales", lineArg("milk", "2027-03-10", 1, 2)))
+
+	f.fail(f.org2, "is owned by Org1MSP", "AnchorDailyMerkleRoot", "S1", "2026-03-01")
+	f.fail(f.org1, "has no invoices dated 2026-03-02", "AnchorDailyMerkleRoot", "S1", "2026-03-02")
+	var root MerkleRoot
+	f.get(&root, f.org1, "AnchorDailyMerkleRoot", "S1", "2026-03-01")
+	if len(root.InvoiceIDs) != 3 || root.InvoiceIDs[0] != "P1" || root.InvoiceIDs[2] != "X2" {
+		t.Fatalf("unexpected root %+v", root)
+	}
+
+	// Anyone holding the invoice JSON derives its leaf and checks the proof offline
+	for _, invoiceID := range root.InvoiceIDs {
+		invoiceJSON := f.ok(f.auditor, "GetInvoice", invoiceID)
+		leaf, err := merkle.ContentHash([]byte(invoiceJSON))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var proof InclusionProof
+		f.get(&proof, f.auditor, "GetInclusionProof", invoiceID)
+		if proof.ContentHash != leaf || proof.Root != root.Root {
+			t.Fatalf("proof of %s does not match the derived leaf %s: %+v", invoiceID, leaf, proof)
+		}
+		ok, err := merkle.Verify(leaf, proof.Path, root.Root)
+		if err != nil || !ok {
+			t.Fatalf("proof of %s does not verify: %v", invoiceID, err)
+		}
+	}
+
+	// A tampered invoice no longer derives to an anchored leaf
+	var invoice map[string]interface{}
+	json.Unmarshal([]byte(f.ok(f.auditor, "GetInvoice", "X1")), &invoice)
+	invoice["items"].([]interface{})[0].(map[string]interface{})["quantity"] = 3
+	tamperedJSON, _ := json.Marshal(invoice)
+	tampered, _ := merkle.ContentHash(tamperedJSON)
+	var proof InclusionProof
+	f.get(&proof, f.auditor, "GetInclusionProof", "X1")
+	if ok, _ := merkle.Verify(tampered, proof.Path, root.Root); ok {
+		t.Fatal("tampered invoice verifies")
+	}
+
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X3", "S1", "sales", lineArg("milk", "2027-03-10", 1, 2)))
+	f.fail(f.auditor, "recorded after the root for 2026-03-01 was anchored", "GetInclusionProof", "X3")
+	f.ok(f.org1, "AmendInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 4, 2.5)), "pricing_error", "wrong shelf price")
+	f.fail(f.auditor, "amended after the root", "GetInclusionProof", "X1")
+
+	// A day is anchored once; a regulator re-anchors it, leaving out voided invoices and keeping the earlier root
+	f.ok(f.org1, "VoidInvoice", "X2", "duplicate", "keyed twice")
+	f.fail(f.org1, "already anchored", "AnchorDailyMerkleRoot", "S1", "2026-03-01")
+	f.fail(f.regulator, "already anchored", "AnchorDailyMerkleRoot", "S1", "2026-03-01")
+	f.fail(f.org1, "not permitted", "ReanchorDailyMerkleRoot", "S1", "2026-03-01", "amended invoice")
+	f.fail(f.regulator, "requires a justification", "ReanchorDailyMerkleRoot", "S1", "2026-03-01", " ")
+	f.fail(f.regulator, "Merkle root not found", "ReanchorDailyMerkleRoot", "S1", "2026-03-02", "amended invoice")
+	var reanchored MerkleRoot
+	f.get(&reanchored, f.regulator, "ReanchorDailyMerkleRoot", "S1", "2026-03-01", "amended invoice")
+	if reanchored.Revision != 2 || len(reanchored.InvoiceIDs) != 3 || reanchored.InvoiceIDs[1] != "X1" || reanchored.InvoiceIDs[2] != "X3" {
+		t.Fatalf("unexpected re-anchored root %+v", reanchored)
+	}
+	f.get(&proof, f.auditor, "GetInclusionProof", "X1")
+	if proof.Root != reanchored.Root {
+		t.Fatalf("proof not under the re-anchored root %+v", proof)
+	}
+
+	var history []MerkleRoot
+	f.get(&history, f.auditor, "GetDailyMerkleRootHistory", "S1", "2026-03-01")
+	if len(history) != 2 || history[0].Root != root.Root || history[0].Revision != 1 || history[1].Root != reanchored.Root {
+		t.Fatalf("unexpected root history %+v", history)
+	}
+}
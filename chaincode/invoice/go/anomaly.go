@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gravityinescapable/BTP/chaincode/invoice/go/analytics"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Kinds of anomaly flagged on invoices
+const (
+	anomalyQuantity    = "quantity_outlier"
+	anomalyPrice       = "price_outlier"
+	anomalySpike       = "quantity_spike"
+	anomalyRoundNumber = "round_number"
+	anomalyTiming      = "timing_outlier"
+)
+
+// Thresholds of the anomaly checks
+const (
+	minAnomalyHistory   = 8    // earlier observations needed before a store's history is trusted
+	anomalyZScore       = 3.0  // standard deviations from the mean
+	anomalyFenceK       = 3.0  // interquartile ranges beyond the quartiles
+	spikeWindow         = 5    // most recent invoices a spike is measured against
+	spikeRatio          = 5.0  // multiple of their median quantity
+	roundQuantityUnit   = 10.0 // base units
+	roundPriceUnit      = 100  // minor units
+	roundShareThreshold = 0.6  // share of round lines that makes rounding a pattern
+	rareHourShare       = 0.05 // share of earlier invoices recorded in the same hour
+	anomalyHistoryDays  = 90   // days before an invoice its history reaches back
+	anomalyHistoryLimit = 200  // most recent invoices its history is read from
+)
+
+// Composite key object type indexing invoices by store, type and the UTC day of their timestamp,
+// so that the history of a trailing window is read day by day
+const invoiceHistoryObjectType = "INVOICE_HISTORY"
+
+// AnomalyFlag structure
+type AnomalyFlag struct {
+	DocType     string  `json:"doc_type"`
+	StoreID     string  `json:"store_id"`
+	InvoiceID   string  `json:"invoice_id"`
+	Version     int     `json:"version"`
+	InvoiceType string  `json:"invoice_type"`
+	ItemID      string  `json:"item_id,omitempty" metadata:",optional"` // empty for flags on the invoice as a whole
+	Kind        string  `json:"kind"`
+	Value       float64 `json:"value"` // observed quantity, unit price or hour
+	Score       float64 `json:"score"` // z-score, spike ratio or share, depending on the kind
+	Detail      string  `json:"detail"`
+	FlaggedAt   string  `json:"flagged_at"`
+}
+
+// Earlier observations of an item in a store's invoices of one type
+type itemHistory struct {
+	quantities []float64
+	unitPrices []float64 // minor units per base unit, from publicly priced invoices in the same currency
+	rounds     []float64 // 1 for each round line, 0 otherwise
+}
+
+// Ledger key indexing an invoice under its store, type and the UTC day of its timestamp
+func invoiceHistoryKey(ctx contractapi.TransactionContextInterface, storeID string, invoiceType string, day string, invoiceID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(invoiceHistoryObjectType, []string{storeID, invoiceType, day, invoiceID})
+}
+
+// Ledger key of an anomaly flagged on an invoice
+func anomalyKey(storeID string, invoiceID string, itemID string, kind string) string {
+	return fmt.Sprintf("ANOMALY_%s_%s_%s_%s", storeID, invoiceID, itemID, kind)
+}
+
+// Retrieve the anomalies flagged on the invoices of a store, restricted to auditors and regulators
+func (s *SmartContract) GetAnomalyFlags(ctx contractapi.TransactionContextInterface, storeID string) ([]AnomalyFlag, error) {
+	err := requireRole(ctx, roleAuditor, roleRegulator)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("ANOMALY_%s_", storeID)
+	resultsIterator, err := ctx.GetStub().GetStateByRange(prefix, prefix+"\uffff")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	flags := []AnomalyFlag{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var flag AnomalyFlag
+		err = json.Unmarshal(queryResponse.Value, &flag)
+		if err != nil {
+			return nil, err
+		}
+		if flag.StoreID == storeID {
+			flags = append(flags, flag)
+		}
+	}
+
+	return flags, nil
+}
+
+// Compare an invoice with the store's history and record a flag for every outlier found, replacing
+// the flags of the version it amends; flags inform auditors and never reject the invoice
+func (s *SmartContract) flagAnomalies(ctx contractapi.TransactionContextInterface, invoice Invoice, previous Invoice) error {
+	var flags []AnomalyFlag
+
+	// Lines of the same item are looked at together
+	quantities := make(map[string]float64)
+	lineTotals := make(map[string]int64)
+	var itemIDs []string
+	for _, item := range invoice.Items {
+		if _, ok := quantities[item.ItemID]; !ok {
+			itemIDs = append(itemIDs, item.ItemID)
+		}
+		quantities[item.ItemID] += baseQuantity(item)
+		lineTotals[item.ItemID] += item.TotalPriceMinor
+	}
+
+	// The history is read once and shared by the checks of every item
+	earlier, err := s.getEarlierInvoices(ctx, invoice)
+	if err != nil {
+		return err
+	}
+
+	for _, itemID := range itemIDs {
+		history := itemHistoryOf(invoice, earlier, itemID)
+		quantity := quantities[itemID]
+
+		if len(history.quantities) >= minAnomalyHistory {
+			if flag, ok := outlierFlag(anomalyQuantity, quantity, history.quantities); ok {
+				flags = append(flags, withItem(flag, itemID))
+			}
+
+			recent := history.quantities[len(history.quantities)-spikeWindow:]
+			if ratio, ok := analytics.SpikeRatio(quantity, recent); ok && ratio >= spikeRatio {
+				flags = append(flags, AnomalyFlag{ItemID: itemID, Kind: anomalySpike, Value: quantity, Score: ratio, Detail: fmt.Sprintf("quantity is %.1f times the median of the last %d invoices", ratio, spikeWindow)})
+			}
+		}
+
+		// Amounts of privately priced invoices are not on the public ledger and are not compared
+		if invoice.PricingHash == "" && quantity > 0 && len(history.unitPrices) >= minAnomalyHistory {
+			unitPrice := float64(lineTotals[itemID]) / quantity
+			if flag, ok := outlierFlag(anomalyPrice, unitPrice, history.unitPrices); ok {
+				flags = append(flags, withItem(flag, itemID))
+			}
+		}
+
+		// A round line on its own is unremarkable, a store where most lines are round is not
+		if len(history.rounds) >= minAnomalyHistory && isRoundLine(quantity, lineTotals[itemID], invoice.PricingHash == "") {
+			share := analytics.Mean(append(history.rounds, 1))
+			if share >= roundShareThreshold {
+				flags = append(flags, AnomalyFlag{ItemID: itemID, Kind: anomalyRoundNumber, Value: quantity, Score: share, Detail: fmt.Sprintf("%.0f%% of this item's lines are round numbers", share*100)})
+			}
+		}
+	}
+
+	timingFlag, ok, err := s.timingAnomaly(ctx, invoice, earlier)
+	if err != nil {
+		return err
+	}
+	if ok {
+		flags = append(flags, timingFlag)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = s.clearAnomalyFlags(ctx, previous, flags)
+	if err != nil {
+		return err
+	}
+
+	// A new invoice joins the history of later ones, an amendment cannot change its timestamp
+	if previous.InvoiceID == "" {
+		err = s.putInvoiceHistoryIndex(ctx, invoice)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, flag := range flags {
+		flag.DocType = "anomaly_flag"
+		flag.StoreID = invoice.StoreID
+		flag.InvoiceID = invoice.InvoiceID
+		flag.Version = invoiceVersion(invoice)
+		flag.InvoiceType = invoice.InvoiceType
+		flag.FlaggedAt = now.Format(time.RFC3339)
+
+		flagJSON, err := json.Marshal(flag)
+		if err != nil {
+			return err
+		}
+		err = ctx.GetStub().PutState(anomalyKey(flag.StoreID, flag.InvoiceID, flag.ItemID, flag.Kind), flagJSON)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete the flags of an earlier version of an invoice that the new version does not raise again
+func (s *SmartContract) clearAnomalyFlags(ctx contractapi.TransactionContextInterface, previous Invoice, flags []AnomalyFlag) error {
+	if previous.InvoiceID == "" {
+		return nil
+	}
+
+	raised := make(map[string]bool)
+	for _, flag := range flags {
+		raised[anomalyKey(previous.StoreID, previous.InvoiceID, flag.ItemID, flag.Kind)] = true
+	}
+
+	// Flags are keyed by item and kind, so the keys the earlier version could have used are known
+	itemIDs := []string{""}
+	for _, item := range previous.Items {
+		itemIDs = append(itemIDs, item.ItemID)
+	}
+	for _, itemID := range itemIDs {
+		for _, kind := range []string{anomalyQuantity, anomalyPrice, anomalySpike, anomalyRoundNumber, anomalyTiming} {
+			key := anomalyKey(previous.StoreID, previous.InvoiceID, itemID, kind)
+			if raised[key] {
+				continue
+			}
+			flagJSON, err := ctx.GetStub().GetState(key)
+			if err != nil {
+				return err
+			}
+			if flagJSON == nil {
+				continue
+			}
+			err = ctx.GetStub().DelState(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Collect the earlier observations of an item in a store's invoices of the same type, oldest first
+func itemHistoryOf(invoice Invoice, earlier []Invoice, itemID string) itemHistory {
+	var history itemHistory
+	for _, earlierInvoice := range earlier {
+		var quantity float64
+		var lineTotal int64
+		var found bool
+		for _, item := range earlierInvoice.Items {
+			if item.ItemID == itemID {
+				quantity += baseQuantity(item)
+				lineTotal += item.TotalPriceMinor
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+
+		publiclyPriced := earlierInvoice.PricingHash == ""
+		history.quantities = append(history.quantities, quantity)
+		if publiclyPriced && earlierInvoice.Currency == invoice.Currency && quantity > 0 {
+			history.unitPrices = append(history.unitPrices, float64(lineTotal)/quantity)
+		}
+		if isRoundLine(quantity, lineTotal, publiclyPriced) {
+			history.rounds = append(history.rounds, 1)
+		} else {
+			history.rounds = append(history.rounds, 0)
+		}
+	}
+
+	return history
+}
+
+// Flag an invoice recorded at an hour, in the store's time zone, at which the store rarely trades
+func (s *SmartContract) timingAnomaly(ctx contractapi.TransactionContextInterface, invoice Invoice, earlier []Invoice) (AnomalyFlag, bool, error) {
+	store, err := s.GetStore(ctx, invoice.StoreID)
+	if err != nil {
+		return AnomalyFlag{}, false, err
+	}
+	location, err := time.LoadLocation(store.TimeZone)
+	if err != nil {
+		return AnomalyFlag{}, false, nil
+	}
+	hour, ok := localHour(invoice.Timestamp, location)
+	if !ok {
+		return AnomalyFlag{}, false, nil
+	}
+
+	var hours []int
+	for _, earlierInvoice := range earlier {
+		if earlierHour, ok := localHour(earlierInvoice.Timestamp, location); ok {
+			hours = append(hours, earlierHour)
+		}
+	}
+	if len(hours) < minAnomalyHistory {
+		return AnomalyFlag{}, false, nil
+	}
+
+	share := analytics.BucketShare(hour, hours)
+	if share >= rareHourShare {
+		return AnomalyFlag{}, false, nil
+	}
+
+	return AnomalyFlag{
+		Kind:   anomalyTiming,
+		Value:  float64(hour),
+		Score:  1 - share,
+		Detail: fmt.Sprintf("%.0f%% of earlier invoices were recorded between %02d:00 and %02d:00 local time", share*100, hour, hour+1),
+	}, true, nil
+}
+
+// Index an invoice under its store, type and the UTC day of its timestamp
+func (s *SmartContract) putInvoiceHistoryIndex(ctx contractapi.TransactionContextInterface, invoice Invoice) error {
+	// An invoice without a readable timestamp has no place in anyone's history
+	timestamp, err := time.Parse(time.RFC3339, invoice.Timestamp)
+	if err != nil {
+		return nil
+	}
+
+	historyKey, err := invoiceHistoryKey(ctx, invoice.StoreID, invoice.InvoiceType, timestamp.UTC().Format("2006-01-02"), invoice.InvoiceID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(historyKey, []byte{0x00})
+}
+
+// Read the most recent live invoices of the same store and type whose timestamps fall within the history
+// window up to an invoice's timestamp, other than the given invoice, oldest first
+func (s *SmartContract) getEarlierInvoices(ctx contractapi.TransactionContextInterface, invoice Invoice) ([]Invoice, error) {
+	// An invoice without a readable timestamp has no history to be compared with
+	timestamp, err := time.Parse(time.RFC3339, invoice.Timestamp)
+	if err != nil {
+		return nil, nil
+	}
+	from := timestamp.AddDate(0, 0, -anomalyHistoryDays)
+	firstDay := from.UTC().Format("2006-01-02")
+
+	// Days are read newest first and only until enough history is found, however long the store's record
+	var invoices []Invoice
+	times := make(map[string]time.Time)
+	for day := timestamp.UTC(); day.Format("2006-01-02") >= firstDay && len(invoices) < anomalyHistoryLimit; day = day.AddDate(0, 0, -1) {
+		resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(invoiceHistoryObjectType, []string{invoice.StoreID, invoice.InvoiceType, day.Format("2006-01-02")})
+		if err != nil {
+			return nil, err
+		}
+
+		var invoiceIDs []string
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			_, keyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			invoiceIDs = append(invoiceIDs, keyParts[3])
+		}
+		resultsIterator.Close()
+
+		for _, invoiceID := range invoiceIDs {
+			if invoiceID == invoice.InvoiceID {
+				continue
+			}
+			earlierInvoice, err := s.GetInvoice(ctx, invoiceID)
+			if err != nil {
+				return nil, err
+			}
+			if !countsTowardTotals(earlierInvoice) {
+				continue
+			}
+
+			// Timestamps are compared as instants, whatever offset they were written with
+			recordedAt, err := time.Parse(time.RFC3339, earlierInvoice.Timestamp)
+			if err != nil || recordedAt.Before(from) || recordedAt.After(timestamp) {
+				continue
+			}
+			times[invoiceID] = recordedAt
+			invoices = append(invoices, earlierInvoice)
+		}
+	}
+
+	sort.SliceStable(invoices, func(i, j int) bool {
+		ti, tj := times[invoices[i].InvoiceID], times[invoices[j].InvoiceID]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return invoices[i].InvoiceID < invoices[j].InvoiceID
+	})
+	if len(invoices) > anomalyHistoryLimit {
+		invoices = invoices[len(invoices)-anomalyHistoryLimit:]
+	}
+
+	return invoices, nil
+}
+
+// Flag a value lying beyond the far Tukey fences or too many standard deviations from the history
+func outlierFlag(kind string, value float64, history []float64) (AnomalyFlag, bool) {
+	z, spread := analytics.ZScore(value, history)
+	outside := analytics.OutsideFences(value, history, anomalyFenceK)
+	if !outside && (!spread || math.Abs(z) < anomalyZScore) {
+		return AnomalyFlag{}, false
+	}
+
+	// Without spread in the history the score is the ratio to its median instead
+	score := z
+	if !spread {
+		score, _ = analytics.SpikeRatio(value, history)
+	}
+
+	return AnomalyFlag{
+		Kind:   kind,
+		Value:  value,
+		Score:  score,
+		Detail: fmt.Sprintf("%v against a median of %v over %d earlier invoices", value, analytics.Median(history), len(history)),
+	}, true
+}
+
+// Set the item of a flag
+func withItem(flag AnomalyFlag, itemID string) AnomalyFlag {
+	flag.ItemID = itemID
+	return flag
+}
+
+// Check whether a line has a round quantity and, when its amounts are public, a round total
+func isRoundLine(quantity float64, lineTotal int64, publiclyPriced bool) bool {
+	if !analytics.IsRound(quantity, roundQuantityUnit) {
+		return false
+	}
+	return !publiclyPriced || analytics.IsRound(float64(lineTotal), roundPriceUnit)
+}
+
+// Hour of an RFC3339 timestamp in a time zone
+func localHour(timestamp string, location *time.Location) (int, bool) {
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return 0, false
+	}
+	return parsed.In(location).Hour(), true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnomalyFlags(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 500, 1)))
+	for i := 0; i < 10; i++ {
+		sale := invoiceArg(fmt.Sprintf("X%02d", i), "S1", "sales", lineArg("milk", "2027-03-10", float64(2+i%3), 2))
+		sale["timestamp"] = fmt.Sprintf("2026-03-01T%02d:15:00Z", 4+i%3)
+		f.ok(f.org1, "CreateOrUpdateInvoice", sale)
+	}
+	f.fail(f.org1, "not permitted", "GetAnomalyFlags", "S1")
+	var flags []AnomalyFlag
+	f.get(&flags, f.auditor, "GetAnomalyFlags", "S1")
+	if len(flags) != 0 {
+		t.Fatalf("unexpected flags %+v", flags)
+	}
+
+	// A large sale in the middle of the night stands out on quantity and timing
+	f.now = f.now.Add(11 * time.Hour)
+	large := invoiceArg("XL", "S1", "sales", lineArg("milk", "2027-03-10", 40, 2))
+	large["date"] = "2026-03-02"
+	large["timestamp"] = "2026-03-01T20:30:00Z"
+	f.ok(f.org1, "CreateOrUpdateInvoice", large)
+	f.get(&flags, f.regulator, "GetAnomalyFlags", "S1")
+	kinds := make(map[string]bool)
+	for _, flag := range flags {
+		if flag.InvoiceID != "XL" || flag.Version != 1 {
+			t.Fatalf("unexpected flag %+v", flag)
+		}
+		kinds[flag.Kind] = true
+	}
+	if !kinds[anomalyQuantity] || !kinds[anomalySpike] || !kinds[anomalyTiming] {
+		t.Fatalf("expected quantity, spike and timing flags, got %+v", flags)
+	}
+
+	// Correcting the quantity withdraws the quantity flags of the earlier version
+	corrected := invoiceArg("XL", "S1", "sales", lineArg("milk", "2027-03-10", 4, 2))
+	corrected["date"] = "2026-03-02"
+	corrected["timestamp"] = "2026-03-01T20:30:00Z"
+	f.ok(f.org1, "AmendInvoice", corrected, "quantity_error", "extra zero")
+	f.ok(f.manager, "ApproveInvoiceAmendment", "XL", 2)
+	f.get(&flags, f.auditor, "GetAnomalyFlags", "S1")
+	if len(flags) != 1 || flags[0].Kind != anomalyTiming || flags[0].Version != 2 {
+		t.Fatalf("expected only the timing flag of version 2, got %+v", flags)
+	}
+
+	// History older than the window is not compared with
+	f.now = time.Date(2026, 6, 15, 10, 0, 0, 0, time.UTC)
+	late := invoiceArg("XM", "S1", "sales", lineArg("milk", "2027-03-10", 40, 2))
+	late["date"] = "2026-06-15"
+	late["timestamp"] = "2026-06-15T09:00:00Z"
+	f.ok(f.org1, "CreateOrUpdateInvoice", late)
+	f.get(&flags, f.auditor, "GetAnomalyFlags", "S1")
+	if len(flags) != 1 {
+		t.Fatalf("invoice compared with history outside the window: %+v", flags)
+	}
+}
+
+func TestAnomalyHistoryTimestamps(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 500, 1)))
+
+	// Written in the store's offset, these sort after the large sale as text but were recorded before it
+	for i := 0; i < 10; i++ {
+		sale := invoiceArg(fmt.Sprintf("X%02d", i), "S1", "sales", lineArg("milk", "2027-03-10", float64(2+i%3), 2))
+		sale["timestamp"] = fmt.Sprintf("2026-03-01T15:%02d:00+05:30", i)
+		f.ok(f.org1, "CreateOrUpdateInvoice", sale)
+	}
+	large := invoiceArg("XL", "S1", "sales", lineArg("milk", "2027-03-10", 40, 2))
+	large["timestamp"] = "2026-03-01T09:55:00Z"
+	f.ok(f.org1, "CreateOrUpdateInvoice", large)
+
+	var flags []AnomalyFlag
+	f.get(&flags, f.auditor, "GetAnomalyFlags", "S1")
+	kinds := make(map[string]bool)
+	for _, flag := range flags {
+		kinds[flag.Kind] = true
+	}
+	if !kinds[anomalyQuantity] || !kinds[anomalySpike] {
+		t.Fatalf("expected quantity and spike flags against the offset history, got %+v", flags)
+	}
+
+	// The history is read day by day from the store's index, not with a query over all its invoices
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X10", "S1", "sales", lineArg("milk", "2027-03-10", 3, 2)))
+	dayKey, _ := f.stub.CreateCompositeKey(invoiceHistoryObjectType, []string{"S1", "sales", "2026-03-01"})
+	var days []string
+	for _, startKey := range f.stub.rangeReads {
+		if strings.HasPrefix(startKey, "\x00"+invoiceHistoryObjectType+"\x00") {
+			days = append(days, startKey)
+		}
+	}
+	if len(days) != anomalyHistoryDays+1 || days[0] != dayKey {
+		t.Fatalf("expected the %d days of the window to be read newest first, got %q", anomalyHistoryDays+1, days)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// CatalogueItem structure
+type CatalogueItem struct {
+	DocType                 string             `json:"doc_type"`
+	ItemID                  string             `json:"item_id"`
+	GTIN                    string             `json:"gtin"`
+	Name                    string             `json:"name"`
+	Category                string             `json:"category"`
+	UnitOfMeasure           string             `json:"unit_of_measure"`                                 // base unit all quantities are converted to
+	UnitConversions         map[string]float64 `json:"unit_conversions,omitempty" metadata:",optional"` // other units expressed in base units, e.g. "case": 24
+	VariableWeight          bool               `json:"variable_weight,omitempty" metadata:",optional"`  // sold by mass rather than by count
+	ShelfLifeDays           int                `json:"shelf_life_days"`                                 // nominal shelf life from production
+	Perishable              bool               `json:"perishable"`
+	ColdChainRules          []ColdChainRule    `json:"cold_chain_rules,omitempty" metadata:",optional"`            // shelf life lost to temperature excursions
+	MinReceiptShelfLifeDays int                `json:"min_receipt_shelf_life_days,omitempty" metadata:",optional"` // shelf life a delivery must have left, a third of the shelf life for perishables by default
+	UpdatedBy               string             `json:"updated_by"`
+	UpdatedAt               string             `json:"updated_at"`
+}
+
+// CategoryIndex structure
+type CategoryIndex struct {
+	Category         string  `json:"category"`
+	NumItemKeys      int     `json:"num_item_keys"`
+	TotalPurchase    float64 `json:"total_purchase"`
+	TotalSales       float64 `json:"total_sales"`
+	AverageWastage   float64 `json:"average_wastage"`
+	AverageRISEIndex float64 `json:"average_rise_index"`
+}
+
+// Ledger key of a catalogue item
+func catalogueKey(itemID string) string {
+	return fmt.Sprintf("CATALOGUE_%s", itemID)
+}
+
+// Create or update an item in the product catalogue, restricted to catalogue managers and regulators
+func (s *SmartContract) CreateOrUpdateCatalogueItem(ctx contractapi.TransactionContextInterface, item CatalogueItem) error {
+	err := requireRole(ctx, roleCatalogueManager, roleRegulator)
+	if err != nil {
+		return err
+	}
+
+	if item.ItemID == "" {
+		return fmt.Errorf("item ID is required")
+	}
+	if strings.TrimSpace(item.Name) == "" || strings.TrimSpace(item.Category) == "" || item.UnitOfMeasure == "" {
+		return fmt.Errorf("catalogue item %s requires a name, category and unit of measure", item.ItemID)
+	}
+	if !validGTIN(item.GTIN) {
+		return fmt.Errorf("catalogue item %s has an invalid GTIN: %q", item.ItemID, item.GTIN)
+	}
+	if item.ShelfLifeDays < 0 || item.MinReceiptShelfLifeDays < 0 {
+		return fmt.Errorf("catalogue item %s cannot have a negative shelf life", item.ItemID)
+	}
+	err = validateUnits(item)
+	if err != nil {
+		return err
+	}
+	err = validateColdChainRules(item)
+	if err != nil {
+		return err
+	}
+
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	item.DocType = "catalogue_item"
+	item.UpdatedBy = mspID
+	item.UpdatedAt = now.Format(time.RFC3339)
+
+	itemJSON, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(catalogueKey(item.ItemID), itemJSON)
+}
+
+// Retrieve an item from the product catalogue
+func (s *SmartContract) GetCatalogueItem(ctx contractapi.TransactionContextInterface, itemID string) (CatalogueItem, error) {
+	itemJSON, err := ctx.GetStub().GetState(catalogueKey(itemID))
+	if err != nil {
+		return CatalogueItem{}, err
+	}
+	if itemJSON == nil {
+		return CatalogueItem{}, fmt.Errorf("Catalogue item not found for ID: %s", itemID)
+	}
+
+	var item CatalogueItem
+	err = json.Unmarshal(itemJSON, &item)
+	if err != nil {
+		return CatalogueItem{}, err
+	}
+
+	return item, nil
+}
+
+// Retrieve the wastage and RISE indices of a store aggregated by catalogue category
+func (s *SmartContract) GetCategoryIndices(ctx contractapi.TransactionContextInterface, storeID string) ([]CategoryIndex, error) {
+	wastageIndices, err := s.getStoreWastageIndices(ctx, storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	categories := make(map[string]*CategoryIndex)
+	for _, wastageIndex := range wastageIndices {
+		item, err := s.GetCatalogueItem(ctx, wastageIndex.ItemKey.ItemID)
+		if err != nil {
+			return nil, err
+		}
+
+		riseIndex, err := s.getRISEIndex(ctx, storeID, wastageIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		categoryIndex, ok := categories[item.Category]
+		if !ok {
+			categoryIndex = &CategoryIndex{Category: item.Category}
+			categories[item.Category] = categoryIndex
+		}
+		categoryIndex.NumItemKeys++
+		categoryIndex.TotalPurchase += wastageIndex.TotalPurchase
+		categoryIndex.TotalSales += wastageIndex.TotalSales
+		categoryIndex.AverageWastage += wastageIndex.Wastage
+		categoryIndex.AverageRISEIndex += riseIndex.RISEIndex
+	}
+
+	categoryIndices := []CategoryIndex{}
+	for _, categoryIndex := range categories {
+		categoryIndex.AverageWastage /= float64(categoryIndex.NumItemKeys)
+		categoryIndex.AverageRISEIndex /= float64(categoryIndex.NumItemKeys)
+		categoryIndices = append(categoryIndices, *categoryIndex)
+	}
+	sort.Slice(categoryIndices, func(i, j int) bool {
+		return categoryIndices[i].Category < categoryIndices[j].Category
+	})
+
+	return categoryIndices, nil
+}
+
+// Validate invoice items against the catalogue, adopting the catalogue names and base units
+func (s *SmartContract) validateItemsAgainstCatalogue(ctx contractapi.TransactionContextInterface, items []Item) error {
+	for i, item := range items {
+		catalogueItem, err := s.GetCatalogueItem(ctx, item.ItemID)
+		if err != nil {
+			return fmt.Errorf("item %s is not in the product catalogue", item.ItemID)
+		}
+		items[i].ItemName = catalogueItem.Name
+
+		if item.Unit == "" {
+			items[i].Unit = catalogueItem.UnitOfMeasure
+		}
+		items[i].BaseQuantity, err = toBaseQuantity(catalogueItem, item.Quantity, item.Unit)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the length and check digit of a GTIN-8, GTIN-12, GTIN-13 or GTIN-14
+func validGTIN(gtin string) bool {
+	switch len(gtin) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+
+	sum := 0
+	for i := 0; i < len(gtin)-1; i++ {
+		digit := int(gtin[i] - '0')
+		if digit < 0 || digit > 9 {
+			return false
+		}
+		// Weights alternate 3, 1 counting leftwards from the digit before the check digit
+		if (len(gtin)-1-i)%2 == 1 {
+			sum += digit * 3
+		} else {
+			sum += digit
+		}
+	}
+
+	checkDigit := int(gtin[len(gtin)-1] - '0')
+	return checkDigit >= 0 && checkDigit <= 9 && (10-sum%10)%10 == checkDigit
+}
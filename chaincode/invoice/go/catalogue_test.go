@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestValidGTIN(t *testing.T) {
+	for gtin, valid := range map[string]bool{
+		"4006381333931":  true,
+		"96385074":       true,
+		"036000291452":   true,
+		"10036000291459": true,
+		"4006381333932":  false,
+		"400638133393":   false,
+		"40063813339a1":  false,
+		"":               false,
+	} {
+		if validGTIN(gtin) != valid {
+			t.Errorf("validGTIN(%q) = %v, expected %v", gtin, !valid, valid)
+		}
+	}
+}
+
+func TestCatalogue(t *testing.T) {
+	f := newFixture(t)
+
+	f.fail(f.org1, "not permitted", "CreateOrUpdateCatalogueItem", catalogueArg("bread", "4006381333931", "each", false, 3, nil))
+	f.fail(f.catalogue, "invalid GTIN", "CreateOrUpdateCatalogueItem", catalogueArg("bread", "4006381333932", "each", false, 3, nil))
+	f.fail(f.catalogue, "negative shelf life", "CreateOrUpdateCatalogueItem", catalogueArg("bread", "4006381333931", "each", false, -1, nil))
+	f.ok(f.regulator, "CreateOrUpdateCatalogueItem", catalogueArg("bread", "4006381333931", "each", false, 3, nil))
+
+	var item CatalogueItem
+	f.get(&item, f.org1, "GetCatalogueItem", "bread")
+	if item.UpdatedBy != "RegMSP" || item.DocType != "catalogue_item" {
+		t.Fatalf("unexpected catalogue item %+v", item)
+	}
+	f.fail(f.org1, "Catalogue item not found for ID: cake", "GetCatalogueItem", "cake")
+
+	// Invoices may only name catalogued items and carry the catalogue name
+	f.fail(f.org1, "item cake is not in the product catalogue", "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("cake", "2027-03-10", 1, 1)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1), lineArg("cheese", "2027-03-20", 2, 9)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 6, 2)))
+
+	var invoice Invoice
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Items[0].ItemName != "milk" || invoice.Items[0].Unit != "each" || invoice.Items[1].Unit != "kg" {
+		t.Fatalf("catalogue not applied to %+v", invoice.Items)
+	}
+
+	var categories []CategoryIndex
+	f.get(&categories, f.org1, "GetCategoryIndices", "S1")
+	if len(categories) != 1 || categories[0].Category != "dairy" || categories[0].NumItemKeys != 2 {
+		t.Fatalf("unexpected category indices %+v", categories)
+	}
+	if categories[0].TotalPurchase != 26 || categories[0].TotalSales != 6 {
+		t.Fatalf("unexpected category totals %+v", categories[0])
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ColdChainRule structure, the shelf life a catalogue item loses while held above a temperature
+type ColdChainRule struct {
+	AboveCelsius      float64 `json:"above_celsius"`
+	HoursLostPerHour  float64 `json:"hours_lost_per_hour"`                                // shelf life lost for each hour of the excursion
+	SpoilAfterMinutes int     `json:"spoil_after_minutes,omitempty" metadata:",optional"` // longer excursions spoil the lot outright
+}
+
+// TemperatureExcursion structure, a signed sensor report of a lot held out of temperature
+type TemperatureExcursion struct {
+	DocType     string  `json:"doc_type"`
+	ReportID    string  `json:"report_id"`
+	StoreID     string  `json:"store_id"`
+	DeviceID    string  `json:"device_id"`
+	ItemID      string  `json:"item_id"`
+	ExpiryDate  string  `json:"expiry_date"` // printed expiry of the lot
+	StartedAt   string  `json:"started_at"`
+	EndedAt     string  `json:"ended_at"`
+	PeakCelsius float64 `json:"peak_celsius"`
+	Signature   string  `json:"signature"`                                 // base64 signature of the canonical report by the sensor
+	HoursLost   float64 `json:"hours_lost,omitempty" metadata:",optional"` // shelf life lost under the catalogue rules
+	SpoiledOn   string  `json:"spoiled_on,omitempty" metadata:",optional"` // local date the excursion spoiled the lot, its last sellable day the day before
+	RecordedAt  string  `json:"recorded_at,omitempty" metadata:",optional"`
+}
+
+// CanonicalExcursion structure, the content a sensor signs
+type CanonicalExcursion struct {
+	ReportID    string  `json:"report_id"`
+	StoreID     string  `json:"store_id"`
+	DeviceID    string  `json:"device_id"`
+	ItemID      string  `json:"item_id"`
+	ExpiryDate  string  `json:"expiry_date"`
+	StartedAt   string  `json:"started_at"`
+	EndedAt     string  `json:"ended_at"`
+	PeakCelsius float64 `json:"peak_celsius"`
+}
+
+// ExcursionInterval structure, a period a lot was held out of temperature and the rate it lost shelf life at
+type ExcursionInterval struct {
+	StartedAt        string  `json:"started_at"`
+	EndedAt          string  `json:"ended_at"`
+	HoursLostPerHour float64 `json:"hours_lost_per_hour"`
+}
+
+// EffectiveExpiry structure, the expiry of a lot in a store after its temperature excursions
+type EffectiveExpiry struct {
+	DocType             string              `json:"doc_type"`
+	StoreID             string              `json:"store_id"`
+	ItemKey             ItemKey             `json:"item_key"`
+	EffectiveExpiryDate string              `json:"effective_expiry_date"`
+	HoursLost           float64             `json:"hours_lost"`
+	SpoiledOn           string              `json:"spoiled_on,omitempty" metadata:",optional"`
+	Excursions          int                 `json:"excursions"`
+	Intervals           []ExcursionInterval `json:"intervals,omitempty" metadata:",optional"` // excursions charged, overlaps counted once
+	UpdatedAt           string              `json:"updated_at,omitempty" metadata:",optional"`
+}
+
+// NearExpiryLot structure
+type NearExpiryLot struct {
+	ItemKey             ItemKey `json:"item_key"`
+	EffectiveExpiryDate string  `json:"effective_expiry_date"`
+	DaysLeft            int     `json:"days_left"`
+	OnHand              float64 `json:"on_hand"` // book inventory in base units
+}
+
+// Ledger key of a temperature excursion report
+func temperatureExcursionKey(reportID string) string {
+	return fmt.Sprintf("TEMPERATURE_EXCURSION_%s", reportID)
+}
+
+// Ledger key of the effective expiry of a lot in a store
+func effectiveExpiryKey(storeID string, itemKey ItemKey) string {
+	return fmt.Sprintf("EFFECTIVE_EXPIRY_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate)
+}
+
+// Record a temperature excursion reported and signed by a store's sensor, shortening the lot's
+// effective expiry under the catalogue rules, restricted to the store's organisation
+func (s *SmartContract) ReportTemperatureExcursion(ctx contractapi.TransactionContextInterface, excursion TemperatureExcursion) error {
+	if excursion.ReportID == "" {
+		return fmt.Errorf("report ID is required")
+	}
+
+	existingJSON, err := ctx.GetStub().GetState(temperatureExcursionKey(excursion.ReportID))
+	if err != nil {
+		return err
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("temperature excursion %s is already recorded", excursion.ReportID)
+	}
+
+	store, err := s.requireActiveStore(ctx, excursion.StoreID)
+	if err != nil {
+		return err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	device, err := s.GetDevice(ctx, excursion.DeviceID)
+	if err != nil {
+		return err
+	}
+	if device.Status != deviceActive || device.DeviceType != deviceSensor || device.StoreID != excursion.StoreID {
+		return fmt.Errorf("device %s is not an active sensor of store %s", device.DeviceID, excursion.StoreID)
+	}
+	message, err := json.Marshal(CanonicalExcursion{
+		ReportID:    excursion.ReportID,
+		StoreID:     excursion.StoreID,
+		DeviceID:    excursion.DeviceID,
+		ItemID:      excursion.ItemID,
+		ExpiryDate:  excursion.ExpiryDate,
+		StartedAt:   excursion.StartedAt,
+		EndedAt:     excursion.EndedAt,
+		PeakCelsius: excursion.PeakCelsius,
+	})
+	if err != nil {
+		return err
+	}
+	valid, err := verifyDevicePayload(device, message, excursion.Signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return fmt.Errorf("signature of temperature excursion %s does not verify against device %s", excursion.ReportID, device.DeviceID)
+	}
+
+	catalogueItem, err := s.GetCatalogueItem(ctx, excursion.ItemID)
+	if err != nil {
+		return fmt.Errorf("item %s is not in the product catalogue", excursion.ItemID)
+	}
+	if _, err := time.Parse("2006-01-02", excursion.ExpiryDate); err != nil {
+		return fmt.Errorf("temperature excursion %s has an invalid expiry date %q", excursion.ReportID, excursion.ExpiryDate)
+	}
+	startedAt, err := time.Parse(time.RFC3339, excursion.StartedAt)
+	if err != nil {
+		return fmt.Errorf("temperature excursion %s has an invalid start %q, expected RFC 3339", excursion.ReportID, excursion.StartedAt)
+	}
+	endedAt, err := time.Parse(time.RFC3339, excursion.EndedAt)
+	if err != nil || !endedAt.After(startedAt) {
+		return fmt.Errorf("temperature excursion %s must end after it starts", excursion.ReportID)
+	}
+
+	policy, err := s.GetRecordingPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	if endedAt.Sub(now) > time.Duration(policy.MaxAheadMinutes)*time.Minute {
+		return fmt.Errorf("temperature excursion %s ends at %s, after the transaction time %s", excursion.ReportID, excursion.EndedAt, now.Format(time.RFC3339))
+	}
+
+	location, err := time.LoadLocation(store.TimeZone)
+	if err != nil {
+		return fmt.Errorf("store %s has an invalid time zone: %q", store.StoreID, store.TimeZone)
+	}
+
+	itemKey := ItemKey{ItemID: excursion.ItemID, ExpiryDate: excursion.ExpiryDate}
+	effectiveExpiry, err := s.GetEffectiveExpiry(ctx, excursion.StoreID, itemKey)
+	if err != nil {
+		return err
+	}
+
+	excursion.DocType = "temperature_excursion"
+	excursion.HoursLost = 0
+	excursion.SpoiledOn = ""
+	excursion.RecordedAt = now.Format(time.RFC3339)
+	if rule, ok := coldChainRule(catalogueItem, excursion.PeakCelsius); ok {
+		// Reports from several sensors may cover the same hours, which the lot loses only once
+		effectiveExpiry.Intervals = append(effectiveExpiry.Intervals, ExcursionInterval{
+			StartedAt:        startedAt.UTC().Format(time.RFC3339),
+			EndedAt:          endedAt.UTC().Format(time.RFC3339),
+			HoursLostPerHour: rule.HoursLostPerHour,
+		})
+		hoursLost := chargedHours(effectiveExpiry.Intervals)
+		excursion.HoursLost = hoursLost - effectiveExpiry.HoursLost
+		effectiveExpiry.HoursLost = hoursLost
+
+		// The lot spoils once the excursion has lasted the rule's limit, not when it ends
+		spoilAfter := time.Duration(rule.SpoilAfterMinutes) * time.Minute
+		if rule.SpoilAfterMinutes > 0 && endedAt.Sub(startedAt) >= spoilAfter {
+			excursion.SpoiledOn = startedAt.Add(spoilAfter).In(location).Format("2006-01-02")
+		}
+	}
+
+	excursionJSON, err := json.Marshal(excursion)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(temperatureExcursionKey(excursion.ReportID), excursionJSON)
+	if err != nil {
+		return err
+	}
+
+	if excursion.SpoiledOn != "" && (effectiveExpiry.SpoiledOn == "" || excursion.SpoiledOn < effectiveExpiry.SpoiledOn) {
+		effectiveExpiry.SpoiledOn = excursion.SpoiledOn
+	}
+	effectiveExpiry.Excursions++
+	effectiveExpiry.EffectiveExpiryDate = adjustedExpiryDate(itemKey.ExpiryDate, effectiveExpiry.HoursLost, effectiveExpiry.SpoiledOn)
+	effectiveExpiry.UpdatedAt = now.Format(time.RFC3339)
+
+	return s.putEffectiveExpiry(ctx, effectiveExpiry)
+}
+
+// Retrieve a temperature excursion report from the ledger
+func (s *SmartContract) GetTemperatureExcursion(ctx contractapi.TransactionContextInterface, reportID string) (TemperatureExcursion, error) {
+	excursionJSON, err := ctx.GetStub().GetState(temperatureExcursionKey(reportID))
+	if err != nil {
+		return TemperatureExcursion{}, err
+	}
+	if excursionJSON == nil {
+		return TemperatureExcursion{}, fmt.Errorf("Temperature excursion not found for ID: %s", reportID)
+	}
+
+	var excursion TemperatureExcursion
+	err = json.Unmarshal(excursionJSON, &excursion)
+	if err != nil {
+		return TemperatureExcursion{}, err
+	}
+
+	return excursion, nil
+}
+
+// Retrieve the effective expiry of a lot in a store, its printed expiry if it has had no excursions
+func (s *SmartContract) GetEffectiveExpiry(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) (EffectiveExpiry, error) {
+	effectiveExpiryJSON, err := ctx.GetStub().GetState(effectiveExpiryKey(storeID, itemKey))
+	if err != nil {
+		return EffectiveExpiry{}, err
+	}
+	if effectiveExpiryJSON == nil {
+		return EffectiveExpiry{DocType: "effective_expiry", StoreID: storeID, ItemKey: itemKey, EffectiveExpiryDate: itemKey.ExpiryDate}, nil
+	}
+
+	var effectiveExpiry EffectiveExpiry
+	err = json.Unmarshal(effectiveExpiryJSON, &effectiveExpiry)
+	if err != nil {
+		return EffectiveExpiry{}, err
+	}
+
+	return effectiveExpiry, nil
+}
+
+// Carry the excursions of a lot to the store receiving it, merged with the receiver's own, since the
+// received stock cannot be told apart from what the receiver already holds
+func (s *SmartContract) transferEffectiveExpiry(ctx contractapi.TransactionContextInterface, fromStoreID string, toStoreID string, itemKey ItemKey) error {
+	sent, err := s.GetEffectiveExpiry(ctx, fromStoreID, itemKey)
+	if err != nil {
+		return err
+	}
+	if sent.Excursions == 0 {
+		return nil
+	}
+
+	effectiveExpiry, err := s.GetEffectiveExpiry(ctx, toStoreID, itemKey)
+	if err != nil {
+		return err
+	}
+
+	// Hours both stores were charged for, as when stock travels back and forth, are lost only once
+	charged := make(map[ExcursionInterval]bool)
+	for _, interval := range effectiveExpiry.Intervals {
+		charged[interval] = true
+	}
+	var added int
+	for _, interval := range sent.Intervals {
+		if !charged[interval] {
+			charged[interval] = true
+			effectiveExpiry.Intervals = append(effectiveExpiry.Intervals, interval)
+			added++
+		}
+	}
+	spoiledEarlier := sent.SpoiledOn != "" && (effectiveExpiry.SpoiledOn == "" || sent.SpoiledOn < effectiveExpiry.SpoiledOn)
+	if added == 0 && !spoiledEarlier {
+		return nil
+	}
+
+	if spoiledEarlier {
+		effectiveExpiry.SpoiledOn = sent.SpoiledOn
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	effectiveExpiry.HoursLost = chargedHours(effectiveExpiry.Intervals)
+	effectiveExpiry.Excursions += added
+	effectiveExpiry.EffectiveExpiryDate = adjustedExpiryDate(itemKey.ExpiryDate, effectiveExpiry.HoursLost, effectiveExpiry.SpoiledOn)
+	effectiveExpiry.UpdatedAt = now.Format(time.RFC3339)
+
+	return s.putEffectiveExpiry(ctx, effectiveExpiry)
+}
+
+// Retrieve the lots a store holds whose effective expiry falls within the given number of days,
+// soonest first, restricted to the store's organisation, auditors and regulators
+func (s *SmartContract) GetNearExpiryLots(ctx contractapi.TransactionContextInterface, storeID string, withinDays int) ([]NearExpiryLot, error) {
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil && requireRole(ctx, roleAuditor, roleRegulator) != nil {
+		return nil, err
+	}
+	if withinDays < 0 {
+		return nil, fmt.Errorf("near-expiry window cannot be negative")
+	}
+
+	location, err := time.LoadLocation(store.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("store %s has an invalid time zone: %q", store.StoreID, store.TimeZone)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	today, _ := time.Parse("2006-01-02", now.In(location).Format("2006-01-02"))
+
+	wastageIndices, err := s.getStoreWastageIndices(ctx, storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	lots := []NearExpiryLot{}
+	for _, wastageIndex := range wastageIndices {
+		itemKey := wastageIndex.ItemKey
+		effectiveExpiry, err := s.GetEffectiveExpiry(ctx, storeID, itemKey)
+		if err != nil {
+			return nil, err
+		}
+		expiry, err := time.Parse("2006-01-02", effectiveExpiry.EffectiveExpiryDate)
+		if err != nil {
+			continue
+		}
+		daysLeft := int(expiry.Sub(today).Hours() / 24)
+		if daysLeft > withinDays {
+			continue
+		}
+
+		_, onHand, err := s.bookInventory(ctx, storeID, itemKey)
+		if err != nil {
+			return nil, err
+		}
+		if onHand <= 0 {
+			continue
+		}
+
+		lots = append(lots, NearExpiryLot{
+			ItemKey:             itemKey,
+			EffectiveExpiryDate: effectiveExpiry.EffectiveExpiryDate,
+			DaysLeft:            daysLeft,
+			OnHand:              onHand,
+		})
+	}
+
+	sort.SliceStable(lots, func(i, j int) bool {
+		return lots[i].EffectiveExpiryDate < lots[j].EffectiveExpiryDate
+	})
+
+	return lots, nil
+}
+
+// Find the rule with the highest threshold an excursion peak exceeds
+func coldChainRule(catalogueItem CatalogueItem, peakCelsius float64) (ColdChainRule, bool) {
+	var applicable ColdChainRule
+	found := false
+	for _, rule := range catalogueItem.ColdChainRules {
+		if peakCelsius > rule.AboveCelsius && (!found || rule.AboveCelsius > applicable.AboveCelsius) {
+			applicable = rule
+			found = true
+		}
+	}
+	return applicable, found
+}
+
+// Hours of shelf life lost over a set of excursion intervals, charging each hour once at the
+// highest rate of the intervals covering it
+func chargedHours(intervals []ExcursionInterval) float64 {
+	var boundaries []time.Time
+	for _, interval := range intervals {
+		startedAt, _ := time.Parse(time.RFC3339, interval.StartedAt)
+		endedAt, _ := time.Parse(time.RFC3339, interval.EndedAt)
+		boundaries = append(boundaries, startedAt, endedAt)
+	}
+	sort.Slice(boundaries, func(i, j int) bool {
+		return boundaries[i].Before(boundaries[j])
+	})
+
+	var hoursLost float64
+	for i := 0; i+1 < len(boundaries); i++ {
+		segmentStart, segmentEnd := boundaries[i], boundaries[i+1]
+		if !segmentEnd.After(segmentStart) {
+			continue
+		}
+
+		var rate float64
+		for _, interval := range intervals {
+			startedAt, _ := time.Parse(time.RFC3339, interval.StartedAt)
+			endedAt, _ := time.Parse(time.RFC3339, interval.EndedAt)
+			if !startedAt.After(segmentStart) && !endedAt.Before(segmentEnd) && interval.HoursLostPerHour > rate {
+				rate = interval.HoursLostPerHour
+			}
+		}
+		hoursLost += segmentEnd.Sub(segmentStart).Hours() * rate
+	}
+
+	return hoursLost
+}
+
+// Bring a printed expiry forward by the shelf life lost, rounded up to whole days,
+// and to the day before the lot spoiled if that is earlier
+func adjustedExpiryDate(printedExpiry string, hoursLost float64, spoiledOn string) string {
+	effective := printedExpiry
+	if expiry, err := time.Parse("2006-01-02", printedExpiry); err == nil && hoursLost > 0 {
+		effective = expiry.AddDate(0, 0, -int(math.Ceil(hoursLost/24))).Format("2006-01-02")
+	}
+	if spoiled, err := time.Parse("2006-01-02", spoiledOn); err == nil {
+		if lastSellable := spoiled.AddDate(0, 0, -1).Format("2006-01-02"); lastSellable < effective {
+			effective = lastSellable
+		}
+	}
+	return effective
+}
+
+// Save the effective expiry of a lot in a store to the ledger
+func (s *SmartContract) putEffectiveExpiry(ctx contractapi.TransactionContextInterface, effectiveExpiry EffectiveExpiry) error {
+	effectiveExpiryJSON, err := json.Marshal(effectiveExpiry)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(effectiveExpiryKey(effectiveExpiry.StoreID, effectiveExpiry.ItemKey), effectiveExpiryJSON)
+}
+
+// Validate the cold-chain rules of a catalogue item
+func validateColdChainRules(item CatalogueItem) error {
+	thresholds := make(map[float64]bool)
+	for _, rule := range item.ColdChainRules {
+		if math.IsNaN(rule.AboveCelsius) || math.IsInf(rule.AboveCelsius, 0) {
+			return fmt.Errorf("catalogue item %s has a cold-chain rule without a valid threshold", item.ItemID)
+		}
+		if thresholds[rule.AboveCelsius] {
+			return fmt.Errorf("catalogue item %s has more than one cold-chain rule above %g degrees", item.ItemID, rule.AboveCelsius)
+		}
+		thresholds[rule.AboveCelsius] = true
+		if rule.HoursLostPerHour < 0 || math.IsNaN(rule.HoursLostPerHour) || math.IsInf(rule.HoursLostPerHour, 0) || rule.SpoilAfterMinutes < 0 {
+			return fmt.Errorf("catalogue item %s has a cold-chain rule above %g degrees with a negative or unbounded loss", item.ItemID, rule.AboveCelsius)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// Excursion report of a lot at store S1, signed by its sensor
+func excursionArg(t *testing.T, key *ecdsa.PrivateKey, reportID string, itemKey ItemKey, startedAt string, endedAt string, peakCelsius float64) TemperatureExcursion {
+	t.Helper()
+	return storeExcursionArg(t, key, "S1", "SENSOR1", reportID, itemKey, startedAt, endedAt, peakCelsius)
+}
+
+// Excursion report of a lot at a store, signed by the given sensor
+func storeExcursionArg(t *testing.T, key *ecdsa.PrivateKey, storeID string, deviceID string, reportID string, itemKey ItemKey, startedAt string, endedAt string, peakCelsius float64) TemperatureExcursion {
+	t.Helper()
+	excursion := TemperatureExcursion{
+		ReportID: reportID, StoreID: storeID, DeviceID: deviceID, ItemID: itemKey.ItemID, ExpiryDate: itemKey.ExpiryDate,
+		StartedAt: startedAt, EndedAt: endedAt, PeakCelsius: peakCelsius,
+	}
+	message, _ := json.Marshal(CanonicalExcursion{
+		ReportID: excursion.ReportID, StoreID: excursion.StoreID, DeviceID: excursion.DeviceID, ItemID: excursion.ItemID,
+		ExpiryDate: excursion.ExpiryDate, StartedAt: excursion.StartedAt, EndedAt: excursion.EndedAt, PeakCelsius: excursion.PeakCelsius,
+	})
+	digest := sha256.Sum256(message)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	excursion.Signature = base64.StdEncoding.EncodeToString(signature)
+	return excursion
+}
+
+func TestTemperatureExcursions(t *testing.T) {
+	f := newFixture(t)
+	milk := catalogueArg("milk", "4006381333931", "each", false, 10, map[string]float64{"case": 12})
+	milk["cold_chain_rules"] = []map[string]interface{}{{"above_celsius": 8, "hours_lost_per_hour": 2, "spoil_after_minutes": 240}}
+	f.ok(f.catalogue, "CreateOrUpdateCatalogueItem", milk)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ok(f.org1, "RegisterDevice", deviceArg("SENSOR1", "S1", deviceSensor, publicKeyPEM(t, &key.PublicKey)))
+
+	// Two reports covering the same hour charge it once: 00:00 to 04:00 at two hours an hour
+	march := ItemKey{ItemID: "milk", ExpiryDate: "2027-03-10"}
+	f.ok(f.org1, "ReportTemperatureExcursion", excursionArg(t, key, "E1", march, "2026-03-01T00:00:00Z", "2026-03-01T03:00:00Z", 10))
+	f.ok(f.org1, "ReportTemperatureExcursion", excursionArg(t, key, "E2", march, "2026-03-01T01:00:00Z", "2026-03-01T04:00:00Z", 10))
+	var excursion TemperatureExcursion
+	f.get(&excursion, f.org1, "GetTemperatureExcursion", "E2")
+	if excursion.HoursLost != 2 || excursion.SpoiledOn != "" {
+		t.Fatalf("overlap charged twice %+v", excursion)
+	}
+	var effectiveExpiry EffectiveExpiry
+	f.get(&effectiveExpiry, f.org1, "GetEffectiveExpiry", "S1", march)
+	if effectiveExpiry.HoursLost != 8 || effectiveExpiry.Excursions != 2 || effectiveExpiry.EffectiveExpiryDate != "2027-03-09" {
+		t.Fatalf("unexpected effective expiry %+v", effectiveExpiry)
+	}
+
+	// The lot spoils four hours in, at 21:30 on 28 February in Kolkata, and is last sellable the day before
+	late := ItemKey{ItemID: "milk", ExpiryDate: "2027-03-20"}
+	f.ok(f.org1, "ReportTemperatureExcursion", excursionArg(t, key, "E3", late, "2026-02-28T12:00:00Z", "2026-03-01T02:00:00Z", 10))
+	f.get(&excursion, f.org1, "GetTemperatureExcursion", "E3")
+	if excursion.SpoiledOn != "2026-02-28" {
+		t.Fatalf("expected the lot to spoil on 2026-02-28, got %+v", excursion)
+	}
+	f.get(&effectiveExpiry, f.org1, "GetEffectiveExpiry", "S1", late)
+	if effectiveExpiry.SpoiledOn != "2026-02-28" || effectiveExpiry.EffectiveExpiryDate != "2026-02-27" {
+		t.Fatalf("unexpected effective expiry of a spoiled lot %+v", effectiveExpiry)
+	}
+
+	// Stock transferred out keeps the shelf life it lost, on top of what the receiver's own stock lost:
+	// four hours at S2 from 05:00 to 07:00 and eight at S1
+	key2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f.ok(f.org2, "RegisterDevice", deviceArg("SENSOR2", "S2", deviceSensor, publicKeyPEM(t, &key2.PublicKey)))
+	f.ok(f.org2, "ReportTemperatureExcursion", storeExcursionArg(t, key2, "S2", "SENSOR2", "E4", march, "2026-03-01T05:00:00Z", "2026-03-01T07:00:00Z", 10))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+	f.ok(f.org1, "InitiateTransfer", "T1", "S1", "S2", []interface{}{transferLineArg("milk", "2027-03-10", 6, "")})
+	f.ok(f.org2, "AcceptTransfer", "T1")
+	f.get(&effectiveExpiry, f.org2, "GetEffectiveExpiry", "S2", march)
+	if effectiveExpiry.StoreID != "S2" || effectiveExpiry.HoursLost != 12 || effectiveExpiry.Excursions != 3 || effectiveExpiry.EffectiveExpiryDate != "2027-03-09" {
+		t.Fatalf("effective expiry not merged into the receiving store's %+v", effectiveExpiry)
+	}
+
+	// A second transfer of the same lot charges nothing twice
+	f.ok(f.org1, "InitiateTransfer", "T2", "S1", "S2", []interface{}{transferLineArg("milk", "2027-03-10", 6, "")})
+	f.ok(f.org2, "AcceptTransfer", "T2")
+	f.get(&effectiveExpiry, f.org2, "GetEffectiveExpiry", "S2", march)
+	if effectiveExpiry.HoursLost != 12 || effectiveExpiry.Excursions != 3 || len(effectiveExpiry.Intervals) != 3 {
+		t.Fatalf("transferred excursions charged twice %+v", effectiveExpiry)
+	}
+}
+
+func TestColdChainRuleValidation(t *testing.T) {
+	for _, rule := range []ColdChainRule{
+		{AboveCelsius: math.NaN(), HoursLostPerHour: 1},
+		{AboveCelsius: math.Inf(1), HoursLostPerHour: 1},
+		{AboveCelsius: 8, HoursLostPerHour: -1},
+		{AboveCelsius: 8, HoursLostPerHour: math.NaN()},
+		{AboveCelsius: 8, HoursLostPerHour: math.Inf(1)},
+		{AboveCelsius: 8, HoursLostPerHour: math.Inf(-1)},
+		{AboveCelsius: 8, HoursLostPerHour: 1, SpoilAfterMinutes: -1},
+	} {
+		if validateColdChainRules(CatalogueItem{ItemID: "milk", ColdChainRules: []ColdChainRule{rule}}) == nil {
+			t.Errorf("rule %+v accepted", rule)
+		}
+	}
+
+	valid := []ColdChainRule{{AboveCelsius: 8, HoursLostPerHour: 2, SpoilAfterMinutes: 240}, {AboveCelsius: 15, HoursLostPerHour: 6}}
+	if err := validateColdChainRules(CatalogueItem{ItemID: "milk", ColdChainRules: valid}); err != nil {
+		t.Fatal(err)
+	}
+	duplicate := append(valid, ColdChainRule{AboveCelsius: 8, HoursLostPerHour: 3})
+	if validateColdChainRules(CatalogueItem{ItemID: "milk", ColdChainRules: duplicate}) == nil {
+		t.Fatal("two rules above the same threshold accepted")
+	}
+}
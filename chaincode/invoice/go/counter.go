@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Composite key object type of transaction validity deltas
+const validityDeltaObjectType = "TRANSACTION_VALIDITY_DELTA"
+
+// ValidityDelta structure, a change to the validity counts of an item key written by one transaction
+type ValidityDelta struct {
+	DocType             string `json:"doc_type"`
+	ValidTransactions   int    `json:"valid_transactions"`
+	InvalidTransactions int    `json:"invalid_transactions"`
+}
+
+// Ledger key of the compacted validity counts of an item key
+func transactionValidityKey(storeID string, itemKey ItemKey) string {
+	return fmt.Sprintf("TRANSACTION_VALIDITY_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate)
+}
+
+// Fold the validity deltas of a store into the compacted counts and delete them, restricted to
+// the store's organisation or a regulator; returns the number of deltas folded
+func (s *SmartContract) CompactTransactionValidity(ctx contractapi.TransactionContextInterface, storeID string) (int, error) {
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return 0, err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil && requireRole(ctx, roleRegulator) != nil {
+		return 0, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(validityDeltaObjectType, []string{storeID})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	// Deltas are keyed by item key first, so a map keeps the folding independent of the order of keys
+	compacted := make(map[ItemKey]*TransactionValidity)
+	var itemKeys []ItemKey
+	var folded int
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return 0, err
+		}
+		if len(attributes) < 3 {
+			return 0, fmt.Errorf("malformed validity delta key %q", queryResponse.Key)
+		}
+		itemKey := ItemKey{ItemID: attributes[1], ExpiryDate: attributes[2]}
+
+		var delta ValidityDelta
+		err = json.Unmarshal(queryResponse.Value, &delta)
+		if err != nil {
+			return 0, err
+		}
+
+		transactionValidity, ok := compacted[itemKey]
+		if !ok {
+			base, err := s.getCompactedValidity(ctx, storeID, itemKey)
+			if err != nil {
+				return 0, err
+			}
+			transactionValidity = &base
+			compacted[itemKey] = transactionValidity
+			itemKeys = append(itemKeys, itemKey)
+		}
+		transactionValidity.ValidTransactions += delta.ValidTransactions
+		transactionValidity.InvalidTransactions += delta.InvalidTransactions
+
+		err = ctx.GetStub().DelState(queryResponse.Key)
+		if err != nil {
+			return 0, err
+		}
+		folded++
+	}
+
+	for _, itemKey := range itemKeys {
+		transactionValidityJSON, err := json.Marshal(compacted[itemKey])
+		if err != nil {
+			return 0, err
+		}
+		err = ctx.GetStub().PutState(transactionValidityKey(storeID, itemKey), transactionValidityJSON)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return folded, nil
+}
+
+// Record a change to the validity counts of an item key under a key of its own, so that
+// concurrent transactions never write the same counter; eventID tells apart the changes of one transaction
+func (s *SmartContract) addValidityDelta(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey, eventID string, valid int, invalid int) error {
+	deltaKey, err := ctx.GetStub().CreateCompositeKey(validityDeltaObjectType, []string{storeID, itemKey.ItemID, itemKey.ExpiryDate, ctx.GetStub().GetTxID(), eventID})
+	if err != nil {
+		return err
+	}
+
+	deltaJSON, err := json.Marshal(ValidityDelta{
+		DocType:             "validity_delta",
+		ValidTransactions:   valid,
+		InvalidTransactions: invalid,
+	})
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(deltaKey, deltaJSON)
+}
+
+// Sum the compacted validity counts of an item key and the deltas written since the last compaction
+func (s *SmartContract) sumTransactionValidity(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) (TransactionValidity, bool, error) {
+	transactionValidity, err := s.getCompactedValidity(ctx, storeID, itemKey)
+	if err != nil {
+		return TransactionValidity{}, false, err
+	}
+	found := transactionValidity.ValidTransactions != 0 || transactionValidity.InvalidTransactions != 0
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(validityDeltaObjectType, []string{storeID, itemKey.ItemID, itemKey.ExpiryDate})
+	if err != nil {
+		return TransactionValidity{}, false, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return TransactionValidity{}, false, err
+		}
+
+		var delta ValidityDelta
+		err = json.Unmarshal(queryResponse.Value, &delta)
+		if err != nil {
+			return TransactionValidity{}, false, err
+		}
+		transactionValidity.ValidTransactions += delta.ValidTransactions
+		transactionValidity.InvalidTransactions += delta.InvalidTransactions
+		found = true
+	}
+
+	return transactionValidity, found, nil
+}
+
+// Retrieve the compacted validity counts of an item key, empty if none were compacted yet
+func (s *SmartContract) getCompactedValidity(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) (TransactionValidity, error) {
+	transactionValidityBytes, err := ctx.GetStub().GetState(transactionValidityKey(storeID, itemKey))
+	if err != nil {
+		return TransactionValidity{}, err
+	}
+	if transactionValidityBytes == nil {
+		return TransactionValidity{StoreID: storeID, ItemKey: itemKey}, nil
+	}
+
+	var transactionValidity TransactionValidity
+	err = json.Unmarshal(transactionValidityBytes, &transactionValidity)
+	if err != nil {
+		return TransactionValidity{}, err
+	}
+
+	return transactionValidity, nil
+}
+
+// Composite key object type of stock movement deltas
+const stockDeltaObjectType = "WASTAGE_INDEX_DELTA"
+
+// StockDelta structure, a change to the stock totals of an item key written by one transaction
+type StockDelta struct {
+	DocType      string  `json:"doc_type"`
+	Purchases    float64 `json:"purchases"`
+	Sales        float64 `json:"sales"`
+	TransfersIn  float64 `json:"transfers_in"`
+	TransfersOut float64 `json:"transfers_out"`
+	Adjustments  float64 `json:"adjustments"`
+	RecordedAt   string  `json:"recorded_at"`
+}
+
+// Ledger key of the compacted wastage index of an item key
+func wastageIndexKey(storeID string, itemKey ItemKey) string {
+	return fmt.Sprintf("WASTAGE_INDEX_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate)
+}
+
+// Ledger key of the RISE index of an item key as of the last compaction
+func riseIndexKey(storeID string, itemKey ItemKey) string {
+	return fmt.Sprintf("RISE_INDEX_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate)
+}
+
+// Record the stock a transaction moves for an item key under a key of its own, so that concurrent
+// invoices of a store never write the same index; eventID tells apart the changes of one transaction
+func (s *SmartContract) addStockDelta(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey, eventID string, delta StockDelta) error {
+	deltaKey, err := ctx.GetStub().CreateCompositeKey(stockDeltaObjectType, []string{storeID, itemKey.ItemID, itemKey.ExpiryDate, ctx.GetStub().GetTxID(), eventID})
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	delta.DocType = "stock_delta"
+	delta.RecordedAt = now.Format(time.RFC3339)
+
+	deltaJSON, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(deltaKey, deltaJSON)
+}
+
+// Record the change in purchase and sales totals from one version of an invoice to the next;
+// a version that does not count toward the totals contributes nothing
+func (s *SmartContract) recordStockMovements(ctx contractapi.TransactionContextInterface, previous Invoice, current Invoice) error {
+	deltas := make(map[ItemKey]*StockDelta)
+	var itemKeys []ItemKey
+	addInvoice := func(invoice Invoice, sign float64) {
+		if !countsTowardTotals(invoice) {
+			return
+		}
+		for _, item := range invoice.Items {
+			itemKey := ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate}
+			delta, ok := deltas[itemKey]
+			if !ok {
+				delta = &StockDelta{}
+				deltas[itemKey] = delta
+				itemKeys = append(itemKeys, itemKey)
+			}
+			switch invoice.InvoiceType {
+			case "purchase":
+				delta.Purchases += sign * baseQuantity(item)
+			case "sales":
+				delta.Sales += sign * baseQuantity(item)
+			}
+		}
+	}
+	addInvoice(previous, -1)
+	addInvoice(current, 1)
+
+	for _, itemKey := range itemKeys {
+		delta := deltas[itemKey]
+		if delta.Purchases == 0 && delta.Sales == 0 {
+			continue
+		}
+		err := s.addStockDelta(ctx, current.StoreID, itemKey, current.InvoiceID, *delta)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add a stock delta to a wastage index and recompute its wastage percentage
+func applyStockDelta(wastageIndex *WastageIndex, delta StockDelta) {
+	wastageIndex.TotalPurchase += delta.Purchases
+	wastageIndex.TotalSales += delta.Sales
+	wastageIndex.TransfersIn += delta.TransfersIn
+	wastageIndex.TransfersOut += delta.TransfersOut
+	wastageIndex.Adjustments += delta.Adjustments
+	wastageIndex.Wastage = wastagePercentage(wastageIndex.TotalPurchase, wastageIndex.TotalSales, wastageIndex.TransfersIn, wastageIndex.TransfersOut, wastageIndex.Adjustments)
+}
+
+// Fold the stock deltas of a store into the compacted wastage indices and delete them, recording the
+// RISE index of every folded item key as of now; restricted to the store's organisation or a regulator
+// and returns the number of deltas folded
+func (s *SmartContract) CompactWastageIndices(ctx contractapi.TransactionContextInterface, storeID string) (int, error) {
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return 0, err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil && requireRole(ctx, roleRegulator) != nil {
+		return 0, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(stockDeltaObjectType, []string{storeID})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	compacted := make(map[ItemKey]*WastageIndex)
+	var itemKeys []ItemKey
+	var folded int
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		itemKey, delta, err := s.decodeStockDelta(ctx, queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return 0, err
+		}
+
+		wastageIndex, ok := compacted[itemKey]
+		if !ok {
+			base, err := s.getCompactedWastageIndex(ctx, storeID, itemKey)
+			if err != nil {
+				return 0, err
+			}
+			wastageIndex = &base
+			compacted[itemKey] = wastageIndex
+			itemKeys = append(itemKeys, itemKey)
+		}
+		applyStockDelta(wastageIndex, delta)
+
+		err = ctx.GetStub().DelState(queryResponse.Key)
+		if err != nil {
+			return 0, err
+		}
+		folded++
+	}
+
+	for _, itemKey := range itemKeys {
+		wastageIndex := *compacted[itemKey]
+		ethicsIndex, err := s.CalculateEthicsIndex(ctx, storeID, []WastageIndex{wastageIndex})
+		if err != nil {
+			return 0, err
+		}
+		err = s.updateLedgerWithIndices(ctx, storeID, wastageIndex.Wastage, wastageIndex, ethicsIndex)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return folded, nil
+}
+
+// Retrieve the wastage indices of every item key of a store, the compacted indices merged with the
+// deltas written since; for queries and compaction only, as the scan would conflict with concurrent invoices
+func (s *SmartContract) getStoreWastageIndices(ctx contractapi.TransactionContextInterface, storeID string) ([]WastageIndex, error) {
+	indices := make(map[ItemKey]*WastageIndex)
+	var itemKeys []ItemKey
+
+	prefix := fmt.Sprintf("WASTAGE_INDEX_%s_", storeID)
+	compactedIterator, err := ctx.GetStub().GetStateByRange(prefix, prefix+"\uffff")
+	if err != nil {
+		return nil, err
+	}
+	defer compactedIterator.Close()
+
+	for compactedIterator.HasNext() {
+		queryResponse, err := compactedIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var wastageIndex WastageIndex
+		err = json.Unmarshal(queryResponse.Value, &wastageIndex)
+		if err != nil {
+			return nil, err
+		}
+		// The prefix of a store also covers stores whose ID extends it
+		if queryResponse.Key != wastageIndexKey(storeID, wastageIndex.ItemKey) {
+			continue
+		}
+		indices[wastageIndex.ItemKey] = &wastageIndex
+		itemKeys = append(itemKeys, wastageIndex.ItemKey)
+	}
+
+	deltaIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(stockDeltaObjectType, []string{storeID})
+	if err != nil {
+		return nil, err
+	}
+	defer deltaIterator.Close()
+
+	for deltaIterator.HasNext() {
+		queryResponse, err := deltaIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		itemKey, delta, err := s.decodeStockDelta(ctx, queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		wastageIndex, ok := indices[itemKey]
+		if !ok {
+			wastageIndex = &WastageIndex{ItemKey: itemKey}
+			indices[itemKey] = wastageIndex
+			itemKeys = append(itemKeys, itemKey)
+		}
+		applyStockDelta(wastageIndex, delta)
+	}
+
+	sort.Slice(itemKeys, func(i, j int) bool {
+		if itemKeys[i].ItemID != itemKeys[j].ItemID {
+			return itemKeys[i].ItemID < itemKeys[j].ItemID
+		}
+		return itemKeys[i].ExpiryDate < itemKeys[j].ExpiryDate
+	})
+	wastageIndices := []WastageIndex{}
+	for _, itemKey := range itemKeys {
+		wastageIndices = append(wastageIndices, *indices[itemKey])
+	}
+
+	return wastageIndices, nil
+}
+
+// Retrieve the stock deltas of an item key written since the last compaction, oldest first
+func (s *SmartContract) getStockDeltas(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) ([]StockDelta, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(stockDeltaObjectType, []string{storeID, itemKey.ItemID, itemKey.ExpiryDate})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var deltas []StockDelta
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, delta, err := s.decodeStockDelta(ctx, queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return nil, err
+		}
+		deltas = append(deltas, delta)
+	}
+
+	// Keys are ordered by transaction ID, which says nothing about time
+	sort.SliceStable(deltas, func(i, j int) bool {
+		return deltas[i].RecordedAt < deltas[j].RecordedAt
+	})
+
+	return deltas, nil
+}
+
+// Decode a stock delta and the item key named by its composite key
+func (s *SmartContract) decodeStockDelta(ctx contractapi.TransactionContextInterface, key string, value []byte) (ItemKey, StockDelta, error) {
+	_, attributes, err := ctx.GetStub().SplitCompositeKey(key)
+	if err != nil {
+		return ItemKey{}, StockDelta{}, err
+	}
+	if len(attributes) < 3 {
+		return ItemKey{}, StockDelta{}, fmt.Errorf("malformed stock delta key %q", key)
+	}
+
+	var delta StockDelta
+	err = json.Unmarshal(value, &delta)
+	if err != nil {
+		return ItemKey{}, StockDelta{}, err
+	}
+
+	return ItemKey{ItemID: attributes[1], ExpiryDate: attributes[2]}, delta, nil
+}
+
+// Retrieve the compacted wastage index of an item key, empty if none was compacted yet
+func (s *SmartContract) getCompactedWastageIndex(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) (WastageIndex, error) {
+	wastageIndexJSON, err := ctx.GetStub().GetState(wastageIndexKey(storeID, itemKey))
+	if err != nil {
+		return WastageIndex{}, err
+	}
+	if wastageIndexJSON == nil {
+		return WastageIndex{ItemKey: itemKey}, nil
+	}
+
+	var wastageIndex WastageIndex
+	err = json.Unmarshal(wastageIndexJSON, &wastageIndex)
+	if err != nil {
+		return WastageIndex{}, err
+	}
+
+	return wastageIndex, nil
+}
+
+// Calculate the RISE index of an item key from its wastage and the store's current ethics index
+func (s *SmartContract) getRISEIndex(ctx contractapi.TransactionContextInterface, storeID string, wastageIndex WastageIndex) (RISEIndex, error) {
+	ethicsIndex, err := s.CalculateEthicsIndex(ctx, storeID, []WastageIndex{wastageIndex})
+	if err != nil {
+		return RISEIndex{}, err
+	}
+
+	return RISEIndex{
+		StoreID:   storeID,
+		ItemKey:   wastageIndex.ItemKey,
+		RISEIndex: wastageIndex.Wastage - ethicsIndex,
+	}, nil
+}
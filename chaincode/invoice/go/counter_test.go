@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// Fail if the last transaction scanned the index deltas of a whole store, which would conflict with every
+// concurrent invoice of the store; scanning the deltas of one lot only conflicts with movements of that lot
+func (f *fixture) requireNoDeltaScans(function string) {
+	f.t.Helper()
+	for _, startKey := range f.stub.rangeReads {
+		for _, objectType := range []string{stockDeltaObjectType, validityDeltaObjectType} {
+			if !strings.HasPrefix(startKey, "\x00"+objectType+"\x00") {
+				continue
+			}
+			if attributes := strings.Split(strings.TrimSuffix(startKey, "\x00"), "\x00"); len(attributes) < 5 {
+				f.t.Fatalf("%s scanned the %s deltas of a whole store", function, objectType)
+			}
+		}
+	}
+}
+
+func (f *fixture) storeSummary(storeID string) StoreIndexSummary {
+	f.t.Helper()
+	var summaries []StoreIndexSummary
+	f.get(&summaries, f.regulator, "QueryStoreIndices", StoreFilter{})
+	for _, summary := range summaries {
+		if summary.Store.StoreID == storeID {
+			return summary
+		}
+	}
+	f.t.Fatalf("no summary for store %s", storeID)
+	return StoreIndexSummary{}
+}
+
+func TestIndexDeltas(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+	f.requireNoDeltaScans("CreateOrUpdateInvoice")
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 6, 2)))
+	f.requireNoDeltaScans("CreateOrUpdateInvoice")
+	f.ok(f.org1, "InitiateTransfer", "T1", "S1", "S2", []interface{}{transferLineArg("milk", "2027-03-10", 6, "")})
+	f.ok(f.org2, "AcceptTransfer", "T1")
+	f.requireNoDeltaScans("AcceptTransfer")
+	f.ok(f.auditor, "RecordInspection", inspectionArg("I1", "S2", severityNone))
+	f.requireNoDeltaScans("RecordInspection")
+
+	// Submissions write deltas only, the indices are derived when queried
+	if keys := append(f.keys("WASTAGE_INDEX_"), f.keys("RISE_INDEX_")...); len(keys) != 0 {
+		t.Fatalf("indices written on submission: %v", keys)
+	}
+	s1 := f.storeSummary("S1")
+	if s1.AverageWastage != 50 || s1.StoreRISE.NumItemKeys != 1 || s1.StoreRISE.TotalRISEIndex != 50-100 {
+		t.Fatalf("unexpected S1 indices %+v", s1)
+	}
+	if s2 := f.storeSummary("S2"); s2.AverageWastage != 100 {
+		t.Fatalf("unexpected S2 indices %+v", s2)
+	}
+
+	if deltas := f.keys("\x00" + stockDeltaObjectType + "\x00S1\x00"); len(deltas) != 3 {
+		t.Fatalf("expected 3 deltas for S1, got %q", deltas)
+	}
+	f.fail(f.org2, "is owned by Org1MSP", "CompactWastageIndices", "S1")
+	if folded := f.ok(f.org1, "CompactWastageIndices", "S1"); folded != "3" {
+		t.Fatalf("expected 3 deltas folded, got %s", folded)
+	}
+	var wastageIndex WastageIndex
+	if !f.state("WASTAGE_INDEX_S1_milk_2027-03-10", &wastageIndex) || wastageIndex.TotalPurchase != 24 || wastageIndex.TotalSales != 6 || wastageIndex.TransfersOut != 6 {
+		t.Fatalf("unexpected compacted index %+v", wastageIndex)
+	}
+	var riseIndex RISEIndex
+	if !f.state("RISE_INDEX_S1_milk_2027-03-10", &riseIndex) || riseIndex.RISEIndex != 50-100 {
+		t.Fatalf("unexpected compacted RISE index %+v", riseIndex)
+	}
+	if deltas := f.keys("\x00" + stockDeltaObjectType + "\x00S1\x00"); len(deltas) != 0 {
+		t.Fatalf("deltas left after compaction: %q", deltas)
+	}
+	if s1 := f.storeSummary("S1"); s1.AverageWastage != 50 {
+		t.Fatalf("compaction changed the indices %+v", s1)
+	}
+
+	// Later movements, including a void, add to the compacted index
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X2", "S1", "sales", lineArg("milk", "2027-03-10", 2, 2)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X3", "S1", "sales", lineArg("milk", "2027-03-10", 4, 2)))
+	f.ok(f.org1, "VoidInvoice", "X3", "entered_in_error", "wrong till")
+	f.requireNoDeltaScans("VoidInvoice")
+	if s1 := f.storeSummary("S1"); math.Abs(s1.AverageWastage-(24-6-6-2)/24.0*100) > 1e-9 {
+		t.Fatalf("unexpected S1 indices after compaction %+v", s1)
+	}
+
+	var report AuditReport
+	f.get(&report, f.regulator, "GenerateAuditReport", "S1", "2026-03-01", "2026-03-01")
+	if len(report.WastageTrajectory) != 4 || len(report.RISETrajectory) != 1 {
+		t.Fatalf("unexpected trajectories %+v %+v", report.WastageTrajectory, report.RISETrajectory)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Device states
+const (
+	deviceActive  = "active"
+	deviceRevoked = "revoked"
+)
+
+// Device types
+const (
+	devicePOS    = "pos"
+	deviceRFID   = "rfid"
+	deviceSensor = "sensor" // cold-chain temperature sensor, signs excursion reports
+)
+
+// Supported device key types
+const (
+	keyTypeECDSA   = "ecdsa"
+	keyTypeEd25519 = "ed25519"
+)
+
+// Device structure
+type Device struct {
+	DocType          string `json:"doc_type"`
+	DeviceID         string `json:"device_id"`
+	StoreID          string `json:"store_id"`
+	DeviceType       string `json:"device_type"` // 'pos', 'rfid' or 'sensor'
+	PublicKey        string `json:"public_key"`  // PEM-encoded PKIX public key
+	KeyType          string `json:"key_type"`    // 'ecdsa' or 'ed25519', derived from the public key
+	KeyVersion       int    `json:"key_version"` // incremented by each rotation
+	Status           string `json:"status"`
+	RegisteredAt     string `json:"registered_at"`
+	UpdatedAt        string `json:"updated_at"`
+	RevocationReason string `json:"revocation_reason,omitempty" metadata:",optional"`
+}
+
+// CanonicalInvoice structure, the content a device signs
+type CanonicalInvoice struct {
+	InvoiceID        string          `json:"invoice_id"`
+	StoreID          string          `json:"store_id"`
+	DeviceID         string          `json:"device_id"`
+	Date             string          `json:"date"`
+	Timestamp        string          `json:"timestamp"`
+	InvoiceType      string          `json:"invoice_type"`
+	Currency         string          `json:"currency"`
+	TotalAmountMinor int64           `json:"total_amount_minor"`
+	TaxAmountMinor   int64           `json:"tax_amount_minor"`
+	TerminalID       string          `json:"terminal_id"`
+	SequenceNumber   int64           `json:"sequence_number"`
+	SupplierMSPID    string          `json:"supplier_msp_id"`
+	PurchaseOrderID  string          `json:"purchase_order_id"`
+	GoodsReceiptID   string          `json:"goods_receipt_id"`
+	Items            []CanonicalItem `json:"items"`
+}
+
+// CanonicalItem structure
+type CanonicalItem struct {
+	ItemID            string  `json:"item_id"`
+	ExpiryDate        string  `json:"expiry_date"`
+	Quantity          float64 `json:"quantity"`
+	Unit              string  `json:"unit"`
+	PricePerUnitMinor int64   `json:"price_per_unit_minor"`
+	TotalPriceMinor   int64   `json:"total_price_minor"`
+	TaxCategory       string  `json:"tax_category"`
+	TaxAmountMinor    int64   `json:"tax_amount_minor"`
+}
+
+// Ledger key of a registered device
+func deviceKey(deviceID string) string {
+	return fmt.Sprintf("DEVICE_%s", deviceID)
+}
+
+// Register a POS terminal or RFID reader of a store, restricted to the store's organisation
+func (s *SmartContract) RegisterDevice(ctx contractapi.TransactionContextInterface, device Device) error {
+	if device.DeviceID == "" {
+		return fmt.Errorf("device ID is required")
+	}
+	if device.DeviceType != devicePOS && device.DeviceType != deviceRFID && device.DeviceType != deviceSensor {
+		return fmt.Errorf("device %s has an unknown type %q", device.DeviceID, device.DeviceType)
+	}
+
+	existingJSON, err := ctx.GetStub().GetState(deviceKey(device.DeviceID))
+	if err != nil {
+		return err
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("device %s is already registered", device.DeviceID)
+	}
+
+	store, err := s.requireActiveStore(ctx, device.StoreID)
+	if err != nil {
+		return err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	device.KeyType, err = parseDeviceKey(device.PublicKey)
+	if err != nil {
+		return fmt.Errorf("device %s: %s", device.DeviceID, err.Error())
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	device.DocType = "device"
+	device.KeyVersion = 1
+	device.Status = deviceActive
+	device.RegisteredAt = now.Format(time.RFC3339)
+	device.UpdatedAt = device.RegisteredAt
+	device.RevocationReason = ""
+
+	return s.putDevice(ctx, device)
+}
+
+// Replace the public key of an active device, restricted to the store's organisation
+func (s *SmartContract) RotateDeviceKey(ctx contractapi.TransactionContextInterface, deviceID string, publicKey string) error {
+	device, err := s.getDeviceForOwner(ctx, deviceID, false)
+	if err != nil {
+		return err
+	}
+	if device.Status != deviceActive {
+		return fmt.Errorf("device %s is %s", deviceID, device.Status)
+	}
+
+	device.KeyType, err = parseDeviceKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("device %s: %s", deviceID, err.Error())
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	device.PublicKey = publicKey
+	device.KeyVersion++
+	device.UpdatedAt = now.Format(time.RFC3339)
+
+	return s.putDevice(ctx, device)
+}
+
+// Revoke a device so that its signatures are no longer accepted, restricted to the store's organisation or a regulator
+func (s *SmartContract) RevokeDevice(ctx contractapi.TransactionContextInterface, deviceID string, reason string) error {
+	device, err := s.getDeviceForOwner(ctx, deviceID, true)
+	if err != nil {
+		return err
+	}
+	if device.Status == deviceRevoked {
+		return fmt.Errorf("device %s is already revoked", deviceID)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	device.Status = deviceRevoked
+	device.RevocationReason = reason
+	device.UpdatedAt = now.Format(time.RFC3339)
+
+	return s.putDevice(ctx, device)
+}
+
+// Retrieve a device from the registry
+func (s *SmartContract) GetDevice(ctx contractapi.TransactionContextInterface, deviceID string) (Device, error) {
+	deviceJSON, err := ctx.GetStub().GetState(deviceKey(deviceID))
+	if err != nil {
+		return Device{}, err
+	}
+	if deviceJSON == nil {
+		return Device{}, fmt.Errorf("Device not found for ID: %s", deviceID)
+	}
+
+	var device Device
+	err = json.Unmarshal(deviceJSON, &device)
+	if err != nil {
+		return Device{}, err
+	}
+
+	return device, nil
+}
+
+// Load a device on behalf of the organisation owning its store, or a regulator if allowed
+func (s *SmartContract) getDeviceForOwner(ctx contractapi.TransactionContextInterface, deviceID string, allowRegulator bool) (Device, error) {
+	device, err := s.GetDevice(ctx, deviceID)
+	if err != nil {
+		return Device{}, err
+	}
+
+	store, err := s.GetStore(ctx, device.StoreID)
+	if err != nil {
+		return Device{}, err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil && (!allowRegulator || requireRole(ctx, roleRegulator) != nil) {
+		return Device{}, err
+	}
+
+	return device, nil
+}
+
+// Verify that an invoice was signed by an active device of its store; unsigned invoices
+// are accepted only from stores that do not require signatures
+func (s *SmartContract) verifyDeviceSignature(ctx contractapi.TransactionContextInterface, invoice Invoice) error {
+	if invoice.DeviceID == "" {
+		store, err := s.GetStore(ctx, invoice.StoreID)
+		if err != nil {
+			return err
+		}
+		if store.RequireSignedInvoices {
+			return fmt.Errorf("store %s only accepts invoices signed by a registered device", invoice.StoreID)
+		}
+		return nil
+	}
+
+	device, err := s.GetDevice(ctx, invoice.DeviceID)
+	if err != nil {
+		return err
+	}
+	if device.Status != deviceActive {
+		return fmt.Errorf("device %s is %s", device.DeviceID, device.Status)
+	}
+	if device.StoreID != invoice.StoreID {
+		return fmt.Errorf("device %s belongs to store %s, not %s", device.DeviceID, device.StoreID, invoice.StoreID)
+	}
+
+	if device.DeviceType == deviceSensor {
+		return fmt.Errorf("device %s is a sensor and cannot sign invoices", device.DeviceID)
+	}
+
+	message, err := canonicalInvoice(invoice)
+	if err != nil {
+		return err
+	}
+
+	valid, err := verifyDevicePayload(device, message, invoice.DeviceSignature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return fmt.Errorf("signature of invoice %s does not verify against device %s", invoice.InvoiceID, device.DeviceID)
+	}
+
+	return nil
+}
+
+// Check a base64 signature of a message against the current key of a device;
+// ECDSA keys sign the SHA-256 digest of the message, Ed25519 keys sign the message itself
+func verifyDevicePayload(device Device, message []byte, encodedSignature string) (bool, error) {
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil || len(signature) == 0 {
+		return false, nil
+	}
+
+	publicKey, err := parsePublicKey(device.PublicKey)
+	if err != nil {
+		return false, err
+	}
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return ecdsa.VerifyASN1(key, digest[:], signature), nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, signature), nil
+	}
+
+	return false, nil
+}
+
+// Serialise the fields of an invoice a device signs, as decoded by the contract: amounts in minor units,
+// the currency defaulted and private pricing merged in, but units and tax rates not yet filled in from
+// the catalogue and rate table; ECDSA keys sign the SHA-256 digest of these bytes, Ed25519 keys the bytes themselves
+func canonicalInvoice(invoice Invoice) ([]byte, error) {
+	canonical := CanonicalInvoice{
+		InvoiceID:        invoice.InvoiceID,
+		StoreID:          invoice.StoreID,
+		DeviceID:         invoice.DeviceID,
+		Date:             invoice.Date,
+		Timestamp:        invoice.Timestamp,
+		InvoiceType:      invoice.InvoiceType,
+		Currency:         invoice.Currency,
+		TotalAmountMinor: invoice.TotalAmountMinor,
+		TaxAmountMinor:   invoice.TaxAmountMinor,
+		TerminalID:       invoice.TerminalID,
+		SequenceNumber:   invoice.SequenceNumber,
+		SupplierMSPID:    invoice.SupplierMSPID,
+		PurchaseOrderID:  invoice.PurchaseOrderID,
+		GoodsReceiptID:   invoice.GoodsReceiptID,
+		Items:            []CanonicalItem{},
+	}
+	for _, item := range invoice.Items {
+		canonical.Items = append(canonical.Items, CanonicalItem{
+			ItemID:            item.ItemID,
+			ExpiryDate:        item.ExpiryDate,
+			Quantity:          item.Quantity,
+			Unit:              item.Unit,
+			PricePerUnitMinor: item.PricePerUnitMinor,
+			TotalPriceMinor:   item.TotalPriceMinor,
+			TaxCategory:       item.TaxCategory,
+			TaxAmountMinor:    item.TaxAmountMinor,
+		})
+	}
+
+	return json.Marshal(canonical)
+}
+
+// Determine the key type of a PEM-encoded device public key
+func parseDeviceKey(publicKeyPEM string) (string, error) {
+	publicKey, err := parsePublicKey(publicKeyPEM)
+	if err != nil {
+		return "", err
+	}
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize < 256 {
+			return "", fmt.Errorf("ECDSA keys must use a curve of at least 256 bits")
+		}
+		return keyTypeECDSA, nil
+	case ed25519.PublicKey:
+		return keyTypeEd25519, nil
+	}
+	return "", fmt.Errorf("device keys must be ECDSA or Ed25519, got %T", publicKey)
+}
+
+// Parse a PEM-encoded PKIX public key
+func parsePublicKey(publicKeyPEM string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("public key is not PEM encoded")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %s", err.Error())
+	}
+
+	return publicKey, nil
+}
+
+// Save a device to the ledger
+func (s *SmartContract) putDevice(ctx contractapi.TransactionContextInterface, device Device) error {
+	deviceJSON, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(deviceKey(device.DeviceID), deviceJSON)
+}
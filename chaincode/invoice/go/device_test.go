@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+)
+
+func publicKeyPEM(t *testing.T, publicKey crypto.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func deviceArg(deviceID string, storeID string, deviceType string, publicKey string) map[string]interface{} {
+	return map[string]interface{}{
+		"doc_type": "", "device_id": deviceID, "store_id": storeID, "device_type": deviceType, "public_key": publicKey,
+		"key_type": "", "key_version": 0, "status": "", "registered_at": "", "updated_at": "",
+	}
+}
+
+// Sign an invoice argument the way a device does, over the canonical form the contract decodes it to
+func signInvoiceArg(t *testing.T, invoiceArg map[string]interface{}, key interface{}) map[string]interface{} {
+	t.Helper()
+	invoiceJSON, _ := json.Marshal(invoiceArg)
+	var invoice Invoice
+	err := json.Unmarshal(invoiceJSON, &invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := canonicalInvoice(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signature []byte
+	switch privateKey := key.(type) {
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(message)
+		signature, err = ecdsa.SignASN1(rand.Reader, privateKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(privateKey, message)
+	}
+	invoiceArg["device_signature"] = base64.StdEncoding.EncodeToString(signature)
+	return invoiceArg
+}
+
+func TestCanonicalInvoice(t *testing.T) {
+	invoice := Invoice{
+		InvoiceID: "P1", StoreID: "S1", DeviceID: "POS1", Date: "2026-03-01", Timestamp: "2026-03-01T10:00:00Z",
+		InvoiceType: "purchase", Currency: "INR", TotalAmountMinor: 2625, TaxAmountMinor: 125, TerminalID: "T1", SequenceNumber: 7,
+		SupplierMSPID: "SupMSP", PurchaseOrderID: "PO1", GoodsReceiptID: "GR1",
+		Items: []Item{{ItemID: "milk", ItemName: "ignored", ExpiryDate: "2027-03-10", Quantity: 2, Unit: "case", PricePerUnitMinor: 1250, TotalPriceMinor: 2500, TaxCategory: "gst5", TaxAmountMinor: 125}},
+	}
+
+	// Devices reproduce these bytes exactly, see hardware/signing.js
+	expected := `{"invoice_id":"P1","store_id":"S1","device_id":"POS1","date":"2026-03-01","timestamp":"2026-03-01T10:00:00Z",` +
+		`"invoice_type":"purchase","currency":"INR","total_amount_minor":2625,"tax_amount_minor":125,"terminal_id":"T1","sequence_number":7,` +
+		`"supplier_msp_id":"SupMSP","purchase_order_id":"PO1","goods_receipt_id":"GR1","items":[{"item_id":"milk","expiry_date":"2027-03-10",` +
+		`"quantity":2,"unit":"case","price_per_unit_minor":1250,"total_price_minor":2500,"tax_category":"gst5","tax_amount_minor":125}]}`
+	message, err := canonicalInvoice(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != expected {
+		t.Fatalf("canonical invoice changed:\n%s", message)
+	}
+}
+
+func TestDeviceSignedInvoices(t *testing.T) {
+	f := newFixture(t)
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ed25519Public, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+
+	f.fail(f.org2, "is owned by Org1MSP", "RegisterDevice", deviceArg("POS1", "S1", devicePOS, publicKeyPEM(t, &ecdsaKey.PublicKey)))
+	f.fail(f.org1, "unknown type", "RegisterDevice", deviceArg("POS1", "S1", "scale", publicKeyPEM(t, &ecdsaKey.PublicKey)))
+	f.ok(f.org1, "RegisterDevice", deviceArg("POS1", "S1", devicePOS, publicKeyPEM(t, &ecdsaKey.PublicKey)))
+	f.ok(f.org1, "RegisterDevice", deviceArg("RF1", "S1", deviceRFID, publicKeyPEM(t, ed25519Public)))
+	var device Device
+	f.get(&device, f.org1, "GetDevice", "RF1")
+	if device.KeyType != keyTypeEd25519 || device.KeyVersion != 1 || device.Status != deviceActive {
+		t.Fatalf("unexpected device %+v", device)
+	}
+
+	purchase := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1))
+	purchase["device_id"] = "POS1"
+	f.ok(f.org1, "CreateOrUpdateInvoice", signInvoiceArg(t, purchase, ecdsaKey))
+
+	// Changing a signed field after signing breaks the signature
+	sale := signInvoiceArg(t, invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 2, 2)), ed25519Key)
+	sale["device_id"] = "RF1"
+	f.fail(f.org1, "does not verify against device RF1", "CreateOrUpdateInvoice", sale)
+	sale = signInvoiceArg(t, sale, ed25519Key)
+	sale["items"].([]map[string]interface{})[0]["tax_category"] = "gst5"
+	f.fail(f.org1, "does not verify against device RF1", "CreateOrUpdateInvoice", sale)
+	delete(sale["items"].([]map[string]interface{})[0], "tax_category")
+	f.ok(f.org1, "CreateOrUpdateInvoice", sale)
+
+	supplied := invoiceArg("P2", "S1", "purchase", lineArg("milk", "2027-03-10", 1, 1))
+	supplied["device_id"] = "POS1"
+	supplied = signInvoiceArg(t, supplied, ecdsaKey)
+	supplied["supplier_msp_id"] = "SupMSP"
+	f.fail(f.org1, "does not verify against device POS1", "CreateOrUpdateInvoice", supplied)
+
+	// A rotated key replaces the old one, a revoked device signs nothing
+	rotatedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f.ok(f.org1, "RotateDeviceKey", "POS1", publicKeyPEM(t, &rotatedKey.PublicKey))
+	delete(supplied, "supplier_msp_id")
+	f.fail(f.org1, "does not verify against device POS1", "CreateOrUpdateInvoice", signInvoiceArg(t, supplied, ecdsaKey))
+	f.ok(f.org1, "CreateOrUpdateInvoice", signInvoiceArg(t, supplied, rotatedKey))
+	f.ok(f.regulator, "RevokeDevice", "POS1", "stolen")
+	revoked := invoiceArg("P3", "S1", "purchase", lineArg("milk", "2027-03-10", 1, 1))
+	revoked["device_id"] = "POS1"
+	f.fail(f.org1, "device POS1 is revoked", "CreateOrUpdateInvoice", signInvoiceArg(t, revoked, rotatedKey))
+}
+
+func TestRequireSignedInvoices(t *testing.T) {
+	f := newFixture(t)
+
+	// Stores cannot impose or lift the requirement on themselves
+	store := storeArg("S3", "north", "large")
+	store["require_signed_invoices"] = true
+	f.ok(f.org1, "RegisterStore", store)
+	var registered Store
+	f.get(&registered, f.regulator, "GetStore", "S3")
+	if registered.RequireSignedInvoices {
+		t.Fatal("store imposed its own controls at registration")
+	}
+
+	f.fail(f.org1, "not permitted", "SetStoreControls", "S1", StoreControls{RequireSignedInvoices: true})
+	f.ok(f.regulator, "SetStoreControls", "S1", StoreControls{RequireSignedInvoices: true})
+	update := storeArg("S1", "north", "large")
+	update["require_signed_invoices"] = false
+	f.ok(f.org1, "UpdateStore", update)
+
+	f.fail(f.org1, "only accepts invoices signed by a registered device", "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 1, 1)))
+	f.ok(f.org2, "CreateOrUpdateInvoice", invoiceArg("P2", "S2", "purchase", lineArg("milk", "2027-03-10", 1, 1)))
+}
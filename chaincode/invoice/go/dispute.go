@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Dispute states
+const (
+	disputeOpen        = "open"
+	disputeUnderReview = "under_review"
+	disputeUpheld      = "upheld"   // the invalidation stands
+	disputeReversed    = "reversed" // the invalidation is withdrawn
+)
+
+// Dispute structure
+type Dispute struct {
+	DocType        string `json:"doc_type"`
+	DisputeID      string `json:"dispute_id"`
+	InvalidationID string `json:"invalidation_id"`
+	StoreID        string `json:"store_id"`
+	Evidence       string `json:"evidence"`
+	Status         string `json:"status"`
+	RaisedBy       string `json:"raised_by"`
+	RaisedAt       string `json:"raised_at"`
+	ReviewedBy     string `json:"reviewed_by,omitempty" metadata:",optional"`
+	ReviewedAt     string `json:"reviewed_at,omitempty" metadata:",optional"`
+	ResolutionNote string `json:"resolution_note,omitempty" metadata:",optional"`
+	ResolvedBy     string `json:"resolved_by,omitempty" metadata:",optional"`
+	ResolvedAt     string `json:"resolved_at,omitempty" metadata:",optional"`
+}
+
+// Ledger key of a dispute, one per invalidation
+func disputeKey(disputeID string) string {
+	return fmt.Sprintf("DISPUTE_%s", disputeID)
+}
+
+// Dispute an invalidated invoice line on behalf of the store it was flagged against
+func (s *SmartContract) RaiseDispute(ctx contractapi.TransactionContextInterface, storeID string, invalidationID string, evidence string) error {
+	if strings.TrimSpace(evidence) == "" {
+		return fmt.Errorf("dispute of invalidation %s requires evidence", invalidationID)
+	}
+
+	invalidation, err := s.GetInvalidation(ctx, invalidationID)
+	if err != nil {
+		return err
+	}
+	if invalidation.StoreID != storeID {
+		return fmt.Errorf("invalidation %s was raised against store %s, not %s", invalidationID, invalidation.StoreID, storeID)
+	}
+	if invalidation.Status == invalidationReversed {
+		return fmt.Errorf("invalidation %s is already reversed", invalidationID)
+	}
+
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	// Each invalidation can be disputed once
+	existingJSON, err := ctx.GetStub().GetState(disputeKey(invalidationID))
+	if err != nil {
+		return err
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("invalidation %s has already been disputed", invalidationID)
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	dispute := Dispute{
+		DocType:        "dispute",
+		DisputeID:      invalidationID,
+		InvalidationID: invalidationID,
+		StoreID:        storeID,
+		Evidence:       evidence,
+		Status:         disputeOpen,
+		RaisedBy:       signer,
+		RaisedAt:       now.Format(time.RFC3339),
+	}
+
+	return s.putDispute(ctx, dispute)
+}
+
+// Take an open dispute under review, restricted to auditors
+func (s *SmartContract) ReviewDispute(ctx contractapi.TransactionContextInterface, disputeID string) error {
+	dispute, err := s.getDisputeForAuditor(ctx, disputeID, disputeOpen)
+	if err != nil {
+		return err
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	dispute.Status = disputeUnderReview
+	dispute.ReviewedBy = signer
+	dispute.ReviewedAt = now.Format(time.RFC3339)
+
+	return s.putDispute(ctx, dispute)
+}
+
+// Decide a dispute under review as upheld or reversed, restricted to auditors
+func (s *SmartContract) ResolveDispute(ctx contractapi.TransactionContextInterface, disputeID string, decision string, note string) error {
+	if decision != disputeUpheld && decision != disputeReversed {
+		return fmt.Errorf("dispute decision must be %q or %q, got %q", disputeUpheld, disputeReversed, decision)
+	}
+
+	dispute, err := s.getDisputeForAuditor(ctx, disputeID, disputeUnderReview)
+	if err != nil {
+		return err
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	dispute.Status = decision
+	dispute.ResolutionNote = note
+	dispute.ResolvedBy = signer
+	dispute.ResolvedAt = now.Format(time.RFC3339)
+
+	err = s.putDispute(ctx, dispute)
+	if err != nil {
+		return err
+	}
+
+	if decision == disputeReversed {
+		return s.reverseInvalidation(ctx, dispute.InvalidationID)
+	}
+
+	return nil
+}
+
+// Retrieve a dispute from the ledger
+func (s *SmartContract) GetDispute(ctx contractapi.TransactionContextInterface, disputeID string) (Dispute, error) {
+	disputeJSON, err := ctx.GetStub().GetState(disputeKey(disputeID))
+	if err != nil {
+		return Dispute{}, err
+	}
+	if disputeJSON == nil {
+		return Dispute{}, fmt.Errorf("Dispute not found for ID: %s", disputeID)
+	}
+
+	var dispute Dispute
+	err = json.Unmarshal(disputeJSON, &dispute)
+	if err != nil {
+		return Dispute{}, err
+	}
+
+	return dispute, nil
+}
+
+// Retrieve the disputes raised by a store
+func (s *SmartContract) GetStoreDisputes(ctx contractapi.TransactionContextInterface, storeID string) ([]Dispute, error) {
+	queryString := fmt.Sprintf(`{"selector":{"doc_type":"dispute","store_id":"%s"}}`, storeID)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	disputes := []Dispute{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var dispute Dispute
+		err = json.Unmarshal(queryResponse.Value, &dispute)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, dispute)
+	}
+
+	return disputes, nil
+}
+
+// Retrieve an invalidated invoice line from the ledger
+func (s *SmartContract) GetInvalidation(ctx contractapi.TransactionContextInterface, invalidationID string) (Invalidation, error) {
+	invalidationJSON, err := ctx.GetStub().GetState(invalidationKey(invalidationID))
+	if err != nil {
+		return Invalidation{}, err
+	}
+	if invalidationJSON == nil {
+		return Invalidation{}, fmt.Errorf("Invalidation not found for ID: %s", invalidationID)
+	}
+
+	var invalidation Invalidation
+	err = json.Unmarshal(invalidationJSON, &invalidation)
+	if err != nil {
+		return Invalidation{}, err
+	}
+
+	return invalidation, nil
+}
+
+// Load a dispute in the given state on behalf of an auditor
+func (s *SmartContract) getDisputeForAuditor(ctx contractapi.TransactionContextInterface, disputeID string, status string) (Dispute, error) {
+	err := requireRole(ctx, roleAuditor)
+	if err != nil {
+		return Dispute{}, err
+	}
+
+	dispute, err := s.GetDispute(ctx, disputeID)
+	if err != nil {
+		return Dispute{}, err
+	}
+	if dispute.Status != status {
+		return Dispute{}, fmt.Errorf("dispute %s is %s, expected %s", disputeID, dispute.Status, status)
+	}
+
+	return dispute, nil
+}
+
+// Withdraw an invalidation, counting the line as valid again
+func (s *SmartContract) reverseInvalidation(ctx contractapi.TransactionContextInterface, invalidationID string) error {
+	invalidation, err := s.GetInvalidation(ctx, invalidationID)
+	if err != nil {
+		return err
+	}
+
+	invalidation.Status = invalidationReversed
+	invalidationJSON, err := json.Marshal(invalidation)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(invalidationKey(invalidationID), invalidationJSON)
+	if err != nil {
+		return err
+	}
+
+	// The reversed line moves from the invalid to the valid count, which the ethics index is derived from when queried
+	return s.addValidityDelta(ctx, invalidation.StoreID, invalidation.ItemKey, invalidationID, 1, -1)
+}
+
+// Save a dispute to the ledger
+func (s *SmartContract) putDispute(ctx contractapi.TransactionContextInterface, dispute Dispute) error {
+	disputeJSON, err := json.Marshal(dispute)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(disputeKey(dispute.DisputeID), disputeJSON)
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestDispute(t *testing.T) {
+	f := newFixture(t)
+	milk := lot("milk", "2027-03-10")
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 10, 1)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 12, 2)))
+	invalidationID := "X1_oversold_milk_2027-03-10"
+
+	var validity TransactionValidity
+	f.get(&validity, f.auditor, "GetTransactionValidity", "S1", milk)
+	if validity.InvalidTransactions != 1 {
+		t.Fatalf("unexpected validity %+v", validity)
+	}
+
+	f.fail(f.org1, "requires evidence", "RaiseDispute", "S1", invalidationID, "")
+	f.fail(f.org2, "was raised against store S1, not S2", "RaiseDispute", "S2", invalidationID, "delivery note")
+	f.fail(f.org2, "is owned by Org1MSP", "RaiseDispute", "S1", invalidationID, "delivery note")
+	f.fail(f.org1, "Invalidation not found for ID: X9", "RaiseDispute", "S1", "X9", "delivery note")
+	f.ok(f.org1, "RaiseDispute", "S1", invalidationID, "unrecorded delivery note")
+	f.fail(f.org1, "already been disputed", "RaiseDispute", "S1", invalidationID, "delivery note")
+
+	f.fail(f.org1, "not permitted", "ReviewDispute", invalidationID)
+	f.fail(f.auditor, "is open, expected under_review", "ResolveDispute", invalidationID, disputeReversed, "accepted")
+	f.ok(f.auditor, "ReviewDispute", invalidationID)
+	f.fail(f.auditor, "dispute decision must be", "ResolveDispute", invalidationID, "dismissed", "no")
+	f.ok(f.auditor, "ResolveDispute", invalidationID, disputeReversed, "delivery note checks out")
+
+	var dispute Dispute
+	f.get(&dispute, f.org1, "GetDispute", invalidationID)
+	if dispute.Status != disputeReversed || dispute.ResolvedBy == "" || dispute.ResolutionNote != "delivery note checks out" {
+		t.Fatalf("unexpected dispute %+v", dispute)
+	}
+	var invalidation Invalidation
+	f.get(&invalidation, f.org1, "GetInvalidation", invalidationID)
+	if invalidation.Status != invalidationReversed {
+		t.Fatalf("invalidation not reversed: %+v", invalidation)
+	}
+	f.get(&validity, f.auditor, "GetTransactionValidity", "S1", milk)
+	if validity.ValidTransactions != 1 || validity.InvalidTransactions != 0 {
+		t.Fatalf("reversed line not counted as valid: %+v", validity)
+	}
+	var disputes []Dispute
+	f.get(&disputes, f.org1, "GetStoreDisputes", "S1")
+	if len(disputes) != 1 {
+		t.Fatalf("unexpected disputes %+v", disputes)
+	}
+}
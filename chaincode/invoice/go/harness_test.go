@@ -0,0 +1,590 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Mock stub that dispatches through the contract API and adds the rich queries and key history
+// the shimtest stub lacks; rich queries understand the selector operators the contract uses
+type testStub struct {
+	*shimtest.MockStub
+	args       [][]byte
+	history    map[string][]*queryresult.KeyModification
+	rangeReads []string // start keys of the range reads of the last transaction
+}
+
+func (stub *testStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *testStub) GetStringArgs() []string {
+	var args []string
+	for _, arg := range stub.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	if len(args) == 0 {
+		return "", nil
+	}
+	return args[0], args[1:]
+}
+
+func (stub *testStub) PutState(key string, value []byte) error {
+	stub.history[key] = append(stub.history[key], &queryresult.KeyModification{TxId: stub.TxID, Value: value, Timestamp: stub.TxTimestamp})
+	return stub.MockStub.PutState(key, value)
+}
+
+func (stub *testStub) DelState(key string) error {
+	stub.history[key] = append(stub.history[key], &queryresult.KeyModification{TxId: stub.TxID, IsDelete: true, Timestamp: stub.TxTimestamp})
+	return stub.MockStub.DelState(key)
+}
+
+func (stub *testStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	stub.rangeReads = append(stub.rangeReads, startKey)
+	return stub.MockStub.GetStateByRange(startKey, endKey)
+}
+
+func (stub *testStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	partialKey, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	stub.rangeReads = append(stub.rangeReads, partialKey)
+	return stub.MockStub.GetStateByPartialCompositeKey(objectType, attributes)
+}
+
+func (stub *testStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{modifications: stub.history[key]}, nil
+}
+
+func (stub *testStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return queryState(stub.State, query)
+}
+
+func (stub *testStub) GetPrivateDataQueryResult(collection string, query string) (shim.StateQueryIteratorInterface, error) {
+	return queryState(stub.PvtState[collection], query)
+}
+
+type stateIterator struct {
+	results []*queryresult.KV
+	next    int
+}
+
+func (iterator *stateIterator) HasNext() bool {
+	return iterator.next < len(iterator.results)
+}
+
+func (iterator *stateIterator) Next() (*queryresult.KV, error) {
+	iterator.next++
+	return iterator.results[iterator.next-1], nil
+}
+
+func (iterator *stateIterator) Close() error {
+	return nil
+}
+
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+	next          int
+}
+
+func (iterator *historyIterator) HasNext() bool {
+	return iterator.next < len(iterator.modifications)
+}
+
+func (iterator *historyIterator) Next() (*queryresult.KeyModification, error) {
+	iterator.next++
+	return iterator.modifications[iterator.next-1], nil
+}
+
+func (iterator *historyIterator) Close() error {
+	return nil
+}
+
+// Evaluate a CouchDB query against the world state, honouring sort and limit
+func queryState(state map[string][]byte, query string) (shim.StateQueryIteratorInterface, error) {
+	var parsed struct {
+		Selector map[string]interface{}   `json:"selector"`
+		Sort     []map[string]interface{} `json:"sort"`
+		Limit    int                      `json:"limit"`
+	}
+	err := json.Unmarshal([]byte(query), &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("malformed query %s: %s", query, err.Error())
+	}
+
+	var keys []string
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	type document struct {
+		kv    *queryresult.KV
+		value interface{}
+	}
+	var documents []document
+	for _, key := range keys {
+		var value interface{}
+		if json.Unmarshal(state[key], &value) != nil {
+			continue
+		}
+		if matchSelector(value, parsed.Selector) {
+			documents = append(documents, document{kv: &queryresult.KV{Key: key, Value: state[key]}, value: value})
+		}
+	}
+
+	for i := len(parsed.Sort) - 1; i >= 0; i-- {
+		for field, direction := range parsed.Sort[i] {
+			sort.SliceStable(documents, func(a, b int) bool {
+				left, _ := lookupField(documents[a].value, field)
+				right, _ := lookupField(documents[b].value, field)
+				order, _ := compareValues(left, right)
+				if direction == "desc" {
+					return order > 0
+				}
+				return order < 0
+			})
+		}
+	}
+	if parsed.Limit > 0 && len(documents) > parsed.Limit {
+		documents = documents[:parsed.Limit]
+	}
+
+	iterator := &stateIterator{}
+	for _, document := range documents {
+		iterator.results = append(iterator.results, document.kv)
+	}
+	return iterator, nil
+}
+
+func lookupField(document interface{}, path string) (interface{}, bool) {
+	current := document
+	for _, part := range strings.Split(path, ".") {
+		fields, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = fields[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func compareValues(left interface{}, right interface{}) (int, bool) {
+	switch leftValue := left.(type) {
+	case float64:
+		rightValue, ok := right.(float64)
+		if !ok {
+			return 0, false
+		}
+		if leftValue < rightValue {
+			return -1, true
+		}
+		if leftValue > rightValue {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		rightValue, ok := right.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(leftValue, rightValue), true
+	}
+	return 0, false
+}
+
+func matchSelector(document interface{}, selector map[string]interface{}) bool {
+	for field, condition := range selector {
+		switch field {
+		case "$and":
+			for _, clause := range condition.([]interface{}) {
+				if !matchSelector(document, clause.(map[string]interface{})) {
+					return false
+				}
+			}
+			continue
+		case "$or":
+			matched := false
+			for _, clause := range condition.([]interface{}) {
+				if matchSelector(document, clause.(map[string]interface{})) {
+					matched = true
+				}
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+
+		value, present := lookupField(document, field)
+		if !matchCondition(value, present, condition) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchCondition(value interface{}, present bool, condition interface{}) bool {
+	operators, ok := condition.(map[string]interface{})
+	if !ok {
+		return present && reflect.DeepEqual(value, condition)
+	}
+
+	hasOperator := false
+	for operator := range operators {
+		if strings.HasPrefix(operator, "$") {
+			hasOperator = true
+		}
+	}
+	if !hasOperator {
+		return present && matchSelector(value, operators)
+	}
+
+	for operator, argument := range operators {
+		switch operator {
+		case "$exists":
+			if present != argument.(bool) {
+				return false
+			}
+		case "$eq":
+			if !present || !reflect.DeepEqual(value, argument) {
+				return false
+			}
+		case "$ne":
+			if present && reflect.DeepEqual(value, argument) {
+				return false
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			if !present {
+				return false
+			}
+			order, ok := compareValues(value, argument)
+			if !ok {
+				return false
+			}
+			if (operator == "$gt" && order <= 0) || (operator == "$gte" && order < 0) || (operator == "$lt" && order >= 0) || (operator == "$lte" && order > 0) {
+				return false
+			}
+		case "$in":
+			found := false
+			for _, candidate := range argument.([]interface{}) {
+				if reflect.DeepEqual(value, candidate) {
+					found = true
+				}
+			}
+			if !present || !found {
+				return false
+			}
+		case "$nin":
+			for _, candidate := range argument.([]interface{}) {
+				if reflect.DeepEqual(value, candidate) {
+					return false
+				}
+			}
+		case "$elemMatch":
+			elements, ok := value.([]interface{})
+			if !ok {
+				return false
+			}
+			found := false
+			for _, element := range elements {
+				if matchSelector(element, argument.(map[string]interface{})) {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		default:
+			panic("unsupported query operator " + operator)
+		}
+	}
+	return true
+}
+
+// Client identity with an X.509 certificate carrying an optional role attribute
+type identity struct {
+	mspID      string
+	serialized []byte
+}
+
+func newIdentity(t *testing.T, mspID string, commonName string, role string) identity {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if role != "" {
+		attributes, _ := json.Marshal(map[string]interface{}{"attrs": map[string]string{"role": role}})
+		template.ExtraExtensions = []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: attributes}}
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	serialized, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: certificatePEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity{mspID: mspID, serialized: serialized}
+}
+
+// Test ledger with two stores, a regulator, a supplier, a catalogue manager and two catalogue items
+type fixture struct {
+	t         *testing.T
+	chaincode *contractapi.ContractChaincode
+	stub      *testStub
+	txCount   int
+	now       time.Time // transaction timestamp of the next call
+
+	org1, org2, regulator, supplier, catalogue, manager, auditor identity
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	chaincode, err := contractapi.NewChaincode(new(SmartContract))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fixture{
+		t:         t,
+		chaincode: chaincode,
+		stub:      &testStub{MockStub: shimtest.NewMockStub("invoice", chaincode), history: map[string][]*queryresult.KeyModification{}},
+		now:       time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC),
+		org1:      newIdentity(t, "Org1MSP", "store1admin", ""),
+		org2:      newIdentity(t, "Org2MSP", "store2admin", ""),
+		regulator: newIdentity(t, "RegMSP", "regulator", roleRegulator),
+		supplier:  newIdentity(t, "SupMSP", "supplier", roleSupplier),
+		catalogue: newIdentity(t, "RegMSP", "catalogue", roleCatalogueManager),
+		manager:   newIdentity(t, "Org1MSP", "store1manager", roleManager),
+		auditor:   newIdentity(t, "AuditMSP", "auditor", roleAuditor),
+	}
+
+	f.ok(f.org1, "RegisterStore", storeArg("S1", "north", "large"))
+	f.ok(f.org2, "RegisterStore", storeArg("S2", "south", "small"))
+	f.ok(f.catalogue, "CreateOrUpdateCatalogueItem", catalogueArg("milk", "4006381333931", "each", false, 10, map[string]float64{"case": 12}))
+	f.ok(f.catalogue, "CreateOrUpdateCatalogueItem", catalogueArg("cheese", "96385074", "kg", true, 30, nil))
+	return f
+}
+
+func storeArg(storeID string, region string, size string) map[string]interface{} {
+	return map[string]interface{}{
+		"doc_type": "", "store_id": storeID, "name": "Store " + storeID, "region": region, "chain": "acme",
+		"time_zone": "Asia/Kolkata", "size_category": size, "owner_msp_id": "", "status": "", "registered_at": "", "updated_at": "",
+	}
+}
+
+func catalogueArg(itemID string, gtin string, unit string, variableWeight bool, shelfLifeDays int, conversions map[string]float64) map[string]interface{} {
+	item := map[string]interface{}{
+		"doc_type": "", "item_id": itemID, "gtin": gtin, "name": itemID, "category": "dairy", "unit_of_measure": unit,
+		"variable_weight": variableWeight, "shelf_life_days": shelfLifeDays, "perishable": true, "updated_by": "", "updated_at": "",
+	}
+	if conversions != nil {
+		item["unit_conversions"] = conversions
+	}
+	return item
+}
+
+// Invoice dated and timestamped at the fixture's default transaction time
+func invoiceArg(invoiceID string, storeID string, invoiceType string, lines ...map[string]interface{}) map[string]interface{} {
+	var total float64
+	for _, line := range lines {
+		total += line["total_price"].(float64)
+	}
+	return map[string]interface{}{
+		"invoice_id": invoiceID, "store_id": storeID, "date": "2026-03-01", "timestamp": "2026-03-01T10:00:00Z",
+		"items": lines, "total_amount": total, "invoice_type": invoiceType, "transaction_hash": "", "prev_block_hash": "",
+	}
+}
+
+// Invoice line priced in major units, converted to minor units by the contract
+func lineArg(itemID string, expiryDate string, quantity float64, price float64) map[string]interface{} {
+	return map[string]interface{}{
+		"item_id": itemID, "item_name": itemID, "expiry_date": expiryDate, "quantity": quantity,
+		"price_per_unit": price, "total_price": quantity * price, "invoice_type": "",
+	}
+}
+
+func lot(itemID string, expiryDate string) map[string]string {
+	return map[string]string{"item_id": itemID, "expiry_date": expiryDate}
+}
+
+// Invoke a transaction as the given identity; world state and private data are rolled back when it fails
+func (f *fixture) invoke(caller identity, transient map[string][]byte, function string, args ...interface{}) (string, error) {
+	f.txCount++
+	txID := fmt.Sprintf("tx%04d", f.txCount)
+	f.stub.MockTransactionStart(txID)
+	f.stub.TxTimestamp = timestamppb.New(f.now)
+	f.stub.Creator = caller.serialized
+	f.stub.TransientMap = transient
+	f.stub.rangeReads = nil
+	f.stub.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		if text, ok := arg.(string); ok {
+			f.stub.args = append(f.stub.args, []byte(text))
+			continue
+		}
+		argJSON, err := json.Marshal(arg)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		f.stub.args = append(f.stub.args, argJSON)
+	}
+
+	state := make(map[string][]byte)
+	for key, value := range f.stub.State {
+		state[key] = value
+	}
+	privateState := make(map[string]map[string][]byte)
+	for collection, values := range f.stub.PvtState {
+		privateState[collection] = make(map[string][]byte)
+		for key, value := range values {
+			privateState[collection][key] = value
+		}
+	}
+
+	response := f.chaincode.Invoke(f.stub)
+	f.stub.MockTransactionEnd(txID)
+	if response.Status == 200 {
+		return string(response.Payload), nil
+	}
+
+	f.stub.State = state
+	f.stub.PvtState = privateState
+	f.stub.Keys.Init()
+	var keys []string
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f.stub.Keys.PushBack(key)
+	}
+	return "", fmt.Errorf("%s", response.Message)
+}
+
+// Invoke a transaction that must succeed, returning its payload
+func (f *fixture) ok(caller identity, function string, args ...interface{}) string {
+	f.t.Helper()
+	payload, err := f.invoke(caller, nil, function, args...)
+	if err != nil {
+		f.t.Fatalf("%s failed: %s", function, err.Error())
+	}
+	return payload
+}
+
+// Invoke a transaction with transient data that must succeed
+func (f *fixture) okTransient(caller identity, transient map[string]interface{}, function string, args ...interface{}) string {
+	f.t.Helper()
+	transientMap := make(map[string][]byte)
+	for key, value := range transient {
+		valueJSON, err := json.Marshal(value)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		transientMap[key] = valueJSON
+	}
+	payload, err := f.invoke(caller, transientMap, function, args...)
+	if err != nil {
+		f.t.Fatalf("%s failed: %s", function, err.Error())
+	}
+	return payload
+}
+
+// Invoke a transaction that must succeed and decode its payload
+func (f *fixture) get(result interface{}, caller identity, function string, args ...interface{}) {
+	f.t.Helper()
+	payload := f.ok(caller, function, args...)
+	err := json.Unmarshal([]byte(payload), result)
+	if err != nil {
+		f.t.Fatalf("%s returned %q: %s", function, payload, err.Error())
+	}
+}
+
+// Invoke a transaction that must fail with an error containing the given text
+func (f *fixture) fail(caller identity, expected string, function string, args ...interface{}) {
+	f.t.Helper()
+	_, err := f.invoke(caller, nil, function, args...)
+	if err == nil {
+		f.t.Fatalf("%s succeeded, expected an error containing %q", function, expected)
+	}
+	if !strings.Contains(err.Error(), expected) {
+		f.t.Fatalf("%s failed with %q, expected an error containing %q", function, err.Error(), expected)
+	}
+}
+
+// Decode a world state value, reporting whether the key exists
+func (f *fixture) state(key string, value interface{}) bool {
+	f.t.Helper()
+	valueJSON, ok := f.stub.State[key]
+	if !ok {
+		return false
+	}
+	err := json.Unmarshal(valueJSON, value)
+	if err != nil {
+		f.t.Fatalf("state %s: %s", key, err.Error())
+	}
+	return true
+}
+
+// Keys of the world state starting with a prefix
+func (f *fixture) keys(prefix string) []string {
+	var keys []string
+	for key := range f.stub.State {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestContractMetadata(t *testing.T) {
+	_, err := contractapi.NewChaincode(new(SmartContract))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Validation only runs as part of recording an invoice, never on a caller's say-so
+	f := newFixture(t)
+	f.fail(f.org2, "not found", "ValidateTransaction", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 1, 2)))
+	f.fail(f.org2, "not found", "UpdateTransactionValidity", "S1", lot("milk", "2027-03-10"), false)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gravityinescapable/BTP/chaincode/invoice/go/merkle"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// IdempotencyRecord structure
+type IdempotencyRecord struct {
+	DocType        string `json:"doc_type"`
+	StoreID        string `json:"store_id"`
+	IdempotencyKey string `json:"idempotency_key"`
+	InvoiceID      string `json:"invoice_id"`
+	ContentHash    string `json:"content_hash"`
+	RecordedAt     string `json:"recorded_at"`
+}
+
+// Ledger key of an idempotency key used by a store
+func idempotencyKey(storeID string, key string) string {
+	return fmt.Sprintf("IDEMPOTENCY_%s_%s", storeID, key)
+}
+
+// Hash the submitted content of an invoice, leaving out the fields set by the contract; the merkle
+// package computes the same hash from the invoice JSON so that proofs can be checked offline
+func contentHash(invoice Invoice) string {
+	invoiceJSON, _ := json.Marshal(invoice)
+	hash, _ := merkle.ContentHash(invoiceJSON)
+	return hash
+}
+
+// Content hash of a stored invoice, computed for records saved before hashes were kept
+func storedContentHash(invoice Invoice) string {
+	if invoice.ContentHash != "" {
+		return invoice.ContentHash
+	}
+	return contentHash(invoice)
+}
+
+// Report whether an invoice replays an earlier submission under the same idempotency key;
+// an amendment may carry the key of the invoice it amends
+func (s *SmartContract) checkIdempotencyKey(ctx contractapi.TransactionContextInterface, invoice Invoice, amend bool) (bool, error) {
+	if invoice.IdempotencyKey == "" {
+		return false, nil
+	}
+
+	recordJSON, err := ctx.GetStub().GetState(idempotencyKey(invoice.StoreID, invoice.IdempotencyKey))
+	if err != nil {
+		return false, fmt.Errorf("failed to read idempotency key: %s", err.Error())
+	}
+	if recordJSON == nil {
+		return false, nil
+	}
+
+	var record IdempotencyRecord
+	err = json.Unmarshal(recordJSON, &record)
+	if err != nil {
+		return false, err
+	}
+
+	if amend && record.InvoiceID == invoice.InvoiceID {
+		return false, nil
+	}
+	if record.InvoiceID != invoice.InvoiceID || record.ContentHash != invoice.ContentHash {
+		return false, fmt.Errorf("idempotency key %s was already used for invoice %s with different content", invoice.IdempotencyKey, record.InvoiceID)
+	}
+
+	return true, nil
+}
+
+// Remember the idempotency key of a recorded invoice; a key stays bound to the first submission,
+// so retries of it remain no-ops after the invoice is amended
+func (s *SmartContract) putIdempotencyRecord(ctx contractapi.TransactionContextInterface, invoice Invoice) error {
+	if invoice.IdempotencyKey == "" {
+		return nil
+	}
+
+	existingJSON, err := ctx.GetStub().GetState(idempotencyKey(invoice.StoreID, invoice.IdempotencyKey))
+	if err != nil {
+		return fmt.Errorf("failed to read idempotency key: %s", err.Error())
+	}
+	if existingJSON != nil {
+		return nil
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	record := IdempotencyRecord{
+		DocType:        "idempotency",
+		StoreID:        invoice.StoreID,
+		IdempotencyKey: invoice.IdempotencyKey,
+		InvoiceID:      invoice.InvoiceID,
+		ContentHash:    invoice.ContentHash,
+		RecordedAt:     now.Format(time.RFC3339),
+	}
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(idempotencyKey(invoice.StoreID, invoice.IdempotencyKey), recordJSON)
+}
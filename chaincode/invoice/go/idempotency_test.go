@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestIdempotentSubmission(t *testing.T) {
+	f := newFixture(t)
+	purchase := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1))
+	purchase["idempotency_key"] = "K1"
+	f.ok(f.org1, "CreateOrUpdateInvoice", purchase)
+
+	var recorded Invoice
+	f.get(&recorded, f.org1, "GetInvoice", "P1")
+	if recorded.ContentHash == "" || recorded.Version != 1 {
+		t.Fatalf("unexpected invoice %+v", recorded)
+	}
+
+	// A retry is acknowledged without recording anything
+	before := len(f.stub.history["P1"])
+	f.ok(f.org1, "CreateOrUpdateInvoice", purchase)
+	if len(f.stub.history["P1"]) != before {
+		t.Fatal("replayed submission rewrote the invoice")
+	}
+
+	var record IdempotencyRecord
+	if !f.state(idempotencyKey("S1", "K1"), &record) || record.InvoiceID != "P1" || record.ContentHash != recorded.ContentHash {
+		t.Fatalf("unexpected idempotency record %+v", record)
+	}
+
+	changed := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 12, 1))
+	changed["idempotency_key"] = "K1"
+	f.fail(f.org1, "idempotency key K1 was already used for invoice P1 with different content", "CreateOrUpdateInvoice", changed)
+	other := invoiceArg("P2", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1))
+	other["idempotency_key"] = "K1"
+	f.fail(f.org1, "already used for invoice P1", "CreateOrUpdateInvoice", other)
+	delete(changed, "idempotency_key")
+	f.fail(f.org1, "amend it with AmendInvoice", "CreateOrUpdateInvoice", changed)
+
+	// Keys are scoped to the store
+	other = invoiceArg("P2", "S2", "purchase", lineArg("milk", "2027-03-10", 24, 1))
+	other["idempotency_key"] = "K1"
+	f.ok(f.org2, "CreateOrUpdateInvoice", other)
+}
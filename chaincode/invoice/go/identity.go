@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Roles carried in the "role" attribute of client certificates
+const (
+	roleSupplier         = "supplier"
+	roleRegulator        = "regulator"
+	roleCatalogueManager = "catalogue_manager"
+	roleManager          = "manager"
+	roleAuditor          = "auditor"
+)
+
+// Ensure the invoking identity carries one of the given roles
+func requireRole(ctx contractapi.TransactionContextInterface, roles ...string) error {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return fmt.Errorf("failed to read client role: %s", err.Error())
+	}
+	if found {
+		for _, allowed := range roles {
+			if role == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client role %q is not permitted, requires one of %v", role, roles)
+}
+
+// Retrieve the MSP ID of the invoking identity
+func clientMSPID(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read client MSP ID: %s", err.Error())
+	}
+	return mspID, nil
+}
+
+// Retrieve the proposal timestamp, which is identical on every endorsing peer
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read transaction timestamp: %s", err.Error())
+	}
+	return timestamp.AsTime().UTC(), nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Inspection severities
+const (
+	severityNone     = "none"
+	severityMinor    = "minor"
+	severityMajor    = "major"
+	severityCritical = "critical"
+)
+
+// Inspection structure
+type Inspection struct {
+	DocType         string   `json:"doc_type"`
+	InspectionID    string   `json:"inspection_id"`
+	StoreID         string   `json:"store_id"`
+	Date            string   `json:"date"`
+	ChecksPerformed []string `json:"checks_performed"`
+	Findings        string   `json:"findings"`
+	Severity        string   `json:"severity"` // 'none', 'minor', 'major' or 'critical'
+	AuditorMSPID    string   `json:"auditor_msp_id"`
+	AuditorID       string   `json:"auditor_id"`
+	RecordedAt      string   `json:"recorded_at"`
+}
+
+// EthicsWeights structure
+type EthicsWeights struct {
+	DocType          string             `json:"doc_type"`
+	ValidityWeight   float64            `json:"validity_weight"`
+	InspectionWeight float64            `json:"inspection_weight"`
+	SeverityScores   map[string]float64 `json:"severity_scores"` // score out of 100 for each severity
+	UpdatedBy        string             `json:"updated_by"`
+	UpdatedAt        string             `json:"updated_at"`
+}
+
+// Ledger key of the ethics weights
+const ethicsWeightsKey = "ETHICS_WEIGHTS"
+
+// Composite key object type of store inspections
+const inspectionObjectType = "INSPECTION"
+
+// Ledger key of an inspection of a store
+func inspectionKey(ctx contractapi.TransactionContextInterface, storeID string, inspectionID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(inspectionObjectType, []string{storeID, inspectionID})
+}
+
+// Weights used until a regulator sets them
+func defaultEthicsWeights() EthicsWeights {
+	return EthicsWeights{
+		DocType:          "ethics_weights",
+		ValidityWeight:   0.7,
+		InspectionWeight: 0.3,
+		SeverityScores: map[string]float64{
+			severityNone:     100,
+			severityMinor:    75,
+			severityMajor:    40,
+			severityCritical: 0,
+		},
+	}
+}
+
+// Record an inspection report signed by an auditor and update the store's indices
+func (s *SmartContract) RecordInspection(ctx contractapi.TransactionContextInterface, inspection Inspection) error {
+	err := requireRole(ctx, roleAuditor)
+	if err != nil {
+		return err
+	}
+	if inspection.InspectionID == "" {
+		return fmt.Errorf("inspection ID is required")
+	}
+	if _, err := time.Parse("2006-01-02", inspection.Date); err != nil {
+		return fmt.Errorf("inspection %s has an invalid date: %q", inspection.InspectionID, inspection.Date)
+	}
+	if len(inspection.ChecksPerformed) == 0 {
+		return fmt.Errorf("inspection %s lists no checks performed", inspection.InspectionID)
+	}
+	if _, found := defaultEthicsWeights().SeverityScores[inspection.Severity]; !found {
+		return fmt.Errorf("inspection %s has an unknown severity %q", inspection.InspectionID, inspection.Severity)
+	}
+
+	_, err = s.GetStore(ctx, inspection.StoreID)
+	if err != nil {
+		return err
+	}
+
+	key, err := inspectionKey(ctx, inspection.StoreID, inspection.InspectionID)
+	if err != nil {
+		return err
+	}
+	existingJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return err
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("inspection %s is already recorded", inspection.InspectionID)
+	}
+
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	inspection.DocType = "inspection"
+	inspection.AuditorMSPID = mspID
+	inspection.AuditorID = signer
+	inspection.RecordedAt = now.Format(time.RFC3339)
+
+	inspectionJSON, err := json.Marshal(inspection)
+	if err != nil {
+		return err
+	}
+	// The ethics index blends in inspections when it is queried
+	return ctx.GetStub().PutState(key, inspectionJSON)
+}
+
+// Retrieve the inspections recorded for a store
+func (s *SmartContract) GetStoreInspections(ctx contractapi.TransactionContextInterface, storeID string) ([]Inspection, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(inspectionObjectType, []string{storeID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	inspections := []Inspection{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var inspection Inspection
+		err = json.Unmarshal(queryResponse.Value, &inspection)
+		if err != nil {
+			return nil, err
+		}
+		inspections = append(inspections, inspection)
+	}
+
+	return inspections, nil
+}
+
+// Set how validity counts and inspections are weighed in the ethics index, restricted to regulators
+func (s *SmartContract) SetEthicsWeights(ctx contractapi.TransactionContextInterface, weights EthicsWeights) error {
+	err := requireRole(ctx, roleRegulator)
+	if err != nil {
+		return err
+	}
+	if weights.ValidityWeight < 0 || weights.InspectionWeight < 0 || weights.ValidityWeight+weights.InspectionWeight == 0 {
+		return fmt.Errorf("ethics weights must not be negative and must not both be zero")
+	}
+	for severity := range defaultEthicsWeights().SeverityScores {
+		score, found := weights.SeverityScores[severity]
+		if !found || score < 0 || score > 100 {
+			return fmt.Errorf("ethics weights require a score between 0 and 100 for severity %q", severity)
+		}
+	}
+	if len(weights.SeverityScores) != len(defaultEthicsWeights().SeverityScores) {
+		return fmt.Errorf("ethics weights may only score the severities none, minor, major and critical")
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	weights.DocType = "ethics_weights"
+	weights.UpdatedBy = signer
+	weights.UpdatedAt = now.Format(time.RFC3339)
+
+	weightsJSON, err := json.Marshal(weights)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(ethicsWeightsKey, weightsJSON)
+}
+
+// Retrieve the ethics weights, falling back to the defaults
+func (s *SmartContract) GetEthicsWeights(ctx contractapi.TransactionContextInterface) (EthicsWeights, error) {
+	weightsJSON, err := ctx.GetStub().GetState(ethicsWeightsKey)
+	if err != nil {
+		return EthicsWeights{}, err
+	}
+	if weightsJSON == nil {
+		return defaultEthicsWeights(), nil
+	}
+
+	var weights EthicsWeights
+	err = json.Unmarshal(weightsJSON, &weights)
+	if err != nil {
+		return EthicsWeights{}, err
+	}
+
+	return weights, nil
+}
+
+// Combine the validity-based ethics index with the average score of the store's inspections
+func (s *SmartContract) weighInspections(ctx contractapi.TransactionContextInterface, storeID string, validityIndex float64) (float64, error) {
+	inspections, err := s.GetStoreInspections(ctx, storeID)
+	if err != nil {
+		return 0, err
+	}
+	if len(inspections) == 0 {
+		return validityIndex, nil
+	}
+
+	weights, err := s.GetEthicsWeights(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var totalScore float64
+	for _, inspection := range inspections {
+		totalScore += weights.SeverityScores[inspection.Severity]
+	}
+	inspectionIndex := totalScore / float64(len(inspections))
+
+	return (weights.ValidityWeight*validityIndex + weights.InspectionWeight*inspectionIndex) / (weights.ValidityWeight + weights.InspectionWeight), nil
+}
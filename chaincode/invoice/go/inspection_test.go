@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func inspectionArg(inspectionID string, storeID string, severity string) map[string]interface{} {
+	return map[string]interface{}{
+		"doc_type": "", "inspection_id": inspectionID, "store_id": storeID, "date": "2026-02-27",
+		"checks_performed": []string{"cold_storage", "expiry_labels"}, "findings": "", "severity": severity,
+		"auditor_msp_id": "", "auditor_id": "", "recorded_at": "",
+	}
+}
+
+func TestInspections(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 10, 1)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 5, 2)))
+
+	f.fail(f.org1, "not permitted", "RecordInspection", inspectionArg("I1", "S1", severityMajor))
+	f.fail(f.auditor, "unknown severity", "RecordInspection", inspectionArg("I1", "S1", "grave"))
+	undated := inspectionArg("I1", "S1", severityMajor)
+	undated["date"] = "27/02/2026"
+	f.fail(f.auditor, "invalid date", "RecordInspection", undated)
+	f.fail(f.auditor, "Store not found for ID: S9", "RecordInspection", inspectionArg("I1", "S9", severityMajor))
+	f.ok(f.auditor, "RecordInspection", inspectionArg("I1", "S1", severityMajor))
+	f.fail(f.auditor, "already recorded", "RecordInspection", inspectionArg("I1", "S1", severityNone))
+
+	var inspections []Inspection
+	f.get(&inspections, f.regulator, "GetStoreInspections", "S1")
+	if len(inspections) != 1 || inspections[0].AuditorMSPID != "AuditMSP" || inspections[0].Severity != severityMajor {
+		t.Fatalf("unexpected inspections %+v", inspections)
+	}
+
+	// A store whose ID extends another's keeps its own inspections
+	f.ok(f.org1, "RegisterStore", storeArg("S1_1", "east", "small"))
+	f.ok(f.auditor, "RecordInspection", inspectionArg("I2", "S1_1", severityCritical))
+	inspections = nil
+	f.get(&inspections, f.regulator, "GetStoreInspections", "S1")
+	if len(inspections) != 1 || inspections[0].InspectionID != "I1" {
+		t.Fatalf("inspections of another store picked up %+v", inspections)
+	}
+
+	// 50% wastage less an ethics index of 0.7 * 100 for validity and 0.3 * 40 for the major finding
+	var summaries []StoreIndexSummary
+	f.get(&summaries, f.regulator, "QueryStoreIndices", StoreFilter{Region: "north"})
+	if len(summaries) != 1 || math.Abs(summaries[0].StoreRISE.TotalRISEIndex-(50-82)) > 1e-9 {
+		t.Fatalf("unexpected RISE index %+v", summaries)
+	}
+
+	weights := map[string]interface{}{
+		"doc_type": "", "validity_weight": 1, "inspection_weight": 1, "updated_by": "", "updated_at": "",
+		"severity_scores": map[string]float64{severityNone: 100, severityMinor: 80, severityMajor: 50},
+	}
+	f.fail(f.regulator, "for severity \"critical\"", "SetEthicsWeights", weights)
+	weights["severity_scores"].(map[string]float64)[severityCritical] = 0
+	f.fail(f.auditor, "not permitted", "SetEthicsWeights", weights)
+	f.ok(f.regulator, "SetEthicsWeights", weights)
+	var stored EthicsWeights
+	f.get(&stored, f.auditor, "GetEthicsWeights")
+	if stored.InspectionWeight != 1 || stored.SeverityScores[severityMajor] != 50 {
+		t.Fatalf("unexpected weights %+v", stored)
+	}
+}
@@ -17,26 +17,59 @@ type SmartContract struct {
 
 // Invoice structure
 type Invoice struct {
-	InvoiceID       string  `json:"invoice_id"`
-	StoreID         string  `json:"store_id"`
-	Date            string  `json:"date"`
-	Items           []Item  `json:"items"`
-	TotalAmount     float64 `json:"total_amount"`
-	TransactionHash string  `json:"transaction_hash"`
-	Timestamp       string  `json:"timestamp"`
-	InvoiceType     string  `json:"invoice_type"` // 'purchase' or 'sales'
-	PrevBlockHash   string  `json:"prev_block_hash"`
+	InvoiceID        string           `json:"invoice_id"`
+	StoreID          string           `json:"store_id"`
+	Date             string           `json:"date"`
+	Items            []Item           `json:"items,omitempty" metadata:",optional"`
+	Currency         string           `json:"currency,omitempty" metadata:",optional"`           // ISO 4217 code of every amount on the invoice
+	TotalAmount      float64          `json:"total_amount,omitempty" metadata:",optional"`       // legacy major-unit amount, decoded into TotalAmountMinor
+	TotalAmountMinor int64            `json:"total_amount_minor,omitempty" metadata:",optional"` // line totals plus tax
+	TaxAmountMinor   int64            `json:"tax_amount_minor,omitempty" metadata:",optional"`
+	TaxSummary       []TaxSummaryLine `json:"tax_summary,omitempty" metadata:",optional"`
+	TransactionHash  string           `json:"transaction_hash"`
+	Timestamp        string           `json:"timestamp"`
+	InvoiceType      string           `json:"invoice_type"` // 'purchase' or 'sales'
+	PrevBlockHash    string           `json:"prev_block_hash"`
+	SupplierMSPID    string           `json:"supplier_msp_id,omitempty" metadata:",optional"` // supplier org that must acknowledge a purchase
+	Status           string           `json:"status,omitempty" metadata:",optional"`          // 'pending' until the supplier acknowledges, then 'confirmed'; 'held' on a failed three-way match; 'voided' once voided
+	AcknowledgedBy   string           `json:"acknowledged_by,omitempty" metadata:",optional"`
+	AcknowledgedAt   string           `json:"acknowledged_at,omitempty" metadata:",optional"`
+	IdempotencyKey   string           `json:"idempotency_key,omitempty" metadata:",optional"`   // chosen by the client, reused on retries
+	ContentHash      string           `json:"content_hash,omitempty" metadata:",optional"`      // hash of the submitted content
+	Version          int              `json:"version,omitempty" metadata:",optional"`           // incremented by each amendment
+	DeviceID         string           `json:"device_id,omitempty" metadata:",optional"`         // registered POS terminal or RFID reader that produced the invoice
+	DeviceSignature  string           `json:"device_signature,omitempty" metadata:",optional"`  // base64 signature of the canonical invoice by that device
+	PricingHash      string           `json:"pricing_hash,omitempty" metadata:",optional"`      // hash of the amounts kept in the store's pricing collection
+	TerminalID       string           `json:"terminal_id,omitempty" metadata:",optional"`       // till or reader numbering the invoice
+	SequenceNumber   int64            `json:"sequence_number,omitempty" metadata:",optional"`   // gapless per terminal, starting at 1
+	PurchaseOrderID  string           `json:"purchase_order_id,omitempty" metadata:",optional"` // order a purchase invoice bills
+	GoodsReceiptID   string           `json:"goods_receipt_id,omitempty" metadata:",optional"`  // receipt of the goods it bills
 }
 
+// Invoice states
+const (
+	invoicePending   = "pending"
+	invoiceConfirmed = "confirmed"
+	invoiceVoided    = "voided"
+	invoiceHeld      = "held" // failed the three-way match, released by a manager or auditor
+)
+
 // Item structure
 type Item struct {
-	ItemID       string  `json:"item_id"`
-	ItemName     string  `json:"item_name"`
-	Quantity     float64 `json:"quantity"`
-	PricePerUnit float64 `json:"price_per_unit"`
-	TotalPrice   float64 `json:"total_price"`
-	ExpiryDate   string  `json:"expiry_date"`
-	InvoiceType  string  `json:"invoice_type"` // 'purchase' or 'sales'
+	ItemID             string  `json:"item_id"`
+	ItemName           string  `json:"item_name"`
+	Quantity           float64 `json:"quantity"`
+	Unit               string  `json:"unit,omitempty" metadata:",optional"`           // defaults to the catalogue base unit
+	BaseQuantity       float64 `json:"base_quantity,omitempty" metadata:",optional"`  // quantity converted to the catalogue base unit
+	PricePerUnit       float64 `json:"price_per_unit,omitempty" metadata:",optional"` // legacy major-unit price, decoded into PricePerUnitMinor
+	TotalPrice         float64 `json:"total_price,omitempty" metadata:",optional"`    // legacy major-unit total, decoded into TotalPriceMinor
+	PricePerUnitMinor  int64   `json:"price_per_unit_minor,omitempty" metadata:",optional"`
+	TotalPriceMinor    int64   `json:"total_price_minor,omitempty" metadata:",optional"` // exclusive of tax
+	TaxCategory        string  `json:"tax_category,omitempty" metadata:",optional"`
+	TaxRateBasisPoints int64   `json:"tax_rate_basis_points,omitempty" metadata:",optional"`
+	TaxAmountMinor     int64   `json:"tax_amount_minor,omitempty" metadata:",optional"`
+	ExpiryDate         string  `json:"expiry_date"`
+	InvoiceType        string  `json:"invoice_type"` // 'purchase' or 'sales'
 }
 
 // ItemKey structure
@@ -51,6 +84,9 @@ type WastageIndex struct {
 	Wastage       float64 `json:"wastage"`
 	TotalPurchase float64 `json:"total_purchase"`
 	TotalSales    float64 `json:"total_sales"`
+	TransfersIn   float64 `json:"transfers_in,omitempty" metadata:",optional"`
+	TransfersOut  float64 `json:"transfers_out,omitempty" metadata:",optional"`
+	Adjustments   float64 `json:"adjustments,omitempty" metadata:",optional"` // stocktake corrections, negative for shrinkage
 }
 
 // RISEIndex structure
@@ -75,169 +111,427 @@ type TransactionValidity struct {
 	InvalidTransactions int     `json:"invalid_transactions"`
 }
 
-// Create or update an invoice and recalculate indices
+// Invalidation reasons
+const (
+	invalidExpired  = "expired"
+	invalidOversold = "oversold"
+)
+
+// Invalidation states
+const (
+	invalidationActive   = "active"
+	invalidationReversed = "reversed"
+)
+
+// Invalidation structure
+type Invalidation struct {
+	DocType        string  `json:"doc_type"`
+	InvalidationID string  `json:"invalidation_id"`
+	StoreID        string  `json:"store_id"`
+	InvoiceID      string  `json:"invoice_id"`
+	ItemKey        ItemKey `json:"item_key"`
+	Reason         string  `json:"reason"` // 'expired' or 'oversold'
+	InvalidatedAt  string  `json:"invalidated_at"`
+	Status         string  `json:"status,omitempty" metadata:",optional"` // 'active' until a dispute reverses it
+}
+
+// Create or update an invoice and record the stock it moves
 func (s *SmartContract) CreateOrUpdateInvoice(ctx contractapi.TransactionContextInterface, invoice Invoice) error {
-	// Generate the hash of the current block
-	currentBlockHash := generateBlockHash(invoice)
-	invoice.TransactionHash = currentBlockHash
+	return s.recordInvoice(ctx, invoice, false)
+}
+
+// Retrieve the current version of an invoice
+func (s *SmartContract) GetInvoice(ctx contractapi.TransactionContextInterface, invoiceID string) (Invoice, error) {
+	invoiceJSON, err := ctx.GetStub().GetState(invoiceID)
+	if err != nil {
+		return Invoice{}, err
+	}
+	if invoiceJSON == nil {
+		return Invoice{}, fmt.Errorf("Invoice not found for ID: %s", invoiceID)
+	}
+
+	var invoice Invoice
+	err = json.Unmarshal(invoiceJSON, &invoice)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	return invoice, nil
+}
+
+// Validate and save an invoice; only an amendment may replace an existing invoice with different content
+func (s *SmartContract) recordInvoice(ctx contractapi.TransactionContextInterface, invoice Invoice, amend bool) error {
+	// Submissions must come from a registered device, amendments are approved by people instead
+	err := s.prepareInvoice(ctx, &invoice, !amend)
+	if err != nil {
+		return err
+	}
+
+	// An exact replay of a recorded submission succeeds without effect
+	replay, err := s.checkIdempotencyKey(ctx, invoice, amend)
+	if err != nil || replay {
+		return err
+	}
 
 	// Retrieve the previous block hash for provenance
-	prevBlockHash, err := ctx.GetStub().GetState(invoice.InvoiceID)
+	invoice.PrevBlockHash = ""
+	invoice.Version = 1
+	var existingInvoice Invoice
+	existingInvoiceJSON, err := ctx.GetStub().GetState(invoice.InvoiceID)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve previous block hash: %s", err.Error())
 	}
-	if prevBlockHash != nil {
-		invoice.PrevBlockHash = string(prevBlockHash)
+	if existingInvoiceJSON != nil {
+		err = json.Unmarshal(existingInvoiceJSON, &existingInvoice)
+		if err != nil {
+			return err
+		}
+
+		if storedContentHash(existingInvoice) == invoice.ContentHash {
+			return nil
+		}
+		if existingInvoice.Status == invoiceVoided {
+			return fmt.Errorf("invoice %s is voided, restore it before amending", invoice.InvoiceID)
+		}
+		if !amend {
+			return fmt.Errorf("invoice %s already exists with different content, amend it with AmendInvoice", invoice.InvoiceID)
+		}
+		if existingInvoice.StoreID != invoice.StoreID {
+			return fmt.Errorf("invoice %s belongs to store %s", invoice.InvoiceID, existingInvoice.StoreID)
+		}
+		if existingInvoice.Date != invoice.Date || existingInvoice.Timestamp != invoice.Timestamp {
+			return fmt.Errorf("amendment of invoice %s cannot change its date or timestamp", invoice.InvoiceID)
+		}
+		if existingInvoice.TerminalID != invoice.TerminalID || existingInvoice.SequenceNumber != invoice.SequenceNumber {
+			return fmt.Errorf("amendment of invoice %s cannot change its terminal or sequence number", invoice.InvoiceID)
+		}
+
+		// The replaced version is archived unchanged and the new one links to its hash
+		err = s.archiveInvoiceVersion(ctx, existingInvoice)
+		if err != nil {
+			return err
+		}
+		invoice.PrevBlockHash = existingInvoice.TransactionHash
+		invoice.Version = invoiceVersion(existingInvoice) + 1
 	}
 
-	// Validate transaction
-	err = s.ValidateTransaction(ctx, invoice)
+	// New invoices must be recorded within the policy window of their timestamp
+	var delayMinutes int
+	if !amend {
+		delayMinutes, err = s.checkRecordingTime(ctx, invoice)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Generate the hash of the current block
+	currentBlockHash := generateBlockHash(invoice)
+	invoice.TransactionHash = currentBlockHash
+
+	// Purchases naming a supplier are held until that supplier acknowledges them
+	invoice.Status = ""
+	invoice.AcknowledgedBy = ""
+	invoice.AcknowledgedAt = ""
+	if invoice.InvoiceType == "purchase" && invoice.SupplierMSPID != "" {
+		invoice.Status = invoicePending
+	}
+
+	// Purchases that do not match their order and receipt are held out of inventory
+	matched, err := s.matchPurchaseInvoice(ctx, invoice)
 	if err != nil {
 		return err
 	}
+	if !matched {
+		invoice.Status = invoiceHeld
+	}
 
-	// Convert invoice to JSON and save to ledger
-	invoiceJSON, err := json.Marshal(invoice)
+	// Validate transaction
+	err = s.validateTransaction(ctx, invoice)
 	if err != nil {
 		return err
 	}
 
-	err = ctx.GetStub().PutState(invoice.InvoiceID, invoiceJSON)
+	// Flag quantities, prices and timings that stand out from the store's history
+	err = s.flagAnomalies(ctx, invoice, existingInvoice)
 	if err != nil {
 		return err
 	}
 
-	// Calculate wastage, RISE, and ethics index
-	wastageIndices, err := s.CalculateWastageIndex(ctx, invoice.StoreID, invoice.Items)
+	// Flag deliveries with less shelf life left than the catalogue requires
+	err = s.checkReceivedShelfLife(ctx, invoice)
 	if err != nil {
 		return err
 	}
 
-	riseIndex, err := s.CalculateRISEIndex(ctx, invoice.StoreID, wastageIndices)
+	// Convert invoice to JSON and save to ledger
+	invoiceJSON, err := json.Marshal(invoice)
 	if err != nil {
 		return err
 	}
 
-	ethicsIndex, err := s.CalculateEthicsIndex(ctx, invoice.StoreID, wastageIndices)
+	err = ctx.GetStub().PutState(invoice.InvoiceID, invoiceJSON)
 	if err != nil {
 		return err
 	}
 
-	// Update ledger with new indices
-	for _, wastageIndex := range wastageIndices {
-		err = s.UpdateLedgerWithIndices(ctx, invoice.StoreID, riseIndex, wastageIndex, ethicsIndex, TransactionValidity{})
+	// Index new invoices by store and date for anchoring, an amendment cannot change either
+	if existingInvoiceJSON == nil {
+		dayKey, err := invoiceDayKey(ctx, invoice.StoreID, invoice.Date, invoice.InvoiceID)
+		if err != nil {
+			return err
+		}
+		err = ctx.GetStub().PutState(dayKey, []byte{0x00})
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
-}
-
-// Validate a transaction and flag it as invalid if necessary
-func (s *SmartContract) ValidateTransaction(ctx contractapi.TransactionContextInterface, invoice Invoice) error {
-	currentDate := time.Now().Format("2006-01-02")
+	err = s.putIdempotencyRecord(ctx, invoice)
+	if err != nil {
+		return err
+	}
 
-	for _, item := range invoice.Items {
-		// Check if the item has expired
-		if currentDate > item.ExpiryDate {
-			err := s.MarkTransactionInvalid(ctx, invoice.StoreID, ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate})
-			if err != nil {
-				return fmt.Errorf("transaction is invalid due to expired item: %s", err.Error())
-			}
+	if !amend {
+		err = s.recordSequenceNumber(ctx, invoice)
+		if err != nil {
+			return err
 		}
-		// Check if total sales exceed total purchases
-		totalPurchases := s.GetTotalPurchases(ctx, invoice.StoreID, ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate})
-		totalSales := s.GetTotalSales(ctx, invoice.StoreID, ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate})
+	}
 
-		if totalSales > totalPurchases {
-			err := s.MarkTransactionInvalid(ctx, invoice.StoreID, ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate})
-			if err != nil {
-				return fmt.Errorf("transaction is invalid due to sales exceeding purchases: %s", err.Error())
-			}
+	if delayMinutes > 0 {
+		err = s.putLateRecording(ctx, invoice, delayMinutes)
+		if err != nil {
+			return err
 		}
 	}
-	return nil
+
+	// Record the stock moved, including item keys dropped by an amendment; the indices are derived from it when queried
+	return s.recordStockMovements(ctx, existingInvoice, invoice)
 }
 
-// Mark a transaction as invalid and delete it while maintaining provenance
-func (s *SmartContract) MarkTransactionInvalid(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) error {
-	// Retrieve the invoice to be invalidated
-	invoiceJSON, err := ctx.GetStub().GetState(itemKey.ItemID)
+// Validate an invoice against the store, catalogue and tax tables and fingerprint its content,
+// checking its device signature when signed is set
+func (s *SmartContract) prepareInvoice(ctx contractapi.TransactionContextInterface, invoice *Invoice, signed bool) error {
+	if len(invoice.Items) == 0 {
+		return fmt.Errorf("invoice %s has no items", invoice.InvoiceID)
+	}
+
+	// Only registered, active stores may record invoices
+	store, err := s.requireActiveStore(ctx, invoice.StoreID)
 	if err != nil {
 		return err
 	}
-	if invoiceJSON == nil {
-		return fmt.Errorf("Invoice not found for ItemID: %s", itemKey.ItemID)
+
+	// Stores with a pricing collection send amounts privately
+	pricing, err := s.mergeInvoicePricing(ctx, store, invoice)
+	if err != nil {
+		return err
 	}
 
-	var invoice Invoice
-	err = json.Unmarshal(invoiceJSON, &invoice)
+	if signed {
+		err = s.verifyDeviceSignature(ctx, *invoice)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Every line must reference an item in the product catalogue and is converted to its base unit
+	err = s.validateItemsAgainstCatalogue(ctx, invoice.Items)
 	if err != nil {
 		return err
 	}
 
-	// Update the transaction validity
-	err = s.UpdateTransactionValidity(ctx, storeID, itemKey, false)
+	// Tax is charged at the rates of the store's region
+	err = s.validateInvoiceTax(ctx, store.Region, invoice)
 	if err != nil {
 		return err
 	}
 
-	// Log the invalid transaction
-	err = ctx.GetStub().PutState(fmt.Sprintf("INVALID_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate), invoiceJSON)
+	// Line and invoice totals must add up exactly in minor units
+	err = validateInvoiceAmounts(*invoice)
 	if err != nil {
 		return err
 	}
 
-	// Delete the invoice while maintaining provenance
-	err = ctx.GetStub().DelState(itemKey.ItemID)
+	// Only the hash of private amounts stays on the public ledger
+	err = s.splitInvoicePricing(ctx, store, invoice, pricing)
 	if err != nil {
 		return err
 	}
 
+	// Fingerprint the submission so that retries can be recognised
+	invoice.ContentHash = contentHash(*invoice)
+
 	return nil
 }
 
-// Update the validity of a transaction
-func (s *SmartContract) UpdateTransactionValidity(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey, isValid bool) error {
-	// Retrieve current validity data
-	transactionValidityBytes, err := ctx.GetStub().GetState(fmt.Sprintf("TRANSACTION_VALIDITY_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate))
+// Validate a transaction and flag it as invalid if necessary
+func (s *SmartContract) validateTransaction(ctx contractapi.TransactionContextInterface, invoice Invoice) error {
+	// Expiry is judged on the day the transaction is recorded where the store trades, not on the
+	// client-supplied invoice date, which a store could backdate within the recording window
+	store, err := s.GetStore(ctx, invoice.StoreID)
+	if err != nil {
+		return err
+	}
+	location, err := time.LoadLocation(store.TimeZone)
+	if err != nil {
+		return fmt.Errorf("store %s has an invalid time zone: %q", store.StoreID, store.TimeZone)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	currentDate := now.In(location).Format("2006-01-02")
+
+	// The invoice is not saved yet, so the ledger totals still hold the version it replaces
+	previousJSON, err := ctx.GetStub().GetState(invoice.InvoiceID)
 	if err != nil {
 		return err
 	}
+	var previousInvoice Invoice
+	if previousJSON != nil {
+		err = json.Unmarshal(previousJSON, &previousInvoice)
+		if err != nil {
+			return err
+		}
+	}
 
-	var transactionValidity TransactionValidity
-	if transactionValidityBytes != nil {
-		err = json.Unmarshal(transactionValidityBytes, &transactionValidity)
+	for _, item := range invoice.Items {
+		// Check if the item has expired, allowing for shelf life lost to temperature excursions
+		itemKey := ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate}
+		effectiveExpiry, err := s.GetEffectiveExpiry(ctx, invoice.StoreID, itemKey)
 		if err != nil {
 			return err
 		}
-	} else {
-		transactionValidity = TransactionValidity{
-			StoreID: storeID,
-			ItemKey: itemKey,
+		if currentDate > effectiveExpiry.EffectiveExpiryDate {
+			err := s.markTransactionInvalid(ctx, invoice, itemKey, invalidExpired)
+			if err != nil {
+				return fmt.Errorf("transaction is invalid due to expired item: %s", err.Error())
+			}
 		}
 	}
 
-	// Update the count
-	if isValid {
-		transactionValidity.ValidTransactions++
-	} else {
-		transactionValidity.InvalidTransactions++
+	return s.validateStock(ctx, invoice, previousInvoice)
+}
+
+// Reject sales of recalled lots and flag sales that take a lot's book inventory below zero, against
+// the ledger totals that still hold the previous version of the invoice
+func (s *SmartContract) validateStock(ctx contractapi.TransactionContextInterface, invoice Invoice, previousInvoice Invoice) error {
+	if invoice.InvoiceType != "sales" {
+		return nil
+	}
+
+	previousMovements := stockMovements(previousInvoice)
+	movements := stockMovements(invoice)
+	checked := make(map[ItemKey]bool)
+
+	for _, item := range invoice.Items {
+		// A lot on several lines is checked once
+		itemKey := ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate}
+		if checked[itemKey] {
+			continue
+		}
+		checked[itemKey] = true
+
+		recalled, err := s.isRecalled(ctx, itemKey)
+		if err != nil {
+			return err
+		}
+		if recalled {
+			return fmt.Errorf("transaction is invalid due to recalled item: %s with expiry %s", item.ItemID, item.ExpiryDate)
+		}
+
+		// Check if the book inventory, allowing for transfers, recall disposals and stocktakes, goes negative once this invoice is recorded
+		_, book, err := s.bookInventory(ctx, invoice.StoreID, itemKey)
+		if err != nil {
+			return err
+		}
+		available := book - previousMovements[itemKey] + movements[itemKey]
+
+		if available < 0 {
+			err := s.markTransactionInvalid(ctx, invoice, itemKey, invalidOversold)
+			if err != nil {
+				return fmt.Errorf("transaction is invalid due to sales exceeding purchases: %s", err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Quantity of each lot an invoice adds to a store's stock, negative for sales, nothing while it does not count
+func stockMovements(invoice Invoice) map[ItemKey]float64 {
+	movements := make(map[ItemKey]float64)
+	if !countsTowardTotals(invoice) {
+		return movements
+	}
+	for _, item := range invoice.Items {
+		itemKey := ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate}
+		switch invoice.InvoiceType {
+		case "purchase":
+			movements[itemKey] += baseQuantity(item)
+		case "sales":
+			movements[itemKey] -= baseQuantity(item)
+		}
+	}
+	return movements
+}
+
+// Flag an invoice line as invalid, keeping the invoice and recording the invalidation for review
+func (s *SmartContract) markTransactionInvalid(ctx contractapi.TransactionContextInterface, invoice Invoice, itemKey ItemKey, reason string) error {
+	invalidationID := fmt.Sprintf("%s_%s_%s_%s", invoice.InvoiceID, reason, itemKey.ItemID, itemKey.ExpiryDate)
+
+	// A line flagged again, for instance by an amendment, is only counted once
+	existingJSON, err := ctx.GetStub().GetState(invalidationKey(invalidationID))
+	if err != nil {
+		return err
+	}
+	if existingJSON != nil {
+		return nil
 	}
 
-	// Save updated validity data on the ledger
-	transactionValidityBytes, err = json.Marshal(transactionValidity)
+	// Update the transaction validity
+	err = s.updateTransactionValidity(ctx, invoice.StoreID, itemKey, invalidationID, false)
 	if err != nil {
 		return err
 	}
 
-	err = ctx.GetStub().PutState(fmt.Sprintf("TRANSACTION_VALIDITY_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate), transactionValidityBytes)
+	now, err := txTime(ctx)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// Log the invalid transaction
+	invalidation := Invalidation{
+		DocType:        "invalidation",
+		InvalidationID: invalidationID,
+		StoreID:        invoice.StoreID,
+		InvoiceID:      invoice.InvoiceID,
+		ItemKey:        itemKey,
+		Reason:         reason,
+		InvalidatedAt:  now.Format(time.RFC3339),
+		Status:         invalidationActive,
+	}
+
+	invalidationJSON, err := json.Marshal(invalidation)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(invalidationKey(invalidationID), invalidationJSON)
+}
+
+// Ledger key of an invalidated invoice line
+func invalidationKey(invalidationID string) string {
+	return fmt.Sprintf("INVALIDATION_%s", invalidationID)
+}
+
+// Update the validity of a transaction, keyed by the event that changed it
+func (s *SmartContract) updateTransactionValidity(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey, eventID string, isValid bool) error {
+	// Counts are written as deltas so that concurrent transactions do not conflict
+	if isValid {
+		return s.addValidityDelta(ctx, storeID, itemKey, eventID, 1, 0)
+	}
+	return s.addValidityDelta(ctx, storeID, itemKey, eventID, 0, 1)
 }
 
 // Calculate wastage index for given items
@@ -251,18 +545,30 @@ func (s *SmartContract) CalculateWastageIndex(ctx contractapi.TransactionContext
 		totalPurchases := s.GetTotalPurchases(ctx, storeID, itemKey)
 		totalSales := s.GetTotalSales(ctx, storeID, itemKey)
 
-		wastage := totalPurchases - totalSales
+		// Stock transferred between stores is neither wastage for the sender nor a sale
+		transfersIn, transfersOut, err := s.getTotalTransfers(ctx, storeID, itemKey)
+		if err != nil {
+			return nil, err
+		}
 
-		if totalSales > totalPurchases {
-			// Mark transactions as invalid
-			s.MarkTransactionInvalid(ctx, storeID, itemKey)
+		// Stock a stocktake found missing is shrinkage, not wastage
+		shrinkageAdjustments, err := s.getShrinkageAdjustments(ctx, storeID, itemKey)
+		if err != nil {
+			return nil, err
+		}
+		var adjustments float64
+		for _, adjustment := range shrinkageAdjustments {
+			adjustments += adjustment.Adjustment
 		}
 
 		wastageIndex := WastageIndex{
 			ItemKey:       itemKey,
-			Wastage:       wastage / totalPurchases * 100,
+			Wastage:       wastagePercentage(totalPurchases, totalSales, transfersIn, transfersOut, adjustments),
 			TotalPurchase: totalPurchases,
 			TotalSales:    totalSales,
+			TransfersIn:   transfersIn,
+			TransfersOut:  transfersOut,
+			Adjustments:   adjustments,
 		}
 
 		wastageIndices = append(wastageIndices, wastageIndex)
@@ -271,6 +577,19 @@ func (s *SmartContract) CalculateWastageIndex(ctx contractapi.TransactionContext
 	return wastageIndices, nil
 }
 
+// Share of the supply of an item key that was neither sold nor transferred out, in percent; stocktake
+// adjustments correct it to the stock on the shelf, so losses count toward shrinkage instead
+func wastagePercentage(totalPurchases float64, totalSales float64, transfersIn float64, transfersOut float64, adjustments float64) float64 {
+	supply := totalPurchases + transfersIn
+	demand := totalSales + transfersOut
+	if supply <= 0 {
+		return 0
+	}
+
+	// Oversold stock shows as negative wastage; validateTransaction flags the sale that oversold it
+	return (supply - demand + adjustments) / supply * 100
+}
+
 // Calculate RISE index based on wastage index
 func (s *SmartContract) CalculateRISEIndex(ctx contractapi.TransactionContextInterface, storeID string, wastageIndices []WastageIndex) (float64, error) {
 	var totalWastageIndex float64
@@ -290,7 +609,7 @@ func (s *SmartContract) CalculateEthicsIndex(ctx contractapi.TransactionContextI
 
 	for _, wastageIndex := range wastageIndices {
 		itemKey := wastageIndex.ItemKey
-		transactionValidity, err := s.GetTransactionValidity(ctx, storeID, itemKey)
+		transactionValidity, err := s.getTransactionValidityOrEmpty(ctx, storeID, itemKey)
 		if err != nil {
 			return 0, err
 		}
@@ -299,111 +618,45 @@ func (s *SmartContract) CalculateEthicsIndex(ctx contractapi.TransactionContextI
 		totalInvalidTransactions += transactionValidity.InvalidTransactions
 	}
 
-	// Ethics index = valid / (valid + invalid)
-	averageethicsIndex := float64(totalValidTransactions) / float64(totalValidTransactions+totalInvalidTransactions) * 100
+	// Ethics index = valid / (valid + invalid); a store without recorded transactions for these items has nothing to answer for
+	averageethicsIndex := 100.0
+	if totalValidTransactions+totalInvalidTransactions > 0 {
+		averageethicsIndex = float64(totalValidTransactions) / float64(totalValidTransactions+totalInvalidTransactions) * 100
+	}
 
-	return averageethicsIndex, nil
+	// Blend in the outcome of auditor inspections
+	ethicsIndex, err := s.weighInspections(ctx, storeID, averageethicsIndex)
+	if err != nil {
+		return 0, err
+	}
+
+	// Systematically late recording costs points
+	return s.weighLateness(ctx, storeID, ethicsIndex)
 }
 
-// Updates the ledger with calculated indices
-func (s *SmartContract) UpdateLedgerWithIndices(ctx contractapi.TransactionContextInterface, storeID string, riseIndex float64, wastageIndex WastageIndex, averageethicsIndex float64, transactionValidity TransactionValidity) error {
+// Updates the ledger with compacted indices
+func (s *SmartContract) updateLedgerWithIndices(ctx contractapi.TransactionContextInterface, storeID string, riseIndex float64, wastageIndex WastageIndex, averageethicsIndex float64) error {
 	// Update RISE index in ledger
-	riseIndexKey := fmt.Sprintf("RISE_INDEX_%s_%s_%s", storeID, wastageIndex.ItemKey.ItemID, wastageIndex.ItemKey.ExpiryDate)
 	riseIndexData := RISEIndex{
 		StoreID:   storeID,
+		ItemKey:   wastageIndex.ItemKey,
 		RISEIndex: riseIndex - averageethicsIndex,
 	}
 	riseIndexJSON, err := json.Marshal(riseIndexData)
 	if err != nil {
 		return err
 	}
-	err = ctx.GetStub().PutState(riseIndexKey, riseIndexJSON)
+	err = ctx.GetStub().PutState(riseIndexKey(storeID, wastageIndex.ItemKey), riseIndexJSON)
 	if err != nil {
 		return err
 	}
 
 	// Update wastage index in ledger
-	wastageIndexKey := fmt.Sprintf("WASTAGE_INDEX_%s_%s_%s", storeID, wastageIndex.ItemKey.ItemID, wastageIndex.ItemKey.ExpiryDate)
 	wastageIndexJSON, err := json.Marshal(wastageIndex)
 	if err != nil {
 		return err
 	}
-	err = ctx.GetStub().PutState(wastageIndexKey, wastageIndexJSON)
-	if err != nil {
-		return err
-	}
-
-	// Update transaction validity in ledger
-	transactionValidityKey := fmt.Sprintf("TRANSACTION_VALIDITY_%s_%s_%s", storeID, wastageIndex.ItemKey.ItemID, wastageIndex.ItemKey.ExpiryDate)
-	transactionValidityJSON, err := json.Marshal(transactionValidity)
-	if err != nil {
-		return err
-	}
-	err = ctx.GetStub().PutState(transactionValidityKey, transactionValidityJSON)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// Delete an invoice and maintain provenance
-func (s *SmartContract) DeleteInvoice(ctx contractapi.TransactionContextInterface, invoiceID string) error {
-	// Retrieve the invoice to be deleted
-	invoiceJSON, err := ctx.GetStub().GetState(invoiceID)
-	if err != nil {
-		return err
-	}
-	if invoiceJSON == nil {
-		return fmt.Errorf("Invoice not found for ID: %s", invoiceID)
-	}
-
-	var invoice Invoice
-	err = json.Unmarshal(invoiceJSON, &invoice)
-	if err != nil {
-		return err
-	}
-
-	// Delete the invoice from ledger
-	err = ctx.GetStub().DelState(invoiceID)
-	if err != nil {
-		return err
-	}
-
-	// Log the deletion for provenance
-	err = ctx.GetStub().PutState(fmt.Sprintf("DELETED_%s_%s", invoice.StoreID, invoiceID), invoiceJSON)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// Update an existing invoice and recalculate indices
-func (s *SmartContract) UpdateInvoice(ctx contractapi.TransactionContextInterface, invoice Invoice) error {
-	// Retrieve the current invoice to be updated
-	existingInvoiceJSON, err := ctx.GetStub().GetState(invoice.InvoiceID)
-	if err != nil {
-		return err
-	}
-	if existingInvoiceJSON == nil {
-		return fmt.Errorf("Invoice not found for ID: %s", invoice.InvoiceID)
-	}
-
-	var existingInvoice Invoice
-	err = json.Unmarshal(existingInvoiceJSON, &existingInvoice)
-	if err != nil {
-		return err
-	}
-
-	// Delete the existing invoice while maintaining provenance
-	err = s.DeleteInvoice(ctx, invoice.InvoiceID)
-	if err != nil {
-		return err
-	}
-
-	// Create or update the invoice with the new data
-	err = s.CreateOrUpdateInvoice(ctx, invoice)
+	err = ctx.GetStub().PutState(wastageIndexKey(storeID, wastageIndex.ItemKey), wastageIndexJSON)
 	if err != nil {
 		return err
 	}
@@ -432,10 +685,14 @@ func (s *SmartContract) GetTotalPurchases(ctx contractapi.TransactionContextInte
 		if err != nil {
 			return -1
 		}
+		// Archived copies share the invoice shape but only the live record counts
+		if queryResponse.Key != invoice.InvoiceID || !countsTowardTotals(invoice) {
+			continue
+		}
 
 		for _, item := range invoice.Items {
 			if item.ItemID == itemKey.ItemID && item.ExpiryDate == itemKey.ExpiryDate {
-				totalPurchases += item.Quantity
+				totalPurchases += baseQuantity(item)
 			}
 		}
 	}
@@ -464,10 +721,14 @@ func (s *SmartContract) GetTotalSales(ctx contractapi.TransactionContextInterfac
 		if err != nil {
 			return -1
 		}
+		// Archived copies share the invoice shape but only the live record counts
+		if queryResponse.Key != invoice.InvoiceID || !countsTowardTotals(invoice) {
+			continue
+		}
 
 		for _, item := range invoice.Items {
 			if item.ItemID == itemKey.ItemID && item.ExpiryDate == itemKey.ExpiryDate {
-				totalSales += item.Quantity
+				totalSales += baseQuantity(item)
 			}
 		}
 	}
@@ -475,28 +736,33 @@ func (s *SmartContract) GetTotalSales(ctx contractapi.TransactionContextInterfac
 	return totalSales
 }
 
+// Check whether an invoice counts toward purchase and sales totals
+func countsTowardTotals(invoice Invoice) bool {
+	return invoice.Status != invoicePending && invoice.Status != invoiceVoided && invoice.Status != invoiceHeld
+}
+
 // Retrieve transaction validity data from the ledger
 func (s *SmartContract) GetTransactionValidity(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) (TransactionValidity, error) {
-	transactionValidityBytes, err := ctx.GetStub().GetState(fmt.Sprintf("TRANSACTION_VALIDITY_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate))
+	transactionValidity, found, err := s.sumTransactionValidity(ctx, storeID, itemKey)
 	if err != nil {
 		return TransactionValidity{}, err
 	}
-	if transactionValidityBytes == nil {
+	if !found {
 		return TransactionValidity{}, fmt.Errorf("transaction validity not found for ItemKey: %s", itemKey)
 	}
 
-	var transactionValidity TransactionValidity
-	err = json.Unmarshal(transactionValidityBytes, &transactionValidity)
-	if err != nil {
-		return TransactionValidity{}, err
-	}
-
 	return transactionValidity, nil
 }
 
+// Retrieve transaction validity data, defaulting to empty counts for item keys not seen before
+func (s *SmartContract) getTransactionValidityOrEmpty(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) (TransactionValidity, error) {
+	transactionValidity, _, err := s.sumTransactionValidity(ctx, storeID, itemKey)
+	return transactionValidity, err
+}
+
 // Generate a SHA-256 hash for the block
 func generateBlockHash(invoice Invoice) string {
-	record := invoice.InvoiceID + invoice.StoreID + invoice.Date + invoice.Timestamp
+	record := invoice.InvoiceID + invoice.StoreID + invoice.Date + invoice.Timestamp + invoice.PrevBlockHash
 	hash := sha256.New()
 	hash.Write([]byte(record))
 	return hex.EncodeToString(hash.Sum(nil))
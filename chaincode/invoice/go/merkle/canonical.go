@@ -0,0 +1,51 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Invoice fields set by the contract rather than the submitter, left out of the content hash
+var contractFields = []string{
+	"transaction_hash",
+	"prev_block_hash",
+	"status",
+	"acknowledged_by",
+	"acknowledged_at",
+	"idempotency_key",
+	"content_hash",
+	"version",
+	"device_signature",
+}
+
+// ContentHash computes the hex-encoded content hash of an invoice, the leaf of its day's tree, from the
+// invoice JSON returned by the ledger: the fields set by the contract are dropped and the remainder is
+// hashed with its object keys sorted and its numbers as written
+func ContentHash(invoiceJSON []byte) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(invoiceJSON))
+	decoder.UseNumber()
+
+	var invoice map[string]interface{}
+	err := decoder.Decode(&invoice)
+	if err != nil {
+		return "", fmt.Errorf("invalid invoice JSON: %s", err.Error())
+	}
+	if invoice == nil {
+		return "", fmt.Errorf("invoice JSON must be an object")
+	}
+	for _, field := range contractFields {
+		delete(invoice, field)
+	}
+
+	// Maps are encoded with sorted keys at every level
+	canonicalJSON, err := json.Marshal(invoice)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(canonicalJSON)
+	return hex.EncodeToString(hash[:]), nil
+}
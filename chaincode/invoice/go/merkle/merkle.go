@@ -0,0 +1,138 @@
+// Package merkle derives invoice content hashes, builds Merkle trees over them and verifies inclusion proofs
+// offline, without access to the ledger.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Prefixes separating leaf hashes from node hashes, so a node can never be passed off as a leaf
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// Step structure, one sibling on the path from a leaf to the root
+type Step struct {
+	Hash string `json:"hash"` // hex-encoded sibling hash
+	Left bool   `json:"left"` // true when the sibling is on the left
+}
+
+// Root computes the hex-encoded root over hex-encoded content hashes, in the given order
+func Root(contentHashes []string) (string, error) {
+	level, err := leaves(contentHashes)
+	if err != nil {
+		return "", err
+	}
+
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+
+	return hex.EncodeToString(level[0]), nil
+}
+
+// Proof computes the path from the leaf at index to the root
+func Proof(contentHashes []string, index int) ([]Step, error) {
+	level, err := leaves(contentHashes)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(level) {
+		return nil, fmt.Errorf("leaf index %d is outside a tree of %d leaves", index, len(level))
+	}
+
+	path := []Step{}
+	for len(level) > 1 {
+		// A node without a sibling is carried up unchanged and adds no step
+		if index%2 == 1 {
+			path = append(path, Step{Hash: hex.EncodeToString(level[index-1]), Left: true})
+		} else if index+1 < len(level) {
+			path = append(path, Step{Hash: hex.EncodeToString(level[index+1]), Left: false})
+		}
+		level = nextLevel(level)
+		index /= 2
+	}
+
+	return path, nil
+}
+
+// Verify checks that a content hash is included under a root by following its proof
+func Verify(contentHash string, path []Step, root string) (bool, error) {
+	current, err := leafHash(contentHash)
+	if err != nil {
+		return false, err
+	}
+
+	for _, step := range path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false, fmt.Errorf("invalid sibling hash %q: %s", step.Hash, err.Error())
+		}
+		if step.Left {
+			current = nodeHash(sibling, current)
+		} else {
+			current = nodeHash(current, sibling)
+		}
+	}
+
+	expected, err := hex.DecodeString(root)
+	if err != nil {
+		return false, fmt.Errorf("invalid root %q: %s", root, err.Error())
+	}
+
+	return bytes.Equal(current, expected), nil
+}
+
+// Hash every content hash into a leaf
+func leaves(contentHashes []string) ([][]byte, error) {
+	if len(contentHashes) == 0 {
+		return nil, fmt.Errorf("a Merkle tree needs at least one leaf")
+	}
+
+	level := make([][]byte, len(contentHashes))
+	for i, contentHash := range contentHashes {
+		leaf, err := leafHash(contentHash)
+		if err != nil {
+			return nil, err
+		}
+		level[i] = leaf
+	}
+
+	return level, nil
+}
+
+// Pair up the nodes of a level, carrying an odd last node up unchanged
+func nextLevel(level [][]byte) [][]byte {
+	var next [][]byte
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			continue
+		}
+		next = append(next, nodeHash(level[i], level[i+1]))
+	}
+	return next
+}
+
+// Hash a hex-encoded content hash into a leaf
+func leafHash(contentHash string) ([]byte, error) {
+	content, err := hex.DecodeString(contentHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content hash %q: %s", contentHash, err.Error())
+	}
+
+	hash := sha256.Sum256(append([]byte{leafPrefix}, content...))
+	return hash[:], nil
+}
+
+// Hash two child nodes into their parent
+func nodeHash(left []byte, right []byte) []byte {
+	data := append([]byte{nodePrefix}, left...)
+	data = append(data, right...)
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
@@ -0,0 +1,92 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func contentHashes(count int) []string {
+	var hashes []string
+	for i := 0; i < count; i++ {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("invoice %d", i)))
+		hashes = append(hashes, hex.EncodeToString(hash[:]))
+	}
+	return hashes
+}
+
+func TestProofsVerify(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		hashes := contentHashes(count)
+		root, err := Root(hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for index, hash := range hashes {
+			path, err := Proof(hashes, index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := Verify(hash, path, root)
+			if err != nil || !ok {
+				t.Fatalf("leaf %d of %d does not verify: %v", index, count, err)
+			}
+
+			// The proof of one leaf does not prove another
+			other := hashes[(index+1)%count]
+			if count > 1 {
+				ok, _ = Verify(other, path, root)
+				if ok {
+					t.Fatalf("proof of leaf %d of %d verifies leaf %d", index, count, (index+1)%count)
+				}
+			}
+		}
+	}
+}
+
+func TestRootRejectsInvalidLeaves(t *testing.T) {
+	_, err := Root(nil)
+	if err == nil {
+		t.Fatal("empty tree accepted")
+	}
+	_, err = Root([]string{"not hex"})
+	if err == nil {
+		t.Fatal("invalid content hash accepted")
+	}
+	_, err = Proof(contentHashes(3), 3)
+	if err == nil {
+		t.Fatal("leaf index outside the tree accepted")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	hash, err := ContentHash([]byte(`{"invoice_id":"P1","store_id":"S1","items":[{"item_id":"milk","quantity":24}],"status":"pending","version":2,"transaction_hash":"ab"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Key order and contract-set fields do not change the hash
+	same, err := ContentHash([]byte(`{"items":[{"quantity":24,"item_id":"milk"}],"store_id":"S1","invoice_id":"P1","content_hash":"cd"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != hash {
+		t.Fatal("content hash depends on key order or contract-set fields")
+	}
+
+	// Submitted content does
+	different, err := ContentHash([]byte(`{"invoice_id":"P1","store_id":"S1","items":[{"item_id":"milk","quantity":25}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if different == hash {
+		t.Fatal("content hash ignores the quantity")
+	}
+
+	_, err = ContentHash([]byte(`[1]`))
+	if err == nil {
+		t.Fatal("non-object invoice accepted")
+	}
+}
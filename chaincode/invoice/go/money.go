@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Currency assumed for invoices recorded before amounts carried a currency code
+const defaultCurrency = "INR"
+
+// ISO 4217 currencies whose minor unit is not one hundredth
+var currencyExponents = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+}
+
+// Number of decimal places of the minor unit of a currency
+func currencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// Convert a legacy major-unit amount to minor units of a currency
+func toMinorUnits(amount float64, currency string) int64 {
+	return int64(math.Round(amount * math.Pow10(currencyExponent(currency))))
+}
+
+// Check that a currency code has the ISO 4217 shape
+func validCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, c := range currency {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode an invoice, converting legacy float amounts to minor units so arithmetic stays exact
+func (invoice *Invoice) UnmarshalJSON(data []byte) error {
+	type invoiceFields Invoice
+	var decoded invoiceFields
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+	*invoice = Invoice(decoded)
+
+	if invoice.Currency == "" {
+		invoice.Currency = defaultCurrency
+	}
+	if invoice.TotalAmountMinor == 0 && invoice.TotalAmount != 0 {
+		invoice.TotalAmountMinor = toMinorUnits(invoice.TotalAmount, invoice.Currency)
+	}
+	invoice.TotalAmount = 0
+
+	for i, item := range invoice.Items {
+		if item.PricePerUnitMinor == 0 && item.PricePerUnit != 0 {
+			invoice.Items[i].PricePerUnitMinor = toMinorUnits(item.PricePerUnit, invoice.Currency)
+		}
+		if item.TotalPriceMinor == 0 && item.TotalPrice != 0 {
+			invoice.Items[i].TotalPriceMinor = toMinorUnits(item.TotalPrice, invoice.Currency)
+		}
+		invoice.Items[i].PricePerUnit = 0
+		invoice.Items[i].TotalPrice = 0
+	}
+
+	return nil
+}
+
+// Validate that line totals match price times quantity and, with tax, sum to the invoice total
+func validateInvoiceAmounts(invoice Invoice) error {
+	if !validCurrency(invoice.Currency) {
+		return fmt.Errorf("invoice %s has an invalid currency code: %q", invoice.InvoiceID, invoice.Currency)
+	}
+
+	var total int64
+	for _, item := range invoice.Items {
+		if item.PricePerUnitMinor < 0 || item.TotalPriceMinor < 0 {
+			return fmt.Errorf("invoice %s has a negative amount for item %s", invoice.InvoiceID, item.ItemID)
+		}
+
+		// Variable-weight quantities are fractional, so the line total is rounded to the nearest minor unit
+		lineTotal := int64(math.Round(float64(item.PricePerUnitMinor) * item.Quantity))
+		if lineTotal != item.TotalPriceMinor {
+			return fmt.Errorf("invoice %s line %s totals %d %s, expected %d", invoice.InvoiceID, item.ItemID, item.TotalPriceMinor, invoice.Currency, lineTotal)
+		}
+		total += item.TotalPriceMinor
+	}
+
+	total += invoice.TaxAmountMinor
+
+	if total != invoice.TotalAmountMinor {
+		return fmt.Errorf("invoice %s totals %d %s, but its lines and tax sum to %d", invoice.InvoiceID, invoice.TotalAmountMinor, invoice.Currency, total)
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestToMinorUnits(t *testing.T) {
+	for _, test := range []struct {
+		amount   float64
+		currency string
+		expected int64
+	}{
+		{0.1 + 0.2, "INR", 30},
+		{19.99, "USD", 1999},
+		{1500, "JPY", 1500},
+		{1.2345, "KWD", 1235},
+	} {
+		if minor := toMinorUnits(test.amount, test.currency); minor != test.expected {
+			t.Errorf("toMinorUnits(%v, %s) = %d, expected %d", test.amount, test.currency, minor, test.expected)
+		}
+	}
+}
+
+func TestDecodeLegacyAmounts(t *testing.T) {
+	var invoice Invoice
+	err := json.Unmarshal([]byte(`{"invoice_id":"P1","items":[{"item_id":"milk","quantity":3,"price_per_unit":0.1,"total_price":0.3}],"total_amount":0.3}`), &invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice.Currency != defaultCurrency || invoice.TotalAmountMinor != 30 || invoice.TotalAmount != 0 {
+		t.Fatalf("legacy total not converted: %+v", invoice)
+	}
+	if invoice.Items[0].PricePerUnitMinor != 10 || invoice.Items[0].TotalPriceMinor != 30 || invoice.Items[0].PricePerUnit != 0 {
+		t.Fatalf("legacy line not converted: %+v", invoice.Items[0])
+	}
+
+	// Minor-unit amounts are kept as submitted
+	err = json.Unmarshal([]byte(`{"invoice_id":"P2","currency":"JPY","items":[{"item_id":"milk","quantity":3,"price_per_unit_minor":120,"total_price_minor":360}],"total_amount_minor":360}`), &invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice.Currency != "JPY" || invoice.TotalAmountMinor != 360 || invoice.Items[0].PricePerUnitMinor != 120 {
+		t.Fatalf("minor amounts changed: %+v", invoice)
+	}
+}
+
+func TestValidateInvoiceAmounts(t *testing.T) {
+	valid := Invoice{
+		InvoiceID:        "P1",
+		Currency:         "INR",
+		Items:            []Item{{ItemID: "cheese", Quantity: 0.333, PricePerUnitMinor: 1000, TotalPriceMinor: 333}},
+		TaxAmountMinor:   17,
+		TotalAmountMinor: 350,
+	}
+	err := validateInvoiceAmounts(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for expected, mutate := range map[string]func(*Invoice){
+		"invalid currency code":      func(invoice *Invoice) { invoice.Currency = "inr" },
+		"negative amount":            func(invoice *Invoice) { invoice.Items[0].PricePerUnitMinor = -1 },
+		"line cheese totals 334 INR": func(invoice *Invoice) { invoice.Items[0].TotalPriceMinor = 334 },
+		"lines and tax sum to 350":   func(invoice *Invoice) { invoice.TotalAmountMinor = 349 },
+	} {
+		invoice := valid
+		invoice.Items = append([]Item(nil), valid.Items...)
+		mutate(&invoice)
+		err = validateInvoiceAmounts(invoice)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %v, expected %q", err, expected)
+		}
+	}
+}
+
+func TestInvoiceAmounts(t *testing.T) {
+	f := newFixture(t)
+	purchase := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 3, 0.1))
+	purchase["total_amount"] = 0.31
+	f.fail(f.org1, "totals 31 INR, but its lines and tax sum to 30", "CreateOrUpdateInvoice", purchase)
+
+	purchase["total_amount"] = 0.1 + 0.2
+	f.ok(f.org1, "CreateOrUpdateInvoice", purchase)
+	var invoice Invoice
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.TotalAmountMinor != 30 || invoice.Items[0].TotalPriceMinor != 30 || invoice.Currency != "INR" {
+		t.Fatalf("unexpected amounts %+v", invoice)
+	}
+}
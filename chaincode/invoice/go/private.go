@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Transient map entry carrying the pricing of an invoice for stores with a pricing collection
+const transientPricingKey = "invoice_pricing"
+
+// InvoicePricing structure, kept in the store's private data collection
+type InvoicePricing struct {
+	DocType          string           `json:"doc_type"`
+	InvoiceID        string           `json:"invoice_id"`
+	StoreID          string           `json:"store_id"`
+	TotalAmountMinor int64            `json:"total_amount_minor"`
+	TaxAmountMinor   int64            `json:"tax_amount_minor"`
+	TaxSummary       []TaxSummaryLine `json:"tax_summary,omitempty" metadata:",optional"`
+	Lines            []LinePricing    `json:"lines,omitempty" metadata:",optional"` // one per invoice item, in the same order
+	SupplierTerms    string           `json:"supplier_terms,omitempty" metadata:",optional"`
+	Salt             string           `json:"salt,omitempty" metadata:",optional"` // hex-encoded random value chosen by the client so the public hash cannot be guessed
+}
+
+// Fewest random bytes a pricing salt must carry to keep the amounts from being guessed from the public hash
+const minPricingSaltBytes = 16
+
+// LinePricing structure
+type LinePricing struct {
+	ItemID            string `json:"item_id"`
+	ExpiryDate        string `json:"expiry_date"`
+	PricePerUnitMinor int64  `json:"price_per_unit_minor"`
+	TotalPriceMinor   int64  `json:"total_price_minor"`
+	TaxAmountMinor    int64  `json:"tax_amount_minor"`
+}
+
+// Private data key of the pricing of an invoice, addressed by its hash so every version keeps its own
+func invoicePricingKey(invoiceID string, pricingHash string) string {
+	return fmt.Sprintf("INVOICE_PRICING_%s_%s", invoiceID, pricingHash)
+}
+
+// Retrieve the pricing of the current version of an invoice, restricted to the store's organisation or an auditor
+func (s *SmartContract) GetInvoicePricing(ctx contractapi.TransactionContextInterface, invoiceID string) (InvoicePricing, error) {
+	invoice, err := s.GetInvoice(ctx, invoiceID)
+	if err != nil {
+		return InvoicePricing{}, err
+	}
+	if invoice.PricingHash == "" {
+		return InvoicePricing{}, fmt.Errorf("invoice %s is priced on the public ledger", invoiceID)
+	}
+
+	store, err := s.GetStore(ctx, invoice.StoreID)
+	if err != nil {
+		return InvoicePricing{}, err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil && requireRole(ctx, roleAuditor) != nil {
+		return InvoicePricing{}, err
+	}
+
+	return s.getInvoicePricing(ctx, store, invoice)
+}
+
+// Merge the private pricing of an invoice into it, taken from the transient map or, for an invoice
+// prepared earlier, from the store's collection; stores without a collection are priced publicly
+func (s *SmartContract) mergeInvoicePricing(ctx contractapi.TransactionContextInterface, store Store, invoice *Invoice) (InvoicePricing, error) {
+	if store.PricingCollection == "" {
+		return InvoicePricing{}, nil
+	}
+
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return InvoicePricing{}, fmt.Errorf("failed to read transient data: %s", err.Error())
+	}
+
+	var pricing InvoicePricing
+	pricingJSON, ok := transientMap[transientPricingKey]
+	switch {
+	case ok:
+		err = json.Unmarshal(pricingJSON, &pricing)
+		if err != nil {
+			return InvoicePricing{}, fmt.Errorf("failed to decode the pricing of invoice %s: %s", invoice.InvoiceID, err.Error())
+		}
+	case invoice.PricingHash != "":
+		pricing, err = s.getInvoicePricing(ctx, store, *invoice)
+		if err != nil {
+			return InvoicePricing{}, err
+		}
+	default:
+		return InvoicePricing{}, fmt.Errorf("store %s keeps prices private, pass the pricing of invoice %s in the transient map under %q", store.StoreID, invoice.InvoiceID, transientPricingKey)
+	}
+
+	// Prices sent in the clear would end up in the transaction on every peer
+	if invoice.TotalAmountMinor != 0 || invoice.TaxAmountMinor != 0 || len(invoice.TaxSummary) > 0 {
+		return InvoicePricing{}, fmt.Errorf("store %s keeps prices private, invoice %s must not carry amounts", store.StoreID, invoice.InvoiceID)
+	}
+	for _, item := range invoice.Items {
+		if item.PricePerUnitMinor != 0 || item.TotalPriceMinor != 0 || item.TaxAmountMinor != 0 {
+			return InvoicePricing{}, fmt.Errorf("store %s keeps prices private, invoice %s line %s must not carry amounts", store.StoreID, invoice.InvoiceID, item.ItemID)
+		}
+	}
+
+	if len(pricing.Lines) != len(invoice.Items) {
+		return InvoicePricing{}, fmt.Errorf("pricing of invoice %s has %d lines, the invoice has %d", invoice.InvoiceID, len(pricing.Lines), len(invoice.Items))
+	}
+	for i, line := range pricing.Lines {
+		item := &invoice.Items[i]
+		if line.ItemID != item.ItemID || line.ExpiryDate != item.ExpiryDate {
+			return InvoicePricing{}, fmt.Errorf("pricing of invoice %s line %d is for %s with expiry %s, the invoice has %s with expiry %s", invoice.InvoiceID, i+1, line.ItemID, line.ExpiryDate, item.ItemID, item.ExpiryDate)
+		}
+		item.PricePerUnitMinor = line.PricePerUnitMinor
+		item.TotalPriceMinor = line.TotalPriceMinor
+		item.TaxAmountMinor = line.TaxAmountMinor
+	}
+	invoice.TotalAmountMinor = pricing.TotalAmountMinor
+	invoice.TaxAmountMinor = pricing.TaxAmountMinor
+	invoice.TaxSummary = pricing.TaxSummary
+
+	return pricing, nil
+}
+
+// Move the validated amounts of an invoice into the store's collection, leaving their hash on the invoice;
+// supplier terms and salt are taken from the submitted pricing
+func (s *SmartContract) splitInvoicePricing(ctx contractapi.TransactionContextInterface, store Store, invoice *Invoice, submitted InvoicePricing) error {
+	invoice.PricingHash = ""
+	if store.PricingCollection == "" {
+		return nil
+	}
+
+	// Without enough randomness the few plausible amounts could be hashed and matched against the public hash
+	salt, err := hex.DecodeString(submitted.Salt)
+	if err != nil || len(salt) < minPricingSaltBytes {
+		return fmt.Errorf("pricing of invoice %s needs a salt of at least %d random bytes, hex-encoded", invoice.InvoiceID, minPricingSaltBytes)
+	}
+
+	pricing := InvoicePricing{
+		DocType:          "invoice_pricing",
+		InvoiceID:        invoice.InvoiceID,
+		StoreID:          invoice.StoreID,
+		TotalAmountMinor: invoice.TotalAmountMinor,
+		TaxAmountMinor:   invoice.TaxAmountMinor,
+		TaxSummary:       invoice.TaxSummary,
+		SupplierTerms:    submitted.SupplierTerms,
+		Salt:             submitted.Salt,
+	}
+	for i, item := range invoice.Items {
+		pricing.Lines = append(pricing.Lines, LinePricing{
+			ItemID:            item.ItemID,
+			ExpiryDate:        item.ExpiryDate,
+			PricePerUnitMinor: item.PricePerUnitMinor,
+			TotalPriceMinor:   item.TotalPriceMinor,
+			TaxAmountMinor:    item.TaxAmountMinor,
+		})
+		invoice.Items[i].PricePerUnitMinor = 0
+		invoice.Items[i].TotalPriceMinor = 0
+		invoice.Items[i].TaxAmountMinor = 0
+	}
+	invoice.TotalAmountMinor = 0
+	invoice.TaxAmountMinor = 0
+	invoice.TaxSummary = nil
+
+	pricingJSON, err := json.Marshal(pricing)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(pricingJSON)
+	invoice.PricingHash = hex.EncodeToString(hash[:])
+
+	// Written under its hash, so saving the same pricing again is harmless
+	return ctx.GetStub().PutPrivateData(store.PricingCollection, invoicePricingKey(invoice.InvoiceID, invoice.PricingHash), pricingJSON)
+}
+
+// Load the private pricing of an invoice and check it against the hash on the public ledger
+func (s *SmartContract) getInvoicePricing(ctx contractapi.TransactionContextInterface, store Store, invoice Invoice) (InvoicePricing, error) {
+	if store.PricingCollection == "" {
+		return InvoicePricing{}, fmt.Errorf("store %s has no pricing collection", store.StoreID)
+	}
+
+	pricingJSON, err := ctx.GetStub().GetPrivateData(store.PricingCollection, invoicePricingKey(invoice.InvoiceID, invoice.PricingHash))
+	if err != nil {
+		return InvoicePricing{}, fmt.Errorf("failed to read the pricing of invoice %s: %s", invoice.InvoiceID, err.Error())
+	}
+	if pricingJSON == nil {
+		return InvoicePricing{}, fmt.Errorf("Pricing not found for invoice %s on this peer", invoice.InvoiceID)
+	}
+
+	hash := sha256.Sum256(pricingJSON)
+	if hex.EncodeToString(hash[:]) != invoice.PricingHash {
+		return InvoicePricing{}, fmt.Errorf("pricing of invoice %s does not match its public hash", invoice.InvoiceID)
+	}
+
+	var pricing InvoicePricing
+	err = json.Unmarshal(pricingJSON, &pricing)
+	if err != nil {
+		return InvoicePricing{}, err
+	}
+
+	return pricing, nil
+}
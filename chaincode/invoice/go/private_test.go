@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Invoice for a store with a pricing collection, carrying quantities but no amounts
+func privateInvoiceArg(invoiceID string, quantity float64) map[string]interface{} {
+	invoice := invoiceArg(invoiceID, "S1", "purchase", lineArg("milk", "2027-03-10", quantity, 0))
+	delete(invoice, "total_amount")
+	for _, line := range invoice["items"].([]map[string]interface{}) {
+		delete(line, "price_per_unit")
+		delete(line, "total_price")
+	}
+	return invoice
+}
+
+// Transient pricing of a single-line milk invoice
+func pricingArg(invoiceID string, quantity int64, priceMinor int64) map[string]interface{} {
+	return map[string]interface{}{
+		transientPricingKey: InvoicePricing{
+			InvoiceID: invoiceID, StoreID: "S1", TotalAmountMinor: quantity * priceMinor,
+			Lines:         []LinePricing{{ItemID: "milk", ExpiryDate: "2027-03-10", PricePerUnitMinor: priceMinor, TotalPriceMinor: quantity * priceMinor}},
+			SupplierTerms: "net 30", Salt: pricingSalt(invoiceID),
+		},
+	}
+}
+
+// Salt of 32 bytes, fixed per invoice so that tests are repeatable
+func pricingSalt(invoiceID string) string {
+	salt := sha256.Sum256([]byte("salt-" + invoiceID))
+	return hex.EncodeToString(salt[:])
+}
+
+func TestPrivatePricing(t *testing.T) {
+	f := newFixture(t)
+	// The pricing collection is a regulator control, a store cannot take its amounts off the public ledger itself
+	store := storeArg("S1", "north", "large")
+	store["pricing_collection"] = "pricing_S1"
+	f.ok(f.org1, "UpdateStore", store)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P0", "S1", "purchase", lineArg("milk", "2027-04-10", 1, 1)))
+	f.fail(f.org1, "not permitted", "SetStoreControls", "S1", StoreControls{PricingCollection: "pricing_S1"})
+	f.ok(f.regulator, "SetStoreControls", "S1", StoreControls{PricingCollection: "pricing_S1"})
+
+	f.fail(f.org1, "pass the pricing of invoice P1 in the transient map", "CreateOrUpdateInvoice", privateInvoiceArg("P1", 24))
+	_, err := f.invoke(f.org1, map[string][]byte{transientPricingKey: []byte(`{}`)}, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+	if err == nil || !strings.Contains(err.Error(), "must not carry amounts") {
+		t.Fatalf("public amounts accepted: %v", err)
+	}
+	// A missing, non-hex or short salt would let the amounts be guessed from the public hash
+	for _, salt := range []string{"", "salt-P1", "00112233445566778899aabbccddee"} {
+		pricing := pricingArg("P1", 24, 100)[transientPricingKey].(InvoicePricing)
+		pricing.Salt = salt
+		pricingJSON, _ := json.Marshal(pricing)
+		_, err = f.invoke(f.org1, map[string][]byte{transientPricingKey: pricingJSON}, "CreateOrUpdateInvoice", privateInvoiceArg("P1", 24))
+		if err == nil || !strings.Contains(err.Error(), "salt of at least 16 random bytes") {
+			t.Fatalf("salt %q accepted: %v", salt, err)
+		}
+	}
+	f.okTransient(f.org1, pricingArg("P1", 24, 100), "CreateOrUpdateInvoice", privateInvoiceArg("P1", 24))
+
+	// Only the hash of the amounts reaches the public ledger, quantities stay countable
+	var invoice Invoice
+	f.get(&invoice, f.org2, "GetInvoice", "P1")
+	if invoice.PricingHash == "" || invoice.TotalAmountMinor != 0 || invoice.Items[0].PricePerUnitMinor != 0 {
+		t.Fatalf("amounts on the public ledger: %+v", invoice)
+	}
+	var total float64
+	f.get(&total, f.org2, "GetTotalPurchases", "S1", lot("milk", "2027-03-10"))
+	if total != 24 {
+		t.Fatalf("private purchase not counted: %v", total)
+	}
+
+	var pricing InvoicePricing
+	f.get(&pricing, f.auditor, "GetInvoicePricing", "P1")
+	if pricing.TotalAmountMinor != 2400 || pricing.SupplierTerms != "net 30" || pricing.Lines[0].PricePerUnitMinor != 100 {
+		t.Fatalf("unexpected pricing %+v", pricing)
+	}
+	f.fail(f.org2, "is owned by Org1MSP", "GetInvoicePricing", "P1")
+	f.ok(f.org2, "CreateOrUpdateInvoice", invoiceArg("P2", "S2", "purchase", lineArg("milk", "2027-03-10", 1, 1)))
+	f.fail(f.org2, "priced on the public ledger", "GetInvoicePricing", "P2")
+
+	// An amendment waiting for approval is applied with the pricing it was submitted with
+	f.okTransient(f.org1, pricingArg("P1", 30, 90), "AmendInvoice", privateInvoiceArg("P1", 30), "quantity_error", "second pallet")
+	f.ok(f.manager, "ApproveInvoiceAmendment", "P1", 2)
+	f.get(&pricing, f.org1, "GetInvoicePricing", "P1")
+	if pricing.TotalAmountMinor != 2700 || pricing.Lines[0].PricePerUnitMinor != 90 {
+		t.Fatalf("amended pricing not applied: %+v", pricing)
+	}
+	f.get(&total, f.org2, "GetTotalPurchases", "S1", lot("milk", "2027-03-10"))
+	if total != 30 {
+		t.Fatalf("amended purchase not counted: %v", total)
+	}
+}
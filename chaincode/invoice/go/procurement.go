@@ -0,0 +1,718 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Purchase order states
+const (
+	purchaseOrderOpen   = "open"
+	purchaseOrderClosed = "closed"
+)
+
+// Ledger key of the three-way match tolerances
+const matchToleranceKey = "MATCH_TOLERANCE"
+
+// Kinds of three-way match discrepancy
+const (
+	discrepancyUnordered        = "unordered_item"
+	discrepancyNotReceived      = "not_received"
+	discrepancyReceived         = "quantity_received" // invoiced quantity differs from the receipt
+	discrepancyOrdered          = "quantity_ordered"  // invoiced quantity exceeds the order
+	discrepancyPrice            = "price"
+	discrepancyReceiptInvoiced  = "receipt_already_invoiced"
+	discrepancyMissingReference = "missing_reference"
+	discrepancyUnknownReference = "unknown_reference" // no order or receipt of the store under the reference
+)
+
+// PurchaseOrderLine structure
+type PurchaseOrderLine struct {
+	ItemID            string  `json:"item_id"`
+	Quantity          float64 `json:"quantity"`
+	Unit              string  `json:"unit,omitempty" metadata:",optional"`                 // defaults to the catalogue base unit
+	BaseQuantity      float64 `json:"base_quantity,omitempty" metadata:",optional"`        // quantity converted to the catalogue base unit
+	PricePerUnitMinor int64   `json:"price_per_unit_minor,omitempty" metadata:",optional"` // agreed price, left out to skip the price match
+}
+
+// PurchaseOrder structure
+type PurchaseOrder struct {
+	DocType         string              `json:"doc_type"`
+	PurchaseOrderID string              `json:"purchase_order_id"`
+	StoreID         string              `json:"store_id"`
+	SupplierMSPID   string              `json:"supplier_msp_id,omitempty" metadata:",optional"`
+	Currency        string              `json:"currency,omitempty" metadata:",optional"`
+	Lines           []PurchaseOrderLine `json:"lines,omitempty" metadata:",optional"`
+	Status          string              `json:"status"`
+	CreatedBy       string              `json:"created_by"`
+	CreatedAt       string              `json:"created_at"`
+}
+
+// GoodsReceiptLine structure
+type GoodsReceiptLine struct {
+	ItemID       string  `json:"item_id"`
+	ExpiryDate   string  `json:"expiry_date"`
+	Quantity     float64 `json:"quantity"`
+	Unit         string  `json:"unit,omitempty" metadata:",optional"`          // defaults to the catalogue base unit
+	BaseQuantity float64 `json:"base_quantity,omitempty" metadata:",optional"` // quantity converted to the catalogue base unit
+}
+
+// GoodsReceipt structure
+type GoodsReceipt struct {
+	DocType         string             `json:"doc_type"`
+	GoodsReceiptID  string             `json:"goods_receipt_id"`
+	PurchaseOrderID string             `json:"purchase_order_id"`
+	StoreID         string             `json:"store_id"`
+	Lines           []GoodsReceiptLine `json:"lines,omitempty" metadata:",optional"`
+	ReceivedBy      string             `json:"received_by"`
+	ReceivedAt      string             `json:"received_at"`
+}
+
+// MatchTolerance structure
+type MatchTolerance struct {
+	DocType         string  `json:"doc_type"`
+	QuantityPercent float64 `json:"quantity_percent"`
+	PricePercent    float64 `json:"price_percent"`
+	UpdatedBy       string  `json:"updated_by"`
+	UpdatedAt       string  `json:"updated_at"`
+}
+
+// MatchDiscrepancy structure
+type MatchDiscrepancy struct {
+	ItemID          string  `json:"item_id,omitempty" metadata:",optional"`
+	ExpiryDate      string  `json:"expiry_date,omitempty" metadata:",optional"`
+	InvoiceID       string  `json:"invoice_id,omitempty" metadata:",optional"` // earlier invoice that already billed the receipt
+	Kind            string  `json:"kind"`
+	Expected        float64 `json:"expected,omitempty" metadata:",optional"`
+	Actual          float64 `json:"actual,omitempty" metadata:",optional"`
+	VariancePercent float64 `json:"variance_percent,omitempty" metadata:",optional"`
+}
+
+// ThreeWayMatch structure, the outcome of matching a purchase invoice to its order and receipt
+type ThreeWayMatch struct {
+	DocType         string             `json:"doc_type"`
+	InvoiceID       string             `json:"invoice_id"`
+	PurchaseOrderID string             `json:"purchase_order_id,omitempty" metadata:",optional"`
+	GoodsReceiptID  string             `json:"goods_receipt_id,omitempty" metadata:",optional"`
+	Matched         bool               `json:"matched"`
+	Discrepancies   []MatchDiscrepancy `json:"discrepancies,omitempty" metadata:",optional"`
+	MatchedAt       string             `json:"matched_at"`
+}
+
+// Ledger key of a purchase order
+func purchaseOrderKey(purchaseOrderID string) string {
+	return fmt.Sprintf("PURCHASE_ORDER_%s", purchaseOrderID)
+}
+
+// Ledger key of a goods receipt
+func goodsReceiptKey(goodsReceiptID string) string {
+	return fmt.Sprintf("GOODS_RECEIPT_%s", goodsReceiptID)
+}
+
+// Ledger key of the three-way match of an invoice
+func threeWayMatchKey(invoiceID string) string {
+	return fmt.Sprintf("THREE_WAY_MATCH_%s", invoiceID)
+}
+
+// Composite key object types of the invoice claiming a goods receipt and of the invoices citing a purchase order
+const (
+	goodsReceiptInvoicedObjectType = "GOODS_RECEIPT_INVOICED"
+	purchaseOrderInvoiceObjectType = "PURCHASE_ORDER_INVOICE"
+)
+
+// Ledger key of the marker naming the invoice that claimed a goods receipt
+func goodsReceiptInvoicedKey(ctx contractapi.TransactionContextInterface, goodsReceiptID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(goodsReceiptInvoicedObjectType, []string{goodsReceiptID})
+}
+
+// Ledger key indexing an invoice under the purchase order it cites
+func purchaseOrderInvoiceKey(ctx contractapi.TransactionContextInterface, purchaseOrderID string, invoiceID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(purchaseOrderInvoiceObjectType, []string{purchaseOrderID, invoiceID})
+}
+
+// Raise a purchase order, restricted to the store's organisation
+func (s *SmartContract) CreatePurchaseOrder(ctx contractapi.TransactionContextInterface, purchaseOrder PurchaseOrder) error {
+	if purchaseOrder.PurchaseOrderID == "" {
+		return fmt.Errorf("purchase order ID is required")
+	}
+	if len(purchaseOrder.Lines) == 0 {
+		return fmt.Errorf("purchase order %s has no lines", purchaseOrder.PurchaseOrderID)
+	}
+
+	existingJSON, err := ctx.GetStub().GetState(purchaseOrderKey(purchaseOrder.PurchaseOrderID))
+	if err != nil {
+		return err
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("purchase order %s already exists", purchaseOrder.PurchaseOrderID)
+	}
+
+	store, err := s.requireActiveStore(ctx, purchaseOrder.StoreID)
+	if err != nil {
+		return err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	if purchaseOrder.Currency == "" {
+		purchaseOrder.Currency = defaultCurrency
+	}
+	if !validCurrency(purchaseOrder.Currency) {
+		return fmt.Errorf("purchase order %s has an invalid currency code: %q", purchaseOrder.PurchaseOrderID, purchaseOrder.Currency)
+	}
+
+	ordered := make(map[string]bool)
+	for i, line := range purchaseOrder.Lines {
+		if ordered[line.ItemID] {
+			return fmt.Errorf("purchase order %s orders item %s more than once", purchaseOrder.PurchaseOrderID, line.ItemID)
+		}
+		ordered[line.ItemID] = true
+
+		catalogueItem, err := s.GetCatalogueItem(ctx, line.ItemID)
+		if err != nil {
+			return fmt.Errorf("item %s is not in the product catalogue", line.ItemID)
+		}
+		if line.Unit == "" {
+			purchaseOrder.Lines[i].Unit = catalogueItem.UnitOfMeasure
+		}
+		purchaseOrder.Lines[i].BaseQuantity, err = toBaseQuantity(catalogueItem, line.Quantity, purchaseOrder.Lines[i].Unit)
+		if err != nil {
+			return err
+		}
+		if purchaseOrder.Lines[i].BaseQuantity <= 0 || line.PricePerUnitMinor < 0 {
+			return fmt.Errorf("purchase order %s line %s requires a positive quantity and a non-negative price", purchaseOrder.PurchaseOrderID, line.ItemID)
+		}
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	purchaseOrder.DocType = "purchase_order"
+	purchaseOrder.Status = purchaseOrderOpen
+	purchaseOrder.CreatedBy = signer
+	purchaseOrder.CreatedAt = now.Format(time.RFC3339)
+
+	return s.putPurchaseOrder(ctx, purchaseOrder)
+}
+
+// Close a purchase order so that no further goods are received against it, restricted to the store's organisation
+func (s *SmartContract) ClosePurchaseOrder(ctx contractapi.TransactionContextInterface, purchaseOrderID string) error {
+	purchaseOrder, err := s.GetPurchaseOrder(ctx, purchaseOrderID)
+	if err != nil {
+		return err
+	}
+	if purchaseOrder.Status != purchaseOrderOpen {
+		return fmt.Errorf("purchase order %s is already %s", purchaseOrderID, purchaseOrder.Status)
+	}
+
+	store, err := s.GetStore(ctx, purchaseOrder.StoreID)
+	if err != nil {
+		return err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	purchaseOrder.Status = purchaseOrderClosed
+
+	return s.putPurchaseOrder(ctx, purchaseOrder)
+}
+
+// Retrieve a purchase order from the ledger
+func (s *SmartContract) GetPurchaseOrder(ctx contractapi.TransactionContextInterface, purchaseOrderID string) (PurchaseOrder, error) {
+	purchaseOrderJSON, err := ctx.GetStub().GetState(purchaseOrderKey(purchaseOrderID))
+	if err != nil {
+		return PurchaseOrder{}, err
+	}
+	if purchaseOrderJSON == nil {
+		return PurchaseOrder{}, fmt.Errorf("Purchase order not found for ID: %s", purchaseOrderID)
+	}
+
+	var purchaseOrder PurchaseOrder
+	err = json.Unmarshal(purchaseOrderJSON, &purchaseOrder)
+	if err != nil {
+		return PurchaseOrder{}, err
+	}
+
+	return purchaseOrder, nil
+}
+
+// Record the goods received against an open purchase order, restricted to the store's organisation
+func (s *SmartContract) RecordGoodsReceipt(ctx contractapi.TransactionContextInterface, goodsReceipt GoodsReceipt) error {
+	if goodsReceipt.GoodsReceiptID == "" {
+		return fmt.Errorf("goods receipt ID is required")
+	}
+	if len(goodsReceipt.Lines) == 0 {
+		return fmt.Errorf("goods receipt %s has no lines", goodsReceipt.GoodsReceiptID)
+	}
+
+	existingJSON, err := ctx.GetStub().GetState(goodsReceiptKey(goodsReceipt.GoodsReceiptID))
+	if err != nil {
+		return err
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("goods receipt %s already exists", goodsReceipt.GoodsReceiptID)
+	}
+
+	purchaseOrder, err := s.GetPurchaseOrder(ctx, goodsReceipt.PurchaseOrderID)
+	if err != nil {
+		return err
+	}
+	if purchaseOrder.Status != purchaseOrderOpen {
+		return fmt.Errorf("purchase order %s is %s", purchaseOrder.PurchaseOrderID, purchaseOrder.Status)
+	}
+	if purchaseOrder.StoreID != goodsReceipt.StoreID {
+		return fmt.Errorf("purchase order %s belongs to store %s", purchaseOrder.PurchaseOrderID, purchaseOrder.StoreID)
+	}
+
+	store, err := s.requireActiveStore(ctx, goodsReceipt.StoreID)
+	if err != nil {
+		return err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	for i, line := range goodsReceipt.Lines {
+		if purchaseOrderLine(purchaseOrder, line.ItemID) == nil {
+			return fmt.Errorf("item %s was not ordered on purchase order %s", line.ItemID, purchaseOrder.PurchaseOrderID)
+		}
+
+		catalogueItem, err := s.GetCatalogueItem(ctx, line.ItemID)
+		if err != nil {
+			return fmt.Errorf("item %s is not in the product catalogue", line.ItemID)
+		}
+		if line.Unit == "" {
+			goodsReceipt.Lines[i].Unit = catalogueItem.UnitOfMeasure
+		}
+		goodsReceipt.Lines[i].BaseQuantity, err = toBaseQuantity(catalogueItem, line.Quantity, goodsReceipt.Lines[i].Unit)
+		if err != nil {
+			return err
+		}
+		if goodsReceipt.Lines[i].BaseQuantity <= 0 {
+			return fmt.Errorf("goods receipt %s line %s requires a positive quantity", goodsReceipt.GoodsReceiptID, line.ItemID)
+		}
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	goodsReceipt.DocType = "goods_receipt"
+	goodsReceipt.ReceivedBy = signer
+	goodsReceipt.ReceivedAt = now.Format(time.RFC3339)
+
+	goodsReceiptJSON, err := json.Marshal(goodsReceipt)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(goodsReceiptKey(goodsReceipt.GoodsReceiptID), goodsReceiptJSON)
+}
+
+// Retrieve a goods receipt from the ledger
+func (s *SmartContract) GetGoodsReceipt(ctx contractapi.TransactionContextInterface, goodsReceiptID string) (GoodsReceipt, error) {
+	goodsReceiptJSON, err := ctx.GetStub().GetState(goodsReceiptKey(goodsReceiptID))
+	if err != nil {
+		return GoodsReceipt{}, err
+	}
+	if goodsReceiptJSON == nil {
+		return GoodsReceipt{}, fmt.Errorf("Goods receipt not found for ID: %s", goodsReceiptID)
+	}
+
+	var goodsReceipt GoodsReceipt
+	err = json.Unmarshal(goodsReceiptJSON, &goodsReceipt)
+	if err != nil {
+		return GoodsReceipt{}, err
+	}
+
+	return goodsReceipt, nil
+}
+
+// Retrieve the three-way match of a purchase invoice
+func (s *SmartContract) GetThreeWayMatch(ctx contractapi.TransactionContextInterface, invoiceID string) (ThreeWayMatch, error) {
+	matchJSON, err := ctx.GetStub().GetState(threeWayMatchKey(invoiceID))
+	if err != nil {
+		return ThreeWayMatch{}, err
+	}
+	if matchJSON == nil {
+		return ThreeWayMatch{}, fmt.Errorf("Three-way match not found for invoice: %s", invoiceID)
+	}
+
+	var match ThreeWayMatch
+	err = json.Unmarshal(matchJSON, &match)
+	if err != nil {
+		return ThreeWayMatch{}, err
+	}
+
+	return match, nil
+}
+
+// Set the three-way match tolerances, restricted to regulators
+func (s *SmartContract) SetMatchTolerance(ctx contractapi.TransactionContextInterface, quantityPercent float64, pricePercent float64) error {
+	err := requireRole(ctx, roleRegulator)
+	if err != nil {
+		return err
+	}
+	if quantityPercent < 0 || pricePercent < 0 || math.IsNaN(quantityPercent) || math.IsNaN(pricePercent) {
+		return fmt.Errorf("match tolerances must not be negative")
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	tolerance := MatchTolerance{
+		DocType:         "match_tolerance",
+		QuantityPercent: quantityPercent,
+		PricePercent:    pricePercent,
+		UpdatedBy:       signer,
+		UpdatedAt:       now.Format(time.RFC3339),
+	}
+
+	toleranceJSON, err := json.Marshal(tolerance)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(matchToleranceKey, toleranceJSON)
+}
+
+// Retrieve the three-way match tolerances in force
+func (s *SmartContract) GetMatchTolerance(ctx contractapi.TransactionContextInterface) (MatchTolerance, error) {
+	toleranceJSON, err := ctx.GetStub().GetState(matchToleranceKey)
+	if err != nil {
+		return MatchTolerance{}, err
+	}
+	if toleranceJSON == nil {
+		return MatchTolerance{DocType: "match_tolerance", QuantityPercent: 2, PricePercent: 1}, nil
+	}
+
+	var tolerance MatchTolerance
+	err = json.Unmarshal(toleranceJSON, &tolerance)
+	if err != nil {
+		return MatchTolerance{}, err
+	}
+
+	return tolerance, nil
+}
+
+// Accept the discrepancies of a held purchase invoice so that it counts toward inventory,
+// restricted to managers of the store's organisation and auditors
+func (s *SmartContract) ReleaseHeldInvoice(ctx contractapi.TransactionContextInterface, invoiceID string, justification string) error {
+	err := requireRole(ctx, roleManager, roleAuditor)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(justification) == "" {
+		return fmt.Errorf("releasing invoice %s requires a justification", invoiceID)
+	}
+
+	invoice, err := s.GetInvoice(ctx, invoiceID)
+	if err != nil {
+		return err
+	}
+	if invoice.Status != invoiceHeld {
+		return fmt.Errorf("invoice %s is not held by the three-way match", invoiceID)
+	}
+
+	// Auditors release any store, managers only the stores of their own organisation
+	if requireRole(ctx, roleAuditor) != nil {
+		store, err := s.GetStore(ctx, invoice.StoreID)
+		if err != nil {
+			return err
+		}
+		err = requireStoreOwner(ctx, store)
+		if err != nil {
+			return err
+		}
+	}
+
+	entry := InvoiceAuditEntry{
+		Action:         auditRelease,
+		Justification:  justification,
+		PreviousStatus: invoice.Status,
+	}
+
+	// A named supplier still has to acknowledge the purchase
+	invoice.Status = ""
+	if invoice.SupplierMSPID != "" {
+		invoice.Status = invoicePending
+	}
+
+	return s.applyInvoiceAudit(ctx, invoice, entry)
+}
+
+// Match a purchase invoice against its purchase order and goods receipt and record the outcome;
+// reports whether the invoice matched within tolerance
+func (s *SmartContract) matchPurchaseInvoice(ctx contractapi.TransactionContextInterface, invoice Invoice) (bool, error) {
+	if invoice.InvoiceType != "purchase" {
+		return true, nil
+	}
+
+	store, err := s.GetStore(ctx, invoice.StoreID)
+	if err != nil {
+		return false, err
+	}
+	// Purchases from a named supplier are always matched, others only when they cite an order or the store requires it
+	if invoice.PurchaseOrderID == "" && invoice.GoodsReceiptID == "" && invoice.SupplierMSPID == "" && !store.RequirePurchaseOrders {
+		return true, nil
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return false, err
+	}
+	match := ThreeWayMatch{
+		DocType:         "three_way_match",
+		InvoiceID:       invoice.InvoiceID,
+		PurchaseOrderID: invoice.PurchaseOrderID,
+		GoodsReceiptID:  invoice.GoodsReceiptID,
+		MatchedAt:       now.Format(time.RFC3339),
+	}
+
+	if invoice.PurchaseOrderID == "" || invoice.GoodsReceiptID == "" {
+		match.Discrepancies = append(match.Discrepancies, MatchDiscrepancy{Kind: discrepancyMissingReference})
+		return false, s.putThreeWayMatch(ctx, match)
+	}
+
+	// A reference to a document that does not exist, or belongs to another store, holds the invoice like a missing one
+	purchaseOrder, err := s.GetPurchaseOrder(ctx, invoice.PurchaseOrderID)
+	if err != nil || purchaseOrder.StoreID != invoice.StoreID {
+		match.Discrepancies = append(match.Discrepancies, MatchDiscrepancy{Kind: discrepancyUnknownReference})
+		return false, s.putThreeWayMatch(ctx, match)
+	}
+	goodsReceipt, err := s.GetGoodsReceipt(ctx, invoice.GoodsReceiptID)
+	if err != nil || goodsReceipt.StoreID != invoice.StoreID {
+		match.Discrepancies = append(match.Discrepancies, MatchDiscrepancy{Kind: discrepancyUnknownReference})
+		return false, s.putThreeWayMatch(ctx, match)
+	}
+	if goodsReceipt.PurchaseOrderID != purchaseOrder.PurchaseOrderID {
+		return false, fmt.Errorf("goods receipt %s was received against purchase order %s, not %s", goodsReceipt.GoodsReceiptID, goodsReceipt.PurchaseOrderID, purchaseOrder.PurchaseOrderID)
+	}
+
+	tolerance, err := s.GetMatchTolerance(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// A receipt is invoiced once; the invoice claiming it is named by a marker read by key
+	claimedBy, err := s.claimGoodsReceipt(ctx, invoice, goodsReceipt.GoodsReceiptID)
+	if err != nil {
+		return false, err
+	}
+	if claimedBy != "" {
+		match.Discrepancies = append(match.Discrepancies, MatchDiscrepancy{Kind: discrepancyReceiptInvoiced, InvoiceID: claimedBy})
+	}
+
+	// Quantities invoiced earlier against the same order count toward what was ordered
+	earlier, err := s.getPurchaseOrderInvoices(ctx, invoice, purchaseOrder.PurchaseOrderID)
+	if err != nil {
+		return false, err
+	}
+	previouslyInvoiced := make(map[string]float64)
+	for _, earlierInvoice := range earlier {
+		for _, item := range earlierInvoice.Items {
+			previouslyInvoiced[item.ItemID] += baseQuantity(item)
+		}
+	}
+
+	received := make(map[ItemKey]float64)
+	for _, line := range goodsReceipt.Lines {
+		received[ItemKey{ItemID: line.ItemID, ExpiryDate: line.ExpiryDate}] += line.BaseQuantity
+	}
+
+	invoicedByKey := make(map[ItemKey]float64)
+	invoicedByItem := make(map[string]float64)
+	amountsByItem := make(map[string]int64)
+	var itemKeys []ItemKey
+	var itemIDs []string
+	for _, item := range invoice.Items {
+		itemKey := ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate}
+		if _, ok := invoicedByKey[itemKey]; !ok {
+			itemKeys = append(itemKeys, itemKey)
+		}
+		if _, ok := invoicedByItem[item.ItemID]; !ok {
+			itemIDs = append(itemIDs, item.ItemID)
+		}
+		invoicedByKey[itemKey] += baseQuantity(item)
+		invoicedByItem[item.ItemID] += baseQuantity(item)
+		amountsByItem[item.ItemID] += item.TotalPriceMinor
+	}
+
+	// Invoice against receipt, lot by lot
+	for _, itemKey := range itemKeys {
+		receivedQuantity, ok := received[itemKey]
+		if !ok {
+			match.Discrepancies = append(match.Discrepancies, MatchDiscrepancy{ItemID: itemKey.ItemID, ExpiryDate: itemKey.ExpiryDate, Kind: discrepancyNotReceived, Actual: invoicedByKey[itemKey]})
+			continue
+		}
+		if variance := variancePercent(receivedQuantity, invoicedByKey[itemKey]); math.Abs(variance) > tolerance.QuantityPercent {
+			match.Discrepancies = append(match.Discrepancies, MatchDiscrepancy{ItemID: itemKey.ItemID, ExpiryDate: itemKey.ExpiryDate, Kind: discrepancyReceived, Expected: receivedQuantity, Actual: invoicedByKey[itemKey], VariancePercent: variance})
+		}
+	}
+
+	// Invoice against order, item by item
+	for _, itemID := range itemIDs {
+		orderLine := purchaseOrderLine(purchaseOrder, itemID)
+		if orderLine == nil {
+			match.Discrepancies = append(match.Discrepancies, MatchDiscrepancy{ItemID: itemID, Kind: discrepancyUnordered, Actual: invoicedByItem[itemID]})
+			continue
+		}
+
+		invoiced := previouslyInvoiced[itemID] + invoicedByItem[itemID]
+		if variance := variancePercent(orderLine.BaseQuantity, invoiced); variance > tolerance.QuantityPercent {
+			match.Discrepancies = append(match.Discrepancies, MatchDiscrepancy{ItemID: itemID, Kind: discrepancyOrdered, Expected: orderLine.BaseQuantity, Actual: invoiced, VariancePercent: variance})
+		}
+
+		// Prices are compared per base unit; amounts kept in a private collection are not on the invoice
+		if orderLine.PricePerUnitMinor == 0 || invoice.PricingHash != "" || invoice.Currency != purchaseOrder.Currency || invoicedByItem[itemID] == 0 {
+			continue
+		}
+		orderedPrice := float64(orderLine.PricePerUnitMinor) * orderLine.Quantity / orderLine.BaseQuantity
+		invoicedPrice := float64(amountsByItem[itemID]) / invoicedByItem[itemID]
+		if variance := variancePercent(orderedPrice, invoicedPrice); math.Abs(variance) > tolerance.PricePercent {
+			match.Discrepancies = append(match.Discrepancies, MatchDiscrepancy{ItemID: itemID, Kind: discrepancyPrice, Expected: orderedPrice, Actual: invoicedPrice, VariancePercent: variance})
+		}
+	}
+
+	match.Matched = len(match.Discrepancies) == 0
+
+	return match.Matched, s.putThreeWayMatch(ctx, match)
+}
+
+// Claim a goods receipt for an invoice, returning the other live invoice that claimed it first, if any
+func (s *SmartContract) claimGoodsReceipt(ctx contractapi.TransactionContextInterface, invoice Invoice, goodsReceiptID string) (string, error) {
+	markerKey, err := goodsReceiptInvoicedKey(ctx, goodsReceiptID)
+	if err != nil {
+		return "", err
+	}
+	claimedByJSON, err := ctx.GetStub().GetState(markerKey)
+	if err != nil {
+		return "", err
+	}
+
+	// A claim lapses when its invoice is voided or amended to cite another receipt
+	if claimedByJSON != nil && string(claimedByJSON) != invoice.InvoiceID {
+		claimant, err := s.GetInvoice(ctx, string(claimedByJSON))
+		if err != nil {
+			return "", err
+		}
+		if claimant.Status != invoiceVoided && claimant.GoodsReceiptID == goodsReceiptID {
+			return claimant.InvoiceID, nil
+		}
+	}
+
+	return "", ctx.GetStub().PutState(markerKey, []byte(invoice.InvoiceID))
+}
+
+// Retrieve the live invoices other than the given one that cite a purchase order, indexing the given one under it
+func (s *SmartContract) getPurchaseOrderInvoices(ctx contractapi.TransactionContextInterface, invoice Invoice, purchaseOrderID string) ([]Invoice, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(purchaseOrderInvoiceObjectType, []string{purchaseOrderID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var invoices []Invoice
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		if keyParts[1] == invoice.InvoiceID {
+			continue
+		}
+
+		// An invoice amended to cite another order keeps its index entry but no longer counts
+		otherInvoice, err := s.GetInvoice(ctx, keyParts[1])
+		if err != nil {
+			return nil, err
+		}
+		if otherInvoice.PurchaseOrderID != purchaseOrderID || otherInvoice.Status == invoiceVoided {
+			continue
+		}
+		invoices = append(invoices, otherInvoice)
+	}
+
+	indexKey, err := purchaseOrderInvoiceKey(ctx, purchaseOrderID, invoice.InvoiceID)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.GetStub().PutState(indexKey, []byte{0x00})
+	if err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
+}
+
+// Find the line of a purchase order for an item
+func purchaseOrderLine(purchaseOrder PurchaseOrder, itemID string) *PurchaseOrderLine {
+	for i := range purchaseOrder.Lines {
+		if purchaseOrder.Lines[i].ItemID == itemID {
+			return &purchaseOrder.Lines[i]
+		}
+	}
+	return nil
+}
+
+// Percentage by which an actual value differs from the expected one
+func variancePercent(expected float64, actual float64) float64 {
+	if expected == 0 {
+		if actual == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return (actual - expected) / expected * 100
+}
+
+// Save a purchase order to the ledger
+func (s *SmartContract) putPurchaseOrder(ctx contractapi.TransactionContextInterface, purchaseOrder PurchaseOrder) error {
+	purchaseOrderJSON, err := json.Marshal(purchaseOrder)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(purchaseOrderKey(purchaseOrder.PurchaseOrderID), purchaseOrderJSON)
+}
+
+// Save the three-way match of an invoice to the ledger
+func (s *SmartContract) putThreeWayMatch(ctx contractapi.TransactionContextInterface, match ThreeWayMatch) error {
+	matchJSON, err := json.Marshal(match)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(threeWayMatchKey(match.InvoiceID), matchJSON)
+}
@@ -0,0 +1,163 @@
+package main
+
+import "testing"
+
+func purchaseOrderArg(purchaseOrderID string, storeID string, itemID string, quantity float64) map[string]interface{} {
+	return map[string]interface{}{
+		"doc_type": "", "purchase_order_id": purchaseOrderID, "store_id": storeID, "supplier_msp_id": "SupMSP",
+		"lines":  []map[string]interface{}{{"item_id": itemID, "quantity": quantity}},
+		"status": "", "created_by": "", "created_at": "",
+	}
+}
+
+func goodsReceiptArg(goodsReceiptID string, purchaseOrderID string, storeID string, itemID string, expiryDate string, quantity float64) map[string]interface{} {
+	return map[string]interface{}{
+		"doc_type": "", "goods_receipt_id": goodsReceiptID, "purchase_order_id": purchaseOrderID, "store_id": storeID,
+		"lines":       []map[string]interface{}{{"item_id": itemID, "expiry_date": expiryDate, "quantity": quantity}},
+		"received_by": "", "received_at": "",
+	}
+}
+
+// Purchase invoice from the test supplier citing an order and receipt
+func supplierPurchaseArg(invoiceID string, storeID string, purchaseOrderID string, goodsReceiptID string, quantity float64) map[string]interface{} {
+	purchase := invoiceArg(invoiceID, storeID, "purchase", lineArg("milk", "2027-03-10", quantity, 1))
+	purchase["supplier_msp_id"] = "SupMSP"
+	purchase["purchase_order_id"] = purchaseOrderID
+	purchase["goods_receipt_id"] = goodsReceiptID
+	return purchase
+}
+
+func TestThreeWayMatch(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreatePurchaseOrder", purchaseOrderArg("PO1", "S1", "milk", 24))
+	f.ok(f.org1, "RecordGoodsReceipt", goodsReceiptArg("GR1", "PO1", "S1", "milk", "2027-03-10", 24))
+	f.ok(f.org2, "CreatePurchaseOrder", purchaseOrderArg("PO2", "S2", "milk", 24))
+	f.ok(f.org1, "CreatePurchaseOrder", purchaseOrderArg("PO3", "S1", "milk", 24))
+
+	status := func(invoiceID string) string {
+		t.Helper()
+		var invoice Invoice
+		f.get(&invoice, f.org1, "GetInvoice", invoiceID)
+		return invoice.Status
+	}
+	discrepancy := func(invoiceID string) string {
+		t.Helper()
+		var match ThreeWayMatch
+		f.get(&match, f.org1, "GetThreeWayMatch", invoiceID)
+		if match.Matched || len(match.Discrepancies) != 1 {
+			t.Fatalf("expected one discrepancy for %s, got %+v", invoiceID, match)
+		}
+		return match.Discrepancies[0].Kind
+	}
+
+	// A supplier's invoice is matched even when it cites nothing, and is held rather than rejected
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P1", "S1", "", "", 24))
+	if status("P1") != invoiceHeld || discrepancy("P1") != discrepancyMissingReference {
+		t.Fatal("supplier invoice without references not held")
+	}
+
+	// References that do not exist, or belong to another store, hold the invoice too
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P2", "S1", "PO9", "GR1", 24))
+	if status("P2") != invoiceHeld || discrepancy("P2") != discrepancyUnknownReference {
+		t.Fatal("invoice citing an unknown order not held")
+	}
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P3", "S1", "PO3", "GR9", 24))
+	if status("P3") != invoiceHeld || discrepancy("P3") != discrepancyUnknownReference {
+		t.Fatal("invoice citing an unknown receipt not held")
+	}
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P4", "S1", "PO2", "GR1", 24))
+	if status("P4") != invoiceHeld || discrepancy("P4") != discrepancyUnknownReference {
+		t.Fatal("invoice citing another store's order not held")
+	}
+
+	// A matching invoice waits for the supplier only
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P5", "S1", "PO1", "GR1", 24))
+	var match ThreeWayMatch
+	f.get(&match, f.org1, "GetThreeWayMatch", "P5")
+	if !match.Matched || status("P5") != invoicePending {
+		t.Fatalf("matching invoice not pending: %+v", match)
+	}
+
+	// A store's own purchase without a supplier is not matched unless a regulator requires it
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P6", "S1", "purchase", lineArg("milk", "2027-03-10", 1, 1)))
+	if status("P6") != "" {
+		t.Fatalf("unmatched own purchase held: %s", status("P6"))
+	}
+}
+
+func TestReceiptInvoicedOnce(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreatePurchaseOrder", purchaseOrderArg("PO1", "S1", "milk", 48))
+	f.ok(f.org1, "RecordGoodsReceipt", goodsReceiptArg("GR1", "PO1", "S1", "milk", "2027-03-10", 24))
+	f.ok(f.org1, "RecordGoodsReceipt", goodsReceiptArg("GR2", "PO1", "S1", "milk", "2027-03-10", 24))
+
+	discrepancies := func(invoiceID string) map[string]string {
+		t.Helper()
+		var match ThreeWayMatch
+		f.get(&match, f.org1, "GetThreeWayMatch", invoiceID)
+		kinds := make(map[string]string)
+		for _, discrepancy := range match.Discrepancies {
+			kinds[discrepancy.Kind] = discrepancy.InvoiceID
+		}
+		return kinds
+	}
+
+	// The first invoice claims the receipt, a second one citing it is held
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P1", "S1", "PO1", "GR1", 24))
+	if kinds := discrepancies("P1"); len(kinds) != 0 {
+		t.Fatalf("first invoice of the receipt not matched: %v", kinds)
+	}
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P2", "S1", "PO1", "GR1", 24))
+	if kinds := discrepancies("P2"); len(kinds) != 1 || kinds[discrepancyReceiptInvoiced] != "P1" {
+		t.Fatalf("second invoice of the receipt not held: %v", kinds)
+	}
+
+	// Invoices held against the order count toward what was ordered, voided ones do not
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P3", "S1", "PO1", "GR2", 24))
+	if kinds := discrepancies("P3"); len(kinds) != 1 || kinds[discrepancyOrdered] != "" {
+		t.Fatalf("invoice beyond the order not held: %v", kinds)
+	}
+	f.ok(f.org1, "VoidInvoice", "P2", "duplicate", "keyed twice")
+	f.ok(f.org1, "VoidInvoice", "P3", "entered_in_error", "wrong receipt")
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P4", "S1", "PO1", "GR2", 24))
+	if kinds := discrepancies("P4"); len(kinds) != 0 {
+		t.Fatalf("invoice within the order not matched: %v", kinds)
+	}
+
+	// Voiding the claiming invoice frees the receipt for its replacement
+	f.ok(f.org1, "VoidInvoice", "P1", "entered_in_error", "wrong price")
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P5", "S1", "PO1", "GR1", 24))
+	if kinds := discrepancies("P5"); len(kinds) != 0 {
+		t.Fatalf("replacement invoice not matched: %v", kinds)
+	}
+}
+
+func TestRequirePurchaseOrders(t *testing.T) {
+	f := newFixture(t)
+
+	// Stores cannot impose or lift the requirement on themselves
+	update := storeArg("S1", "north", "large")
+	update["require_purchase_orders"] = true
+	f.ok(f.org1, "UpdateStore", update)
+	var store Store
+	f.get(&store, f.regulator, "GetStore", "S1")
+	if store.RequirePurchaseOrders {
+		t.Fatal("store imposed its own purchase orders")
+	}
+
+	f.fail(f.org1, "not permitted", "SetStoreControls", "S1", StoreControls{RequirePurchaseOrders: true})
+	f.ok(f.regulator, "SetStoreControls", "S1", StoreControls{RequirePurchaseOrders: true})
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 1, 1)))
+	var invoice Invoice
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Status != invoiceHeld {
+		t.Fatalf("unmatched purchase not held: %s", invoice.Status)
+	}
+
+	// Lifting the control leaves the other controls as the regulator set them
+	f.ok(f.regulator, "SetStoreControls", "S1", StoreControls{RequireSequenceNumbers: true})
+	f.get(&store, f.regulator, "GetStore", "S1")
+	if store.RequirePurchaseOrders || !store.RequireSequenceNumbers {
+		t.Fatalf("unexpected controls %+v", store)
+	}
+}
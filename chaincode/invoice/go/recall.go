@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Recall structure
+type Recall struct {
+	DocType    string  `json:"doc_type"`
+	ItemKey    ItemKey `json:"item_key"`
+	Reason     string  `json:"reason"`
+	RecalledBy string  `json:"recalled_by"` // MSP ID of the supplier or regulator
+	RecalledAt string  `json:"recalled_at"`
+}
+
+// RecallDisposal structure
+type RecallDisposal struct {
+	DocType     string  `json:"doc_type"`
+	StoreID     string  `json:"store_id"`
+	ItemKey     ItemKey `json:"item_key"`
+	Quantity    float64 `json:"quantity"` // in the catalogue base unit
+	ConfirmedBy string  `json:"confirmed_by"`
+	ConfirmedAt string  `json:"confirmed_at"`
+}
+
+// RecallStoreStatus structure
+type RecallStoreStatus struct {
+	StoreID           string  `json:"store_id"`
+	RemainingQuantity float64 `json:"remaining_quantity"`
+	DisposedQuantity  float64 `json:"disposed_quantity"`
+	DisposalConfirmed bool    `json:"disposal_confirmed"`
+	ConfirmedAt       string  `json:"confirmed_at,omitempty" metadata:",optional"`
+}
+
+// RecallStatus structure
+type RecallStatus struct {
+	Recall Recall              `json:"recall"`
+	Stores []RecallStoreStatus `json:"stores,omitempty" metadata:",optional"`
+}
+
+// Ledger key of the recall for a lot
+func recallKey(itemKey ItemKey) string {
+	return fmt.Sprintf("RECALL_%s_%s", itemKey.ItemID, itemKey.ExpiryDate)
+}
+
+// Ledger key of a store's disposal confirmation for a recalled lot
+func recallDisposalKey(storeID string, itemKey ItemKey) string {
+	return fmt.Sprintf("RECALL_DISPOSAL_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate)
+}
+
+// Recall a lot across all stores, restricted to suppliers and regulators
+func (s *SmartContract) RecallLot(ctx contractapi.TransactionContextInterface, itemKey ItemKey, reason string) error {
+	err := requireRole(ctx, roleSupplier, roleRegulator)
+	if err != nil {
+		return err
+	}
+
+	recalled, err := s.isRecalled(ctx, itemKey)
+	if err != nil {
+		return err
+	}
+	if recalled {
+		return fmt.Errorf("lot %s with expiry %s is already recalled", itemKey.ItemID, itemKey.ExpiryDate)
+	}
+
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	recall := Recall{
+		DocType:    "recall",
+		ItemKey:    itemKey,
+		Reason:     reason,
+		RecalledBy: mspID,
+		RecalledAt: now.Format(time.RFC3339),
+	}
+	recallJSON, err := json.Marshal(recall)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(recallKey(itemKey), recallJSON)
+}
+
+// Confirm that a store has disposed of its stock of a recalled lot
+func (s *SmartContract) ConfirmRecallDisposal(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey, quantity float64) error {
+	recalled, err := s.isRecalled(ctx, itemKey)
+	if err != nil {
+		return err
+	}
+	if !recalled {
+		return fmt.Errorf("lot %s with expiry %s is not recalled", itemKey.ItemID, itemKey.ExpiryDate)
+	}
+	if quantity < 0 {
+		return fmt.Errorf("disposed quantity cannot be negative: %v", quantity)
+	}
+
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	disposal := RecallDisposal{
+		DocType:     "recall_disposal",
+		StoreID:     storeID,
+		ItemKey:     itemKey,
+		Quantity:    quantity,
+		ConfirmedBy: mspID,
+		ConfirmedAt: now.Format(time.RFC3339),
+	}
+	disposalJSON, err := json.Marshal(disposal)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(recallDisposalKey(storeID, itemKey), disposalJSON)
+}
+
+// Retrieve a recall together with the stores holding the recalled lot
+func (s *SmartContract) GetRecallStatus(ctx contractapi.TransactionContextInterface, itemKey ItemKey) (RecallStatus, error) {
+	recallJSON, err := ctx.GetStub().GetState(recallKey(itemKey))
+	if err != nil {
+		return RecallStatus{}, err
+	}
+	if recallJSON == nil {
+		return RecallStatus{}, fmt.Errorf("no recall found for ItemKey: %s", itemKey)
+	}
+
+	var recall Recall
+	err = json.Unmarshal(recallJSON, &recall)
+	if err != nil {
+		return RecallStatus{}, err
+	}
+
+	storeIDs, err := s.getStoresHoldingLot(ctx, itemKey)
+	if err != nil {
+		return RecallStatus{}, err
+	}
+
+	status := RecallStatus{Recall: recall, Stores: []RecallStoreStatus{}}
+	for _, storeID := range storeIDs {
+		storeStatus := RecallStoreStatus{StoreID: storeID}
+
+		disposalJSON, err := ctx.GetStub().GetState(recallDisposalKey(storeID, itemKey))
+		if err != nil {
+			return RecallStatus{}, err
+		}
+		if disposalJSON != nil {
+			var disposal RecallDisposal
+			err = json.Unmarshal(disposalJSON, &disposal)
+			if err != nil {
+				return RecallStatus{}, err
+			}
+			storeStatus.DisposedQuantity = disposal.Quantity
+			storeStatus.DisposalConfirmed = true
+			storeStatus.ConfirmedAt = disposal.ConfirmedAt
+		}
+
+		// Book inventory already leaves out the confirmed disposal and allows for stocktakes
+		_, onHand, err := s.bookInventory(ctx, storeID, itemKey)
+		if err != nil {
+			return RecallStatus{}, err
+		}
+		storeStatus.RemainingQuantity = math.Max(onHand, 0)
+
+		status.Stores = append(status.Stores, storeStatus)
+	}
+
+	return status, nil
+}
+
+// Check whether a lot has been recalled
+func (s *SmartContract) isRecalled(ctx contractapi.TransactionContextInterface, itemKey ItemKey) (bool, error) {
+	recallJSON, err := ctx.GetStub().GetState(recallKey(itemKey))
+	if err != nil {
+		return false, fmt.Errorf("failed to read recall status: %s", err.Error())
+	}
+	return recallJSON != nil, nil
+}
+
+// Retrieve the stores that have purchased or been transferred a lot, in a deterministic order
+func (s *SmartContract) getStoresHoldingLot(ctx contractapi.TransactionContextInterface, itemKey ItemKey) ([]string, error) {
+	queryString := fmt.Sprintf(`{"selector":{"items":{"$elemMatch":{"item_id":"%s","expiry_date":"%s"}},"invoice_type":"purchase"}}`, itemKey.ItemID, itemKey.ExpiryDate)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	seen := make(map[string]bool)
+	var storeIDs []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var invoice Invoice
+		err = json.Unmarshal(queryResponse.Value, &invoice)
+		if err != nil {
+			return nil, err
+		}
+		if queryResponse.Key != invoice.InvoiceID || !countsTowardTotals(invoice) {
+			continue
+		}
+
+		if !seen[invoice.StoreID] {
+			seen[invoice.StoreID] = true
+			storeIDs = append(storeIDs, invoice.StoreID)
+		}
+	}
+
+	// Stores that received the lot from another store hold it too
+	queryString = fmt.Sprintf(`{"selector":{"doc_type":"transfer","status":"%s","lines":{"$elemMatch":{"item_id":"%s","expiry_date":"%s"}}}}`, transferAccepted, itemKey.ItemID, itemKey.ExpiryDate)
+	transferIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer transferIterator.Close()
+
+	for transferIterator.HasNext() {
+		queryResponse, err := transferIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var transfer Transfer
+		err = json.Unmarshal(queryResponse.Value, &transfer)
+		if err != nil {
+			return nil, err
+		}
+
+		if !seen[transfer.ToStoreID] {
+			seen[transfer.ToStoreID] = true
+			storeIDs = append(storeIDs, transfer.ToStoreID)
+		}
+	}
+
+	sort.Strings(storeIDs)
+	return storeIDs, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestRecallLot(t *testing.T) {
+	f := newFixture(t)
+	milk := lot("milk", "2027-03-10")
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 4, 2)))
+	f.ok(f.org2, "CreateOrUpdateInvoice", invoiceArg("P2", "S2", "purchase", lineArg("milk", "2027-03-10", 12, 1)))
+	f.ok(f.org1, "RecordStocktake", "ST1", "S1", []interface{}{stocktakeLineArg("milk", "2027-03-10", 18)})
+
+	f.fail(f.org1, "not permitted", "RecallLot", milk, "contamination")
+	f.fail(f.org1, "is not recalled", "ConfirmRecallDisposal", "S1", milk, 20)
+	f.ok(f.supplier, "RecallLot", milk, "contamination")
+	f.fail(f.regulator, "already recalled", "RecallLot", milk, "contamination")
+
+	f.fail(f.org1, "recalled item: milk", "CreateOrUpdateInvoice", invoiceArg("X2", "S1", "sales", lineArg("milk", "2027-03-10", 1, 2)))
+	f.fail(f.org1, "cannot be negative", "ConfirmRecallDisposal", "S1", milk, -1)
+	f.fail(f.org1, "is owned by Org2MSP", "ConfirmRecallDisposal", "S2", milk, 12)
+	f.ok(f.org2, "ConfirmRecallDisposal", "S2", milk, 12)
+
+	var status RecallStatus
+	f.get(&status, f.regulator, "GetRecallStatus", milk)
+	if status.Recall.RecalledBy != "SupMSP" || status.Recall.Reason != "contamination" {
+		t.Fatalf("unexpected recall %+v", status.Recall)
+	}
+	if len(status.Stores) != 2 {
+		t.Fatalf("expected both stores to hold the lot, got %+v", status.Stores)
+	}
+	s1, s2 := status.Stores[0], status.Stores[1]
+	if s1.StoreID != "S1" || s1.RemainingQuantity != 18 || s1.DisposalConfirmed {
+		t.Fatalf("unexpected status for S1: %+v", s1)
+	}
+	if s2.StoreID != "S2" || s2.RemainingQuantity != 0 || !s2.DisposalConfirmed || s2.DisposedQuantity != 12 {
+		t.Fatalf("unexpected status for S2: %+v", s2)
+	}
+
+	f.fail(f.regulator, "no recall found", "GetRecallStatus", lot("milk", "2027-04-01"))
+}
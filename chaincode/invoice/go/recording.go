@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Ledger key of the recording policy
+const recordingPolicyKey = "RECORDING_POLICY"
+
+// RecordingPolicy structure, bounding how far invoice timestamps may lie from the transaction time
+type RecordingPolicy struct {
+	DocType            string  `json:"doc_type"`
+	MaxDelayMinutes    int     `json:"max_delay_minutes"`    // older invoices are rejected
+	LateAfterMinutes   int     `json:"late_after_minutes"`   // older invoices are accepted but recorded as late
+	MaxAheadMinutes    int     `json:"max_ahead_minutes"`    // clock skew tolerated for timestamps in the future
+	TolerableLate      int     `json:"tolerable_late"`       // late recordings within the window that cost nothing
+	LatePenalty        float64 `json:"late_penalty"`         // ethics points deducted for every further late recording
+	MaxLatePenalty     float64 `json:"max_late_penalty"`     // cap on the deduction
+	LatenessWindowDays int     `json:"lateness_window_days"` // trailing window over which late recordings are counted
+	UpdatedBy          string  `json:"updated_by"`
+	UpdatedAt          string  `json:"updated_at"`
+}
+
+// LateRecording structure, an invoice accepted after the late threshold
+type LateRecording struct {
+	DocType          string `json:"doc_type"`
+	StoreID          string `json:"store_id"`
+	InvoiceID        string `json:"invoice_id"`
+	InvoiceTimestamp string `json:"invoice_timestamp"`
+	RecordedAt       string `json:"recorded_at"`
+	DelayMinutes     int    `json:"delay_minutes"`
+}
+
+// Recording policy applied until a regulator sets one
+func defaultRecordingPolicy() RecordingPolicy {
+	return RecordingPolicy{
+		DocType:            "recording_policy",
+		MaxDelayMinutes:    72 * 60,
+		LateAfterMinutes:   60,
+		MaxAheadMinutes:    5,
+		TolerableLate:      3,
+		LatePenalty:        2,
+		MaxLatePenalty:     30,
+		LatenessWindowDays: 30,
+	}
+}
+
+// Composite key object type of late recordings, keyed by store, recording date and invoice
+// so that the recordings of a trailing window are read day by day
+const lateRecordingObjectType = "LATE_RECORDING"
+
+// Set the recording policy, restricted to regulators
+func (s *SmartContract) SetRecordingPolicy(ctx contractapi.TransactionContextInterface, policy RecordingPolicy) error {
+	err := requireRole(ctx, roleRegulator)
+	if err != nil {
+		return err
+	}
+	if policy.MaxDelayMinutes <= 0 || policy.LateAfterMinutes < 0 || policy.LateAfterMinutes > policy.MaxDelayMinutes {
+		return fmt.Errorf("recording policy requires 0 <= late_after_minutes <= max_delay_minutes and a positive max_delay_minutes")
+	}
+	if policy.MaxAheadMinutes < 0 || policy.TolerableLate < 0 || policy.LatenessWindowDays <= 0 {
+		return fmt.Errorf("recording policy requires non-negative max_ahead_minutes and tolerable_late and a positive lateness_window_days")
+	}
+	if policy.LatePenalty < 0 || policy.MaxLatePenalty < 0 || policy.MaxLatePenalty > 100 || math.IsNaN(policy.LatePenalty) || math.IsNaN(policy.MaxLatePenalty) {
+		return fmt.Errorf("recording policy requires a non-negative late_penalty and a max_late_penalty between 0 and 100")
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	policy.DocType = "recording_policy"
+	policy.UpdatedBy = signer
+	policy.UpdatedAt = now.Format(time.RFC3339)
+
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(recordingPolicyKey, policyJSON)
+}
+
+// Retrieve the recording policy in force
+func (s *SmartContract) GetRecordingPolicy(ctx contractapi.TransactionContextInterface) (RecordingPolicy, error) {
+	policyJSON, err := ctx.GetStub().GetState(recordingPolicyKey)
+	if err != nil {
+		return RecordingPolicy{}, err
+	}
+	if policyJSON == nil {
+		return defaultRecordingPolicy(), nil
+	}
+
+	var policy RecordingPolicy
+	err = json.Unmarshal(policyJSON, &policy)
+	if err != nil {
+		return RecordingPolicy{}, err
+	}
+
+	return policy, nil
+}
+
+// Retrieve the late recordings of a store
+func (s *SmartContract) GetLateRecordings(ctx contractapi.TransactionContextInterface, storeID string) ([]LateRecording, error) {
+	lateRecordings := []LateRecording{}
+	err := s.appendLateRecordings(ctx, []string{storeID}, &lateRecordings)
+	if err != nil {
+		return nil, err
+	}
+
+	return lateRecordings, nil
+}
+
+// Append the late recordings under a partial key of store and, optionally, recording date
+func (s *SmartContract) appendLateRecordings(ctx contractapi.TransactionContextInterface, attributes []string, lateRecordings *[]LateRecording) error {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(lateRecordingObjectType, attributes)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+
+		var lateRecording LateRecording
+		err = json.Unmarshal(queryResponse.Value, &lateRecording)
+		if err != nil {
+			return err
+		}
+		*lateRecordings = append(*lateRecordings, lateRecording)
+	}
+
+	return nil
+}
+
+// Check the client-supplied date and timestamp of a new invoice against the transaction time,
+// returning how many minutes late it is recorded
+func (s *SmartContract) checkRecordingTime(ctx contractapi.TransactionContextInterface, invoice Invoice) (int, error) {
+	timestamp, err := time.Parse(time.RFC3339, invoice.Timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("invoice %s has an invalid timestamp %q, expected RFC 3339", invoice.InvoiceID, invoice.Timestamp)
+	}
+
+	// The business date is the date of the timestamp where the store trades
+	store, err := s.GetStore(ctx, invoice.StoreID)
+	if err != nil {
+		return 0, err
+	}
+	location, err := time.LoadLocation(store.TimeZone)
+	if err != nil {
+		return 0, fmt.Errorf("store %s has an invalid time zone: %q", store.StoreID, store.TimeZone)
+	}
+	if localDate := timestamp.In(location).Format("2006-01-02"); invoice.Date != localDate {
+		return 0, fmt.Errorf("invoice %s is dated %s but its timestamp falls on %s in %s", invoice.InvoiceID, invoice.Date, localDate, store.TimeZone)
+	}
+
+	policy, err := s.GetRecordingPolicy(ctx)
+	if err != nil {
+		return 0, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	delay := now.Sub(timestamp)
+	if delay < -time.Duration(policy.MaxAheadMinutes)*time.Minute {
+		return 0, fmt.Errorf("invoice %s is timestamped %s, after the transaction time %s", invoice.InvoiceID, invoice.Timestamp, now.Format(time.RFC3339))
+	}
+	if delay > time.Duration(policy.MaxDelayMinutes)*time.Minute {
+		return 0, fmt.Errorf("invoice %s is timestamped %s, more than %d minutes before the transaction time %s", invoice.InvoiceID, invoice.Timestamp, policy.MaxDelayMinutes, now.Format(time.RFC3339))
+	}
+	if delay <= time.Duration(policy.LateAfterMinutes)*time.Minute {
+		return 0, nil
+	}
+
+	return int(delay / time.Minute), nil
+}
+
+// Record an invoice accepted after the late threshold
+func (s *SmartContract) putLateRecording(ctx contractapi.TransactionContextInterface, invoice Invoice, delayMinutes int) error {
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	lateRecording := LateRecording{
+		DocType:          "late_recording",
+		StoreID:          invoice.StoreID,
+		InvoiceID:        invoice.InvoiceID,
+		InvoiceTimestamp: invoice.Timestamp,
+		RecordedAt:       now.Format(time.RFC3339),
+		DelayMinutes:     delayMinutes,
+	}
+
+	lateRecordingJSON, err := json.Marshal(lateRecording)
+	if err != nil {
+		return err
+	}
+
+	lateRecordingKey, err := ctx.GetStub().CreateCompositeKey(lateRecordingObjectType, []string{invoice.StoreID, now.Format("2006-01-02"), invoice.InvoiceID})
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(lateRecordingKey, lateRecordingJSON)
+}
+
+// Deduct points from the ethics index of a store that records invoices late as a habit
+func (s *SmartContract) weighLateness(ctx contractapi.TransactionContextInterface, storeID string, ethicsIndex float64) (float64, error) {
+	policy, err := s.GetRecordingPolicy(ctx)
+	if err != nil {
+		return 0, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+	start := now.AddDate(0, 0, -policy.LatenessWindowDays)
+	windowStart := start.Format(time.RFC3339)
+
+	// Only the days of the window are read, however long the store's record
+	var lateRecordings []LateRecording
+	for day := start; day.Format("2006-01-02") <= now.Format("2006-01-02"); day = day.AddDate(0, 0, 1) {
+		err = s.appendLateRecordings(ctx, []string{storeID, day.Format("2006-01-02")}, &lateRecordings)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var recent int
+	for _, lateRecording := range lateRecordings {
+		if lateRecording.RecordedAt >= windowStart {
+			recent++
+		}
+	}
+
+	penalty := math.Min(float64(recent-policy.TolerableLate)*policy.LatePenalty, policy.MaxLatePenalty)
+	if penalty <= 0 {
+		return ethicsIndex, nil
+	}
+
+	return math.Max(ethicsIndex-penalty, 0), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRecordingWindow(t *testing.T) {
+	f := newFixture(t)
+
+	policy := defaultRecordingPolicy()
+	f.fail(f.org1, "not permitted", "SetRecordingPolicy", policy)
+	policy.LateAfterMinutes = policy.MaxDelayMinutes + 1
+	f.fail(f.regulator, "late_after_minutes <= max_delay_minutes", "SetRecordingPolicy", policy)
+
+	misdated := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 1, 1))
+	misdated["date"] = "2026-02-28"
+	f.fail(f.org1, "its timestamp falls on 2026-03-01 in Asia/Kolkata", "CreateOrUpdateInvoice", misdated)
+	ahead := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 1, 1))
+	ahead["timestamp"] = "2026-03-01T10:30:00Z"
+	f.fail(f.org1, "after the transaction time", "CreateOrUpdateInvoice", ahead)
+	stale := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 1, 1))
+	stale["date"] = "2026-02-25"
+	stale["timestamp"] = "2026-02-25T10:00:00Z"
+	f.fail(f.org1, "more than 4320 minutes before", "CreateOrUpdateInvoice", stale)
+
+	// Five late recordings, two more than tolerated, cost 2 points each
+	for i := 1; i <= 5; i++ {
+		late := invoiceArg(fmt.Sprintf("P%d", i), "S1", "purchase", lineArg("milk", "2027-03-10", 1, 1))
+		late["timestamp"] = "2026-03-01T08:00:00Z"
+		f.ok(f.org1, "CreateOrUpdateInvoice", late)
+	}
+	var lateRecordings []LateRecording
+	f.get(&lateRecordings, f.regulator, "GetLateRecordings", "S1")
+	if len(lateRecordings) != 5 || lateRecordings[0].DelayMinutes != 120 || lateRecordings[0].RecordedAt != "2026-03-01T10:00:00Z" {
+		t.Fatalf("unexpected late recordings %+v", lateRecordings)
+	}
+	f.get(&lateRecordings, f.regulator, "GetLateRecordings", "S2")
+	if len(lateRecordings) != 0 {
+		t.Fatalf("unexpected late recordings for S2 %+v", lateRecordings)
+	}
+	if rise := f.storeSummary("S1").StoreRISE.TotalRISEIndex; math.Abs(rise-(100-96)) > 1e-9 {
+		t.Fatalf("expected a lateness penalty of 4, RISE index %v", rise)
+	}
+
+	// Recordings older than the window no longer count
+	f.now = f.now.AddDate(0, 0, defaultRecordingPolicy().LatenessWindowDays+1)
+	if rise := f.storeSummary("S1").StoreRISE.TotalRISEIndex; math.Abs(rise-(100-100)) > 1e-9 {
+		t.Fatalf("expected no lateness penalty, RISE index %v", rise)
+	}
+}
+
+func TestBackdatedSaleOfExpiredStock(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2026-03-05", 10, 1)))
+
+	// Recorded the day after expiry, the sale is dated within the window to the expiry date
+	f.now = time.Date(2026, 3, 6, 1, 0, 0, 0, time.UTC)
+	backdated := invoiceArg("X1", "S1", "sales", lineArg("milk", "2026-03-05", 2, 2))
+	backdated["date"] = "2026-03-05"
+	backdated["timestamp"] = "2026-03-04T19:00:00Z"
+	f.ok(f.org1, "CreateOrUpdateInvoice", backdated)
+
+	var invalidations []Invalidation
+	f.get(&invalidations, f.regulator, "GetInvalidations", "S1")
+	if len(invalidations) != 1 || invalidations[0].InvoiceID != "X1" || invalidations[0].Reason != invalidExpired {
+		t.Fatalf("backdated sale of expired stock not flagged: %+v", invalidations)
+	}
+}
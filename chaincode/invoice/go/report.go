@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// InvoiceTypeTotals structure
+type InvoiceTypeTotals struct {
+	InvoiceType  string           `json:"invoice_type"`
+	InvoiceCount int              `json:"invoice_count"` // invoices counting toward the store's totals
+	PendingCount int              `json:"pending_count"`
+	HeldCount    int              `json:"held_count"` // purchases held until they match their order and receipt
+	VoidedCount  int              `json:"voided_count"`
+	BaseQuantity float64          `json:"base_quantity"`
+	AmountsMinor map[string]int64 `json:"amounts_minor"`                                // invoice totals by currency
+	PrivateCount int              `json:"private_count,omitempty" metadata:",optional"` // counted invoices whose amounts are kept in a private collection and left out of AmountsMinor
+}
+
+// InvalidationCount structure
+type InvalidationCount struct {
+	Reason   string `json:"reason"`
+	Count    int    `json:"count"`
+	Reversed int    `json:"reversed"`
+}
+
+// IndexPoint structure
+type IndexPoint struct {
+	ItemKey   ItemKey `json:"item_key"`
+	Timestamp string  `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// IntegrityFailure structure
+type IntegrityFailure struct {
+	InvoiceID string `json:"invoice_id"`
+	Check     string `json:"check"` // 'transaction_hash', 'content_hash' or 'version_chain'
+}
+
+// IntegrityResult structure
+type IntegrityResult struct {
+	InvoicesChecked int                `json:"invoices_checked"`
+	Failures        []IntegrityFailure `json:"failures,omitempty" metadata:",optional"`
+}
+
+// AuditReport structure
+type AuditReport struct {
+	StoreID           string              `json:"store_id"`
+	From              string              `json:"from"`
+	To                string              `json:"to"`
+	InvoiceCount      int                 `json:"invoice_count"`
+	Totals            []InvoiceTypeTotals `json:"totals,omitempty" metadata:",optional"`
+	Invalidations     []InvalidationCount `json:"invalidations,omitempty" metadata:",optional"`
+	WastageTrajectory []IndexPoint        `json:"wastage_trajectory,omitempty" metadata:",optional"`
+	RISETrajectory    []IndexPoint        `json:"rise_trajectory,omitempty" metadata:",optional"`
+	AverageRISE       float64             `json:"average_rise"`
+	RewardOrPenalty   float64             `json:"reward_or_penalty"` // positive rewards, negative corrective measures
+	Integrity         IntegrityResult     `json:"integrity"`
+	ReportHash        string              `json:"report_hash"` // SHA-256 of the report with this field empty
+}
+
+// AuditReportAnchor structure
+type AuditReportAnchor struct {
+	DocType    string `json:"doc_type"`
+	StoreID    string `json:"store_id"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	ReportHash string `json:"report_hash"`
+	AnchoredBy string `json:"anchored_by"`
+	AnchoredAt string `json:"anchored_at"`
+}
+
+// Ledger key of the anchored report of a store for a period
+func auditReportAnchorKey(storeID string, from string, to string) string {
+	return fmt.Sprintf("AUDIT_REPORT_%s_%s_%s", storeID, from, to)
+}
+
+// Compile the audit report of a store for the invoices dated within a period, both dates inclusive
+func (s *SmartContract) GenerateAuditReport(ctx contractapi.TransactionContextInterface, storeID string, from string, to string) (AuditReport, error) {
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return AuditReport{}, err
+	}
+
+	// Reports are available to regulators, auditors and the store's own organisation
+	if requireRole(ctx, roleRegulator, roleAuditor) != nil {
+		err = requireStoreOwner(ctx, store)
+		if err != nil {
+			return AuditReport{}, err
+		}
+	}
+
+	return s.compileAuditReport(ctx, store, from, to)
+}
+
+// Anchor the hash of a store's audit report for a period, restricted to regulators; the report is
+// compiled with GenerateAuditReport in a query so that every endorser anchors the same hash
+func (s *SmartContract) AnchorAuditReport(ctx contractapi.TransactionContextInterface, storeID string, from string, to string, reportHash string) error {
+	err := requireRole(ctx, roleRegulator)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.GetStore(ctx, storeID)
+	if err != nil {
+		return err
+	}
+	err = validateReportPeriod(from, to)
+	if err != nil {
+		return err
+	}
+	if decoded, err := hex.DecodeString(reportHash); err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("report hash must be a hex-encoded SHA-256 digest, got %q", reportHash)
+	}
+
+	existingJSON, err := ctx.GetStub().GetState(auditReportAnchorKey(storeID, from, to))
+	if err != nil {
+		return err
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("audit report of store %s for %s to %s is already anchored", storeID, from, to)
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	anchor := AuditReportAnchor{
+		DocType:    "audit_report_anchor",
+		StoreID:    storeID,
+		From:       from,
+		To:         to,
+		ReportHash: reportHash,
+		AnchoredBy: signer,
+		AnchoredAt: now.Format(time.RFC3339),
+	}
+
+	anchorJSON, err := json.Marshal(anchor)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(auditReportAnchorKey(storeID, from, to), anchorJSON)
+}
+
+// Retrieve the anchored hash of a store's audit report for a period
+func (s *SmartContract) GetAuditReportAnchor(ctx contractapi.TransactionContextInterface, storeID string, from string, to string) (AuditReportAnchor, error) {
+	anchorJSON, err := ctx.GetStub().GetState(auditReportAnchorKey(storeID, from, to))
+	if err != nil {
+		return AuditReportAnchor{}, err
+	}
+	if anchorJSON == nil {
+		return AuditReportAnchor{}, fmt.Errorf("Audit report anchor not found for store %s from %s to %s", storeID, from, to)
+	}
+
+	var anchor AuditReportAnchor
+	err = json.Unmarshal(anchorJSON, &anchor)
+	if err != nil {
+		return AuditReportAnchor{}, err
+	}
+
+	return anchor, nil
+}
+
+// Compile an audit report and hash it
+func (s *SmartContract) compileAuditReport(ctx contractapi.TransactionContextInterface, store Store, from string, to string) (AuditReport, error) {
+	err := validateReportPeriod(from, to)
+	if err != nil {
+		return AuditReport{}, err
+	}
+
+	report := AuditReport{
+		StoreID:   store.StoreID,
+		From:      from,
+		To:        to,
+		Integrity: IntegrityResult{Failures: []IntegrityFailure{}},
+	}
+
+	err = s.addInvoiceTotals(ctx, &report)
+	if err != nil {
+		return AuditReport{}, err
+	}
+
+	err = s.addInvalidationCounts(ctx, &report)
+	if err != nil {
+		return AuditReport{}, err
+	}
+
+	err = s.addIndexTrajectories(ctx, &report)
+	if err != nil {
+		return AuditReport{}, err
+	}
+
+	summary, err := s.getStoreIndexSummary(ctx, store)
+	if err != nil {
+		return AuditReport{}, err
+	}
+	if summary.StoreRISE.NumItemKeys > 0 {
+		report.AverageRISE = summary.StoreRISE.TotalRISEIndex / float64(summary.StoreRISE.NumItemKeys)
+	}
+	report.RewardOrPenalty, err = s.RewardAndCorrectiveSystem(ctx, store.StoreID, report.AverageRISE)
+	if err != nil {
+		return AuditReport{}, err
+	}
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return AuditReport{}, err
+	}
+	hash := sha256.Sum256(reportJSON)
+	report.ReportHash = hex.EncodeToString(hash[:])
+
+	return report, nil
+}
+
+// Check that a report period is given as two dates, the end not before the start
+func validateReportPeriod(from string, to string) error {
+	fromDate, err := time.Parse("2006-01-02", from)
+	if err != nil {
+		return fmt.Errorf("invalid report start date: %q", from)
+	}
+	toDate, err := time.Parse("2006-01-02", to)
+	if err != nil {
+		return fmt.Errorf("invalid report end date: %q", to)
+	}
+	if toDate.Before(fromDate) {
+		return fmt.Errorf("report period ends on %s before it starts on %s", to, from)
+	}
+	return nil
+}
+
+// Count and total the invoices of the report period by type and check their integrity
+func (s *SmartContract) addInvoiceTotals(ctx contractapi.TransactionContextInterface, report *AuditReport) error {
+	queryString := fmt.Sprintf(`{"selector":{"store_id":"%s","date":{"$gte":"%s","$lte":"%s"}}}`, report.StoreID, report.From, report.To)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	totals := map[string]*InvoiceTypeTotals{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+
+		var invoice Invoice
+		err = json.Unmarshal(queryResponse.Value, &invoice)
+		if err != nil {
+			return err
+		}
+		if queryResponse.Key != invoice.InvoiceID {
+			continue
+		}
+
+		typeTotals, found := totals[invoice.InvoiceType]
+		if !found {
+			typeTotals = &InvoiceTypeTotals{InvoiceType: invoice.InvoiceType, AmountsMinor: map[string]int64{}}
+			totals[invoice.InvoiceType] = typeTotals
+		}
+
+		report.InvoiceCount++
+		switch {
+		case invoice.Status == invoiceVoided:
+			typeTotals.VoidedCount++
+		case invoice.Status == invoicePending:
+			typeTotals.PendingCount++
+		case invoice.Status == invoiceHeld:
+			typeTotals.HeldCount++
+		case countsTowardTotals(invoice):
+			typeTotals.InvoiceCount++
+			if invoice.PricingHash != "" {
+				typeTotals.PrivateCount++
+			} else {
+				typeTotals.AmountsMinor[invoice.Currency] += invoice.TotalAmountMinor
+			}
+			for _, item := range invoice.Items {
+				typeTotals.BaseQuantity += baseQuantity(item)
+			}
+		}
+
+		failures, err := s.checkInvoiceIntegrity(ctx, invoice)
+		if err != nil {
+			return err
+		}
+		report.Integrity.InvoicesChecked++
+		report.Integrity.Failures = append(report.Integrity.Failures, failures...)
+	}
+
+	report.Totals = []InvoiceTypeTotals{}
+	for _, typeTotals := range totals {
+		report.Totals = append(report.Totals, *typeTotals)
+	}
+	sort.Slice(report.Totals, func(i, j int) bool {
+		return report.Totals[i].InvoiceType < report.Totals[j].InvoiceType
+	})
+
+	return nil
+}
+
+// Recompute the hashes of an invoice and check the link to the version it amended
+func (s *SmartContract) checkInvoiceIntegrity(ctx contractapi.TransactionContextInterface, invoice Invoice) ([]IntegrityFailure, error) {
+	var failures []IntegrityFailure
+
+	// Invoices recorded before versioning stored the previous record itself rather than its hash
+	expected := invoice
+	if invoice.Version == 0 {
+		expected.PrevBlockHash = ""
+	}
+	if generateBlockHash(expected) != invoice.TransactionHash {
+		failures = append(failures, IntegrityFailure{InvoiceID: invoice.InvoiceID, Check: "transaction_hash"})
+	}
+	if invoice.ContentHash != "" && contentHash(invoice) != invoice.ContentHash {
+		failures = append(failures, IntegrityFailure{InvoiceID: invoice.InvoiceID, Check: "content_hash"})
+	}
+
+	if invoice.Version > 1 {
+		versionKey, err := invoiceVersionKey(ctx, invoice.InvoiceID, invoice.Version-1)
+		if err != nil {
+			return nil, err
+		}
+		versionJSON, err := ctx.GetStub().GetState(versionKey)
+		if err != nil {
+			return nil, err
+		}
+		var version InvoiceVersion
+		if versionJSON != nil {
+			err = json.Unmarshal(versionJSON, &version)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if versionJSON == nil || version.Invoice.TransactionHash != invoice.PrevBlockHash {
+			failures = append(failures, IntegrityFailure{InvoiceID: invoice.InvoiceID, Check: "version_chain"})
+		}
+	}
+
+	return failures, nil
+}
+
+// Count the invalidations recorded in the report period by reason
+func (s *SmartContract) addInvalidationCounts(ctx contractapi.TransactionContextInterface, report *AuditReport) error {
+	invalidations, err := s.GetInvalidations(ctx, report.StoreID)
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]*InvalidationCount{}
+	for _, invalidation := range invalidations {
+		if !withinPeriod(invalidation.InvalidatedAt, report.From, report.To) {
+			continue
+		}
+
+		count, found := counts[invalidation.Reason]
+		if !found {
+			count = &InvalidationCount{Reason: invalidation.Reason}
+			counts[invalidation.Reason] = count
+		}
+		count.Count++
+		if invalidation.Status == invalidationReversed {
+			count.Reversed++
+		}
+	}
+
+	report.Invalidations = []InvalidationCount{}
+	for _, count := range counts {
+		report.Invalidations = append(report.Invalidations, *count)
+	}
+	sort.Slice(report.Invalidations, func(i, j int) bool {
+		return report.Invalidations[i].Reason < report.Invalidations[j].Reason
+	})
+
+	return nil
+}
+
+// Collect the wastage and RISE indices of the report period: the wastage index after every compaction
+// and every stock movement since, the RISE index as of every compaction
+func (s *SmartContract) addIndexTrajectories(ctx contractapi.TransactionContextInterface, report *AuditReport) error {
+	wastageIndices, err := s.getStoreWastageIndices(ctx, report.StoreID)
+	if err != nil {
+		return err
+	}
+
+	report.WastageTrajectory = []IndexPoint{}
+	report.RISETrajectory = []IndexPoint{}
+	for _, wastageIndex := range wastageIndices {
+		itemKey := wastageIndex.ItemKey
+
+		wastagePoints, err := s.indexHistory(ctx, wastageIndexKey(report.StoreID, itemKey), itemKey, report.From, report.To, func(value []byte) (float64, error) {
+			var index WastageIndex
+			err := json.Unmarshal(value, &index)
+			return index.Wastage, err
+		})
+		if err != nil {
+			return err
+		}
+		report.WastageTrajectory = append(report.WastageTrajectory, wastagePoints...)
+
+		// Movements not compacted yet continue from the compacted index
+		wastageIndex, err := s.getCompactedWastageIndex(ctx, report.StoreID, itemKey)
+		if err != nil {
+			return err
+		}
+		deltas, err := s.getStockDeltas(ctx, report.StoreID, itemKey)
+		if err != nil {
+			return err
+		}
+		for _, delta := range deltas {
+			applyStockDelta(&wastageIndex, delta)
+			if withinPeriod(delta.RecordedAt, report.From, report.To) {
+				report.WastageTrajectory = append(report.WastageTrajectory, IndexPoint{ItemKey: itemKey, Timestamp: delta.RecordedAt, Value: wastageIndex.Wastage})
+			}
+		}
+
+		risePoints, err := s.indexHistory(ctx, riseIndexKey(report.StoreID, itemKey), itemKey, report.From, report.To, func(value []byte) (float64, error) {
+			var index RISEIndex
+			err := json.Unmarshal(value, &index)
+			return index.RISEIndex, err
+		})
+		if err != nil {
+			return err
+		}
+		report.RISETrajectory = append(report.RISETrajectory, risePoints...)
+	}
+
+	sortIndexPoints(report.WastageTrajectory)
+	sortIndexPoints(report.RISETrajectory)
+
+	return nil
+}
+
+// Read the values written to an index key during a period
+func (s *SmartContract) indexHistory(ctx contractapi.TransactionContextInterface, key string, itemKey ItemKey, from string, to string, value func([]byte) (float64, error)) ([]IndexPoint, error) {
+	historyIterator, err := ctx.GetStub().GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer historyIterator.Close()
+
+	var points []IndexPoint
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if modification.IsDelete || modification.Timestamp == nil {
+			continue
+		}
+
+		timestamp := modification.Timestamp.AsTime().UTC().Format(time.RFC3339)
+		if !withinPeriod(timestamp, from, to) {
+			continue
+		}
+
+		point := IndexPoint{ItemKey: itemKey, Timestamp: timestamp}
+		point.Value, err = value(modification.Value)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+
+	return points, nil
+}
+
+// Order index points by time, then by item key
+func sortIndexPoints(points []IndexPoint) {
+	sort.SliceStable(points, func(i, j int) bool {
+		if points[i].Timestamp != points[j].Timestamp {
+			return points[i].Timestamp < points[j].Timestamp
+		}
+		if points[i].ItemKey.ItemID != points[j].ItemKey.ItemID {
+			return points[i].ItemKey.ItemID < points[j].ItemKey.ItemID
+		}
+		return points[i].ItemKey.ExpiryDate < points[j].ItemKey.ExpiryDate
+	})
+}
+
+// Check whether an RFC3339 timestamp falls on a date within a period, both dates inclusive
+func withinPeriod(timestamp string, from string, to string) bool {
+	if len(timestamp) < len("2006-01-02") {
+		return false
+	}
+	date := timestamp[:len("2006-01-02")]
+	return date >= from && date <= to
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func TestAuditReport(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 10, 1.5)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 4, 2)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X2", "S1", "sales", lineArg("milk", "2027-03-10", 1, 2)))
+	f.ok(f.org1, "VoidInvoice", "X2", "entered_in_error", "wrong till")
+
+	f.fail(f.org2, "is owned by Org1MSP", "GenerateAuditReport", "S1", "2026-03-01", "2026-03-31")
+	f.fail(f.regulator, "ends on 2026-02-01 before it starts", "GenerateAuditReport", "S1", "2026-03-01", "2026-02-01")
+
+	var report AuditReport
+	f.get(&report, f.regulator, "GenerateAuditReport", "S1", "2026-03-01", "2026-03-31")
+	if report.InvoiceCount != 3 || len(report.Totals) != 2 || report.Integrity.InvoicesChecked != 3 || len(report.Integrity.Failures) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	purchases, sales := report.Totals[0], report.Totals[1]
+	if purchases.InvoiceType != "purchase" || purchases.AmountsMinor["INR"] != 1500 || purchases.BaseQuantity != 10 {
+		t.Fatalf("unexpected purchase totals %+v", purchases)
+	}
+	if sales.InvoiceCount != 1 || sales.VoidedCount != 1 || sales.AmountsMinor["INR"] != 800 {
+		t.Fatalf("unexpected sales totals %+v", sales)
+	}
+
+	// The hash covers the report with the hash left empty
+	hash := report.ReportHash
+	report.ReportHash = ""
+	reportJSON, _ := json.Marshal(report)
+	digest := sha256.Sum256(reportJSON)
+	if hex.EncodeToString(digest[:]) != hash {
+		t.Fatal("report hash does not cover the report")
+	}
+
+	// The regulator anchors the hash of the report it generated
+	f.fail(f.auditor, "not permitted", "AnchorAuditReport", "S1", "2026-03-01", "2026-03-31", hash)
+	f.fail(f.regulator, "hex-encoded SHA-256 digest", "AnchorAuditReport", "S1", "2026-03-01", "2026-03-31", "abc")
+	f.fail(f.regulator, "invalid report end date", "AnchorAuditReport", "S1", "2026-03-01", "March", hash)
+	f.ok(f.regulator, "AnchorAuditReport", "S1", "2026-03-01", "2026-03-31", hash)
+	f.fail(f.regulator, "already anchored", "AnchorAuditReport", "S1", "2026-03-01", "2026-03-31", hash)
+
+	var anchor AuditReportAnchor
+	f.get(&anchor, f.org1, "GetAuditReportAnchor", "S1", "2026-03-01", "2026-03-31")
+	if anchor.ReportHash != hash || anchor.AnchoredAt != "2026-03-01T10:00:00Z" {
+		t.Fatalf("unexpected anchor %+v", anchor)
+	}
+	var regenerated AuditReport
+	f.get(&regenerated, f.org1, "GenerateAuditReport", "S1", "2026-03-01", "2026-03-31")
+	if regenerated.ReportHash != anchor.ReportHash {
+		t.Fatal("regenerated report does not match the anchor")
+	}
+}
+
+func TestAuditReportHeldPurchases(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.regulator, "SetStoreControls", "S1", StoreControls{RequirePurchaseOrders: true})
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 10, 1.5)))
+
+	// A purchase held for matching is reported apart and adds nothing to the totals
+	var report AuditReport
+	f.get(&report, f.auditor, "GenerateAuditReport", "S1", "2026-03-01", "2026-03-31")
+	if len(report.Totals) != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	purchases := report.Totals[0]
+	if purchases.HeldCount != 1 || purchases.InvoiceCount != 0 || purchases.BaseQuantity != 0 || purchases.AmountsMinor["INR"] != 0 {
+		t.Fatalf("held purchase counted toward the totals %+v", purchases)
+	}
+}
+
+func TestAuditReportPrivatePricing(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.regulator, "SetStoreControls", "S1", StoreControls{PricingCollection: "Org1PricingCollection"})
+
+	pricing := map[string]interface{}{
+		"total_amount_minor": 1500, "tax_amount_minor": 0, "salt": pricingSalt("P1"),
+		"lines": []map[string]interface{}{{"item_id": "milk", "expiry_date": "2027-03-10", "price_per_unit_minor": 150, "total_price_minor": 1500, "tax_amount_minor": 0}},
+	}
+	f.okTransient(f.org1, map[string]interface{}{transientPricingKey: pricing}, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 10, 0)))
+
+	var report AuditReport
+	f.get(&report, f.auditor, "GenerateAuditReport", "S1", "2026-03-01", "2026-03-01")
+	purchases := report.Totals[0]
+	if purchases.InvoiceCount != 1 || purchases.PrivateCount != 1 || len(purchases.AmountsMinor) != 0 {
+		t.Fatalf("private amounts not reported as withheld: %+v", purchases)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// TerminalSequence structure, the sequence numbers a terminal has reported
+type TerminalSequence struct {
+	DocType       string `json:"doc_type"`
+	StoreID       string `json:"store_id"`
+	TerminalID    string `json:"terminal_id"`
+	FirstSequence int64  `json:"first_sequence"`
+	LastSequence  int64  `json:"last_sequence"`
+	Reported      int64  `json:"reported"` // distinct sequence numbers recorded, fewer than the span when there are gaps
+	UpdatedAt     string `json:"updated_at"`
+}
+
+// SequenceMarker structure, claiming one sequence number of a terminal for an invoice
+type SequenceMarker struct {
+	DocType        string `json:"doc_type"`
+	StoreID        string `json:"store_id"`
+	TerminalID     string `json:"terminal_id"`
+	SequenceNumber int64  `json:"sequence_number"`
+	InvoiceID      string `json:"invoice_id"`
+}
+
+// SequenceGap structure, a run of sequence numbers never reported by a terminal, counting from 1
+type SequenceGap struct {
+	TerminalID string `json:"terminal_id"`
+	From       int64  `json:"from"`
+	To         int64  `json:"to"` // inclusive
+	Missing    int64  `json:"missing"`
+}
+
+// Composite key object types of terminal sequence summaries and claimed sequence numbers
+const (
+	terminalSequenceObjectType = "TERMINAL_SEQUENCE"
+	sequenceMarkerObjectType   = "SEQUENCE"
+)
+
+// Ledger key of the sequence summary of a terminal
+func terminalSequenceKey(ctx contractapi.TransactionContextInterface, storeID string, terminalID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(terminalSequenceObjectType, []string{storeID, terminalID})
+}
+
+// Ledger key of a claimed sequence number, zero-padded so that scans return numbers in order
+func sequenceMarkerKey(ctx contractapi.TransactionContextInterface, storeID string, terminalID string, sequenceNumber int64) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(sequenceMarkerObjectType, []string{storeID, terminalID, fmt.Sprintf("%020d", sequenceNumber)})
+}
+
+// List the sequence numbers missing up to the last number reported by each terminal of a store,
+// counting from 1, restricted to the store's organisation, auditors and regulators
+func (s *SmartContract) GetSequenceGaps(ctx contractapi.TransactionContextInterface, storeID string) ([]SequenceGap, error) {
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil && requireRole(ctx, roleAuditor, roleRegulator) != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(terminalSequenceObjectType, []string{storeID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	gaps := []SequenceGap{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var terminalSequence TerminalSequence
+		err = json.Unmarshal(queryResponse.Value, &terminalSequence)
+		if err != nil {
+			return nil, err
+		}
+		if terminalSequence.StoreID != storeID {
+			continue
+		}
+
+		// Terminals that reported every number up to their last need no scan
+		if terminalSequence.Reported == terminalSequence.LastSequence {
+			continue
+		}
+
+		terminalGaps, err := s.getTerminalGaps(ctx, terminalSequence)
+		if err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, terminalGaps...)
+	}
+
+	return gaps, nil
+}
+
+// Claim the sequence number of a new invoice for its terminal; sales of stores that require
+// sequence numbers must carry one
+func (s *SmartContract) recordSequenceNumber(ctx contractapi.TransactionContextInterface, invoice Invoice) error {
+	if invoice.TerminalID == "" && invoice.SequenceNumber == 0 {
+		store, err := s.GetStore(ctx, invoice.StoreID)
+		if err != nil {
+			return err
+		}
+		if store.RequireSequenceNumbers && invoice.InvoiceType == "sales" {
+			return fmt.Errorf("store %s requires sales invoices to carry a terminal ID and sequence number", invoice.StoreID)
+		}
+		return nil
+	}
+	if invoice.TerminalID == "" || invoice.SequenceNumber <= 0 {
+		return fmt.Errorf("invoice %s requires both a terminal ID and a positive sequence number", invoice.InvoiceID)
+	}
+
+	// Only an active till or reader registered to the store numbers its invoices, so a store
+	// cannot hide gaps behind terminals made up for the purpose
+	terminal, err := s.GetDevice(ctx, invoice.TerminalID)
+	if err != nil {
+		return err
+	}
+	if terminal.StoreID != invoice.StoreID {
+		return fmt.Errorf("terminal %s belongs to store %s, not %s", terminal.DeviceID, terminal.StoreID, invoice.StoreID)
+	}
+	if terminal.DeviceType != devicePOS && terminal.DeviceType != deviceRFID {
+		return fmt.Errorf("device %s is a %s and cannot number invoices", terminal.DeviceID, terminal.DeviceType)
+	}
+	if terminal.Status != deviceActive {
+		return fmt.Errorf("terminal %s is %s", terminal.DeviceID, terminal.Status)
+	}
+
+	// A signed invoice is numbered by the device that signed it
+	if invoice.DeviceID != "" && invoice.DeviceID != invoice.TerminalID {
+		return fmt.Errorf("invoice %s was signed by device %s but numbered by terminal %s", invoice.InvoiceID, invoice.DeviceID, invoice.TerminalID)
+	}
+
+	markerKey, err := sequenceMarkerKey(ctx, invoice.StoreID, invoice.TerminalID, invoice.SequenceNumber)
+	if err != nil {
+		return err
+	}
+	markerJSON, err := ctx.GetStub().GetState(markerKey)
+	if err != nil {
+		return err
+	}
+	if markerJSON != nil {
+		var marker SequenceMarker
+		err = json.Unmarshal(markerJSON, &marker)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("sequence number %d of terminal %s was already used by invoice %s", invoice.SequenceNumber, invoice.TerminalID, marker.InvoiceID)
+	}
+
+	terminalSequence, err := s.getTerminalSequence(ctx, invoice.StoreID, invoice.TerminalID)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A number below the last one fills a gap, one above it may open a new gap
+	if terminalSequence.Reported == 0 || invoice.SequenceNumber < terminalSequence.FirstSequence {
+		terminalSequence.FirstSequence = invoice.SequenceNumber
+	}
+	if invoice.SequenceNumber > terminalSequence.LastSequence {
+		terminalSequence.LastSequence = invoice.SequenceNumber
+	}
+	terminalSequence.Reported++
+	terminalSequence.UpdatedAt = now.Format(time.RFC3339)
+
+	marker := SequenceMarker{
+		DocType:        "sequence_marker",
+		StoreID:        invoice.StoreID,
+		TerminalID:     invoice.TerminalID,
+		SequenceNumber: invoice.SequenceNumber,
+		InvoiceID:      invoice.InvoiceID,
+	}
+	markerJSON, err = json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(markerKey, markerJSON)
+	if err != nil {
+		return err
+	}
+
+	terminalSequenceJSON, err := json.Marshal(terminalSequence)
+	if err != nil {
+		return err
+	}
+
+	sequenceKey, err := terminalSequenceKey(ctx, invoice.StoreID, invoice.TerminalID)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(sequenceKey, terminalSequenceJSON)
+}
+
+// Retrieve the sequence summary of a terminal, empty for a terminal not seen before
+func (s *SmartContract) getTerminalSequence(ctx contractapi.TransactionContextInterface, storeID string, terminalID string) (TerminalSequence, error) {
+	sequenceKey, err := terminalSequenceKey(ctx, storeID, terminalID)
+	if err != nil {
+		return TerminalSequence{}, err
+	}
+	terminalSequenceJSON, err := ctx.GetStub().GetState(sequenceKey)
+	if err != nil {
+		return TerminalSequence{}, err
+	}
+	if terminalSequenceJSON == nil {
+		return TerminalSequence{DocType: "terminal_sequence", StoreID: storeID, TerminalID: terminalID}, nil
+	}
+
+	var terminalSequence TerminalSequence
+	err = json.Unmarshal(terminalSequenceJSON, &terminalSequence)
+	if err != nil {
+		return TerminalSequence{}, err
+	}
+
+	return terminalSequence, nil
+}
+
+// Walk the claimed sequence numbers of a terminal in order and collect the runs before and between them
+func (s *SmartContract) getTerminalGaps(ctx contractapi.TransactionContextInterface, terminalSequence TerminalSequence) ([]SequenceGap, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(sequenceMarkerObjectType, []string{terminalSequence.StoreID, terminalSequence.TerminalID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var gaps []SequenceGap
+	var expected int64 = 1
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var marker SequenceMarker
+		err = json.Unmarshal(queryResponse.Value, &marker)
+		if err != nil {
+			return nil, err
+		}
+		if marker.StoreID != terminalSequence.StoreID || marker.TerminalID != terminalSequence.TerminalID {
+			continue
+		}
+
+		if marker.SequenceNumber > expected {
+			gaps = append(gaps, SequenceGap{
+				TerminalID: terminalSequence.TerminalID,
+				From:       expected,
+				To:         marker.SequenceNumber - 1,
+				Missing:    marker.SequenceNumber - expected,
+			})
+		}
+		expected = marker.SequenceNumber + 1
+	}
+
+	return gaps, nil
+}
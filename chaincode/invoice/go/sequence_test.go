@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+func sequencedSaleArg(invoiceID string, storeID string, terminalID string, sequenceNumber int64) map[string]interface{} {
+	sale := invoiceArg(invoiceID, storeID, "sales", lineArg("milk", "2027-03-10", 1, 2))
+	sale["terminal_id"] = terminalID
+	sale["sequence_number"] = sequenceNumber
+	return sale
+}
+
+// Register a device of a store that may number its invoices
+func registerTerminal(f *fixture, caller identity, terminalID string, storeID string, deviceType string) {
+	f.t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f.ok(caller, "RegisterDevice", deviceArg(terminalID, storeID, deviceType, publicKeyPEM(f.t, &key.PublicKey)))
+}
+
+func TestSequenceGaps(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "RegisterStore", storeArg("S1_A", "north", "small"))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P2", "S1_A", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+	registerTerminal(f, f.org1, "A_T", "S1", devicePOS)
+	registerTerminal(f, f.org1, "T", "S1_A", deviceRFID)
+
+	for i, sequenceNumber := range []int64{3, 4, 7} {
+		f.ok(f.org1, "CreateOrUpdateInvoice", sequencedSaleArg(fmt.Sprintf("X%d", i), "S1", "A_T", sequenceNumber))
+	}
+	f.fail(f.org1, "sequence number 4 of terminal A_T was already used by invoice X1", "CreateOrUpdateInvoice", sequencedSaleArg("X9", "S1", "A_T", 4))
+	f.fail(f.org1, "requires both a terminal ID and a positive sequence number", "CreateOrUpdateInvoice", sequencedSaleArg("X9", "S1", "A_T", -1))
+
+	// Terminal T of store S1_A is not terminal A_T of store S1
+	f.ok(f.org1, "CreateOrUpdateInvoice", sequencedSaleArg("Y1", "S1_A", "T", 1))
+	f.ok(f.org1, "CreateOrUpdateInvoice", sequencedSaleArg("Y2", "S1_A", "T", 3))
+
+	f.fail(f.org2, "is owned by Org1MSP", "GetSequenceGaps", "S1")
+	var gaps []SequenceGap
+	f.get(&gaps, f.auditor, "GetSequenceGaps", "S1")
+	expected := []SequenceGap{{TerminalID: "A_T", From: 1, To: 2, Missing: 2}, {TerminalID: "A_T", From: 5, To: 6, Missing: 2}}
+	if fmt.Sprint(gaps) != fmt.Sprint(expected) {
+		t.Fatalf("expected gaps %+v, got %+v", expected, gaps)
+	}
+	f.get(&gaps, f.regulator, "GetSequenceGaps", "S1_A")
+	if len(gaps) != 1 || gaps[0].TerminalID != "T" || gaps[0].From != 2 || gaps[0].To != 2 {
+		t.Fatalf("unexpected gaps for S1_A %+v", gaps)
+	}
+
+	// A late sale fills its gap
+	f.ok(f.org1, "CreateOrUpdateInvoice", sequencedSaleArg("Y3", "S1_A", "T", 2))
+	f.get(&gaps, f.regulator, "GetSequenceGaps", "S1_A")
+	if len(gaps) != 0 {
+		t.Fatalf("filled gap still reported %+v", gaps)
+	}
+}
+
+func TestRequireSequenceNumbers(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+
+	// Stores cannot impose or lift the requirement on themselves
+	update := storeArg("S1", "north", "large")
+	update["require_sequence_numbers"] = true
+	f.ok(f.org1, "UpdateStore", update)
+	var store Store
+	f.get(&store, f.regulator, "GetStore", "S1")
+	if store.RequireSequenceNumbers {
+		t.Fatal("store imposed its own sequence numbers")
+	}
+
+	f.fail(f.org1, "not permitted", "SetStoreControls", "S1", StoreControls{RequireSequenceNumbers: true})
+	f.ok(f.regulator, "SetStoreControls", "S1", StoreControls{RequireSequenceNumbers: true})
+	registerTerminal(f, f.org1, "T1", "S1", devicePOS)
+	f.fail(f.org1, "requires sales invoices to carry a terminal ID and sequence number", "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 1, 2)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", sequencedSaleArg("X1", "S1", "T1", 1))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P2", "S1", "purchase", lineArg("milk", "2027-03-10", 1, 1)))
+}
+
+func TestSequenceTerminals(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+	registerTerminal(f, f.org1, "T1", "S1", devicePOS)
+	registerTerminal(f, f.org1, "T2", "S1", devicePOS)
+	registerTerminal(f, f.org1, "SENSOR1", "S1", deviceSensor)
+	registerTerminal(f, f.org2, "T3", "S2", devicePOS)
+
+	// Terminals must be the store's own active tills or readers
+	f.fail(f.org1, "Device not found for ID: T9", "CreateOrUpdateInvoice", sequencedSaleArg("X1", "S1", "T9", 1))
+	f.fail(f.org1, "terminal T3 belongs to store S2, not S1", "CreateOrUpdateInvoice", sequencedSaleArg("X1", "S1", "T3", 1))
+	f.fail(f.org1, "is a sensor and cannot number invoices", "CreateOrUpdateInvoice", sequencedSaleArg("X1", "S1", "SENSOR1", 1))
+	f.ok(f.org1, "RevokeDevice", "T2", "stolen")
+	f.fail(f.org1, "terminal T2 is revoked", "CreateOrUpdateInvoice", sequencedSaleArg("X1", "S1", "T2", 1))
+
+	// A signed invoice carries the sequence number of the device that signed it
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f.ok(f.org1, "RegisterDevice", deviceArg("POS1", "S1", devicePOS, publicKeyPEM(t, &key.PublicKey)))
+	signed := func(invoiceID string, terminalID string) map[string]interface{} {
+		sale := sequencedSaleArg(invoiceID, "S1", terminalID, 1)
+		sale["device_id"] = "POS1"
+		return signInvoiceArg(t, sale, key)
+	}
+	f.fail(f.org1, "signed by device POS1 but numbered by terminal T1", "CreateOrUpdateInvoice", signed("X1", "T1"))
+	f.ok(f.org1, "CreateOrUpdateInvoice", signed("X1", "POS1"))
+	f.ok(f.org1, "CreateOrUpdateInvoice", sequencedSaleArg("X2", "S1", "T1", 1))
+}
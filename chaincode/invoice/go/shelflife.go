@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ShortDatedDelivery structure, a purchased lot received with less shelf life than the catalogue minimum
+type ShortDatedDelivery struct {
+	DocType       string  `json:"doc_type"`
+	StoreID       string  `json:"store_id"`
+	InvoiceID     string  `json:"invoice_id"`
+	SupplierMSPID string  `json:"supplier_msp_id,omitempty" metadata:",optional"`
+	ItemKey       ItemKey `json:"item_key"`
+	ReceivedOn    string  `json:"received_on"`
+	RemainingDays int     `json:"remaining_days"` // days from receipt to the lot's printed expiry
+	MinimumDays   int     `json:"minimum_days"`
+	Quantity      float64 `json:"quantity"` // base units received
+	FlaggedAt     string  `json:"flagged_at"`
+}
+
+// SupplierScorecard structure
+type SupplierScorecard struct {
+	SupplierMSPID          string               `json:"supplier_msp_id"`
+	Deliveries             int                  `json:"deliveries"` // live purchase invoices naming the supplier
+	Lines                  int                  `json:"lines"`
+	ShortDatedLines        int                  `json:"short_dated_lines"`
+	ShortDatedRate         float64              `json:"short_dated_rate"`         // percentage of lines received short-dated
+	AverageShelfLifeShare  float64              `json:"average_shelf_life_share"` // remaining shelf life at receipt as a percentage of the catalogue shelf life
+	HeldInvoices           int                  `json:"held_invoices"`            // failing the three-way match
+	UnacknowledgedInvoices int                  `json:"unacknowledged_invoices"`  // still awaiting the supplier's acknowledgement
+	AttributedWastage      float64              `json:"attributed_wastage"`       // base units of short-dated lots left unsold past expiry
+	ShortDatedDeliveries   []ShortDatedDelivery `json:"short_dated_deliveries,omitempty" metadata:",optional"`
+}
+
+// Composite key object type of short-dated deliveries
+const shortDatedObjectType = "SHORT_DATED"
+
+// Ledger key of a short-dated delivery, one per lot of a purchase invoice
+func shortDatedDeliveryKey(ctx contractapi.TransactionContextInterface, storeID string, invoiceID string, itemKey ItemKey) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(shortDatedObjectType, []string{storeID, invoiceID, itemKey.ItemID, itemKey.ExpiryDate})
+}
+
+// Flag the lots of a purchase invoice received with less remaining shelf life than the catalogue minimum,
+// replacing the flags of any version it amends
+func (s *SmartContract) checkReceivedShelfLife(ctx contractapi.TransactionContextInterface, invoice Invoice) error {
+	if invoice.InvoiceType != "purchase" {
+		return nil
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(shortDatedObjectType, []string{invoice.StoreID, invoice.InvoiceID})
+	if err != nil {
+		return err
+	}
+	var staleKeys []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return err
+		}
+		staleKeys = append(staleKeys, queryResponse.Key)
+	}
+	resultsIterator.Close()
+	for _, key := range staleKeys {
+		err = ctx.GetStub().DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	receivedOn, err := time.Parse("2006-01-02", invoice.Date)
+	if err != nil {
+		return fmt.Errorf("invoice %s has an invalid date %q", invoice.InvoiceID, invoice.Date)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Lines of the same lot are received together
+	quantities := make(map[ItemKey]float64)
+	var itemKeys []ItemKey
+	for _, item := range invoice.Items {
+		itemKey := ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate}
+		if _, ok := quantities[itemKey]; !ok {
+			itemKeys = append(itemKeys, itemKey)
+		}
+		quantities[itemKey] += baseQuantity(item)
+	}
+
+	for _, itemKey := range itemKeys {
+		catalogueItem, err := s.GetCatalogueItem(ctx, itemKey.ItemID)
+		if err != nil {
+			return err
+		}
+		minimumDays := minReceiptShelfLife(catalogueItem)
+		if minimumDays == 0 {
+			continue
+		}
+		remainingDays, err := remainingShelfLife(itemKey, receivedOn)
+		if err != nil {
+			return err
+		}
+		if remainingDays >= minimumDays {
+			continue
+		}
+
+		delivery := ShortDatedDelivery{
+			DocType:       "short_dated_delivery",
+			StoreID:       invoice.StoreID,
+			InvoiceID:     invoice.InvoiceID,
+			SupplierMSPID: invoice.SupplierMSPID,
+			ItemKey:       itemKey,
+			ReceivedOn:    invoice.Date,
+			RemainingDays: remainingDays,
+			MinimumDays:   minimumDays,
+			Quantity:      quantities[itemKey],
+			FlaggedAt:     now.Format(time.RFC3339),
+		}
+		deliveryJSON, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		deliveryKey, err := shortDatedDeliveryKey(ctx, invoice.StoreID, invoice.InvoiceID, itemKey)
+		if err != nil {
+			return err
+		}
+		err = ctx.GetStub().PutState(deliveryKey, deliveryJSON)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Retrieve the short-dated deliveries flagged on a store's purchases
+func (s *SmartContract) GetShortDatedDeliveries(ctx contractapi.TransactionContextInterface, storeID string) ([]ShortDatedDelivery, error) {
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil && requireRole(ctx, roleAuditor, roleRegulator) != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(shortDatedObjectType, []string{storeID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	deliveries := []ShortDatedDelivery{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var delivery ShortDatedDelivery
+		err = json.Unmarshal(queryResponse.Value, &delivery)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// Score a supplier on the shelf life it delivers, the wastage left by its short-dated lots and its
+// invoice discrepancies, restricted to the supplier itself, store managers, auditors and regulators;
+// managers only see the short-dated deliveries to their own organisation's stores
+func (s *SmartContract) GetSupplierScorecard(ctx contractapi.TransactionContextInterface, supplierMSPID string) (SupplierScorecard, error) {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return SupplierScorecard{}, err
+	}
+	if mspID != supplierMSPID && requireRole(ctx, roleManager, roleAuditor, roleRegulator) != nil {
+		return SupplierScorecard{}, fmt.Errorf("scorecard of supplier %s is not available to %s", supplierMSPID, mspID)
+	}
+
+	scorecard := SupplierScorecard{SupplierMSPID: supplierMSPID}
+
+	queryString := fmt.Sprintf(`{"selector":{"supplier_msp_id":"%s","invoice_type":"purchase"}}`, supplierMSPID)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return SupplierScorecard{}, err
+	}
+	defer resultsIterator.Close()
+
+	var shareTotal float64
+	var shareLines int
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return SupplierScorecard{}, err
+		}
+
+		var invoice Invoice
+		err = json.Unmarshal(queryResponse.Value, &invoice)
+		if err != nil {
+			return SupplierScorecard{}, err
+		}
+		// Archived copies share the invoice shape but only the live record counts
+		if queryResponse.Key != invoice.InvoiceID || invoice.Status == invoiceVoided {
+			continue
+		}
+
+		scorecard.Deliveries++
+		switch invoice.Status {
+		case invoiceHeld:
+			scorecard.HeldInvoices++
+		case invoicePending:
+			scorecard.UnacknowledgedInvoices++
+		}
+
+		receivedOn, err := time.Parse("2006-01-02", invoice.Date)
+		if err != nil {
+			continue
+		}
+		for _, item := range invoice.Items {
+			scorecard.Lines++
+
+			catalogueItem, err := s.GetCatalogueItem(ctx, item.ItemID)
+			if err != nil || catalogueItem.ShelfLifeDays <= 0 {
+				continue
+			}
+			remainingDays, err := remainingShelfLife(ItemKey{ItemID: item.ItemID, ExpiryDate: item.ExpiryDate}, receivedOn)
+			if err != nil {
+				return SupplierScorecard{}, err
+			}
+			shareTotal += math.Min(math.Max(float64(remainingDays)/float64(catalogueItem.ShelfLifeDays), 0), 1) * 100
+			shareLines++
+		}
+	}
+	if shareLines > 0 {
+		scorecard.AverageShelfLifeShare = shareTotal / float64(shareLines)
+	}
+
+	deliveries, err := s.querySupplierShortDatedDeliveries(ctx, supplierMSPID)
+	if err != nil {
+		return SupplierScorecard{}, err
+	}
+	scorecard.ShortDatedDeliveries = deliveries
+	scorecard.AttributedWastage, err = s.attributedWastage(ctx, deliveries)
+	if err != nil {
+		return SupplierScorecard{}, err
+	}
+
+	// A short-dated record covers every line of its lot on the invoice
+	for _, delivery := range deliveries {
+		invoice, err := s.GetInvoice(ctx, delivery.InvoiceID)
+		if err != nil {
+			return SupplierScorecard{}, err
+		}
+		for _, item := range invoice.Items {
+			if item.ItemID == delivery.ItemKey.ItemID && item.ExpiryDate == delivery.ItemKey.ExpiryDate {
+				scorecard.ShortDatedLines++
+			}
+		}
+	}
+	if scorecard.Lines > 0 {
+		scorecard.ShortDatedRate = float64(scorecard.ShortDatedLines) / float64(scorecard.Lines) * 100
+	}
+
+	// Managers of other organisations see the aggregates but only the deliveries to their own stores
+	if mspID != supplierMSPID && requireRole(ctx, roleAuditor, roleRegulator) != nil {
+		owners := make(map[string]string)
+		visible := []ShortDatedDelivery{}
+		for _, delivery := range deliveries {
+			owner, ok := owners[delivery.StoreID]
+			if !ok {
+				store, err := s.GetStore(ctx, delivery.StoreID)
+				if err != nil {
+					return SupplierScorecard{}, err
+				}
+				owner = store.OwnerMSPID
+				owners[delivery.StoreID] = owner
+			}
+			if owner == mspID {
+				visible = append(visible, delivery)
+			}
+		}
+		scorecard.ShortDatedDeliveries = visible
+	}
+
+	return scorecard, nil
+}
+
+// Retrieve the short-dated deliveries of a supplier on live invoices
+func (s *SmartContract) querySupplierShortDatedDeliveries(ctx contractapi.TransactionContextInterface, supplierMSPID string) ([]ShortDatedDelivery, error) {
+	queryString := fmt.Sprintf(`{"selector":{"doc_type":"short_dated_delivery","supplier_msp_id":"%s"}}`, supplierMSPID)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var deliveries []ShortDatedDelivery
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var delivery ShortDatedDelivery
+		err = json.Unmarshal(queryResponse.Value, &delivery)
+		if err != nil {
+			return nil, err
+		}
+
+		// Voided invoices no longer count against the supplier
+		invoice, err := s.GetInvoice(ctx, delivery.InvoiceID)
+		if err != nil || invoice.Status == invoiceVoided {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].ReceivedOn < deliveries[j].ReceivedOn
+	})
+
+	return deliveries, nil
+}
+
+// Quantity of short-dated lots left unsold once their effective expiry has passed, capped for each
+// delivery by the quantity it brought in and for each lot by what the store still holds
+func (s *SmartContract) attributedWastage(ctx contractapi.TransactionContextInterface, deliveries []ShortDatedDelivery) (float64, error) {
+	now, err := txTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	type storeLot struct {
+		storeID string
+		itemKey ItemKey
+	}
+	unsold := make(map[storeLot]float64)
+	var wastage float64
+	for _, delivery := range deliveries {
+		lot := storeLot{storeID: delivery.StoreID, itemKey: delivery.ItemKey}
+		remaining, ok := unsold[lot]
+		if !ok {
+			store, err := s.GetStore(ctx, delivery.StoreID)
+			if err != nil {
+				return 0, err
+			}
+			location, err := time.LoadLocation(store.TimeZone)
+			if err != nil {
+				location = time.UTC
+			}
+
+			// Stock is only wasted once it passes its printed expiry; shelf life lost to excursions in the
+			// store is the store's doing, not the supplier's
+			if now.In(location).Format("2006-01-02") > delivery.ItemKey.ExpiryDate {
+				_, remaining, err = s.bookInventory(ctx, delivery.StoreID, delivery.ItemKey)
+				if err != nil {
+					return 0, err
+				}
+			}
+			remaining = math.Max(remaining, 0)
+		}
+
+		attributed := math.Min(delivery.Quantity, remaining)
+		wastage += attributed
+		unsold[lot] = remaining - attributed
+	}
+
+	return wastage, nil
+}
+
+// Whole days from a receipt date to the printed expiry of a lot; excursions after receipt shorten the
+// effective expiry but are the store's doing, not the supplier's
+func remainingShelfLife(itemKey ItemKey, receivedOn time.Time) (int, error) {
+	expiry, err := time.Parse("2006-01-02", itemKey.ExpiryDate)
+	if err != nil {
+		return 0, fmt.Errorf("lot %s has an invalid expiry date %q", itemKey.ItemID, itemKey.ExpiryDate)
+	}
+
+	return int(math.Round(expiry.Sub(receivedOn).Hours() / 24)), nil
+}
+
+// Minimum remaining shelf life in days a delivered item must have; perishables without an explicit
+// minimum follow the one-third rule, other items have none
+func minReceiptShelfLife(catalogueItem CatalogueItem) int {
+	if catalogueItem.MinReceiptShelfLifeDays > 0 {
+		return catalogueItem.MinReceiptShelfLifeDays
+	}
+	if catalogueItem.Perishable && catalogueItem.ShelfLifeDays > 0 {
+		return int(math.Ceil(float64(catalogueItem.ShelfLifeDays) / 3))
+	}
+	return 0
+}
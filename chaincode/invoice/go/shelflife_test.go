@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestShortDatedDeliveries(t *testing.T) {
+	f := newFixture(t)
+	milk := catalogueArg("milk", "4006381333931", "each", false, 10, map[string]float64{"case": 12})
+	milk["cold_chain_rules"] = []map[string]interface{}{{"above_celsius": 8, "hours_lost_per_hour": 2, "spoil_after_minutes": 240}}
+	f.ok(f.catalogue, "CreateOrUpdateCatalogueItem", milk)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ok(f.org1, "RegisterDevice", deviceArg("SENSOR1", "S1", deviceSensor, publicKeyPEM(t, &key.PublicKey)))
+
+	deliveries := func() map[string]int {
+		t.Helper()
+		var flagged []ShortDatedDelivery
+		f.get(&flagged, f.regulator, "GetShortDatedDeliveries", "S1")
+		remaining := make(map[string]int)
+		for _, delivery := range flagged {
+			remaining[delivery.InvoiceID] = delivery.RemainingDays
+		}
+		return remaining
+	}
+
+	// Two days left of a ten-day shelf life falls short of the one-third rule
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2026-03-03", 5, 1)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1_A", "S1", "purchase", lineArg("milk", "2026-03-03", 5, 1)))
+	if flagged := deliveries(); len(flagged) != 2 || flagged["P1"] != 2 || flagged["P1_A"] != 2 {
+		t.Fatalf("unexpected short-dated deliveries %v", flagged)
+	}
+
+	// Amending P1 clears its own flag and leaves P1_A's
+	f.ok(f.org1, "AmendInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 5, 1)), "quantity_error", "wrong lot keyed")
+	f.ok(f.manager, "ApproveInvoiceAmendment", "P1", 2)
+	if flagged := deliveries(); len(flagged) != 1 || flagged["P1_A"] != 2 {
+		t.Fatalf("amendment cleared another invoice's flag %v", flagged)
+	}
+
+	// A lot spoiled in the store was not short-dated when the supplier delivered it
+	spoiled := ItemKey{ItemID: "milk", ExpiryDate: "2026-03-10"}
+	f.ok(f.org1, "ReportTemperatureExcursion", excursionArg(t, key, "E1", spoiled, "2026-03-01T00:00:00Z", "2026-03-01T06:00:00Z", 10))
+	purchase := invoiceArg("P2", "S1", "purchase", lineArg("milk", "2026-03-10", 5, 1))
+	purchase["supplier_msp_id"] = "SupMSP"
+	f.ok(f.org1, "CreateOrUpdateInvoice", purchase)
+	if flagged := deliveries(); len(flagged) != 1 {
+		t.Fatalf("delivery flagged for shelf life lost after receipt %v", flagged)
+	}
+	var scorecard SupplierScorecard
+	f.get(&scorecard, f.supplier, "GetSupplierScorecard", "SupMSP")
+	if scorecard.Deliveries != 1 || scorecard.AverageShelfLifeShare != 90 || scorecard.ShortDatedLines != 0 {
+		t.Fatalf("unexpected scorecard %+v", scorecard)
+	}
+}
+
+func TestAttributedWastage(t *testing.T) {
+	f := newFixture(t)
+	milk := catalogueArg("milk", "4006381333931", "each", false, 10, map[string]float64{"case": 12})
+	milk["cold_chain_rules"] = []map[string]interface{}{{"above_celsius": 8, "hours_lost_per_hour": 2, "spoil_after_minutes": 240}}
+	f.ok(f.catalogue, "CreateOrUpdateCatalogueItem", milk)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ok(f.org1, "RegisterDevice", deviceArg("SENSOR1", "S1", deviceSensor, publicKeyPEM(t, &key.PublicKey)))
+
+	short := ItemKey{ItemID: "milk", ExpiryDate: "2026-03-03"}
+	purchase := invoiceArg("P1", "S1", "purchase", lineArg("milk", short.ExpiryDate, 5, 1))
+	purchase["supplier_msp_id"] = "SupMSP"
+	f.ok(f.org1, "CreateOrUpdateInvoice", purchase)
+	f.ok(f.manager, "ReleaseHeldInvoice", "P1", "no order for a top-up delivery")
+	f.ok(f.supplier, "AcknowledgePurchaseInvoice", "P1")
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", short.ExpiryDate, 2, 2)))
+
+	// Spoiling the lot in the store does not charge the supplier before its printed expiry
+	f.ok(f.org1, "ReportTemperatureExcursion", excursionArg(t, key, "E1", short, "2026-03-01T00:00:00Z", "2026-03-01T06:00:00Z", 10))
+	f.now = time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	var scorecard SupplierScorecard
+	f.get(&scorecard, f.supplier, "GetSupplierScorecard", "SupMSP")
+	if scorecard.ShortDatedLines != 1 || scorecard.AttributedWastage != 0 {
+		t.Fatalf("supplier charged for stock spoiled in the store %+v", scorecard)
+	}
+
+	// Past the printed expiry the unsold stock is wasted
+	f.now = time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	f.get(&scorecard, f.supplier, "GetSupplierScorecard", "SupMSP")
+	if scorecard.AttributedWastage != 3 {
+		t.Fatalf("expected 3 units of attributed wastage, got %+v", scorecard)
+	}
+}
+
+func TestSupplierScorecardVisibility(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.catalogue, "CreateOrUpdateCatalogueItem", catalogueArg("milk", "4006381333931", "each", false, 10, map[string]float64{"case": 12}))
+	p1 := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2026-03-03", 5, 1))
+	p1["supplier_msp_id"] = "SupMSP"
+	f.ok(f.org1, "CreateOrUpdateInvoice", p1)
+	p2 := invoiceArg("P2", "S2", "purchase", lineArg("milk", "2026-03-03", 5, 1))
+	p2["supplier_msp_id"] = "SupMSP"
+	f.ok(f.org2, "CreateOrUpdateInvoice", p2)
+
+	storesOf := func(scorecard SupplierScorecard) []string {
+		stores := []string{}
+		for _, delivery := range scorecard.ShortDatedDeliveries {
+			stores = append(stores, delivery.StoreID)
+		}
+		return stores
+	}
+
+	// The supplier, auditors and regulators see every short-dated delivery
+	for _, caller := range []identity{f.supplier, f.auditor, f.regulator} {
+		var scorecard SupplierScorecard
+		f.get(&scorecard, caller, "GetSupplierScorecard", "SupMSP")
+		if len(scorecard.ShortDatedDeliveries) != 2 {
+			t.Fatalf("expected both short-dated deliveries, got %v", storesOf(scorecard))
+		}
+	}
+
+	// Managers share the aggregates but only see the deliveries to their own stores
+	manager2 := newIdentity(t, "Org2MSP", "store2manager", roleManager)
+	for _, manager := range []struct {
+		caller identity
+		store  string
+	}{{f.manager, "S1"}, {manager2, "S2"}} {
+		var scorecard SupplierScorecard
+		f.get(&scorecard, manager.caller, "GetSupplierScorecard", "SupMSP")
+		if stores := storesOf(scorecard); len(stores) != 1 || stores[0] != manager.store {
+			t.Fatalf("manager of %s sees short-dated deliveries of %v", manager.store, stores)
+		}
+		if scorecard.Deliveries != 2 || scorecard.ShortDatedLines != 2 {
+			t.Fatalf("unexpected scorecard aggregates %+v", scorecard)
+		}
+	}
+	f.fail(f.org1, "scorecard of supplier SupMSP is not available to Org1MSP", "GetSupplierScorecard", "SupMSP")
+}
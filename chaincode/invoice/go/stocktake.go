@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// StocktakeLine structure
+type StocktakeLine struct {
+	ItemID          string  `json:"item_id"`
+	ExpiryDate      string  `json:"expiry_date"`
+	CountedQuantity float64 `json:"counted_quantity"`
+	Unit            string  `json:"unit,omitempty" metadata:",optional"`          // defaults to the catalogue base unit
+	CountedBase     float64 `json:"counted_base,omitempty" metadata:",optional"`  // counted quantity converted to the catalogue base unit
+	BookQuantity    float64 `json:"book_quantity,omitempty" metadata:",optional"` // inventory according to the ledger, in base units
+	Variance        float64 `json:"variance,omitempty" metadata:",optional"`      // counted minus book, negative for a loss
+}
+
+// Stocktake structure
+type Stocktake struct {
+	DocType      string          `json:"doc_type"`
+	StocktakeID  string          `json:"stocktake_id"`
+	StoreID      string          `json:"store_id"`
+	Lines        []StocktakeLine `json:"lines,omitempty" metadata:",optional"`
+	TotalLoss    float64         `json:"total_loss"`
+	TotalSurplus float64         `json:"total_surplus"`
+	CountedBy    string          `json:"counted_by"`
+	CountedAt    string          `json:"counted_at"`
+}
+
+// ShrinkageAdjustment structure, correcting book inventory to a physical count
+type ShrinkageAdjustment struct {
+	DocType         string  `json:"doc_type"`
+	StocktakeID     string  `json:"stocktake_id"`
+	StoreID         string  `json:"store_id"`
+	ItemKey         ItemKey `json:"item_key"`
+	BookQuantity    float64 `json:"book_quantity"`
+	CountedQuantity float64 `json:"counted_quantity"`
+	Adjustment      float64 `json:"adjustment"` // counted minus book, negative for a loss
+	RecordedAt      string  `json:"recorded_at"`
+}
+
+// ShrinkageIndex structure, stock lost between the ledger and the shelf for an item key
+type ShrinkageIndex struct {
+	StoreID   string  `json:"store_id"`
+	ItemKey   ItemKey `json:"item_key"`
+	Supply    float64 `json:"supply"`    // purchases and transfers in
+	Loss      float64 `json:"loss"`      // sum of negative adjustments
+	Surplus   float64 `json:"surplus"`   // sum of positive adjustments
+	Shrinkage float64 `json:"shrinkage"` // loss as a percentage of supply
+}
+
+// StoreShrinkage structure
+type StoreShrinkage struct {
+	StoreID        string  `json:"store_id"`
+	NumItemKeys    int     `json:"num_item_keys"`
+	TotalSupply    float64 `json:"total_supply"`
+	TotalLoss      float64 `json:"total_loss"`
+	TotalSurplus   float64 `json:"total_surplus"`
+	ShrinkageIndex float64 `json:"shrinkage_index"` // total loss as a percentage of total supply
+}
+
+// Ledger key of a stocktake
+func stocktakeKey(stocktakeID string) string {
+	return fmt.Sprintf("STOCKTAKE_%s", stocktakeID)
+}
+
+// Ledger key of a shrinkage adjustment
+func shrinkageAdjustmentKey(storeID string, itemKey ItemKey, stocktakeID string) string {
+	return fmt.Sprintf("SHRINKAGE_ADJUSTMENT_%s_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate, stocktakeID)
+}
+
+// Ledger key of the shrinkage index of an item key
+func shrinkageIndexKey(storeID string, itemKey ItemKey) string {
+	return fmt.Sprintf("SHRINKAGE_INDEX_%s_%s_%s", storeID, itemKey.ItemID, itemKey.ExpiryDate)
+}
+
+// Record a physical count, adjust book inventory to it and update the shrinkage indices,
+// restricted to the store's organisation
+func (s *SmartContract) RecordStocktake(ctx contractapi.TransactionContextInterface, stocktakeID string, storeID string, lines []StocktakeLine) (Stocktake, error) {
+	if stocktakeID == "" {
+		return Stocktake{}, fmt.Errorf("stocktake ID is required")
+	}
+	if len(lines) == 0 {
+		return Stocktake{}, fmt.Errorf("stocktake %s has no lines", stocktakeID)
+	}
+
+	existingJSON, err := ctx.GetStub().GetState(stocktakeKey(stocktakeID))
+	if err != nil {
+		return Stocktake{}, err
+	}
+	if existingJSON != nil {
+		return Stocktake{}, fmt.Errorf("stocktake %s already exists", stocktakeID)
+	}
+
+	store, err := s.requireActiveStore(ctx, storeID)
+	if err != nil {
+		return Stocktake{}, err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil {
+		return Stocktake{}, err
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return Stocktake{}, fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return Stocktake{}, err
+	}
+
+	stocktake := Stocktake{
+		DocType:     "stocktake",
+		StocktakeID: stocktakeID,
+		StoreID:     storeID,
+		CountedBy:   signer,
+		CountedAt:   now.Format(time.RFC3339),
+	}
+
+	counted := make(map[ItemKey]bool)
+	for _, line := range lines {
+		itemKey := ItemKey{ItemID: line.ItemID, ExpiryDate: line.ExpiryDate}
+		if counted[itemKey] {
+			return Stocktake{}, fmt.Errorf("stocktake %s counts ItemKey %s more than once", stocktakeID, itemKey)
+		}
+		counted[itemKey] = true
+
+		catalogueItem, err := s.GetCatalogueItem(ctx, line.ItemID)
+		if err != nil {
+			return Stocktake{}, fmt.Errorf("item %s is not in the product catalogue", line.ItemID)
+		}
+		if line.Unit == "" {
+			line.Unit = catalogueItem.UnitOfMeasure
+		}
+		if line.CountedQuantity < 0 {
+			return Stocktake{}, fmt.Errorf("stocktake %s counts a negative quantity of ItemKey %s", stocktakeID, itemKey)
+		}
+		line.CountedBase = 0
+		if line.CountedQuantity > 0 {
+			line.CountedBase, err = toBaseQuantity(catalogueItem, line.CountedQuantity, line.Unit)
+			if err != nil {
+				return Stocktake{}, err
+			}
+		}
+
+		supply, book, err := s.bookInventory(ctx, storeID, itemKey)
+		if err != nil {
+			return Stocktake{}, err
+		}
+		line.BookQuantity = book
+		line.Variance = line.CountedBase - book
+
+		if line.Variance < 0 {
+			stocktake.TotalLoss -= line.Variance
+		} else {
+			stocktake.TotalSurplus += line.Variance
+		}
+		stocktake.Lines = append(stocktake.Lines, line)
+
+		// A count matching the book needs no adjustment
+		if line.Variance == 0 {
+			continue
+		}
+
+		adjustment := ShrinkageAdjustment{
+			DocType:         "shrinkage_adjustment",
+			StocktakeID:     stocktakeID,
+			StoreID:         storeID,
+			ItemKey:         itemKey,
+			BookQuantity:    book,
+			CountedQuantity: line.CountedBase,
+			Adjustment:      line.Variance,
+			RecordedAt:      stocktake.CountedAt,
+		}
+		adjustments, err := s.getShrinkageAdjustments(ctx, storeID, itemKey)
+		if err != nil {
+			return Stocktake{}, err
+		}
+		adjustmentJSON, err := json.Marshal(adjustment)
+		if err != nil {
+			return Stocktake{}, err
+		}
+		err = ctx.GetStub().PutState(shrinkageAdjustmentKey(storeID, itemKey, stocktakeID), adjustmentJSON)
+		if err != nil {
+			return Stocktake{}, err
+		}
+
+		// Writes are not visible to reads in the same transaction, so the new adjustment is added by hand
+		err = s.putShrinkageIndex(ctx, storeID, itemKey, supply, append(adjustments, adjustment))
+		if err != nil {
+			return Stocktake{}, err
+		}
+
+		// The wastage index counts the corrected stock, leaving the loss to the shrinkage index
+		err = s.addStockDelta(ctx, storeID, itemKey, stocktakeID, StockDelta{Adjustments: line.Variance})
+		if err != nil {
+			return Stocktake{}, err
+		}
+	}
+
+	stocktakeJSON, err := json.Marshal(stocktake)
+	if err != nil {
+		return Stocktake{}, err
+	}
+	err = ctx.GetStub().PutState(stocktakeKey(stocktakeID), stocktakeJSON)
+	if err != nil {
+		return Stocktake{}, err
+	}
+
+	return stocktake, nil
+}
+
+// Retrieve a stocktake from the ledger
+func (s *SmartContract) GetStocktake(ctx contractapi.TransactionContextInterface, stocktakeID string) (Stocktake, error) {
+	stocktakeJSON, err := ctx.GetStub().GetState(stocktakeKey(stocktakeID))
+	if err != nil {
+		return Stocktake{}, err
+	}
+	if stocktakeJSON == nil {
+		return Stocktake{}, fmt.Errorf("Stocktake not found for ID: %s", stocktakeID)
+	}
+
+	var stocktake Stocktake
+	err = json.Unmarshal(stocktakeJSON, &stocktake)
+	if err != nil {
+		return Stocktake{}, err
+	}
+
+	return stocktake, nil
+}
+
+// Aggregate the shrinkage indices of a store across its counted item keys
+func (s *SmartContract) GetStoreShrinkage(ctx contractapi.TransactionContextInterface, storeID string) (StoreShrinkage, error) {
+	prefix := fmt.Sprintf("SHRINKAGE_INDEX_%s_", storeID)
+	resultsIterator, err := ctx.GetStub().GetStateByRange(prefix, prefix+"\uffff")
+	if err != nil {
+		return StoreShrinkage{}, err
+	}
+	defer resultsIterator.Close()
+
+	storeShrinkage := StoreShrinkage{StoreID: storeID}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return StoreShrinkage{}, err
+		}
+
+		var shrinkageIndex ShrinkageIndex
+		err = json.Unmarshal(queryResponse.Value, &shrinkageIndex)
+		if err != nil {
+			return StoreShrinkage{}, err
+		}
+		if shrinkageIndex.StoreID != storeID {
+			continue
+		}
+
+		storeShrinkage.NumItemKeys++
+		storeShrinkage.TotalSupply += shrinkageIndex.Supply
+		storeShrinkage.TotalLoss += shrinkageIndex.Loss
+		storeShrinkage.TotalSurplus += shrinkageIndex.Surplus
+	}
+	if storeShrinkage.TotalSupply > 0 {
+		storeShrinkage.ShrinkageIndex = storeShrinkage.TotalLoss / storeShrinkage.TotalSupply * 100
+	}
+
+	return storeShrinkage, nil
+}
+
+// Compute the supply and book inventory of an item key in base units: purchases and transfers in,
+// less sales, transfers out and confirmed recall disposals, corrected by earlier stocktakes; read from
+// the compacted wastage index and the lot's stock deltas, so that a concurrent movement of the same
+// lot fails validation instead of going unseen
+func (s *SmartContract) bookInventory(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) (float64, float64, error) {
+	wastageIndex, err := s.getCompactedWastageIndex(ctx, storeID, itemKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	deltas, err := s.getStockDeltas(ctx, storeID, itemKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, delta := range deltas {
+		applyStockDelta(&wastageIndex, delta)
+	}
+
+	var disposed float64
+	disposalJSON, err := ctx.GetStub().GetState(recallDisposalKey(storeID, itemKey))
+	if err != nil {
+		return 0, 0, err
+	}
+	if disposalJSON != nil {
+		var disposal RecallDisposal
+		err = json.Unmarshal(disposalJSON, &disposal)
+		if err != nil {
+			return 0, 0, err
+		}
+		disposed = disposal.Quantity
+	}
+
+	supply := wastageIndex.TotalPurchase + wastageIndex.TransfersIn
+	book := supply - wastageIndex.TotalSales - wastageIndex.TransfersOut - disposed + wastageIndex.Adjustments
+
+	return supply, book, nil
+}
+
+// Retrieve the shrinkage adjustments of an item key
+func (s *SmartContract) getShrinkageAdjustments(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) ([]ShrinkageAdjustment, error) {
+	prefix := fmt.Sprintf("SHRINKAGE_ADJUSTMENT_%s_%s_%s_", storeID, itemKey.ItemID, itemKey.ExpiryDate)
+	resultsIterator, err := ctx.GetStub().GetStateByRange(prefix, prefix+"\uffff")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var adjustments []ShrinkageAdjustment
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var adjustment ShrinkageAdjustment
+		err = json.Unmarshal(queryResponse.Value, &adjustment)
+		if err != nil {
+			return nil, err
+		}
+		if adjustment.StoreID == storeID && adjustment.ItemKey == itemKey {
+			adjustments = append(adjustments, adjustment)
+		}
+	}
+
+	return adjustments, nil
+}
+
+// Save the shrinkage index of an item key from its adjustments
+func (s *SmartContract) putShrinkageIndex(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey, supply float64, adjustments []ShrinkageAdjustment) error {
+	shrinkageIndex := ShrinkageIndex{
+		StoreID: storeID,
+		ItemKey: itemKey,
+		Supply:  supply,
+	}
+	for _, adjustment := range adjustments {
+		if adjustment.Adjustment < 0 {
+			shrinkageIndex.Loss -= adjustment.Adjustment
+		} else {
+			shrinkageIndex.Surplus += adjustment.Adjustment
+		}
+	}
+	if supply > 0 {
+		shrinkageIndex.Shrinkage = shrinkageIndex.Loss / supply * 100
+	}
+
+	shrinkageIndexJSON, err := json.Marshal(shrinkageIndex)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(shrinkageIndexKey(storeID, itemKey), shrinkageIndexJSON)
+}
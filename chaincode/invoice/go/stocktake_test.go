@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func stocktakeLineArg(itemID string, expiryDate string, counted float64) map[string]interface{} {
+	return map[string]interface{}{"item_id": itemID, "expiry_date": expiryDate, "counted_quantity": counted}
+}
+
+func TestStocktakeShrinkage(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 10, 1)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 2, 2)))
+
+	// Four of the eight on the books are missing from the shelf
+	f.fail(f.org2, "is owned by Org1MSP", "RecordStocktake", "ST1", "S1", []interface{}{stocktakeLineArg("milk", "2027-03-10", 4)})
+	f.ok(f.org1, "RecordStocktake", "ST1", "S1", []interface{}{stocktakeLineArg("milk", "2027-03-10", 4)})
+	f.requireNoDeltaScans("RecordStocktake")
+
+	var shrinkage StoreShrinkage
+	f.get(&shrinkage, f.regulator, "GetStoreShrinkage", "S1")
+	if shrinkage.TotalLoss != 4 || shrinkage.ShrinkageIndex != 40 {
+		t.Fatalf("unexpected shrinkage %+v", shrinkage)
+	}
+
+	// The loss counts toward shrinkage only, wastage is the four left on the shelf
+	if s1 := f.storeSummary("S1"); s1.AverageWastage != 40 {
+		t.Fatalf("shrinkage counted as wastage %+v", s1)
+	}
+	var wastageIndices []WastageIndex
+	f.get(&wastageIndices, f.regulator, "CalculateWastageIndex", "S1", []interface{}{lot("milk", "2027-03-10")})
+	if len(wastageIndices) != 1 || wastageIndices[0].Wastage != 40 || wastageIndices[0].Adjustments != -4 {
+		t.Fatalf("unexpected wastage index %+v", wastageIndices)
+	}
+	f.ok(f.org1, "CompactWastageIndices", "S1")
+	if s1 := f.storeSummary("S1"); s1.AverageWastage != 40 {
+		t.Fatalf("compaction lost the adjustment %+v", s1)
+	}
+
+	// Selling more than the counted stock oversells, though the invoices alone would allow it
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X2", "S1", "sales", lineArg("milk", "2027-03-10", 4, 2)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X3", "S1", "sales", lineArg("milk", "2027-03-10", 1, 2)))
+
+	// The check reads the lot's deltas by key range, so a concurrent sale of the lot fails validation at commit
+	lotDeltas := "\x00" + stockDeltaObjectType + "\x00S1\x00milk\x002027-03-10\x00"
+	scanned := false
+	for _, startKey := range f.stub.rangeReads {
+		scanned = scanned || startKey == lotDeltas
+	}
+	if !scanned {
+		t.Fatalf("oversell check did not read the lot's deltas: %q", f.stub.rangeReads)
+	}
+	f.requireNoDeltaScans("CreateOrUpdateInvoice")
+	var invalidations []Invalidation
+	f.get(&invalidations, f.regulator, "GetInvalidations", "S1")
+	if len(invalidations) != 1 || invalidations[0].InvoiceID != "X3" || invalidations[0].Reason != invalidOversold {
+		t.Fatalf("expected only X3 to be flagged as oversold, got %+v", invalidations)
+	}
+}
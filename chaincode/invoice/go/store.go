@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // chaincode images do not ship a zoneinfo database
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Store states
+const (
+	storeActive   = "active"
+	storeInactive = "inactive"
+)
+
+// Store structure
+type Store struct {
+	DocType                string `json:"doc_type"`
+	StoreID                string `json:"store_id"`
+	OwnerMSPID             string `json:"owner_msp_id"`
+	Name                   string `json:"name"`
+	Region                 string `json:"region"`
+	Chain                  string `json:"chain"` // chain or franchise the store trades under
+	TimeZone               string `json:"time_zone"`
+	SizeCategory           string `json:"size_category"`
+	Status                 string `json:"status"`
+	RegisteredAt           string `json:"registered_at"`
+	UpdatedAt              string `json:"updated_at"`
+	RequireSignedInvoices  bool   `json:"require_signed_invoices,omitempty" metadata:",optional"`  // reject invoices not signed by a registered device, set by a regulator
+	PricingCollection      string `json:"pricing_collection,omitempty" metadata:",optional"`       // private data collection holding the store's invoice amounts, set by a regulator
+	RequireSequenceNumbers bool   `json:"require_sequence_numbers,omitempty" metadata:",optional"` // reject sales invoices without a terminal sequence number, set by a regulator
+	RequirePurchaseOrders  bool   `json:"require_purchase_orders,omitempty" metadata:",optional"`  // hold purchase invoices not matched to an order and receipt, set by a regulator
+}
+
+// StoreControls structure, the controls a regulator imposes on a store
+type StoreControls struct {
+	RequireSignedInvoices  bool   `json:"require_signed_invoices"`
+	RequireSequenceNumbers bool   `json:"require_sequence_numbers"`
+	RequirePurchaseOrders  bool   `json:"require_purchase_orders"`
+	PricingCollection      string `json:"pricing_collection,omitempty" metadata:",optional"` // private data collection holding the store's invoice amounts
+}
+
+// StoreFilter structure, empty fields match any store
+type StoreFilter struct {
+	Region       string `json:"region"`
+	Chain        string `json:"chain"`
+	SizeCategory string `json:"size_category"`
+	Status       string `json:"status"`
+}
+
+// StoreIndexSummary structure
+type StoreIndexSummary struct {
+	Store          Store     `json:"store"`
+	AverageWastage float64   `json:"average_wastage"`
+	StoreRISE      StoreRISE `json:"store_rise"`
+}
+
+// Ledger key of a registered store
+func storeKey(storeID string) string {
+	return fmt.Sprintf("STORE_%s", storeID)
+}
+
+// Register a store owned by the invoking organisation
+func (s *SmartContract) RegisterStore(ctx contractapi.TransactionContextInterface, store Store) error {
+	if store.StoreID == "" {
+		return fmt.Errorf("store ID is required")
+	}
+
+	existingJSON, err := ctx.GetStub().GetState(storeKey(store.StoreID))
+	if err != nil {
+		return err
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("store %s is already registered", store.StoreID)
+	}
+
+	err = validateStoreMetadata(store)
+	if err != nil {
+		return err
+	}
+
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	store.DocType = "store"
+	store.OwnerMSPID = mspID
+	store.Status = storeActive
+	store.RequireSignedInvoices = false
+	store.RequireSequenceNumbers = false
+	store.RequirePurchaseOrders = false
+	store.PricingCollection = ""
+	store.RegisteredAt = now.Format(time.RFC3339)
+	store.UpdatedAt = store.RegisteredAt
+
+	return s.putStore(ctx, store)
+}
+
+// Update the metadata of a store, restricted to its owning organisation
+func (s *SmartContract) UpdateStore(ctx contractapi.TransactionContextInterface, store Store) error {
+	existing, err := s.GetStore(ctx, store.StoreID)
+	if err != nil {
+		return err
+	}
+
+	err = requireStoreOwner(ctx, existing)
+	if err != nil {
+		return err
+	}
+
+	err = validateStoreMetadata(store)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Ownership, status, registration date and regulator controls are not editable through an update
+	existing.Name = store.Name
+	existing.Region = store.Region
+	existing.Chain = store.Chain
+	existing.TimeZone = store.TimeZone
+	existing.SizeCategory = store.SizeCategory
+	existing.UpdatedAt = now.Format(time.RFC3339)
+
+	return s.putStore(ctx, existing)
+}
+
+// Set the controls imposed on a store, restricted to regulators
+func (s *SmartContract) SetStoreControls(ctx contractapi.TransactionContextInterface, storeID string, controls StoreControls) error {
+	err := requireRole(ctx, roleRegulator)
+	if err != nil {
+		return err
+	}
+
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	store.RequireSignedInvoices = controls.RequireSignedInvoices
+	store.RequireSequenceNumbers = controls.RequireSequenceNumbers
+	store.RequirePurchaseOrders = controls.RequirePurchaseOrders
+	store.PricingCollection = controls.PricingCollection
+	store.UpdatedAt = now.Format(time.RFC3339)
+
+	return s.putStore(ctx, store)
+}
+
+// Deactivate a store, restricted to its owning organisation or a regulator
+func (s *SmartContract) DeactivateStore(ctx contractapi.TransactionContextInterface, storeID string) error {
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return err
+	}
+	if store.Status == storeInactive {
+		return fmt.Errorf("store %s is already inactive", storeID)
+	}
+
+	err = requireStoreOwner(ctx, store)
+	if err != nil && requireRole(ctx, roleRegulator) != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	store.Status = storeInactive
+	store.UpdatedAt = now.Format(time.RFC3339)
+
+	return s.putStore(ctx, store)
+}
+
+// Retrieve a store from the registry
+func (s *SmartContract) GetStore(ctx contractapi.TransactionContextInterface, storeID string) (Store, error) {
+	storeJSON, err := ctx.GetStub().GetState(storeKey(storeID))
+	if err != nil {
+		return Store{}, err
+	}
+	if storeJSON == nil {
+		return Store{}, fmt.Errorf("Store not found for ID: %s", storeID)
+	}
+
+	var store Store
+	err = json.Unmarshal(storeJSON, &store)
+	if err != nil {
+		return Store{}, err
+	}
+
+	return store, nil
+}
+
+// Retrieve the indices of every store matching the given attributes
+func (s *SmartContract) QueryStoreIndices(ctx contractapi.TransactionContextInterface, filter StoreFilter) ([]StoreIndexSummary, error) {
+	selector := map[string]interface{}{"doc_type": "store"}
+	if filter.Region != "" {
+		selector["region"] = filter.Region
+	}
+	if filter.Chain != "" {
+		selector["chain"] = filter.Chain
+	}
+	if filter.SizeCategory != "" {
+		selector["size_category"] = filter.SizeCategory
+	}
+	if filter.Status != "" {
+		selector["status"] = filter.Status
+	}
+	queryJSON, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetQueryResult(string(queryJSON))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	summaries := []StoreIndexSummary{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var store Store
+		err = json.Unmarshal(queryResponse.Value, &store)
+		if err != nil {
+			return nil, err
+		}
+
+		summary, err := s.getStoreIndexSummary(ctx, store)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
+
+// Aggregate the stored wastage and RISE indices of a store across its item keys
+func (s *SmartContract) getStoreIndexSummary(ctx contractapi.TransactionContextInterface, store Store) (StoreIndexSummary, error) {
+	summary := StoreIndexSummary{
+		Store:     store,
+		StoreRISE: StoreRISE{StoreID: store.StoreID},
+	}
+
+	wastageIndices, err := s.getStoreWastageIndices(ctx, store.StoreID)
+	if err != nil {
+		return StoreIndexSummary{}, err
+	}
+
+	var totalWastage float64
+	for _, wastageIndex := range wastageIndices {
+		totalWastage += wastageIndex.Wastage
+	}
+	if len(wastageIndices) > 0 {
+		summary.AverageWastage = totalWastage / float64(len(wastageIndices))
+	}
+
+	for _, wastageIndex := range wastageIndices {
+		riseIndex, err := s.getRISEIndex(ctx, store.StoreID, wastageIndex)
+		if err != nil {
+			return StoreIndexSummary{}, err
+		}
+		summary.StoreRISE.TotalRISEIndex += riseIndex.RISEIndex
+		summary.StoreRISE.NumItemKeys++
+	}
+
+	return summary, nil
+}
+
+// Ensure a store is registered and active before it records stock movements
+func (s *SmartContract) requireActiveStore(ctx contractapi.TransactionContextInterface, storeID string) (Store, error) {
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return Store{}, err
+	}
+	if store.Status != storeActive {
+		return Store{}, fmt.Errorf("store %s is %s", storeID, store.Status)
+	}
+	return store, nil
+}
+
+// Ensure the invoking identity belongs to the organisation owning a store
+func requireStoreOwner(ctx contractapi.TransactionContextInterface, store Store) error {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != store.OwnerMSPID {
+		return fmt.Errorf("store %s is owned by %s, not %s", store.StoreID, store.OwnerMSPID, mspID)
+	}
+	return nil
+}
+
+// Validate the user-editable metadata of a store
+func validateStoreMetadata(store Store) error {
+	if strings.TrimSpace(store.Name) == "" {
+		return fmt.Errorf("store %s requires a name", store.StoreID)
+	}
+	if _, err := time.LoadLocation(store.TimeZone); store.TimeZone == "" || err != nil {
+		return fmt.Errorf("store %s has an invalid time zone: %q", store.StoreID, store.TimeZone)
+	}
+	return nil
+}
+
+// Save a store to the ledger
+func (s *SmartContract) putStore(ctx contractapi.TransactionContextInterface, store Store) error {
+	storeJSON, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(storeKey(store.StoreID), storeJSON)
+}
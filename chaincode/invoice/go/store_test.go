@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestStoreRegistry(t *testing.T) {
+	f := newFixture(t)
+
+	f.fail(f.org1, "already registered", "RegisterStore", storeArg("S1", "north", "large"))
+	invalid := storeArg("S3", "north", "large")
+	invalid["time_zone"] = "Mars/Olympus"
+	f.fail(f.org1, "invalid time zone", "RegisterStore", invalid)
+	invalid = storeArg("S3", "north", "large")
+	invalid["name"] = " "
+	f.fail(f.org1, "requires a name", "RegisterStore", invalid)
+
+	var store Store
+	f.get(&store, f.regulator, "GetStore", "S1")
+	if store.OwnerMSPID != "Org1MSP" || store.Status != storeActive || store.RegisteredAt != "2026-03-01T10:00:00Z" {
+		t.Fatalf("unexpected store %+v", store)
+	}
+
+	update := storeArg("S1", "west", "medium")
+	update["owner_msp_id"] = "Org2MSP"
+	f.fail(f.org2, "is owned by Org1MSP", "UpdateStore", update)
+	f.ok(f.org1, "UpdateStore", update)
+	f.get(&store, f.regulator, "GetStore", "S1")
+	if store.Region != "west" || store.SizeCategory != "medium" || store.OwnerMSPID != "Org1MSP" {
+		t.Fatalf("unexpected update %+v", store)
+	}
+
+	var summaries []StoreIndexSummary
+	f.get(&summaries, f.regulator, "QueryStoreIndices", StoreFilter{Region: "west"})
+	if len(summaries) != 1 || summaries[0].Store.StoreID != "S1" {
+		t.Fatalf("unexpected summaries %+v", summaries)
+	}
+	f.get(&summaries, f.regulator, "QueryStoreIndices", StoreFilter{Chain: "acme"})
+	if len(summaries) != 2 {
+		t.Fatalf("unexpected summaries %+v", summaries)
+	}
+
+	f.fail(f.org1, "is owned by Org2MSP", "DeactivateStore", "S2")
+	f.ok(f.regulator, "DeactivateStore", "S2")
+	f.fail(f.org2, "already inactive", "DeactivateStore", "S2")
+	f.fail(f.org2, "store S2 is inactive", "CreateOrUpdateInvoice", invoiceArg("P1", "S2", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+	f.get(&summaries, f.regulator, "QueryStoreIndices", StoreFilter{Status: storeActive})
+	if len(summaries) != 1 || summaries[0].Store.StoreID != "S1" {
+		t.Fatalf("unexpected summaries %+v", summaries)
+	}
+
+	f.fail(f.regulator, "Store not found for ID: S9", "GetStore", "S9")
+}
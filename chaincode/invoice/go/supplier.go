@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Acknowledge a pending purchase invoice on behalf of the named supplier organisation
+func (s *SmartContract) AcknowledgePurchaseInvoice(ctx contractapi.TransactionContextInterface, invoiceID string) error {
+	invoiceJSON, err := ctx.GetStub().GetState(invoiceID)
+	if err != nil {
+		return err
+	}
+	if invoiceJSON == nil {
+		return fmt.Errorf("Invoice not found for ID: %s", invoiceID)
+	}
+
+	var invoice Invoice
+	err = json.Unmarshal(invoiceJSON, &invoice)
+	if err != nil {
+		return err
+	}
+	if invoice.Status != invoicePending {
+		return fmt.Errorf("invoice %s is not awaiting supplier acknowledgement", invoiceID)
+	}
+
+	// Only the supplier named on the invoice may co-sign it
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != invoice.SupplierMSPID {
+		return fmt.Errorf("invoice %s must be acknowledged by %s, not %s", invoiceID, invoice.SupplierMSPID, mspID)
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending := invoice
+	invoice.Status = invoiceConfirmed
+	invoice.AcknowledgedBy = signer
+	invoice.AcknowledgedAt = now.Format(time.RFC3339)
+
+	invoiceJSON, err = json.Marshal(invoice)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(invoiceID, invoiceJSON)
+	if err != nil {
+		return err
+	}
+
+	// The purchase now counts toward inventory
+	return s.recordStockMovements(ctx, pending, invoice)
+}
+
+// Retrieve the purchase invoices still awaiting acknowledgement from a supplier
+func (s *SmartContract) GetPendingPurchaseInvoices(ctx contractapi.TransactionContextInterface, supplierMSPID string) ([]Invoice, error) {
+	queryString := fmt.Sprintf(`{"selector":{"supplier_msp_id":"%s","invoice_type":"purchase","status":"%s"}}`, supplierMSPID, invoicePending)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	invoices := []Invoice{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var invoice Invoice
+		err = json.Unmarshal(queryResponse.Value, &invoice)
+		if err != nil {
+			return nil, err
+		}
+		if queryResponse.Key != invoice.InvoiceID {
+			continue
+		}
+
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestAcknowledgePurchaseInvoice(t *testing.T) {
+	f := newFixture(t)
+	milk := lot("milk", "2027-03-10")
+	f.ok(f.org1, "CreatePurchaseOrder", purchaseOrderArg("PO1", "S1", "milk", 24))
+	f.ok(f.org1, "RecordGoodsReceipt", goodsReceiptArg("GR1", "PO1", "S1", "milk", "2027-03-10", 24))
+	f.ok(f.org1, "CreateOrUpdateInvoice", supplierPurchaseArg("P1", "S1", "PO1", "GR1", 24))
+
+	var pending []Invoice
+	f.get(&pending, f.supplier, "GetPendingPurchaseInvoices", "SupMSP")
+	if len(pending) != 1 || pending[0].InvoiceID != "P1" || pending[0].Status != invoicePending {
+		t.Fatalf("unexpected pending invoices %+v", pending)
+	}
+
+	// A pending purchase does not count toward inventory
+	var total float64
+	f.get(&total, f.org1, "GetTotalPurchases", "S1", milk)
+	if total != 0 {
+		t.Fatalf("pending purchase counted: %v", total)
+	}
+
+	f.fail(f.org1, "must be acknowledged by SupMSP, not Org1MSP", "AcknowledgePurchaseInvoice", "P1")
+	f.ok(f.supplier, "AcknowledgePurchaseInvoice", "P1")
+	f.fail(f.supplier, "not awaiting supplier acknowledgement", "AcknowledgePurchaseInvoice", "P1")
+	f.fail(f.supplier, "Invoice not found for ID: P2", "AcknowledgePurchaseInvoice", "P2")
+
+	var invoice Invoice
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Status != invoiceConfirmed || invoice.AcknowledgedBy == "" || invoice.AcknowledgedAt != "2026-03-01T10:00:00Z" {
+		t.Fatalf("unexpected acknowledgement %+v", invoice)
+	}
+	f.get(&total, f.org1, "GetTotalPurchases", "S1", milk)
+	if total != 24 {
+		t.Fatalf("acknowledged purchase not counted: %v", total)
+	}
+	f.get(&pending, f.supplier, "GetPendingPurchaseInvoices", "SupMSP")
+	if len(pending) != 0 {
+		t.Fatalf("acknowledged invoice still pending: %+v", pending)
+	}
+}
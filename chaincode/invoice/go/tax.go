@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// TaxRate structure
+type TaxRate struct {
+	DocType         string `json:"doc_type"`
+	Region          string `json:"region"`
+	Category        string `json:"category"`          // e.g. a GST slab or VAT band
+	RateBasisPoints int64  `json:"rate_basis_points"` // 1800 is 18%
+	UpdatedBy       string `json:"updated_by"`
+	UpdatedAt       string `json:"updated_at"`
+}
+
+// TaxSummaryLine structure
+type TaxSummaryLine struct {
+	RateBasisPoints    int64 `json:"rate_basis_points"`
+	TaxableAmountMinor int64 `json:"taxable_amount_minor"`
+	TaxAmountMinor     int64 `json:"tax_amount_minor"`
+}
+
+// Ledger key of the tax rate for a category in a region
+func taxRateKey(region string, category string) string {
+	return fmt.Sprintf("TAX_RATE_%s_%s", region, category)
+}
+
+// Set the tax rate for a category in a region, restricted to regulators
+func (s *SmartContract) SetTaxRate(ctx contractapi.TransactionContextInterface, region string, category string, rateBasisPoints int64) error {
+	err := requireRole(ctx, roleRegulator)
+	if err != nil {
+		return err
+	}
+	if region == "" || category == "" {
+		return fmt.Errorf("tax rates require a region and a category")
+	}
+	if rateBasisPoints < 0 || rateBasisPoints > 10000 {
+		return fmt.Errorf("tax rate must be between 0 and 10000 basis points, got %d", rateBasisPoints)
+	}
+
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	taxRate := TaxRate{
+		DocType:         "tax_rate",
+		Region:          region,
+		Category:        category,
+		RateBasisPoints: rateBasisPoints,
+		UpdatedBy:       mspID,
+		UpdatedAt:       now.Format(time.RFC3339),
+	}
+	taxRateJSON, err := json.Marshal(taxRate)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(taxRateKey(region, category), taxRateJSON)
+}
+
+// Retrieve the tax rate for a category in a region
+func (s *SmartContract) GetTaxRate(ctx contractapi.TransactionContextInterface, region string, category string) (TaxRate, error) {
+	taxRateJSON, err := ctx.GetStub().GetState(taxRateKey(region, category))
+	if err != nil {
+		return TaxRate{}, err
+	}
+	if taxRateJSON == nil {
+		return TaxRate{}, fmt.Errorf("no tax rate for category %s in region %s", category, region)
+	}
+
+	var taxRate TaxRate
+	err = json.Unmarshal(taxRateJSON, &taxRate)
+	if err != nil {
+		return TaxRate{}, err
+	}
+
+	return taxRate, nil
+}
+
+// Resolve line tax rates from the rate table, check the declared tax amounts and build the tax summary
+func (s *SmartContract) validateInvoiceTax(ctx contractapi.TransactionContextInterface, region string, invoice *Invoice) error {
+	summary := make(map[int64]*TaxSummaryLine)
+	var totalTax int64
+
+	for i, item := range invoice.Items {
+		var rate int64
+		if item.TaxCategory != "" {
+			taxRate, err := s.GetTaxRate(ctx, region, item.TaxCategory)
+			if err != nil {
+				return err
+			}
+			rate = taxRate.RateBasisPoints
+		}
+
+		// A declared rate must agree with the ledger, an omitted one is filled in
+		if item.TaxRateBasisPoints != 0 && item.TaxRateBasisPoints != rate {
+			return fmt.Errorf("invoice %s line %s declares a tax rate of %d basis points, the rate for %q in %s is %d", invoice.InvoiceID, item.ItemID, item.TaxRateBasisPoints, item.TaxCategory, region, rate)
+		}
+		invoice.Items[i].TaxRateBasisPoints = rate
+
+		tax := taxOn(item.TotalPriceMinor, rate)
+		if item.TaxAmountMinor != tax {
+			return fmt.Errorf("invoice %s line %s declares tax of %d %s, expected %d", invoice.InvoiceID, item.ItemID, item.TaxAmountMinor, invoice.Currency, tax)
+		}
+
+		if item.TaxCategory != "" {
+			line, ok := summary[rate]
+			if !ok {
+				line = &TaxSummaryLine{RateBasisPoints: rate}
+				summary[rate] = line
+			}
+			line.TaxableAmountMinor += item.TotalPriceMinor
+			line.TaxAmountMinor += tax
+		}
+		totalTax += tax
+	}
+
+	if invoice.TaxAmountMinor != totalTax {
+		return fmt.Errorf("invoice %s declares tax of %d %s, but its lines sum to %d", invoice.InvoiceID, invoice.TaxAmountMinor, invoice.Currency, totalTax)
+	}
+
+	computed := []TaxSummaryLine{}
+	for _, line := range summary {
+		computed = append(computed, *line)
+	}
+	sort.Slice(computed, func(i, j int) bool {
+		return computed[i].RateBasisPoints < computed[j].RateBasisPoints
+	})
+
+	// A declared summary must match the lines, an omitted one is filled in
+	if len(invoice.TaxSummary) > 0 {
+		declared := append([]TaxSummaryLine(nil), invoice.TaxSummary...)
+		sort.Slice(declared, func(i, j int) bool {
+			return declared[i].RateBasisPoints < declared[j].RateBasisPoints
+		})
+		if len(declared) != len(computed) {
+			return fmt.Errorf("invoice %s tax summary has %d rates, its lines have %d", invoice.InvoiceID, len(declared), len(computed))
+		}
+		for i := range declared {
+			if declared[i] != computed[i] {
+				return fmt.Errorf("invoice %s tax summary at %d basis points does not match its lines", invoice.InvoiceID, computed[i].RateBasisPoints)
+			}
+		}
+	}
+	if len(computed) > 0 {
+		invoice.TaxSummary = computed
+	} else {
+		invoice.TaxSummary = nil
+	}
+
+	return nil
+}
+
+// Tax on an amount in minor units, rounded half up to the nearest minor unit
+func taxOn(amountMinor int64, rateBasisPoints int64) int64 {
+	return (amountMinor*rateBasisPoints + 5000) / 10000
+}
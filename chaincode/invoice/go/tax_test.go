@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestTaxOn(t *testing.T) {
+	for _, test := range []struct {
+		amount, rate, expected int64
+	}{
+		{1000, 1800, 180},
+		{25, 1800, 5}, // 4.5 rounds half up
+		{24, 1800, 4}, // 4.32 rounds down
+		{999, 0, 0},
+	} {
+		if tax := taxOn(test.amount, test.rate); tax != test.expected {
+			t.Errorf("taxOn(%d, %d) = %d, expected %d", test.amount, test.rate, tax, test.expected)
+		}
+	}
+}
+
+func TestInvoiceTax(t *testing.T) {
+	f := newFixture(t)
+	f.fail(f.org1, "not permitted", "SetTaxRate", "north", "gst5", 500)
+	f.fail(f.regulator, "between 0 and 10000", "SetTaxRate", "north", "gst5", 10001)
+	f.ok(f.regulator, "SetTaxRate", "north", "gst5", 500)
+	f.ok(f.regulator, "SetTaxRate", "north", "gst12", 1200)
+
+	var rate TaxRate
+	f.get(&rate, f.org1, "GetTaxRate", "north", "gst5")
+	if rate.RateBasisPoints != 500 || rate.UpdatedBy != "RegMSP" {
+		t.Fatalf("unexpected rate %+v", rate)
+	}
+	f.fail(f.org1, "no tax rate for category gst5 in region south", "GetTaxRate", "south", "gst5")
+
+	taxed := func(tax0 int64, tax1 int64, total int64) map[string]interface{} {
+		purchase := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 10, 1.25), lineArg("cheese", "2027-03-20", 2, 4))
+		lines := purchase["items"].([]map[string]interface{})
+		lines[0]["tax_category"] = "gst5"
+		lines[0]["tax_amount_minor"] = tax0
+		lines[1]["tax_category"] = "gst12"
+		lines[1]["tax_amount_minor"] = tax1
+		purchase["tax_amount_minor"] = tax0 + tax1
+		purchase["total_amount"] = 0
+		purchase["total_amount_minor"] = total
+		return purchase
+	}
+
+	// 5% of 1250 is 62.5, rounded half up; 12% of 800 is 96
+	f.fail(f.org1, "line milk declares tax of 62 INR, expected 63", "CreateOrUpdateInvoice", taxed(62, 96, 2208))
+	f.fail(f.org1, "but its lines and tax sum to 2209", "CreateOrUpdateInvoice", taxed(63, 96, 2208))
+	f.ok(f.org1, "CreateOrUpdateInvoice", taxed(63, 96, 2209))
+
+	var invoice Invoice
+	f.get(&invoice, f.org1, "GetInvoice", "P1")
+	if invoice.Items[0].TaxRateBasisPoints != 500 || invoice.TaxAmountMinor != 159 {
+		t.Fatalf("unexpected tax %+v", invoice)
+	}
+	expected := []TaxSummaryLine{{RateBasisPoints: 500, TaxableAmountMinor: 1250, TaxAmountMinor: 63}, {RateBasisPoints: 1200, TaxableAmountMinor: 800, TaxAmountMinor: 96}}
+	if len(invoice.TaxSummary) != 2 || invoice.TaxSummary[0] != expected[0] || invoice.TaxSummary[1] != expected[1] {
+		t.Fatalf("unexpected tax summary %+v", invoice.TaxSummary)
+	}
+}
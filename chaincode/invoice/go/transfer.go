@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Transfer states
+const (
+	transferInitiated = "initiated"
+	transferAccepted  = "accepted"
+	transferRejected  = "rejected"
+)
+
+// TransferLine structure
+type TransferLine struct {
+	ItemID       string  `json:"item_id"`
+	ExpiryDate   string  `json:"expiry_date"`
+	Quantity     float64 `json:"quantity"`
+	Unit         string  `json:"unit,omitempty" metadata:",optional"`          // defaults to the catalogue base unit
+	BaseQuantity float64 `json:"base_quantity,omitempty" metadata:",optional"` // quantity converted to the catalogue base unit
+}
+
+// Transfer structure
+type Transfer struct {
+	DocType         string         `json:"doc_type"`
+	TransferID      string         `json:"transfer_id"`
+	FromStoreID     string         `json:"from_store_id"`
+	ToStoreID       string         `json:"to_store_id"`
+	Lines           []TransferLine `json:"lines,omitempty" metadata:",optional"`
+	Status          string         `json:"status"`
+	InitiatedBy     string         `json:"initiated_by"`
+	InitiatedAt     string         `json:"initiated_at"`
+	RespondedBy     string         `json:"responded_by,omitempty" metadata:",optional"`
+	RespondedAt     string         `json:"responded_at,omitempty" metadata:",optional"`
+	RejectionReason string         `json:"rejection_reason,omitempty" metadata:",optional"`
+}
+
+// Ledger key of an inter-store transfer
+func transferKey(transferID string) string {
+	return fmt.Sprintf("TRANSFER_%s", transferID)
+}
+
+// Initiate a transfer of stock from the sending store, signed by the sender
+func (s *SmartContract) InitiateTransfer(ctx contractapi.TransactionContextInterface, transferID string, fromStoreID string, toStoreID string, lines []TransferLine) error {
+	if fromStoreID == toStoreID {
+		return fmt.Errorf("transfer %s must move stock between two different stores", transferID)
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("transfer %s has no lines", transferID)
+	}
+
+	existingJSON, err := ctx.GetStub().GetState(transferKey(transferID))
+	if err != nil {
+		return err
+	}
+	if existingJSON != nil {
+		return fmt.Errorf("transfer %s already exists", transferID)
+	}
+
+	// The sending half is signed by the organisation owning the sending store
+	fromStore, err := s.requireActiveStore(ctx, fromStoreID)
+	if err != nil {
+		return err
+	}
+	err = requireStoreOwner(ctx, fromStore)
+	if err != nil {
+		return err
+	}
+	_, err = s.requireActiveStore(ctx, toStoreID)
+	if err != nil {
+		return err
+	}
+
+	for i, line := range lines {
+		catalogueItem, err := s.GetCatalogueItem(ctx, line.ItemID)
+		if err != nil {
+			return fmt.Errorf("item %s is not in the product catalogue", line.ItemID)
+		}
+		if line.Unit == "" {
+			lines[i].Unit = catalogueItem.UnitOfMeasure
+		}
+		lines[i].BaseQuantity, err = toBaseQuantity(catalogueItem, line.Quantity, line.Unit)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.checkTransferLines(ctx, fromStoreID, lines)
+	if err != nil {
+		return err
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	transfer := Transfer{
+		DocType:     "transfer",
+		TransferID:  transferID,
+		FromStoreID: fromStoreID,
+		ToStoreID:   toStoreID,
+		Lines:       lines,
+		Status:      transferInitiated,
+		InitiatedBy: signer,
+		InitiatedAt: now.Format(time.RFC3339),
+	}
+
+	return s.putTransfer(ctx, transfer)
+}
+
+// Accept a transfer on behalf of the receiving store and move the inventory
+func (s *SmartContract) AcceptTransfer(ctx contractapi.TransactionContextInterface, transferID string) error {
+	transfer, err := s.respondToTransfer(ctx, transferID)
+	if err != nil {
+		return err
+	}
+
+	// Stock may have been sold while the transfer was pending
+	err = s.checkTransferLines(ctx, transfer.FromStoreID, transfer.Lines)
+	if err != nil {
+		return err
+	}
+
+	transfer.Status = transferAccepted
+	err = s.putTransfer(ctx, transfer)
+	if err != nil {
+		return err
+	}
+
+	// Record the moved quantity on both sides so it counts as neither wastage nor sale
+	for i, line := range transfer.Lines {
+		itemKey := ItemKey{ItemID: line.ItemID, ExpiryDate: line.ExpiryDate}
+		eventID := fmt.Sprintf("%s_%d", transfer.TransferID, i)
+		err = s.addStockDelta(ctx, transfer.FromStoreID, itemKey, eventID, StockDelta{TransfersOut: line.BaseQuantity})
+		if err != nil {
+			return err
+		}
+		err = s.addStockDelta(ctx, transfer.ToStoreID, itemKey, eventID, StockDelta{TransfersIn: line.BaseQuantity})
+		if err != nil {
+			return err
+		}
+
+		// Shelf life lost to excursions at the sender travels with the stock
+		err = s.transferEffectiveExpiry(ctx, transfer.FromStoreID, transfer.ToStoreID, itemKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reject a transfer on behalf of the receiving store, leaving inventory untouched
+func (s *SmartContract) RejectTransfer(ctx contractapi.TransactionContextInterface, transferID string, reason string) error {
+	transfer, err := s.respondToTransfer(ctx, transferID)
+	if err != nil {
+		return err
+	}
+
+	transfer.Status = transferRejected
+	transfer.RejectionReason = reason
+
+	return s.putTransfer(ctx, transfer)
+}
+
+// Retrieve a transfer from the ledger
+func (s *SmartContract) GetTransfer(ctx contractapi.TransactionContextInterface, transferID string) (Transfer, error) {
+	transferJSON, err := ctx.GetStub().GetState(transferKey(transferID))
+	if err != nil {
+		return Transfer{}, err
+	}
+	if transferJSON == nil {
+		return Transfer{}, fmt.Errorf("Transfer not found for ID: %s", transferID)
+	}
+
+	var transfer Transfer
+	err = json.Unmarshal(transferJSON, &transfer)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	return transfer, nil
+}
+
+// Load a pending transfer and record the receiving side's signature on it
+func (s *SmartContract) respondToTransfer(ctx contractapi.TransactionContextInterface, transferID string) (Transfer, error) {
+	transfer, err := s.GetTransfer(ctx, transferID)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if transfer.Status != transferInitiated {
+		return Transfer{}, fmt.Errorf("transfer %s is already %s", transferID, transfer.Status)
+	}
+
+	// The receiving half is signed by the organisation owning the receiving store
+	toStore, err := s.requireActiveStore(ctx, transfer.ToStoreID)
+	if err != nil {
+		return Transfer{}, err
+	}
+	err = requireStoreOwner(ctx, toStore)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	signer, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	if signer == transfer.InitiatedBy {
+		return Transfer{}, fmt.Errorf("transfer %s must be answered by the receiving store, not its initiator", transferID)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	transfer.RespondedBy = signer
+	transfer.RespondedAt = now.Format(time.RFC3339)
+
+	return transfer, nil
+}
+
+// Check that the sending store holds enough unrecalled stock for the lines of a transfer, adding up
+// the lines that move the same lot
+func (s *SmartContract) checkTransferLines(ctx contractapi.TransactionContextInterface, storeID string, lines []TransferLine) error {
+	quantities := make(map[ItemKey]float64)
+	var itemKeys []ItemKey
+	for _, line := range lines {
+		itemKey := ItemKey{ItemID: line.ItemID, ExpiryDate: line.ExpiryDate}
+
+		quantity := baseTransferQuantity(line)
+		if quantity <= 0 {
+			return fmt.Errorf("transfer quantity for ItemKey %s must be positive", itemKey)
+		}
+		if _, ok := quantities[itemKey]; !ok {
+			itemKeys = append(itemKeys, itemKey)
+		}
+		quantities[itemKey] += quantity
+	}
+
+	for _, itemKey := range itemKeys {
+		recalled, err := s.isRecalled(ctx, itemKey)
+		if err != nil {
+			return err
+		}
+		if recalled {
+			return fmt.Errorf("recalled item %s with expiry %s cannot be transferred", itemKey.ItemID, itemKey.ExpiryDate)
+		}
+
+		// Book inventory allows for stocktakes and confirmed recall disposals
+		_, available, err := s.bookInventory(ctx, storeID, itemKey)
+		if err != nil {
+			return err
+		}
+		if quantities[itemKey] > available {
+			return fmt.Errorf("store %s holds %v of ItemKey %s, cannot transfer %v", storeID, available, itemKey, quantities[itemKey])
+		}
+	}
+
+	return nil
+}
+
+// Retrieve the accepted quantities of an itemkey transferred into and out of a store
+func (s *SmartContract) getTotalTransfers(ctx contractapi.TransactionContextInterface, storeID string, itemKey ItemKey) (float64, float64, error) {
+	transfersIn, err := s.sumAcceptedTransfers(ctx, "to_store_id", storeID, itemKey)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	transfersOut, err := s.sumAcceptedTransfers(ctx, "from_store_id", storeID, itemKey)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return transfersIn, transfersOut, nil
+}
+
+// Sum the quantity of an itemkey over accepted transfers matching a store field
+func (s *SmartContract) sumAcceptedTransfers(ctx contractapi.TransactionContextInterface, storeField string, storeID string, itemKey ItemKey) (float64, error) {
+	queryString := fmt.Sprintf(`{"selector":{"doc_type":"transfer","status":"%s","%s":"%s","lines":{"$elemMatch":{"item_id":"%s","expiry_date":"%s"}}}}`, transferAccepted, storeField, storeID, itemKey.ItemID, itemKey.ExpiryDate)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	var total float64
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		var transfer Transfer
+		err = json.Unmarshal(queryResponse.Value, &transfer)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, line := range transfer.Lines {
+			if line.ItemID == itemKey.ItemID && line.ExpiryDate == itemKey.ExpiryDate {
+				total += baseTransferQuantity(line)
+			}
+		}
+	}
+
+	return total, nil
+}
+
+// Save a transfer to the ledger
+func (s *SmartContract) putTransfer(ctx contractapi.TransactionContextInterface, transfer Transfer) error {
+	transferJSON, err := json.Marshal(transfer)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(transferKey(transfer.TransferID), transferJSON)
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func transferLineArg(itemID string, expiryDate string, quantity float64, unit string) map[string]interface{} {
+	line := map[string]interface{}{"item_id": itemID, "expiry_date": expiryDate, "quantity": quantity}
+	if unit != "" {
+		line["unit"] = unit
+	}
+	return line
+}
+
+func TestTransfer(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+
+	f.fail(f.org1, "between two different stores", "InitiateTransfer", "T1", "S1", "S1", []interface{}{transferLineArg("milk", "2027-03-10", 1, "")})
+	f.fail(f.org1, "has no lines", "InitiateTransfer", "T1", "S1", "S2", []interface{}{})
+	f.fail(f.org2, "is owned by Org1MSP", "InitiateTransfer", "T1", "S1", "S2", []interface{}{transferLineArg("milk", "2027-03-10", 1, "")})
+	f.fail(f.org1, "cannot transfer 36", "InitiateTransfer", "T1", "S1", "S2", []interface{}{transferLineArg("milk", "2027-03-10", 3, "case")})
+
+	f.ok(f.org1, "InitiateTransfer", "T1", "S1", "S2", []interface{}{transferLineArg("milk", "2027-03-10", 1, "case")})
+	f.fail(f.org1, "already exists", "InitiateTransfer", "T1", "S1", "S2", []interface{}{transferLineArg("milk", "2027-03-10", 1, "")})
+	f.fail(f.org1, "is owned by Org2MSP", "AcceptTransfer", "T1")
+	f.ok(f.org2, "AcceptTransfer", "T1")
+	f.fail(f.org2, "already accepted", "RejectTransfer", "T1", "late")
+
+	var transfer Transfer
+	f.get(&transfer, f.org1, "GetTransfer", "T1")
+	if transfer.Status != transferAccepted || transfer.Lines[0].BaseQuantity != 12 || transfer.RespondedBy == "" {
+		t.Fatalf("unexpected transfer %+v", transfer)
+	}
+
+	// Only the untransferred half is left to send, and the receiving store can pass its stock on
+	f.fail(f.org1, "holds 12", "InitiateTransfer", "T2", "S1", "S2", []interface{}{transferLineArg("milk", "2027-03-10", 13, "")})
+	f.fail(f.org1, "cannot transfer 20", "InitiateTransfer", "T2", "S1", "S2", []interface{}{transferLineArg("milk", "2027-03-10", 10, ""), transferLineArg("milk", "2027-03-10", 10, "")})
+	f.ok(f.org2, "InitiateTransfer", "T2", "S2", "S1", []interface{}{transferLineArg("milk", "2027-03-10", 12, "")})
+	f.ok(f.org1, "RejectTransfer", "T2", "not ordered")
+	f.get(&transfer, f.org2, "GetTransfer", "T2")
+	if transfer.Status != transferRejected || transfer.RejectionReason != "not ordered" {
+		t.Fatalf("unexpected transfer %+v", transfer)
+	}
+
+	// Stock sold while a transfer waits is checked again on acceptance, all of the lot's lines together
+	f.ok(f.org1, "InitiateTransfer", "T3", "S1", "S2", []interface{}{transferLineArg("milk", "2027-03-10", 6, ""), transferLineArg("milk", "2027-03-10", 6, "")})
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 1, 2)))
+	f.fail(f.org2, "holds 11 of ItemKey", "AcceptTransfer", "T3")
+
+	f.fail(f.org1, "Transfer not found for ID: T4", "GetTransfer", "T4")
+}
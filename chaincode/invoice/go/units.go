@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Mass units accepted for variable-weight items, expressed in grams
+var massUnits = map[string]float64{
+	"mg": 0.001,
+	"g":  1,
+	"kg": 1000,
+	"oz": 28.349523125,
+	"lb": 453.59237,
+}
+
+// Convert a quantity in the given unit to the catalogue base unit of an item
+func toBaseQuantity(catalogueItem CatalogueItem, quantity float64, unit string) (float64, error) {
+	if quantity <= 0 || math.IsNaN(quantity) || math.IsInf(quantity, 0) {
+		return 0, fmt.Errorf("item %s requires a positive quantity, got %v", catalogueItem.ItemID, quantity)
+	}
+
+	if unit == "" || unit == catalogueItem.UnitOfMeasure {
+		return checkBaseQuantity(catalogueItem, quantity)
+	}
+
+	// Units explicitly defined in the catalogue take precedence, e.g. a case of 24
+	if factor, ok := catalogueItem.UnitConversions[unit]; ok {
+		return checkBaseQuantity(catalogueItem, quantity*factor)
+	}
+
+	// Variable-weight items may be sold in any mass unit when the base unit is a mass
+	if catalogueItem.VariableWeight {
+		fromGrams, fromOK := massUnits[unit]
+		toGrams, toOK := massUnits[catalogueItem.UnitOfMeasure]
+		if fromOK && toOK {
+			return quantity * fromGrams / toGrams, nil
+		}
+	}
+
+	return 0, fmt.Errorf("item %s cannot be measured in %q, base unit is %q", catalogueItem.ItemID, unit, catalogueItem.UnitOfMeasure)
+}
+
+// Ensure a base quantity is whole unless the item is sold by weight
+func checkBaseQuantity(catalogueItem CatalogueItem, baseQuantity float64) (float64, error) {
+	if catalogueItem.VariableWeight {
+		return baseQuantity, nil
+	}
+
+	// Absorb floating-point noise from fractional conversion factors
+	rounded := math.Round(baseQuantity)
+	if math.Abs(baseQuantity-rounded) > 1e-9 {
+		return 0, fmt.Errorf("item %s is counted in whole %s, got %v", catalogueItem.ItemID, catalogueItem.UnitOfMeasure, baseQuantity)
+	}
+	return rounded, nil
+}
+
+// Validate the unit definitions of a catalogue item
+func validateUnits(catalogueItem CatalogueItem) error {
+	for unit, factor := range catalogueItem.UnitConversions {
+		if unit == "" || factor <= 0 {
+			return fmt.Errorf("catalogue item %s has an invalid conversion for unit %q", catalogueItem.ItemID, unit)
+		}
+	}
+	if catalogueItem.VariableWeight {
+		if _, ok := massUnits[catalogueItem.UnitOfMeasure]; !ok {
+			return fmt.Errorf("variable-weight item %s must have a mass base unit, got %q", catalogueItem.ItemID, catalogueItem.UnitOfMeasure)
+		}
+	}
+	return nil
+}
+
+// Quantity of an invoice line in base units; lines recorded before units were introduced are already in base units
+func baseQuantity(item Item) float64 {
+	if item.Unit == "" {
+		return item.Quantity
+	}
+	return item.BaseQuantity
+}
+
+// Quantity of a transfer line in base units
+func baseTransferQuantity(line TransferLine) float64 {
+	if line.Unit == "" {
+		return line.Quantity
+	}
+	return line.BaseQuantity
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestToBaseQuantity(t *testing.T) {
+	milk := CatalogueItem{ItemID: "milk", UnitOfMeasure: "each", UnitConversions: map[string]float64{"case": 12, "sixth": 1.0 / 6}}
+	cheese := CatalogueItem{ItemID: "cheese", UnitOfMeasure: "kg", VariableWeight: true}
+
+	for _, test := range []struct {
+		item     CatalogueItem
+		quantity float64
+		unit     string
+		expected float64
+	}{
+		{milk, 3, "", 3},
+		{milk, 3, "each", 3},
+		{milk, 2, "case", 24},
+		{milk, 6, "sixth", 1},
+		{cheese, 0.25, "kg", 0.25},
+		{cheese, 1500, "g", 1.5},
+	} {
+		baseQuantity, err := toBaseQuantity(test.item, test.quantity, test.unit)
+		if err != nil {
+			t.Fatalf("%v %s of %s: %s", test.quantity, test.unit, test.item.ItemID, err.Error())
+		}
+		if math.Abs(baseQuantity-test.expected) > 1e-12 {
+			t.Errorf("%v %s of %s converted to %v, expected %v", test.quantity, test.unit, test.item.ItemID, baseQuantity, test.expected)
+		}
+	}
+
+	for _, test := range []struct {
+		item     CatalogueItem
+		quantity float64
+		unit     string
+		expected string
+	}{
+		{milk, 1.5, "", "counted in whole each"},
+		{milk, 1, "g", "cannot be measured in"},
+		{milk, 0, "", "requires a positive quantity"},
+		{milk, -2, "case", "requires a positive quantity"},
+		{cheese, 0, "g", "requires a positive quantity"},
+		{cheese, -500, "g", "requires a positive quantity"},
+		{cheese, math.NaN(), "g", "requires a positive quantity"},
+		{cheese, math.Inf(1), "kg", "requires a positive quantity"},
+	} {
+		_, err := toBaseQuantity(test.item, test.quantity, test.unit)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v %s of %s: got error %v, expected %q", test.quantity, test.unit, test.item.ItemID, err, test.expected)
+		}
+	}
+}
+
+func TestInvoiceUnits(t *testing.T) {
+	f := newFixture(t)
+	f.fail(f.org1, "requires a positive quantity", "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", -24, 1)))
+
+	purchase := invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 2, 12), lineArg("cheese", "2027-03-20", 1500, 0.01))
+	purchase["items"].([]map[string]interface{})[0]["unit"] = "case"
+	purchase["items"].([]map[string]interface{})[1]["unit"] = "g"
+	f.ok(f.org1, "CreateOrUpdateInvoice", purchase)
+
+	var total float64
+	f.get(&total, f.org1, "GetTotalPurchases", "S1", lot("milk", "2027-03-10"))
+	if total != 24 {
+		t.Fatalf("cases not converted to units: %v", total)
+	}
+	f.get(&total, f.org1, "GetTotalPurchases", "S1", lot("cheese", "2027-03-20"))
+	if total != 1.5 {
+		t.Fatalf("grams not converted to kilograms: %v", total)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Audit actions on an invoice
+const (
+	auditVoid    = "void"
+	auditRestore = "restore"
+	auditRelease = "release"
+)
+
+// Reasons an invoice may be voided for
+var voidReasonCodes = map[string]bool{
+	"duplicate":        true,
+	"entered_in_error": true,
+	"cancelled":        true,
+	"returned_in_full": true,
+	"suspected_fraud":  true,
+	"other":            true,
+}
+
+// InvoiceAuditEntry structure
+type InvoiceAuditEntry struct {
+	DocType        string `json:"doc_type"`
+	InvoiceID      string `json:"invoice_id"`
+	StoreID        string `json:"store_id"`
+	Action         string `json:"action"` // 'void', 'restore' or 'release'
+	ReasonCode     string `json:"reason_code,omitempty" metadata:",optional"`
+	Justification  string `json:"justification"`
+	PreviousStatus string `json:"previous_status,omitempty" metadata:",optional"` // status the invoice returns to when restored
+	Actor          string `json:"actor"`
+	RecordedAt     string `json:"recorded_at"`
+	TxID           string `json:"tx_id"`
+}
+
+// Composite key object type of invoice audit entries
+const invoiceAuditObjectType = "INVOICE_AUDIT"
+
+// Ledger key of an audit entry, ordered by time within an invoice
+func invoiceAuditKey(ctx contractapi.TransactionContextInterface, invoiceID string, recordedAt string, txID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(invoiceAuditObjectType, []string{invoiceID, recordedAt, txID})
+}
+
+// Void an invoice so that it no longer counts toward the store's totals, keeping it on the ledger
+func (s *SmartContract) VoidInvoice(ctx contractapi.TransactionContextInterface, invoiceID string, reasonCode string, justification string) error {
+	if !voidReasonCodes[reasonCode] {
+		return fmt.Errorf("unknown void reason code %q", reasonCode)
+	}
+
+	invoice, err := s.getInvoiceForAudit(ctx, invoiceID, justification)
+	if err != nil {
+		return err
+	}
+	if invoice.Status == invoiceVoided {
+		return fmt.Errorf("invoice %s is already voided", invoiceID)
+	}
+
+	entry := InvoiceAuditEntry{
+		Action:         auditVoid,
+		ReasonCode:     reasonCode,
+		Justification:  justification,
+		PreviousStatus: invoice.Status,
+	}
+	invoice.Status = invoiceVoided
+
+	return s.applyInvoiceAudit(ctx, invoice, entry)
+}
+
+// Restore a voided invoice to the status it had before it was voided
+func (s *SmartContract) RestoreInvoice(ctx contractapi.TransactionContextInterface, invoiceID string, justification string) error {
+	invoice, err := s.getInvoiceForAudit(ctx, invoiceID, justification)
+	if err != nil {
+		return err
+	}
+	if invoice.Status != invoiceVoided {
+		return fmt.Errorf("invoice %s is not voided", invoiceID)
+	}
+
+	// The most recent void records the status to return to
+	trail, err := s.GetInvoiceAuditTrail(ctx, invoiceID)
+	if err != nil {
+		return err
+	}
+	previousStatus := ""
+	for _, entry := range trail {
+		if entry.Action == auditVoid {
+			previousStatus = entry.PreviousStatus
+		}
+	}
+
+	entry := InvoiceAuditEntry{
+		Action:        auditRestore,
+		Justification: justification,
+	}
+	voided := invoice
+	invoice.Status = previousStatus
+
+	// The stock may have moved on while the invoice was voided, so a restored sale is checked again
+	err = s.validateStock(ctx, invoice, voided)
+	if err != nil {
+		return err
+	}
+
+	return s.applyInvoiceAudit(ctx, invoice, entry)
+}
+
+// Retrieve the void and restore history of an invoice, oldest first
+func (s *SmartContract) GetInvoiceAuditTrail(ctx contractapi.TransactionContextInterface, invoiceID string) ([]InvoiceAuditEntry, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(invoiceAuditObjectType, []string{invoiceID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	trail := []InvoiceAuditEntry{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var entry InvoiceAuditEntry
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return nil, err
+		}
+		trail = append(trail, entry)
+	}
+
+	return trail, nil
+}
+
+// Retrieve the voided invoices of a store
+func (s *SmartContract) GetVoidedInvoices(ctx contractapi.TransactionContextInterface, storeID string) ([]Invoice, error) {
+	queryString := fmt.Sprintf(`{"selector":{"store_id":"%s","status":"%s"}}`, storeID, invoiceVoided)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	invoices := []Invoice{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var invoice Invoice
+		err = json.Unmarshal(queryResponse.Value, &invoice)
+		if err != nil {
+			return nil, err
+		}
+		if queryResponse.Key != invoice.InvoiceID {
+			continue
+		}
+
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
+
+// Retrieve the invoice lines of a store flagged as invalid
+func (s *SmartContract) GetInvalidations(ctx contractapi.TransactionContextInterface, storeID string) ([]Invalidation, error) {
+	queryString := fmt.Sprintf(`{"selector":{"doc_type":"invalidation","store_id":"%s"}}`, storeID)
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	invalidations := []Invalidation{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var invalidation Invalidation
+		err = json.Unmarshal(queryResponse.Value, &invalidation)
+		if err != nil {
+			return nil, err
+		}
+		invalidations = append(invalidations, invalidation)
+	}
+
+	return invalidations, nil
+}
+
+// Load an invoice for voiding or restoring, restricted to the store's organisation or an auditor
+func (s *SmartContract) getInvoiceForAudit(ctx contractapi.TransactionContextInterface, invoiceID string, justification string) (Invoice, error) {
+	if strings.TrimSpace(justification) == "" {
+		return Invoice{}, fmt.Errorf("changing the status of invoice %s requires a justification", invoiceID)
+	}
+
+	invoice, err := s.GetInvoice(ctx, invoiceID)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	store, err := s.GetStore(ctx, invoice.StoreID)
+	if err != nil {
+		return Invoice{}, err
+	}
+	err = requireStoreOwner(ctx, store)
+	if err != nil && requireRole(ctx, roleAuditor) != nil {
+		return Invoice{}, err
+	}
+
+	return invoice, nil
+}
+
+// Save an invoice whose status changed, log the change and record the stock it adds or removes
+func (s *SmartContract) applyInvoiceAudit(ctx contractapi.TransactionContextInterface, invoice Invoice, entry InvoiceAuditEntry) error {
+	actor, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %s", err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	entry.DocType = "invoice_audit"
+	entry.InvoiceID = invoice.InvoiceID
+	entry.StoreID = invoice.StoreID
+	entry.Actor = actor
+	entry.RecordedAt = now.Format(time.RFC3339)
+	entry.TxID = ctx.GetStub().GetTxID()
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	auditKey, err := invoiceAuditKey(ctx, entry.InvoiceID, entry.RecordedAt, entry.TxID)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(auditKey, entryJSON)
+	if err != nil {
+		return err
+	}
+
+	previous, err := s.GetInvoice(ctx, invoice.InvoiceID)
+	if err != nil {
+		return err
+	}
+
+	invoiceJSON, err := json.Marshal(invoice)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(invoice.InvoiceID, invoiceJSON)
+	if err != nil {
+		return err
+	}
+
+	// The invoice quantities enter or leave the totals
+	return s.recordStockMovements(ctx, previous, invoice)
+}
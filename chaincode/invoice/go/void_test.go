@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+func TestVoidAndRestoreInvoice(t *testing.T) {
+	f := newFixture(t)
+	milk := lot("milk", "2027-03-10")
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 24, 1)))
+
+	f.fail(f.org1, "unknown void reason code", "VoidInvoice", "P1", "mistake", "keyed twice")
+	f.fail(f.org1, "requires a justification", "VoidInvoice", "P1", "duplicate", "")
+	f.fail(f.org2, "is owned by Org1MSP", "VoidInvoice", "P1", "duplicate", "keyed twice")
+	f.ok(f.org1, "VoidInvoice", "P1", "duplicate", "keyed twice")
+	f.fail(f.auditor, "already voided", "VoidInvoice", "P1", "duplicate", "keyed twice")
+
+	var total float64
+	f.get(&total, f.org1, "GetTotalPurchases", "S1", milk)
+	if total != 0 {
+		t.Fatalf("voided purchase counted: %v", total)
+	}
+	var voided []Invoice
+	f.get(&voided, f.auditor, "GetVoidedInvoices", "S1")
+	if len(voided) != 1 || voided[0].InvoiceID != "P1" {
+		t.Fatalf("unexpected voided invoices %+v", voided)
+	}
+	f.fail(f.org1, "is voided, restore it before amending", "AmendInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 25, 1)), "quantity_error", "recount")
+
+	f.ok(f.auditor, "RestoreInvoice", "P1", "not a duplicate after all")
+	f.fail(f.org1, "is not voided", "RestoreInvoice", "P1", "again")
+	f.get(&total, f.org1, "GetTotalPurchases", "S1", milk)
+	if total != 24 {
+		t.Fatalf("restored purchase not counted: %v", total)
+	}
+
+	var trail []InvoiceAuditEntry
+	f.get(&trail, f.auditor, "GetInvoiceAuditTrail", "P1")
+	if len(trail) != 2 || trail[0].Action != auditVoid || trail[0].ReasonCode != "duplicate" || trail[1].Action != auditRestore {
+		t.Fatalf("unexpected audit trail %+v", trail)
+	}
+
+	// An invoice whose ID extends another's keeps its own trail
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1_1", "S1", "purchase", lineArg("milk", "2027-03-10", 5, 1)))
+	f.ok(f.org1, "VoidInvoice", "P1_1", "duplicate", "keyed twice")
+	trail = nil
+	f.get(&trail, f.auditor, "GetInvoiceAuditTrail", "P1")
+	if len(trail) != 2 {
+		t.Fatalf("audit trail picked up another invoice %+v", trail)
+	}
+}
+
+func TestOversoldSaleIsFlagged(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.regulator, "SetAmendmentPolicy", 100)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 10, 1)))
+
+	invalidations := func() map[string]string {
+		var invalidations []Invalidation
+		f.get(&invalidations, f.auditor, "GetInvalidations", "S1")
+		reasons := make(map[string]string)
+		for _, invalidation := range invalidations {
+			reasons[invalidation.InvoiceID] = invalidation.Reason
+		}
+		return reasons
+	}
+
+	// Selling what is on hand is fine; a sale amended upward is checked against the stock left without its old quantity
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 6, 2)))
+	f.ok(f.org1, "AmendInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 9, 2)), "quantity_error", "three more sold")
+	if reasons := invalidations(); len(reasons) != 0 {
+		t.Fatalf("sale within stock flagged: %v", reasons)
+	}
+
+	// The sale taking stock below zero is flagged, split over two lines or not, and the restock that follows is not
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X2", "S1", "sales", lineArg("milk", "2027-03-10", 1, 2), lineArg("milk", "2027-03-10", 1, 2)))
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P2", "S1", "purchase", lineArg("milk", "2027-03-10", 10, 1)))
+	reasons := invalidations()
+	if len(reasons) != 1 || reasons["X2"] != invalidOversold {
+		t.Fatalf("expected only the oversold sale to be flagged, got %v", reasons)
+	}
+
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X3", "S1", "sales", lineArg("milk", "2027-03-10", 9, 2)))
+	if reasons := invalidations(); len(reasons) != 1 {
+		t.Fatalf("sale of restocked milk flagged: %v", reasons)
+	}
+}
+
+func TestRestoredSaleIsRevalidated(t *testing.T) {
+	f := newFixture(t)
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("P1", "S1", "purchase", lineArg("milk", "2027-03-10", 10, 1), lineArg("milk", "2027-04-10", 10, 1)))
+
+	// The stock a voided sale took was sold again, so restoring it oversells the lot
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X1", "S1", "sales", lineArg("milk", "2027-03-10", 6, 2)))
+	f.ok(f.org1, "VoidInvoice", "X1", "entered_in_error", "wrong till")
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X2", "S1", "sales", lineArg("milk", "2027-03-10", 8, 2)))
+	f.ok(f.auditor, "RestoreInvoice", "X1", "sale did happen")
+
+	var invalidations []Invalidation
+	f.get(&invalidations, f.auditor, "GetInvalidations", "S1")
+	if len(invalidations) != 1 || invalidations[0].InvoiceID != "X1" || invalidations[0].Reason != invalidOversold {
+		t.Fatalf("expected the restored sale to be flagged as oversold, got %+v", invalidations)
+	}
+
+	// A voided sale of a lot recalled since cannot come back
+	f.ok(f.org1, "CreateOrUpdateInvoice", invoiceArg("X3", "S1", "sales", lineArg("milk", "2027-04-10", 2, 2)))
+	f.ok(f.org1, "VoidInvoice", "X3", "duplicate", "keyed twice")
+	f.ok(f.supplier, "RecallLot", lot("milk", "2027-04-10"), "contamination")
+	f.fail(f.auditor, "recalled item: milk", "RestoreInvoice", "X3", "not a duplicate after all")
+}
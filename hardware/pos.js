@@ -1,32 +1,56 @@
+const fs = require('fs');
 const axios = require('axios');
+const { signInvoice } = require('./signing');
+
+// Registered device of this terminal and the key it signs with
+const STORE_ID = process.env.STORE_ID || 'STORE001';
+const DEVICE_ID = process.env.DEVICE_ID || 'POS001';
+const TERMINAL_ID = process.env.TERMINAL_ID || DEVICE_ID;
+const CURRENCY = process.env.CURRENCY || 'INR';
+const DEVICE_KEY = fs.readFileSync(process.env.DEVICE_KEY_FILE || '/etc/pos/device-key.pem', 'utf8');
+
+// Convert a major-unit amount to minor units
+function toMinor(amount) {
+    return Math.round((amount || 0) * 100);
+}
 
 // Function to handle POS data
 async function handlePOSData(data) {
-    // Process each item and format it using the itemData structure
-    const formattedItems = data.items.map(item => {
+    const now = new Date().toISOString();
+
+    // Process each item into an invoice line the contract accepts
+    const items = data.items.map(item => {
+        const quantity = item.quantity || 1;
+        const pricePerUnitMinor = toMinor(item.pricePerUnit);
         return {
-            itemID: item.itemID,
-            itemName: item.itemName || 'Unknown Item',
-            quantity: item.quantity || 1,
-            pricePerUnit: item.pricePerUnit || 0.0,
-            totalPrice: (item.quantity || 1) * (item.pricePerUnit || 0.0),
-            expiryDate: item.expiryDate || 'N/A',
-            storeID: 'STORE001', 
-            eventType: 'purchase',
-            timestamp: new Date().toISOString() 
+            item_id: item.itemID,
+            item_name: item.itemName || 'Unknown Item',
+            expiry_date: item.expiryDate,
+            quantity: quantity,
+            unit: item.unit,
+            price_per_unit_minor: pricePerUnitMinor,
+            total_price_minor: Math.round(quantity * pricePerUnitMinor)
         };
     });
 
-    const posData = {
-        transactionID: data.transactionID,
-        items: formattedItems, 
-        totalAmount: data.totalAmount,
-        timestamp: new Date().toISOString(),
-        storeID: 'STORE001', 
+    const invoice = {
+        invoice_id: data.transactionID,
+        store_id: STORE_ID,
+        date: now.slice(0, 10),
+        timestamp: now,
+        invoice_type: 'sales',
+        currency: CURRENCY,
+        total_amount_minor: items.reduce((total, item) => total + item.total_price_minor, 0),
+        transaction_hash: '',
+        prev_block_hash: '',
+        device_id: DEVICE_ID,
+        terminal_id: TERMINAL_ID,
+        sequence_number: data.sequenceNumber,
+        items: items
     };
 
     try {
-        const response = await axios.post('http://pos-system-url/api/transactions', posData);
+        const response = await axios.post('http://pos-system-url/api/invoice', signInvoice(invoice, DEVICE_KEY));
         console.log('Transaction recorded:', response.data);
     } catch (error) {
         console.error('Error sending data to POS system:', error);
@@ -36,11 +60,11 @@ async function handlePOSData(data) {
 // Data received from POS
 const exampleData = {
     transactionID: '12345',
+    sequenceNumber: 1,
     items: [
-        { itemID: 'item01', itemName: 'Item Name 1', quantity: 2, pricePerUnit: 10.0 },
-        { itemID: 'item02', itemName: 'Item Name 2', quantity: 1, pricePerUnit: 20.0 }
-    ],
-    totalAmount: 40.0,
+        { itemID: 'item01', itemName: 'Item Name 1', expiryDate: '2027-03-10', quantity: 2, pricePerUnit: 10.0 },
+        { itemID: 'item02', itemName: 'Item Name 2', expiryDate: '2027-03-20', quantity: 1, pricePerUnit: 20.0 }
+    ]
 };
 
 // Handle the data
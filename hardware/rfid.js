@@ -1,25 +1,46 @@
+const fs = require('fs');
 const RFID = require('node-rfid'); 
 const axios = require('axios');
+const { signInvoice } = require('./signing');
+
+// Registered device of this reader and the key it signs with
+const STORE_ID = process.env.STORE_ID || 'STORE001';
+const DEVICE_ID = process.env.DEVICE_ID || 'RFID001';
+const CURRENCY = process.env.CURRENCY || 'INR';
+const DEVICE_KEY = fs.readFileSync(process.env.DEVICE_KEY_FILE || '/etc/rfid/device-key.pem', 'utf8');
 
 // Initialize RFID Reader
 const rfid = new RFID('/dev/tty-usbserial1', { baudRate: 9600 });
 
-// Event listener for detecting tags 
+// Event listener for detecting tags, each read is a single-line purchase invoice
 rfid.on('data', (data) => {
-    const itemData = {
-        itemID: data.id,                     
-        itemName: data.name || 'Unknown Item',                 
-        quantity: data.quantity || 1,             
-        pricePerUnit: data.pricePerUnit || 0.0,    
-        totalPrice: data.totalPrice || 0.0,         
-        expiryDate: data.expiryDate || 'N/A',         
-        storeID: 'STORE001',                 
-        eventType: 'purchase',               
-        timestamp: new Date().toISOString()  
+    const now = new Date().toISOString();
+    const quantity = data.quantity || 1;
+    const pricePerUnitMinor = Math.round((data.pricePerUnit || 0) * 100);
+
+    const invoice = {
+        invoice_id: `${DEVICE_ID}-${data.id}-${Date.now()}`,
+        store_id: STORE_ID,
+        date: now.slice(0, 10),
+        timestamp: now,
+        invoice_type: 'purchase',
+        currency: CURRENCY,
+        total_amount_minor: Math.round(quantity * pricePerUnitMinor),
+        transaction_hash: '',
+        prev_block_hash: '',
+        device_id: DEVICE_ID,
+        items: [{
+            item_id: data.id,
+            item_name: data.name || 'Unknown Item',
+            expiry_date: data.expiryDate,
+            quantity: quantity,
+            price_per_unit_minor: pricePerUnitMinor,
+            total_price_minor: Math.round(quantity * pricePerUnitMinor)
+        }]
     };
 
-    // Send data to the middleware system
-    axios.post('http://middleware-system-url/api/storeItem', itemData)
+    // Send the signed invoice to the middleware system
+    axios.post('http://middleware-system-url/api/invoice', signInvoice(invoice, DEVICE_KEY))
         .then(response => {
             console.log('Item recorded on blockchain: ', response.data);
         })
@@ -32,5 +53,3 @@ rfid.on('data', (data) => {
 rfid.on('error', (error) => {
     console.error('RFID Read Error:', error);
 });
-
-
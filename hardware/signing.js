@@ -0,0 +1,54 @@
+const crypto = require('crypto');
+
+// Escape the characters Go's encoding/json escapes, so both sides sign the same bytes
+function goJSON(value) {
+    return JSON.stringify(value)
+        .replace(/</g, '\\u003c')
+        .replace(/>/g, '\\u003e')
+        .replace(/&/g, '\\u0026')
+        .replace(/\u2028/g, '\\u2028')
+        .replace(/\u2029/g, '\\u2029');
+}
+
+// Canonical form of an invoice, field for field and in the order the contract's CanonicalInvoice uses
+function canonicalInvoice(invoice) {
+    return goJSON({
+        invoice_id: invoice.invoice_id,
+        store_id: invoice.store_id,
+        device_id: invoice.device_id || '',
+        date: invoice.date,
+        timestamp: invoice.timestamp,
+        invoice_type: invoice.invoice_type,
+        currency: invoice.currency || '',
+        total_amount_minor: invoice.total_amount_minor || 0,
+        tax_amount_minor: invoice.tax_amount_minor || 0,
+        terminal_id: invoice.terminal_id || '',
+        sequence_number: invoice.sequence_number || 0,
+        supplier_msp_id: invoice.supplier_msp_id || '',
+        purchase_order_id: invoice.purchase_order_id || '',
+        goods_receipt_id: invoice.goods_receipt_id || '',
+        items: (invoice.items || []).map(item => ({
+            item_id: item.item_id,
+            expiry_date: item.expiry_date,
+            quantity: item.quantity,
+            unit: item.unit || '',
+            price_per_unit_minor: item.price_per_unit_minor || 0,
+            total_price_minor: item.total_price_minor || 0,
+            tax_category: item.tax_category || '',
+            tax_amount_minor: item.tax_amount_minor || 0
+        }))
+    });
+}
+
+// Sign an invoice with the device's private key, ECDSA over SHA-256 or Ed25519
+function signInvoice(invoice, privateKeyPEM) {
+    const key = crypto.createPrivateKey(privateKeyPEM);
+    const message = Buffer.from(canonicalInvoice(invoice));
+    const algorithm = key.asymmetricKeyType === 'ed25519' ? null : 'sha256';
+    return {
+        ...invoice,
+        device_signature: crypto.sign(algorithm, message, key).toString('base64')
+    };
+}
+
+module.exports = { canonicalInvoice, signInvoice };